@@ -3,6 +3,7 @@ module github.com/pyroscope-io/pyroscope
 go 1.14
 
 require (
+	github.com/DataDog/zstd v1.4.1
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/aybabtme/rgbterm v0.0.0-20170906152045-cc83f3b3ce59
 	github.com/cheggaaa/pb/v3 v3.0.5
@@ -30,6 +31,7 @@ require (
 	github.com/mgechev/revive v1.0.3
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/morikuni/aec v1.0.0 // indirect
+	github.com/nats-io/nats.go v1.11.0
 	github.com/onsi/ginkgo v1.16.2
 	github.com/onsi/gomega v1.12.0
 	github.com/pelletier/go-toml v1.8.1 // indirect
@@ -43,6 +45,7 @@ require (
 	github.com/wacul/ptr v1.0.0 // indirect
 	golang.org/x/tools v0.1.0
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 	honnef.co/go/tools v0.0.1-2020.1.6
 )
 
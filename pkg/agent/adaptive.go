@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"runtime"
+	"time"
+)
+
+// With adaptive sample rate the rate is halved when the process is busy and doubled when it's idle,
+// so that profiling overhead stays bounded on busy hosts. Usage is the share of all host CPUs
+// used by the process since the previous adjustment.
+const (
+	adaptiveHighCPUUsage = 0.7
+	adaptiveLowCPUUsage  = 0.3
+)
+
+type adaptiveSampleRate struct {
+	min uint32
+	max uint32
+
+	cpuTime  func() (time.Duration, error)
+	numCPU   int
+	lastCPU  time.Duration
+	lastTime time.Time
+}
+
+func newAdaptiveSampleRate(min, max uint32) *adaptiveSampleRate {
+	a := &adaptiveSampleRate{
+		min:     min,
+		max:     max,
+		cpuTime: processCPUTime,
+		numCPU:  runtime.NumCPU(),
+	}
+	a.lastCPU, _ = a.cpuTime()
+	a.lastTime = time.Now()
+	return a
+}
+
+func (a *adaptiveSampleRate) clamp(rate uint32) uint32 {
+	if rate < a.min {
+		return a.min
+	}
+	if rate > a.max {
+		return a.max
+	}
+	return rate
+}
+
+// next returns the sample rate for the next period and CPU usage of the process in the previous one
+func (a *adaptiveSampleRate) next(rate uint32, now time.Time) (uint32, float64) {
+	cpu, err := a.cpuTime()
+	if err != nil {
+		return rate, 0
+	}
+	wall := now.Sub(a.lastTime)
+	if wall <= 0 {
+		return rate, 0
+	}
+	usage := float64(cpu-a.lastCPU) / float64(wall) / float64(a.numCPU)
+	a.lastCPU, a.lastTime = cpu, now
+
+	switch {
+	case usage > adaptiveHighCPUUsage:
+		rate = a.clamp(rate / 2)
+	case usage < adaptiveLowCPUUsage:
+		rate = a.clamp(rate * 2)
+	}
+	return rate, usage
+}
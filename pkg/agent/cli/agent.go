@@ -2,10 +2,12 @@ package cli
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	"github.com/pyroscope-io/pyroscope/pkg/agent"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/csock"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream/remote"
@@ -15,11 +17,30 @@ import (
 )
 
 type Agent struct {
-	cfg            *config.Agent
+	cfg *config.Agent
+	// control socket requests are handled concurrently, m also guards cs, selfProfile and stopping
+	// which Start and Stop may access concurrently
+	m              sync.Mutex
 	cs             *csock.CSock
-	activeProfiles map[int]*agent.ProfileSession
+	activeProfiles map[int]*activeProfile
 	id             id.ID
 	u              upstream.Upstream
+
+	// sessions of the targets file, see targets.go
+	targetsM       sync.Mutex
+	targetSessions map[string]*targetSession
+
+	selfProfile *agent.ProfileSession
+	// stopping is set by Stop, new sessions (target ones included) aren't started afterwards
+	stopping bool
+	// done is closed on Stop
+	done chan struct{}
+}
+
+type activeProfile struct {
+	s *agent.ProfileSession
+	// renewed is the last time the client started or renewed the session
+	renewed time.Time
 }
 
 func New(cfg *config.Agent) (*Agent, error) {
@@ -27,6 +48,11 @@ func New(cfg *config.Agent) (*Agent, error) {
 		UpstreamThreads:        cfg.UpstreamThreads,
 		UpstreamAddress:        cfg.ServerAddress,
 		UpstreamRequestTimeout: cfg.UpstreamRequestTimeout,
+		BatchWindow:            cfg.UpstreamBatchWindow,
+		HealthCheckInterval:    cfg.UpstreamHealthCheckInterval,
+		Compression:            cfg.UpstreamCompression,
+		QueueSize:              cfg.UpstreamQueueSize,
+		QueuePolicy:            cfg.UpstreamQueuePolicy,
 	}
 	upstream, err := remote.New(rc, logrus.StandardLogger())
 	if err != nil {
@@ -34,8 +60,10 @@ func New(cfg *config.Agent) (*Agent, error) {
 	}
 	return &Agent{
 		cfg:            cfg,
-		activeProfiles: make(map[int]*agent.ProfileSession),
+		activeProfiles: make(map[int]*activeProfile),
+		targetSessions: make(map[string]*targetSession),
 		u:              upstream,
+		done:           make(chan struct{}),
 	}, nil
 }
 
@@ -45,18 +73,32 @@ func (a *Agent) Start() error {
 	if err != nil {
 		return err
 	}
+	a.m.Lock()
 	a.cs = cs
-	defer os.Remove(sockPath)
+	a.m.Unlock()
 
-	go agent.SelfProfile(100, a.u, "pyroscope.agent.cpu{}", logrus.StandardLogger())
+	if a.cfg.TargetsFile != "" {
+		if err = a.startTargets(); err != nil {
+			cs.Stop()
+			os.Remove(sockPath)
+			return err
+		}
+	}
+	selfProfile, err := agent.StartSelfProfile(100, a.u, "pyroscope.agent.cpu{}", logrus.StandardLogger())
+	if err != nil {
+		logrus.WithError(err).Warn("failed to start self profiling")
+	}
+	a.m.Lock()
+	a.selfProfile = selfProfile
+	a.m.Unlock()
+	if a.cfg.SessionIdleTimeout > 0 {
+		go a.reapIdleSessions(a.cfg.SessionIdleTimeout)
+	}
+	// serves until Stop closes the socket, which Stop removes once everything is shut down
 	cs.Start()
 	return nil
 }
 
-func (a *Agent) Stop() {
-	a.cs.Stop()
-}
-
 func (a *Agent) controlSocketHandler(req *csock.Request) *csock.Response {
 	switch req.Command {
 	case "start":
@@ -72,22 +114,102 @@ func (a *Agent) controlSocketHandler(req *csock.Request) *csock.Response {
 			SpyName:          types.GoSpy,
 			SampleRate:       types.DefaultSampleRate,
 			UploadRate:       10 * time.Second,
+			UploadRates:      uploadRates(req.UploadRates),
 			Pid:              0,
 			WithSubprocesses: false,
+			WarmupDuration:   a.cfg.WarmupDuration,
+			HostLabel:        a.cfg.HostLabel,
+			Hostname:         a.cfg.Hostname,
 		}
 		s := agent.NewSession(&sc, logrus.StandardLogger())
-		a.activeProfiles[profileID] = s
+		a.m.Lock()
+		if a.stopping {
+			a.m.Unlock()
+			return &csock.Response{Error: errStopping.Error()}
+		}
+		a.activeProfiles[profileID] = &activeProfile{s: s, renewed: time.Now()}
+		a.m.Unlock()
 		s.Start()
 		return &csock.Response{ProfileID: profileID}
+	case "renew":
+		// clients renew sessions periodically, so that sessions of crashed clients can be told apart
+		a.m.Lock()
+		if p, ok := a.activeProfiles[req.ProfileID]; ok {
+			p.renewed = time.Now()
+		}
+		a.m.Unlock()
+		return &csock.Response{ProfileID: req.ProfileID}
 	case "stop":
 		// TODO: "testapp.cpu{}" should come from the client
 		profileID := req.ProfileID
-		if s, ok := a.activeProfiles[profileID]; ok {
-			s.Stop()
-			delete(a.activeProfiles, profileID)
+		a.m.Lock()
+		p, ok := a.activeProfiles[profileID]
+		delete(a.activeProfiles, profileID)
+		a.m.Unlock()
+		if ok {
+			p.s.Stop()
 		}
 		return &csock.Response{}
+	case "capture":
+		profiles, err := a.capture(req)
+		if err != nil {
+			return &csock.Response{Error: err.Error()}
+		}
+		return &csock.Response{Profiles: profiles}
 	default:
 		return &csock.Response{}
 	}
 }
+
+// reapIdleSessions stops sessions that weren't renewed within timeout, otherwise sessions of
+// clients that exit without stopping them would run forever
+func (a *Agent) reapIdleSessions(timeout time.Duration) {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			for profileID, s := range a.removeIdleSessions(now.Add(-timeout)) {
+				logrus.WithField("profileID", profileID).Warn("stopping profiling session that wasn't renewed")
+				// uploads the data collected so far
+				s.Stop()
+			}
+		}
+	}
+}
+
+func (a *Agent) removeIdleSessions(renewedBefore time.Time) map[int]*agent.ProfileSession {
+	a.m.Lock()
+	defer a.m.Unlock()
+	idle := make(map[int]*agent.ProfileSession)
+	for profileID, p := range a.activeProfiles {
+		if p.renewed.Before(renewedBefore) {
+			idle[profileID] = p.s
+			delete(a.activeProfiles, profileID)
+		}
+	}
+	return idle
+}
+
+// uploadRates parses upload rates sent by clients, invalid ones are ignored
+func uploadRates(m map[string]string) map[spy.ProfileType]time.Duration {
+	res := make(map[spy.ProfileType]time.Duration, len(m))
+	for pt, v := range m {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || !spy.ProfileType(pt).IsKnown() {
+			logrus.WithFields(logrus.Fields{
+				"profileType": pt,
+				"uploadRate":  v,
+			}).Warn("ignoring invalid upload rate")
+			continue
+		}
+		res[spy.ProfileType(pt)] = d
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/agent"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/csock"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/sirupsen/logrus"
+)
+
+var _ = Describe("idle sessions", func() {
+	var a *Agent
+	BeforeEach(func() {
+		a = &Agent{
+			cfg:            &config.Agent{},
+			u:              &upstreamMock{},
+			activeProfiles: make(map[int]*activeProfile),
+			done:           make(chan struct{}),
+		}
+	})
+	AfterEach(func() {
+		for _, p := range a.activeProfiles {
+			p.s.Stop()
+		}
+	})
+
+	startSession := func(profileID int, renewed time.Time) {
+		s := agent.NewSession(&agent.SessionConfig{
+			Upstream:       a.u,
+			AppName:        "app",
+			ProfilingTypes: []spy.ProfileType{spy.ProfileInuseObjects},
+			SpyName:        types.GoSpy,
+			SampleRate:     types.DefaultSampleRate,
+			UploadRate:     10 * time.Second,
+		}, logrus.StandardLogger())
+		Expect(s.Start()).To(Succeed())
+		a.m.Lock()
+		a.activeProfiles[profileID] = &activeProfile{s: s, renewed: renewed}
+		a.m.Unlock()
+	}
+	activeProfileIDs := func() []int {
+		a.m.Lock()
+		defer a.m.Unlock()
+		var ids []int
+		for profileID := range a.activeProfiles {
+			ids = append(ids, profileID)
+		}
+		return ids
+	}
+
+	It("removes sessions that weren't renewed and keeps renewed ones", func() {
+		startSession(1, time.Now().Add(-time.Hour))
+		startSession(2, time.Now().Add(-time.Hour))
+		res := a.controlSocketHandler(&csock.Request{Command: "renew", ProfileID: 2})
+		Expect(res.ProfileID).To(Equal(2))
+
+		idle := a.removeIdleSessions(time.Now().Add(-time.Minute))
+		Expect(idle).To(HaveLen(1))
+		Expect(idle).To(HaveKey(1))
+		idle[1].Stop()
+		Expect(activeProfileIDs()).To(ConsistOf(2))
+	})
+
+	It("stops idle sessions in the background until the agent is stopped", func() {
+		startSession(1, time.Now().Add(-time.Hour))
+		startSession(2, time.Now())
+		reaped := make(chan struct{})
+		go func() {
+			a.reapIdleSessions(time.Second)
+			close(reaped)
+		}()
+
+		// the active session is renewed more often than the timeout
+		stopRenewing := make(chan struct{})
+		defer close(stopRenewing)
+		go func() {
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopRenewing:
+					return
+				case <-ticker.C:
+					a.controlSocketHandler(&csock.Request{Command: "renew", ProfileID: 2})
+				}
+			}
+		}()
+		Eventually(activeProfileIDs, 5*time.Second).Should(ConsistOf(2))
+		Consistently(activeProfileIDs, 1500*time.Millisecond).Should(ConsistOf(2))
+
+		close(a.done)
+		Eventually(reaped).Should(BeClosed())
+	})
+})
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/csock"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+	"github.com/sirupsen/logrus"
+)
+
+// captureProfileTypes are the profile types of captures. Cumulative types are left out:
+// their first upload period only sets the baseline, so a single capture window would have no data.
+var captureProfileTypes = []spy.ProfileType{
+	spy.ProfileCPU,
+	spy.ProfileInuseObjects,
+	spy.ProfileInuseSpace,
+}
+
+// capture profiles for the requested duration and returns the result instead of uploading it,
+// the session is stopped automatically
+func (a *Agent) capture(req *csock.Request) (map[string]string, error) {
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("invalid duration %q", req.Duration)
+	}
+	if d > a.cfg.MaxCaptureDuration {
+		return nil, fmt.Errorf("duration %v is longer than the max of %v", d, a.cfg.MaxCaptureDuration)
+	}
+	a.m.Lock()
+	stopping := a.stopping
+	a.m.Unlock()
+	if stopping {
+		return nil, errStopping
+	}
+
+	u := &captureUpstream{tries: make(map[string]*transporttrie.Trie)}
+	// TODO: same as for the start command, these should come from the client
+	sc := agent.SessionConfig{
+		Upstream:         u,
+		AppName:          "testapp",
+		ProfilingTypes:   captureProfileTypes,
+		SpyName:          types.GoSpy,
+		SampleRate:       types.DefaultSampleRate,
+		UploadRate:       d,
+		Pid:              0,
+		WithSubprocesses: false,
+	}
+	s := agent.NewSession(&sc, logrus.StandardLogger())
+	if err := s.Start(); err != nil {
+		return nil, fmt.Errorf("start profiling: %v", err)
+	}
+	select {
+	case <-time.After(d):
+	case <-a.done:
+	}
+	s.Stop()
+	return u.collapsed(), nil
+}
+
+// captureUpstream keeps uploaded profiles in memory. Sessions may upload a profile
+// in several parts, e.g when the capture spans an upload boundary, parts are merged.
+type captureUpstream struct {
+	m     sync.Mutex
+	tries map[string]*transporttrie.Trie
+}
+
+func (u *captureUpstream) Upload(j *upstream.UploadJob) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if t, ok := u.tries[j.Name]; ok {
+		t.Merge(j.Trie)
+	} else {
+		u.tries[j.Name] = j.Trie
+	}
+}
+
+func (*captureUpstream) Stop() {}
+
+func (u *captureUpstream) collapsed() map[string]string {
+	u.m.Lock()
+	defer u.m.Unlock()
+	res := make(map[string]string, len(u.tries))
+	for name, t := range u.tries {
+		var sb strings.Builder
+		t.Iterate(func(stack []byte, val uint64) {
+			fmt.Fprintf(&sb, "%s %d\n", stack, val)
+		})
+		res[name] = sb.String()
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+package cli
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/csock"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+)
+
+var _ = Describe("capture", func() {
+	var a *Agent
+	BeforeEach(func() {
+		a = &Agent{
+			cfg:  &config.Agent{MaxCaptureDuration: time.Minute},
+			done: make(chan struct{}),
+		}
+	})
+
+	It("rejects invalid durations", func() {
+		for _, d := range []string{"", "foo", "0s", "-1s", "2m"} {
+			_, err := a.capture(&csock.Request{Command: "capture", Duration: d})
+			Expect(err).To(HaveOccurred(), d)
+		}
+	})
+
+	It("rejects captures while the agent is stopping", func() {
+		a.stopping = true
+		_, err := a.capture(&csock.Request{Command: "capture", Duration: "1s"})
+		Expect(err).To(MatchError(errStopping))
+	})
+
+	It("profiles for the requested duration", func() {
+		start := time.Now()
+		profiles, err := a.capture(&csock.Request{Command: "capture", Duration: "500ms"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically(">=", 500*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		// every capture profile type is returned, cumulative types would have no data
+		Expect(profiles).To(HaveLen(len(captureProfileTypes)))
+		for _, pt := range captureProfileTypes {
+			Expect(profiles).To(HaveKey("testapp." + string(pt)))
+		}
+	})
+
+	It("stops early when the agent stops", func() {
+		close(a.done)
+		start := time.Now()
+		_, err := a.capture(&csock.Request{Command: "capture", Duration: "30s"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("merges profiles uploaded in several parts", func() {
+		u := &captureUpstream{tries: make(map[string]*transporttrie.Trie)}
+		for _, stack := range []string{"a;b", "a;c", "a;b"} {
+			t := transporttrie.New()
+			t.Insert([]byte(stack), 1)
+			u.Upload(&upstream.UploadJob{Name: "testapp.cpu", Trie: t})
+		}
+		Expect(u.collapsed()).To(Equal(map[string]string{"testapp.cpu": "a;b 2\na;c 1\n"}))
+	})
+})
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+)
+
+var errStopping = errors.New("agent is stopping")
+
+// stopErrors are errors of shutdown steps, a failed step doesn't stop the ones after it
+type stopErrors []error
+
+func (e stopErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e stopErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Stop shuts the agent down in an order that doesn't lose collected profiles: new sessions aren't
+// accepted anymore, active sessions are stopped, uploading what they collected, self profiling is
+// stopped, the upstream uploads queued profiles and is closed, and the control socket is removed.
+// Errors of all steps are returned together. Calling Stop more than once is a no-op.
+func (a *Agent) Stop() error {
+	a.m.Lock()
+	if a.stopping {
+		a.m.Unlock()
+		return nil
+	}
+	a.stopping = true
+	cs, selfProfile := a.cs, a.selfProfile
+	a.m.Unlock()
+
+	var errs stopErrors
+	if cs != nil {
+		if err := cs.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("close control socket: %v", err))
+		}
+	}
+	// stops the idle sessions reaper, targets reloads and captures
+	close(a.done)
+
+	a.stopTargets()
+	if u, ok := a.u.(upstream.StopBeginner); ok {
+		u.BeginStop()
+	}
+	a.m.Lock()
+	profiles := a.activeProfiles
+	a.activeProfiles = make(map[int]*activeProfile)
+	a.m.Unlock()
+	for _, p := range profiles {
+		p.s.Stop()
+	}
+
+	if selfProfile != nil {
+		selfProfile.Stop()
+	}
+
+	a.u.Stop()
+
+	if cs != nil {
+		if err := os.Remove(a.cfg.UNIXSocketPath); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Errorf("remove control socket: %v", err))
+		}
+	}
+	return errs.err()
+}
@@ -0,0 +1,83 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/csock"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+)
+
+var _ = Describe("Stop", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "agent-stop")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("shuts components down in order", func() {
+		sockPath := filepath.Join(dir, "agent.sock")
+		u := &upstreamMock{}
+		a := &Agent{
+			cfg:            &config.Agent{UNIXSocketPath: sockPath},
+			u:              u,
+			activeProfiles: make(map[int]*activeProfile),
+			targetSessions: make(map[string]*targetSession),
+			done:           make(chan struct{}),
+		}
+		started := make(chan error, 1)
+		go func() { started <- a.Start() }()
+
+		client := &http.Client{Transport: &http.Transport{
+			// every request dials, so that closing the socket is noticed
+			DisableKeepAlives: true,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+		}}
+		renew := func() error {
+			resp, err := client.Post("http://agent/renew", "application/json", strings.NewReader("{}"))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			return nil
+		}
+		Eventually(renew).Should(Succeed())
+		a.reconcileTargets([]Target{
+			{ApplicationName: "app", SpyName: "gospy", ProfileTypes: []string{string(spy.ProfileInuseObjects)}},
+		})
+
+		Expect(a.Stop()).To(Succeed())
+		Eventually(started).Should(Receive(BeNil()))
+		Expect(renew()).ToNot(Succeed())
+		_, err := os.Stat(sockPath)
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(a.targetSessions).To(BeEmpty())
+		Expect(u.stopped).To(BeTrue())
+		Expect(u.uploadsAfterStop).To(BeZero())
+
+		res := a.controlSocketHandler(&csock.Request{Command: "start"})
+		Expect(res.Error).To(Equal(errStopping.Error()))
+		Expect(a.Stop()).To(Succeed())
+	})
+
+	It("returns errors of all failed steps", func() {
+		errs := stopErrors{errors.New("foo"), errors.New("bar")}
+		Expect(errs.err()).To(MatchError("foo; bar"))
+		Expect(stopErrors(nil).err()).To(BeNil())
+	})
+})
@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/pyroscope-io/pyroscope/pkg/util/slices"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Targets are processes profiled for as long as they're listed in the targets file, without
+// clients starting sessions via the control socket. The file is re-read on SIGHUP, sessions of
+// removed targets are stopped, sessions of changed ones are restarted. For example:
+//
+//   targets:
+//     - application-name: backend{env=prod}
+//       spy-name: pyspy
+//       pid: 1234
+//       sample-rate: 100
+//     - application-name: worker
+//       spy-name: rbspy
+//       pid: 5678
+//       profile-types: [cpu]
+
+// Target is a process the agent profiles
+type Target struct {
+	ApplicationName string   `yaml:"application-name"`
+	SpyName         string   `yaml:"spy-name"`
+	Pid             int      `yaml:"pid"`
+	ProfileTypes    []string `yaml:"profile-types"`
+	// SampleRate is in Hz, 0 means the default rate
+	SampleRate uint32 `yaml:"sample-rate"`
+}
+
+type targetsFile struct {
+	Targets []Target `yaml:"targets"`
+}
+
+type targetSession struct {
+	t Target
+	s *agent.ProfileSession
+}
+
+// key identifies a target, a process is profiled once per app
+func (t Target) key() string {
+	return fmt.Sprintf("%s/%d", t.ApplicationName, t.Pid)
+}
+
+func (t Target) profileTypes() []spy.ProfileType {
+	if len(t.ProfileTypes) == 0 {
+		if t.SpyName == types.GoSpy {
+			return types.DefaultProfileTypes
+		}
+		return []spy.ProfileType{spy.ProfileCPU}
+	}
+	res := make([]spy.ProfileType, len(t.ProfileTypes))
+	for i, pt := range t.ProfileTypes {
+		res[i] = spy.ProfileType(pt)
+	}
+	return res
+}
+
+func (t Target) validate() error {
+	if t.ApplicationName == "" {
+		return fmt.Errorf("application-name is required")
+	}
+	if t.SpyName != types.GoSpy && !slices.StringContains(spy.SupportedSpies, t.SpyName) {
+		return fmt.Errorf("unsupported spy-name %q", t.SpyName)
+	}
+	if t.Pid < 0 {
+		return fmt.Errorf("invalid pid %d", t.Pid)
+	}
+	for _, pt := range t.ProfileTypes {
+		if !spy.ProfileType(pt).IsKnown() {
+			return fmt.Errorf("unknown profile type %q", pt)
+		}
+	}
+	if t.SpyName != types.GoSpy && len(t.ProfileTypes) > 1 {
+		return fmt.Errorf("%s profiles a single type", t.SpyName)
+	}
+	return nil
+}
+
+func loadTargets(path string) ([]Target, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f targetsFile
+	if err = yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %v", path, err)
+	}
+	keys := make(map[string]struct{}, len(f.Targets))
+	for i, t := range f.Targets {
+		if err = t.validate(); err != nil {
+			return nil, fmt.Errorf("%s: target %d: %v", path, i+1, err)
+		}
+		if _, ok := keys[t.key()]; ok {
+			return nil, fmt.Errorf("%s: target %d: %s is listed more than once", path, i+1, t.key())
+		}
+		keys[t.key()] = struct{}{}
+	}
+	return f.Targets, nil
+}
+
+// startTargets starts sessions of the targets file and reloads it on SIGHUP until the agent is stopped
+func (a *Agent) startTargets() error {
+	targets, err := loadTargets(a.cfg.TargetsFile)
+	if err != nil {
+		return err
+	}
+	a.reconcileTargets(targets)
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-a.done:
+				return
+			case <-sighup:
+				targets, err := loadTargets(a.cfg.TargetsFile)
+				if err != nil {
+					logrus.WithError(err).Error("failed to reload targets, running sessions are kept")
+					continue
+				}
+				a.reconcileTargets(targets)
+			}
+		}
+	}()
+	return nil
+}
+
+// reconcileTargets stops sessions of targets that aren't listed anymore or changed, and starts
+// sessions of new and changed ones. Reloads racing Stop are ignored, Stop sets stopping before it
+// stops target sessions, so sessions started here are either stopped by Stop or not started at all
+func (a *Agent) reconcileTargets(targets []Target) {
+	a.targetsM.Lock()
+	defer a.targetsM.Unlock()
+	a.m.Lock()
+	stopping := a.stopping
+	a.m.Unlock()
+	if stopping {
+		return
+	}
+
+	listed := make(map[string]Target, len(targets))
+	for _, t := range targets {
+		listed[t.key()] = t
+	}
+	for k, ts := range a.targetSessions {
+		if t, ok := listed[k]; ok && reflect.DeepEqual(t, ts.t) {
+			continue
+		}
+		logrus.WithField("target", k).Info("stopping profiling session of target")
+		ts.s.Stop()
+		delete(a.targetSessions, k)
+	}
+	for k, t := range listed {
+		if _, ok := a.targetSessions[k]; ok {
+			continue
+		}
+		s := agent.NewSession(a.targetSessionConfig(t), logrus.StandardLogger())
+		if err := s.Start(); err != nil {
+			// it's retried on the next reload
+			logrus.WithError(err).WithField("target", k).Error("failed to start profiling session of target")
+			continue
+		}
+		logrus.WithField("target", k).Info("started profiling session of target")
+		a.targetSessions[k] = &targetSession{t: t, s: s}
+	}
+}
+
+func (a *Agent) stopTargets() {
+	a.targetsM.Lock()
+	defer a.targetsM.Unlock()
+	for k, ts := range a.targetSessions {
+		ts.s.Stop()
+		delete(a.targetSessions, k)
+	}
+}
+
+func (a *Agent) targetSessionConfig(t Target) *agent.SessionConfig {
+	sampleRate := t.SampleRate
+	if sampleRate == 0 {
+		sampleRate = types.DefaultSampleRate
+	}
+	return &agent.SessionConfig{
+		Upstream:       a.u,
+		AppName:        t.ApplicationName,
+		ProfilingTypes: t.profileTypes(),
+		SpyName:        t.SpyName,
+		SampleRate:     sampleRate,
+		UploadRate:     10 * time.Second,
+		Pid:            t.Pid,
+		WarmupDuration: a.cfg.WarmupDuration,
+		HostLabel:      a.cfg.HostLabel,
+		Hostname:       a.cfg.Hostname,
+	}
+}
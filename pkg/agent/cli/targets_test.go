@@ -0,0 +1,141 @@
+package cli
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+)
+
+type upstreamMock struct {
+	m       sync.Mutex
+	names   []string
+	stopped bool
+	// uploadsAfterStop counts uploads of profiles that are lost because the upstream was already stopped
+	uploadsAfterStop int
+}
+
+func (u *upstreamMock) Stop() {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.stopped = true
+}
+
+func (u *upstreamMock) Upload(j *upstream.UploadJob) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	u.names = append(u.names, j.Name)
+	if u.stopped {
+		u.uploadsAfterStop++
+	}
+}
+
+var _ = Describe("targets", func() {
+	var dir string
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pyroscope-targets")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeTargets := func(content string) string {
+		path := filepath.Join(dir, "targets.yml")
+		Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		return path
+	}
+
+	Context("loadTargets", func() {
+		It("parses targets", func() {
+			targets, err := loadTargets(writeTargets(`
+targets:
+  - application-name: backend{env=prod}
+    spy-name: gospy
+    profile-types: [cpu, inuse_space]
+    sample-rate: 50
+  - application-name: worker
+    spy-name: gospy
+    pid: 42
+`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(targets).To(Equal([]Target{
+				{ApplicationName: "backend{env=prod}", SpyName: "gospy", ProfileTypes: []string{"cpu", "inuse_space"}, SampleRate: 50},
+				{ApplicationName: "worker", SpyName: "gospy", Pid: 42},
+			}))
+			Expect(targets[1].profileTypes()).To(HaveLen(5))
+		})
+
+		It("rejects invalid targets", func() {
+			for _, content := range []string{
+				"targets:\n  - spy-name: gospy\n",
+				"targets:\n  - application-name: app\n    spy-name: nospy\n",
+				"targets:\n  - application-name: app\n    spy-name: gospy\n    profile-types: [foo]\n",
+				"targets:\n  - application-name: app\n    spy-name: gospy\n    pid: -2\n",
+				"targets:\n  - application-name: app\n    spy-name: gospy\n  - application-name: app\n    spy-name: gospy\n",
+				"targets:\n  - application-name: app\n    spy-name: gospy\n    unknown-field: 1\n",
+			} {
+				_, err := loadTargets(writeTargets(content))
+				Expect(err).To(HaveOccurred(), content)
+			}
+		})
+	})
+
+	Context("reconcileTargets", func() {
+		It("starts new sessions, restarts changed ones and stops removed ones", func() {
+			u := &upstreamMock{}
+			a := &Agent{
+				cfg:            &config.Agent{},
+				u:              u,
+				targetSessions: make(map[string]*targetSession),
+			}
+			defer a.stopTargets()
+
+			// heap profiles, unlike cpu ones, can be taken by several sessions at once
+			heap := []string{string(spy.ProfileInuseObjects)}
+			a.reconcileTargets([]Target{
+				{ApplicationName: "app1", SpyName: "gospy", ProfileTypes: heap},
+				{ApplicationName: "app2", SpyName: "gospy", ProfileTypes: heap},
+			})
+			Expect(a.targetSessions).To(HaveLen(2))
+			app1 := a.targetSessions["app1/0"].s
+
+			a.reconcileTargets([]Target{
+				{ApplicationName: "app1", SpyName: "gospy", ProfileTypes: heap},
+				{ApplicationName: "app2", SpyName: "gospy", ProfileTypes: heap, SampleRate: 10},
+				{ApplicationName: "app3", SpyName: "gospy", ProfileTypes: heap},
+			})
+			Expect(a.targetSessions).To(HaveLen(3))
+			Expect(a.targetSessions["app1/0"].s).To(BeIdenticalTo(app1))
+			Expect(a.targetSessions["app2/0"].t.SampleRate).To(Equal(uint32(10)))
+
+			a.reconcileTargets([]Target{
+				{ApplicationName: "app3", SpyName: "gospy", ProfileTypes: heap},
+			})
+			Expect(a.targetSessions).To(HaveLen(1))
+			Expect(a.targetSessions).To(HaveKey("app3/0"))
+		})
+
+		It("doesn't start sessions once the agent is stopping", func() {
+			a := &Agent{
+				cfg:            &config.Agent{},
+				u:              &upstreamMock{},
+				targetSessions: make(map[string]*targetSession),
+				stopping:       true,
+			}
+			defer a.stopTargets()
+
+			a.reconcileTargets([]Target{
+				{ApplicationName: "app1", SpyName: "gospy", ProfileTypes: []string{string(spy.ProfileInuseObjects)}},
+			})
+			Expect(a.targetSessions).To(BeEmpty())
+		})
+	})
+})
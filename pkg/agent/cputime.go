@@ -0,0 +1,17 @@
+// +build !windows
+
+package agent
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns user and system CPU time used by the current process
+func processCPUTime() (time.Duration, error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, err
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano()), nil
+}
@@ -0,0 +1,24 @@
+package agent
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime returns user and kernel CPU time used by the current process
+func processCPUTime() (time.Duration, error) {
+	var creation, exit, kernel, user syscall.Filetime
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, err
+	}
+	if err := syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return 0, err
+	}
+	// filetime durations are in 100ns intervals
+	return time.Duration(filetimeTicks(kernel)+filetimeTicks(user)) * 100, nil
+}
+
+func filetimeTicks(ft syscall.Filetime) int64 {
+	return int64(ft.HighDateTime)<<32 | int64(ft.LowDateTime)
+}
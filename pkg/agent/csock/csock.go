@@ -35,10 +35,17 @@ type Request struct {
 	Command       string `json:"command"`
 	Pid           int    `json:"pid"`
 	ProfileID     int    `json:"profile_id"`
+	// UploadRates sets upload rates of profile types, e.g {"inuse_space": "1m"}
+	UploadRates map[string]string `json:"upload_rates"`
+	// Duration is how long the capture command profiles for, e.g "30s"
+	Duration string `json:"duration"`
 }
 
 type Response struct {
 	ProfileID int `json:"profile_id"`
+	// Profiles are the results of the capture command in collapsed format, keyed by profile name
+	Profiles map[string]string `json:"profiles,omitempty"`
+	Error    string            `json:"error,omitempty"`
 }
 
 func commandFromRequest(r *http.Request) string {
@@ -0,0 +1,38 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+// Package cgobusy keeps a thread busy in C code, it's used to test native stacks of the Go profiler.
+// Test files can't use cgo, hence the separate package.
+package cgobusy
+
+/*
+#include <stdint.h>
+#include <time.h>
+
+static double elapsed(struct timespec* start) {
+	struct timespec now;
+	clock_gettime(CLOCK_MONOTONIC, &now);
+	return (double)(now.tv_sec - start->tv_sec) + (double)(now.tv_nsec - start->tv_nsec) / 1e9;
+}
+
+// cgobusySpin doesn't return to Go until the given number of seconds passed
+uint64_t cgobusySpin(double seconds) {
+	struct timespec start;
+	clock_gettime(CLOCK_MONOTONIC, &start);
+	volatile uint64_t n = 0;
+	while (elapsed(&start) < seconds) {
+		for (int i = 0; i < 100000; i++) {
+			n += i;
+		}
+	}
+	return n;
+}
+*/
+import "C"
+
+import "time"
+
+// Spin keeps the calling goroutine busy in C code for d
+func Spin(d time.Duration) {
+	C.cgobusySpin(C.double(d.Seconds()))
+}
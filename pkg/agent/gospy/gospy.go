@@ -26,11 +26,12 @@ type GoSpy struct {
 	profileType   spy.ProfileType
 	disableGCRuns bool
 	sampleRate    uint32
+	// withLocations makes frames carry source locations, see tree.FrameWithLocation
+	withLocations bool
 
 	lastGCGeneration uint32
 
-	stopCh chan struct{}
-	buf    *bytes.Buffer
+	buf *bytes.Buffer
 }
 
 func startCPUProfile(w io.Writer, hz uint32) error {
@@ -43,13 +44,13 @@ func startCPUProfile(w io.Writer, hz uint32) error {
 	}
 }
 
-func Start(profileType spy.ProfileType, sampleRate uint32, disableGCRuns bool) (spy.Spy, error) {
+func Start(profileType spy.ProfileType, sampleRate uint32, disableGCRuns, withLocations bool) (spy.Spy, error) {
 	s := &GoSpy{
-		stopCh:        make(chan struct{}),
 		buf:           &bytes.Buffer{},
 		profileType:   profileType,
 		disableGCRuns: disableGCRuns,
 		sampleRate:    sampleRate,
+		withLocations: withLocations,
 	}
 	if s.profileType == spy.ProfileCPU {
 		if err := startCPUProfile(s.buf, sampleRate); err != nil {
@@ -60,8 +61,15 @@ func Start(profileType spy.ProfileType, sampleRate uint32, disableGCRuns bool) (
 }
 
 func (s *GoSpy) Stop() error {
+	s.resetMutex.Lock()
+	defer s.resetMutex.Unlock()
+
 	s.stop = true
-	<-s.stopCh
+	if s.profileType == spy.ProfileCPU {
+		// which profiler runs depends on the sample rate, stopping the one that isn't running is a no-op
+		pprof.StopCPUProfile()
+		custom_pprof.StopCPUProfile()
+	}
 	return nil
 }
 
@@ -128,9 +136,7 @@ func (s *GoSpy) Snapshot(cb func([]byte, uint64, error)) {
 			cb(nil, uint64(0), fmt.Errorf("parse pprof: %v", err))
 			return
 		}
-		profile.Get("samples", func(name []byte, val int) {
-			cb(name, uint64(val), nil)
-		})
+		s.get(profile, "samples", cb)
 	} else {
 		// this is current GC generation
 		currentGCGeneration := numGC()
@@ -146,18 +152,34 @@ func (s *GoSpy) Snapshot(cb func([]byte, uint64, error)) {
 		// if there's no GC run then the profile is gonna be the same
 		//   in such case it does not make sense to upload the same profile twice
 		if currentGCGeneration != s.lastGCGeneration {
-			getHeapProfile(s.buf).Get(string(s.profileType), func(name []byte, val int) {
-				cb(name, uint64(val), nil)
-			})
+			s.get(getHeapProfile(s.buf), string(s.profileType), cb)
 			s.lastGCGeneration = currentGCGeneration
 		}
 	}
 	s.buf.Reset()
 }
 
+func (s *GoSpy) get(p *convert.Profile, sampleType string, cb func([]byte, uint64, error)) {
+	get := p.Get
+	if s.withLocations {
+		get = p.GetWithLocations
+	}
+	get(sampleType, func(name []byte, val int) {
+		cb(name, uint64(val), nil)
+	})
+}
+
 func (s *GoSpy) Reset() {
 	s.resetMutex.Lock()
 	defer s.resetMutex.Unlock()
 
 	s.reset = true
 }
+
+// SetSampleRate changes the rate of CPU profiling, it's applied when the profiler is restarted after a reset
+func (s *GoSpy) SetSampleRate(sampleRate uint32) {
+	s.resetMutex.Lock()
+	defer s.resetMutex.Unlock()
+
+	s.sampleRate = sampleRate
+}
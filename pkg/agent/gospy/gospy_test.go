@@ -1,6 +1,7 @@
 package gospy
 
 import (
+	"bytes"
 	"log"
 	"time"
 
@@ -11,12 +12,16 @@ import (
 	"github.com/pyroscope-io/pyroscope/pkg/testing"
 )
 
+// retained keeps an allocation alive so that it shows up in heap profiles
+var retained []byte
+
 var _ = Describe("analytics", func() {
 	testing.WithConfig(func(cfg **config.Config) {
 		Describe("NewSession", func() {
 			It("works as expected", func(done Done) {
-				s, err := Start(spy.ProfileCPU, 100, false)
+				s, err := Start(spy.ProfileCPU, 100, false, false)
 				Expect(err).ToNot(HaveOccurred())
+				defer s.Stop()
 				go func() {
 					s := time.Now()
 					i := 0
@@ -32,6 +37,22 @@ var _ = Describe("analytics", func() {
 				})
 				close(done)
 			})
+
+			It("adds source locations to frames when asked to", func() {
+				s, err := Start(spy.ProfileInuseSpace, 100, false, true)
+				Expect(err).ToNot(HaveOccurred())
+				retained = make([]byte, 4<<20)
+
+				s.(spy.Resettable).Reset()
+				withLocations := 0
+				s.Snapshot(func(name []byte, samples uint64, err error) {
+					Expect(err).ToNot(HaveOccurred())
+					if bytes.Contains(name, []byte(".go:")) {
+						withLocations++
+					}
+				})
+				Expect(withLocations).ToNot(BeZero())
+			})
 		})
 	})
 })
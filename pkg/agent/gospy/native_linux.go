@@ -0,0 +1,121 @@
+// +build linux,cgo
+
+package gospy
+
+/*
+#cgo LDFLAGS: -ldl
+
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <execinfo.h>
+#include <stdint.h>
+#include <ucontext.h>
+
+#define MAX_NATIVE_FRAMES 64
+
+// these structs are defined by runtime.SetCgoTraceback
+struct cgoTracebackArg {
+	uintptr_t  Context;
+	uintptr_t  SigContext;
+	uintptr_t* Buf;
+	uintptr_t  Max;
+};
+
+struct cgoSymbolizerArg {
+	uintptr_t   PC;
+	const char* File;
+	uintptr_t   Lineno;
+	const char* Func;
+	uintptr_t   Entry;
+	uintptr_t   More;
+	uintptr_t   Data;
+};
+
+static uintptr_t signalPC(uintptr_t sigContext) {
+	ucontext_t* uc = (ucontext_t*)sigContext;
+	if (uc == NULL) {
+		return 0;
+	}
+#if defined(__x86_64__)
+	return (uintptr_t)uc->uc_mcontext.gregs[REG_RIP];
+#elif defined(__aarch64__)
+	return (uintptr_t)uc->uc_mcontext.pc;
+#else
+	return 0;
+#endif
+}
+
+// nativeTraceback is called from the SIGPROF handler when a signal arrives while running C code.
+// backtrace() also returns frames of the signal handler itself, so we skip everything up to
+// the interrupted PC. If it can't be found only the interrupted function is reported.
+void nativeTraceback(void* p) {
+	struct cgoTracebackArg* arg = (struct cgoTracebackArg*)p;
+	if (arg->Max == 0) {
+		return;
+	}
+	uintptr_t pc = signalPC(arg->SigContext);
+
+	void* frames[MAX_NATIVE_FRAMES];
+	int n = 0;
+	if (pc != 0) {
+		n = backtrace(frames, MAX_NATIVE_FRAMES);
+	}
+	int start = n;
+	for (int i = 0; i < n; i++) {
+		if ((uintptr_t)frames[i] == pc) {
+			start = i;
+			break;
+		}
+	}
+
+	uintptr_t j = 0;
+	if (start == n && pc != 0) {
+		arg->Buf[j++] = pc;
+	}
+	for (int i = start; i < n && j < arg->Max; i++) {
+		arg->Buf[j++] = (uintptr_t)frames[i];
+	}
+	if (j < arg->Max) {
+		arg->Buf[j] = 0;
+	}
+}
+
+// nativeSymbolizer resolves native PCs using dynamic symbol tables, so only exported symbols
+// get names. Other frames are named after the binary or shared library they belong to.
+void nativeSymbolizer(void* p) {
+	struct cgoSymbolizerArg* arg = (struct cgoSymbolizerArg*)p;
+	Dl_info info;
+	arg->More = 0;
+	if (dladdr((void*)arg->PC, &info) != 0) {
+		arg->Func = info.dli_sname != NULL ? info.dli_sname : info.dli_fname;
+		arg->Entry = (uintptr_t)info.dli_saddr;
+		arg->File = info.dli_fname;
+	}
+}
+
+// backtrace loads libgcc lazily, that's not safe to do from a signal handler
+static void warmupBacktrace() {
+	void* frames[1];
+	backtrace(frames, 1);
+}
+*/
+import "C"
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+var enableNativeStacksOnce sync.Once
+
+// EnableNativeStacks makes CPU profiles include native (C) frames for goroutines running cgo code.
+// Without it all time spent in C code is attributed to the cgo call site.
+// It can only be enabled once per process and can't be disabled.
+func EnableNativeStacks() error {
+	enableNativeStacksOnce.Do(func() {
+		C.warmupBacktrace()
+		runtime.SetCgoTraceback(0, unsafe.Pointer(C.nativeTraceback), nil, unsafe.Pointer(C.nativeSymbolizer))
+	})
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build linux && cgo
+// +build linux,cgo
+
+package gospy
+
+import (
+	"bytes"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/gospy/cgobusy"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+)
+
+var _ = Describe("EnableNativeStacks", func() {
+	It("can be called more than once", func() {
+		Expect(EnableNativeStacks()).To(Succeed())
+		Expect(EnableNativeStacks()).To(Succeed())
+	})
+
+	It("adds native frames to stacks of cgo calls", func() {
+		Expect(EnableNativeStacks()).To(Succeed())
+		s, err := Start(spy.ProfileCPU, 100, false, false)
+		Expect(err).ToNot(HaveOccurred())
+		defer s.Stop()
+
+		cgobusy.Spin(500 * time.Millisecond)
+
+		// C code of the test binary isn't in its dynamic symbol table, so it's named after the binary
+		nativeFrame := []byte("runtime.asmcgocall;" + os.Args[0])
+		s.(spy.Resettable).Reset()
+		withNativeFrames := 0
+		s.Snapshot(func(name []byte, samples uint64, err error) {
+			Expect(err).ToNot(HaveOccurred())
+			if bytes.Contains(name, nativeFrame) {
+				withNativeFrames++
+			}
+		})
+		Expect(withNativeFrames).ToNot(BeZero())
+	})
+})
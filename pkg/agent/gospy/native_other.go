@@ -0,0 +1,10 @@
+// +build !linux !cgo
+
+package gospy
+
+import "errors"
+
+// EnableNativeStacks is only supported on Linux in binaries built with cgo
+func EnableNativeStacks() error {
+	return errors.New("native stacks are only supported on linux with cgo enabled")
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+)
+
+// DefaultHostLabel is the name of the host label unless it's configured otherwise
+const DefaultHostLabel = "host"
+
+// generatedHostname matches hostnames that change with every deployment or restart,
+// e.g docker container IDs (3f4e5d6c7b8a) and kubernetes pod names (api-5d4f8b7c9-x2v7k)
+var generatedHostname = regexp.MustCompile(`^[0-9a-f]{12,64}$|-[0-9a-f]{6,10}-[0-9a-z]{5}$`)
+
+// hostLabel returns the hostname label pair added to profile keys, e.g host=web-1.
+// Empty label disables it, empty hostname means the one of the machine.
+func hostLabel(label, hostname string, logger Logger) string {
+	if label == "" {
+		return ""
+	}
+	if hostname == "" {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			if logger != nil {
+				logger.Errorf("failed to get hostname, profiles won't have the %s label: %v", label, err)
+			}
+			return ""
+		}
+	}
+	// these would break the key syntax
+	hostname = strings.Map(func(r rune) rune {
+		switch r {
+		case '{', '}', ',', '=':
+			return '_'
+		}
+		return r
+	}, hostname)
+	// Logger has no warning level, this has to be visible with the default one
+	if generatedHostname.MatchString(hostname) && logger != nil {
+		logger.Errorf("hostname %q looks generated, e.g by a container runtime. Every new one creates new profile series, "+
+			"consider setting a stable hostname or disabling the %s label", hostname, label)
+	}
+	return label + "=" + hostname
+}
+
+// profileName returns the name profiles of the type are uploaded with. App names can have labels,
+// e.g myapp{env=prod} is uploaded as myapp.cpu{env=prod,host=web-1}. The host label isn't added when
+// the app name sets it already.
+func profileName(appName string, pt spy.ProfileType, host string) string {
+	name, labels := appName, ""
+	if i := strings.Index(appName, "{"); i >= 0 {
+		name = appName[:i]
+		labels = strings.TrimSuffix(strings.TrimSpace(appName[i+1:]), "}")
+		labels = strings.Trim(labels, " ,")
+	}
+	if host != "" {
+		hostKey := host[:strings.Index(host, "=")]
+		set := false
+		for _, l := range strings.Split(labels, ",") {
+			if i := strings.Index(l, "="); i >= 0 && strings.TrimSpace(l[:i]) == hostKey {
+				set = true
+			}
+		}
+		if !set {
+			if labels != "" {
+				labels += ","
+			}
+			labels += host
+		}
+	}
+	name = strings.TrimSpace(name) + "." + string(pt)
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
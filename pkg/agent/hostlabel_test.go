@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+)
+
+type recordingLogger struct {
+	NoopLogger
+	messages []string
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+var _ = Describe("host label", func() {
+	DescribeTable("profileName",
+		func(appName, host, expected string) {
+			Expect(profileName(appName, spy.ProfileCPU, host)).To(Equal(expected))
+		},
+		Entry("no labels", "myapp", "", "myapp.cpu"),
+		Entry("host", "myapp", "host=web-1", "myapp.cpu{host=web-1}"),
+		Entry("app labels", "myapp{env=prod}", "", "myapp.cpu{env=prod}"),
+		Entry("app labels and host", "myapp{env=prod,}", "host=web-1", "myapp.cpu{env=prod,host=web-1}"),
+		Entry("host set by the app name", "myapp{host=db-1}", "host=web-1", "myapp.cpu{host=db-1}"),
+	)
+
+	It("uses the hostname of the machine by default", func() {
+		Expect(hostLabel("", "web-1", nil)).To(BeEmpty())
+		Expect(hostLabel("instance", "web-1", nil)).To(Equal("instance=web-1"))
+		Expect(hostLabel("host", "", nil)).To(HavePrefix("host="))
+		Expect(hostLabel("host", "a,b{c}", nil)).To(Equal("host=a_b_c_"))
+	})
+
+	It("warns about generated hostnames", func() {
+		l := &recordingLogger{}
+		hostLabel("host", "web-1", l)
+		Expect(l.messages).To(BeEmpty())
+		hostLabel("host", "3f4e5d6c7b8a", l)
+		hostLabel("host", "api-5d4f8b7c9-x2v7k", l)
+		Expect(l.messages).To(HaveLen(2))
+	})
+})
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/pyroscope-io/pyroscope/pkg/agent"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/gospy"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream/remote"
@@ -30,6 +31,24 @@ type Config struct {
 	Logger          agent.Logger
 	ProfileTypes    []ProfileType
 	DisableGCRuns   bool // this will disable automatic runtime.GC runs
+	NativeStacks    bool // this will add native (C) frames to CPU profiles, only supported on linux with cgo
+	WithLocations   bool // this will add source locations (file:line) to frames, for line level views
+
+	// AdaptiveSampleRate lowers the sample rate when the process is busy and raises it back when it's idle,
+	// within [MinSampleRate, MaxSampleRate]
+	AdaptiveSampleRate bool
+	MinSampleRate      uint32
+	MaxSampleRate      uint32
+
+	// UploadBatchWindow makes profile types of an upload interval be uploaded in a single request
+	// when they're ready within the window. 0 means every profile is uploaded separately
+	UploadBatchWindow time.Duration
+
+	// HostLabel is the name of the label set to the hostname on uploaded profiles, host by default
+	// as for the agent. Hostname overrides the hostname of the machine.
+	HostLabel        string
+	Hostname         string
+	DisableHostLabel bool // this will upload profiles without the host label
 }
 
 type Profiler struct {
@@ -47,12 +66,23 @@ func Start(cfg Config) (*Profiler, error) {
 	if cfg.Logger == nil {
 		cfg.Logger = &agent.NoopLogger{}
 	}
+	if cfg.DisableHostLabel {
+		cfg.HostLabel = ""
+	} else if cfg.HostLabel == "" {
+		cfg.HostLabel = agent.DefaultHostLabel
+	}
+	if cfg.NativeStacks {
+		if err := gospy.EnableNativeStacks(); err != nil {
+			return nil, fmt.Errorf("enable native stacks: %v", err)
+		}
+	}
 
 	rc := remote.RemoteConfig{
 		AuthToken:              cfg.AuthToken,
 		UpstreamAddress:        cfg.ServerAddress,
 		UpstreamThreads:        4,
 		UpstreamRequestTimeout: 30 * time.Second,
+		BatchWindow:            cfg.UploadBatchWindow,
 	}
 	upstream, err := remote.New(rc, cfg.Logger)
 	if err != nil {
@@ -64,11 +94,19 @@ func Start(cfg Config) (*Profiler, error) {
 		AppName:          cfg.ApplicationName,
 		ProfilingTypes:   types.DefaultProfileTypes,
 		DisableGCRuns:    cfg.DisableGCRuns,
+		WithLocations:    cfg.WithLocations,
 		SpyName:          types.GoSpy,
 		SampleRate:       cfg.SampleRate,
 		UploadRate:       10 * time.Second,
 		Pid:              0,
 		WithSubprocesses: false,
+
+		AdaptiveSampleRate: cfg.AdaptiveSampleRate,
+		MinSampleRate:      cfg.MinSampleRate,
+		MaxSampleRate:      cfg.MaxSampleRate,
+
+		HostLabel: cfg.HostLabel,
+		Hostname:  cfg.Hostname,
 	}
 	session := agent.NewSession(&sc, cfg.Logger)
 	if err := session.Start(); err != nil {
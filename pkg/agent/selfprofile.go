@@ -8,7 +8,18 @@ import (
 	"github.com/pyroscope-io/pyroscope/pkg/util/atexit"
 )
 
+// SelfProfile profiles the current process until it exits
 func SelfProfile(sampleRate uint32, u upstream.Upstream, appName string, logger Logger) error {
+	s, err := StartSelfProfile(sampleRate, u, appName, logger)
+	if err != nil {
+		return err
+	}
+	atexit.Register(s.Stop)
+	return nil
+}
+
+// StartSelfProfile starts profiling the current process, it's up to the caller to stop the session
+func StartSelfProfile(sampleRate uint32, u upstream.Upstream, appName string, logger Logger) (*ProfileSession, error) {
 	// TODO: upload rate should come from config
 	c := SessionConfig{
 		Upstream:         u,
@@ -22,10 +33,8 @@ func SelfProfile(sampleRate uint32, u upstream.Upstream, appName string, logger
 	}
 	s := NewSession(&c, logger)
 	if err := s.Start(); err != nil {
-		return err
+		return nil, err
 	}
 	s.Logger = logger
-
-	atexit.Register(s.Stop)
-	return nil
+	return s, nil
 }
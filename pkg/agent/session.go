@@ -31,21 +31,36 @@ type ProfileSession struct {
 	appName    string
 	spyName    string
 	sampleRate uint32
-	uploadRate time.Duration
 	pids       []int
 	spies      []spy.Spy
 	stopCh     chan struct{}
-	trieMutex  sync.Mutex
+	// spiesStopped is closed once the spies are stopped, nil until the session is started
+	spiesStopped chan struct{}
+	trieMutex    sync.Mutex
 
 	previousTries []*transporttrie.Trie
 	tries         []*transporttrie.Trie
+	// every trie is uploaded at its own rate, startTimes are the beginnings of the current upload periods
+	uploadRates []time.Duration
+	startTimes  []time.Time
 
 	profileTypes     []spy.ProfileType
 	disableGCRuns    bool
 	withSubprocesses bool
+	withLocations    bool
 
-	startTime time.Time
-	stopTime  time.Time
+	// adaptive is nil unless adaptive sample rate is enabled
+	adaptive *adaptiveSampleRate
+
+	// hostLabel is added to profile keys, e.g host=web-1. Empty means no host label
+	hostLabel string
+
+	// profiles of upload periods that start before warmupUntil are discarded
+	warmupDuration time.Duration
+	warmupUntil    time.Time
+	warmingUp      bool
+
+	stopTime time.Time
 
 	Logger Logger
 }
@@ -60,6 +75,30 @@ type SessionConfig struct {
 	UploadRate       time.Duration
 	Pid              int
 	WithSubprocesses bool
+
+	// UploadRates overrides UploadRate for some profile types, e.g heap profiles change slowly
+	// and don't need to be uploaded as often as cpu ones
+	UploadRates map[spy.ProfileType]time.Duration
+
+	// AdaptiveSampleRate lowers the sample rate when the process is busy and raises it when it's idle,
+	// within [MinSampleRate, MaxSampleRate]. SampleRate is the initial rate. Zero MinSampleRate means 1,
+	// zero MaxSampleRate means SampleRate
+	AdaptiveSampleRate bool
+	MinSampleRate      uint32
+	MaxSampleRate      uint32
+
+	// HostLabel is the name of the label set to the hostname on uploaded profiles, e.g host or instance.
+	// Hostname overrides the hostname of the machine. Empty HostLabel means no host label
+	HostLabel string
+	Hostname  string
+
+	// WarmupDuration is how long after start profiles are collected but not uploaded, e.g to keep
+	// noisy initialization out. Upload periods that start before it ends are discarded as a whole.
+	WarmupDuration time.Duration
+
+	// WithLocations makes frames carry their source locations (file:line) for line level views.
+	// Only supported by gospy, it makes uploaded profiles and storage a lot bigger
+	WithLocations bool
 }
 
 func NewSession(c *SessionConfig, logger Logger) *ProfileSession {
@@ -70,38 +109,87 @@ func NewSession(c *SessionConfig, logger Logger) *ProfileSession {
 		profileTypes:     c.ProfilingTypes,
 		disableGCRuns:    c.DisableGCRuns,
 		sampleRate:       c.SampleRate,
-		uploadRate:       c.UploadRate,
 		pids:             []int{c.Pid},
 		stopCh:           make(chan struct{}),
 		withSubprocesses: c.WithSubprocesses,
+		withLocations:    c.WithLocations,
+		warmupDuration:   c.WarmupDuration,
 		Logger:           logger,
 	}
+	ps.hostLabel = hostLabel(c.HostLabel, c.Hostname, logger)
+
+	if c.AdaptiveSampleRate {
+		min, max := c.MinSampleRate, c.MaxSampleRate
+		if min == 0 {
+			min = 1
+		}
+		if max == 0 {
+			max = c.SampleRate
+		}
+		if max < min {
+			max = min
+		}
+		ps.adaptive = newAdaptiveSampleRate(min, max)
+		ps.sampleRate = ps.adaptive.clamp(ps.sampleRate)
+	}
 
+	n := 1
 	if ps.spyName == types.GoSpy {
-		ps.previousTries = make([]*transporttrie.Trie, len(ps.profileTypes))
-		ps.tries = make([]*transporttrie.Trie, len(ps.profileTypes))
-	} else {
-		ps.previousTries = make([]*transporttrie.Trie, 1)
-		ps.tries = make([]*transporttrie.Trie, 1)
+		n = len(ps.profileTypes)
+	}
+	ps.previousTries = make([]*transporttrie.Trie, n)
+	ps.tries = make([]*transporttrie.Trie, n)
+	ps.uploadRates = make([]time.Duration, n)
+	ps.startTimes = make([]time.Time, n)
+	for i := range ps.uploadRates {
+		ps.uploadRates[i] = c.UploadRate
+		if r, ok := c.UploadRates[ps.profileTypes[i]]; ok && r > 0 {
+			ps.uploadRates[i] = r
+		}
 	}
 
 	return ps
 }
 
+// trieIndex returns the index of the trie the spy writes to. Go spies profile one type each,
+// other spies profile a single type, one spy per process.
+func (ps *ProfileSession) trieIndex(spyIndex int) int {
+	if ps.spyName == types.GoSpy {
+		return spyIndex
+	}
+	return 0
+}
+
 func (ps *ProfileSession) takeSnapshots() {
 	ticker := time.NewTicker(time.Second / time.Duration(ps.sampleRate))
 	for {
 		select {
 		case <-ticker.C:
-			isdueToReset := ps.isDueForReset()
-			// reset the profiler for spies every upload rate(10s), and before uploading, it needs to read profile data every sample rate
-			if isdueToReset {
-				for _, s := range ps.spies {
-					if sr, ok := s.(spy.Resettable); ok {
-						sr.Reset()
+			now := time.Now()
+			due, anyDue := ps.dueForReset(now)
+			// the rate only changes when all tries start new upload periods, so that every upload has a single rate
+			var newRate uint32
+			if ps.adaptive != nil && allDue(due) {
+				var usage float64
+				newRate, usage = ps.adaptive.next(ps.sampleRate, now)
+				if newRate != ps.sampleRate {
+					if ps.Logger != nil {
+						ps.Logger.Infof("process cpu usage is %.0f%%, changing sample rate from %d to %d Hz", usage*100, ps.sampleRate, newRate)
+					}
+					// go spies apply the new rate when they're reset below
+					for _, s := range ps.spies {
+						if sa, ok := s.(spy.Adjustable); ok {
+							sa.SetSampleRate(newRate)
+						}
 					}
 				}
 			}
+			// reset the profiler for spies every upload rate(10s), and before uploading, it needs to read profile data every sample rate
+			for i, s := range ps.spies {
+				if sr, ok := s.(spy.Resettable); ok && due[ps.trieIndex(i)] {
+					sr.Reset()
+				}
+			}
 
 			for i, s := range ps.spies {
 				s.Snapshot(func(stack []byte, v uint64, err error) {
@@ -117,18 +205,20 @@ func (ps *ProfileSession) takeSnapshots() {
 						ps.trieMutex.Lock()
 						defer ps.trieMutex.Unlock()
 
-						if ps.spyName == types.GoSpy {
-							ps.tries[i].Insert(stack, v, true)
-						} else {
-							ps.tries[0].Insert(stack, v, true)
-						}
+						ps.tries[ps.trieIndex(i)].Insert(stack, v, true)
 					}
 				})
 			}
 
 			// upload the read data to server and reset the start time
-			if isdueToReset {
-				ps.reset()
+			if anyDue {
+				ps.reset(due)
+			}
+
+			if newRate != 0 && newRate != ps.sampleRate {
+				ps.setSampleRate(newRate)
+				ticker.Stop()
+				ticker = time.NewTicker(time.Second / time.Duration(newRate))
 			}
 
 		case <-ps.stopCh:
@@ -137,17 +227,22 @@ func (ps *ProfileSession) takeSnapshots() {
 			for _, spy := range ps.spies {
 				spy.Stop()
 			}
+			close(ps.spiesStopped)
 			return
 		}
 	}
 }
 
 func (ps *ProfileSession) Start() error {
-	ps.reset()
+	if ps.warmupDuration > 0 {
+		ps.warmupUntil = time.Now().Add(ps.warmupDuration)
+		ps.warmingUp = true
+	}
+	ps.reset(nil)
 
 	if ps.spyName == types.GoSpy {
 		for _, pt := range ps.profileTypes {
-			s, err := gospy.Start(pt, ps.sampleRate, ps.disableGCRuns)
+			s, err := gospy.Start(pt, ps.sampleRate, ps.disableGCRuns, ps.withLocations)
 			if err != nil {
 				return err
 			}
@@ -162,30 +257,62 @@ func (ps *ProfileSession) Start() error {
 
 		ps.spies = append(ps.spies, s)
 	}
+	ps.trieMutex.Lock()
+	ps.spiesStopped = make(chan struct{})
+	ps.trieMutex.Unlock()
 	go ps.takeSnapshots()
 	return nil
 }
 
-func (ps *ProfileSession) isDueForReset() bool {
-	// TODO: duration should be either taken from config or ideally passed from server
-	now := time.Now().Truncate(ps.uploadRate)
-	start := ps.startTime.Truncate(ps.uploadRate)
+// dueForReset tells which tries are due for upload, i.e their upload periods have ended
+func (ps *ProfileSession) dueForReset(now time.Time) (due []bool, anyDue bool) {
+	due = make([]bool, len(ps.tries))
+	for i, rate := range ps.uploadRates {
+		// TODO: duration should be either taken from config or ideally passed from server
+		due[i] = !ps.startTimes[i].Truncate(rate).Equal(now.Truncate(rate))
+		anyDue = anyDue || due[i]
+	}
+	return due, anyDue
+}
+
+func allDue(due []bool) bool {
+	for _, d := range due {
+		if !d {
+			return false
+		}
+	}
+	return true
+}
+
+func (ps *ProfileSession) setSampleRate(sampleRate uint32) {
+	ps.trieMutex.Lock()
+	defer ps.trieMutex.Unlock()
 
-	return !start.Equal(now)
+	ps.sampleRate = sampleRate
 }
 
 // the difference between stop and reset is that reset stops current session
-// and then instantly starts a new one
-func (ps *ProfileSession) reset() {
+// and then instantly starts a new one. Only the tries that are due are reset, nil due means all of them.
+func (ps *ProfileSession) reset(due []bool) {
 	ps.trieMutex.Lock()
 	defer ps.trieMutex.Unlock()
 
 	now := time.Now()
 	// upload the read data to server
-	ps.uploadTries(now)
+	ps.uploadTries(now, due)
 
 	// reset the start time
-	ps.startTime = now
+	for i := range ps.startTimes {
+		if due == nil || due[i] {
+			ps.startTimes[i] = now
+		}
+	}
+	if ps.warmingUp && !now.Before(ps.warmupUntil) {
+		ps.warmingUp = false
+		if ps.Logger != nil {
+			ps.Logger.Infof("warmup of %s is complete, uploading profiles from now on", ps.warmupDuration)
+		}
+	}
 
 	if ps.withSubprocesses {
 		ps.addSubprocesses()
@@ -194,8 +321,6 @@ func (ps *ProfileSession) reset() {
 
 func (ps *ProfileSession) Stop() {
 	ps.trieMutex.Lock()
-	defer ps.trieMutex.Unlock()
-
 	ps.stopTime = time.Now()
 	select {
 	case ps.stopCh <- struct{}{}:
@@ -204,16 +329,26 @@ func (ps *ProfileSession) Stop() {
 	close(ps.stopCh)
 
 	// before stopping, upload the tries
-	ps.uploadTries(time.Now())
+	ps.uploadTries(time.Now(), nil)
+	spiesStopped := ps.spiesStopped
+	ps.trieMutex.Unlock()
+
+	// waits for the spies so that a new session can start right away, there can only be one cpu profile at a time
+	if spiesStopped != nil {
+		<-spiesStopped
+	}
 }
 
-// upload the read profile data about 10s to server
-func (ps *ProfileSession) uploadTries(now time.Time) {
+// upload the read profile data about 10s to server, nil due means all tries
+func (ps *ProfileSession) uploadTries(now time.Time, due []bool) {
 	for i, trie := range ps.tries {
+		if due != nil && !due[i] {
+			continue
+		}
 		skipUpload := false
 
 		if trie != nil {
-			endTime := now.Truncate(ps.uploadRate)
+			endTime := now.Truncate(ps.uploadRates[i])
 
 			uploadTrie := trie
 			if ps.profileTypes[i].IsCumulative() {
@@ -226,11 +361,16 @@ func (ps *ProfileSession) uploadTries(now time.Time) {
 				}
 			}
 
+			// the trie is still kept as the previous one below, so that cumulative profiles are right after warmup
+			if ps.startTimes[i].Before(ps.warmupUntil) {
+				skipUpload = true
+			}
+
 			if !skipUpload {
-				name := ps.appName + "." + string(ps.profileTypes[i])
+				name := profileName(ps.appName, ps.profileTypes[i], ps.hostLabel)
 				ps.upstream.Upload(&upstream.UploadJob{
 					Name:            name,
-					StartTime:       ps.startTime,
+					StartTime:       ps.startTimes[i],
 					EndTime:         endTime,
 					SpyName:         ps.spyName,
 					SampleRate:      ps.sampleRate,
@@ -2,6 +2,7 @@ package agent
 
 import (
 	"os"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -17,7 +18,10 @@ import (
 const durThreshold = 30 * time.Millisecond
 
 type upstreamMock struct {
-	tries []*transporttrie.Trie
+	m           sync.Mutex
+	tries       []*transporttrie.Trie
+	names       []string
+	sampleRates []uint32
 }
 
 func (u *upstreamMock) Stop() {
@@ -25,7 +29,23 @@ func (u *upstreamMock) Stop() {
 }
 
 func (u *upstreamMock) Upload(j *upstream.UploadJob) {
+	u.m.Lock()
+	defer u.m.Unlock()
 	u.tries = append(u.tries, j.Trie)
+	u.names = append(u.names, j.Name)
+	u.sampleRates = append(u.sampleRates, j.SampleRate)
+}
+
+func (u *upstreamMock) uploads(name string) int {
+	u.m.Lock()
+	defer u.m.Unlock()
+	n := 0
+	for _, v := range u.names {
+		if v == name {
+			n++
+		}
+	}
+	return n
 }
 
 var _ = Describe("agent.Session", func() {
@@ -64,6 +84,114 @@ var _ = Describe("agent.Session", func() {
 				})
 				close(done)
 			})
+
+			It("uploads every profile type at its own rate", func(done Done) {
+				u := &upstreamMock{}
+				uploadRate := 200 * time.Millisecond
+				s := NewSession(&SessionConfig{
+					Upstream:       u,
+					AppName:        "test-app",
+					ProfilingTypes: []spy.ProfileType{spy.ProfileInuseObjects, spy.ProfileInuseSpace},
+					SpyName:        "gospy",
+					SampleRate:     100,
+					UploadRate:     uploadRate,
+					UploadRates:    map[spy.ProfileType]time.Duration{spy.ProfileInuseSpace: 4 * uploadRate},
+				}, logrus.StandardLogger())
+				now := time.Now()
+				time.Sleep(now.Truncate(4 * uploadRate).Add(4*uploadRate + 10*time.Millisecond).Sub(now))
+				Expect(s.Start()).To(Succeed())
+				time.Sleep(4*uploadRate + 100*time.Millisecond)
+
+				Expect(u.uploads("test-app.inuse_objects")).To(Equal(4))
+				Expect(u.uploads("test-app.inuse_space")).To(Equal(1))
+				s.Stop()
+				close(done)
+			}, 5)
+
+			It("discards profiles collected during warmup", func(done Done) {
+				u := &upstreamMock{}
+				uploadRate := 200 * time.Millisecond
+				s := NewSession(&SessionConfig{
+					Upstream:       u,
+					AppName:        "test-app",
+					ProfilingTypes: []spy.ProfileType{spy.ProfileCPU},
+					SpyName:        "debugspy",
+					SampleRate:     100,
+					UploadRate:     uploadRate,
+					Pid:            os.Getpid(),
+					WarmupDuration: 300 * time.Millisecond,
+				}, logrus.StandardLogger())
+				now := time.Now()
+				time.Sleep(now.Truncate(uploadRate).Add(uploadRate + 10*time.Millisecond).Sub(now))
+				Expect(s.Start()).To(Succeed())
+				time.Sleep(700 * time.Millisecond)
+				s.Stop()
+
+				// the first two periods start during warmup
+				u.m.Lock()
+				defer u.m.Unlock()
+				Expect(u.tries).To(HaveLen(2))
+				close(done)
+			}, 5)
+
+			It("lowers the sample rate when the process is busy", func(done Done) {
+				u := &upstreamMock{}
+				uploadRate := 200 * time.Millisecond
+				s := NewSession(&SessionConfig{
+					Upstream:           u,
+					AppName:            "test-app",
+					ProfilingTypes:     []spy.ProfileType{spy.ProfileCPU},
+					SpyName:            "debugspy",
+					SampleRate:         100,
+					UploadRate:         uploadRate,
+					Pid:                os.Getpid(),
+					AdaptiveSampleRate: true,
+					MinSampleRate:      25,
+				}, logrus.StandardLogger())
+				// pretend the process uses way more than all CPUs
+				var cpu time.Duration
+				s.adaptive.lastCPU = 0
+				s.adaptive.cpuTime = func() (time.Duration, error) {
+					cpu += time.Duration(s.adaptive.numCPU) * time.Hour
+					return cpu, nil
+				}
+				now := time.Now()
+				time.Sleep(now.Truncate(uploadRate).Add(uploadRate + 10*time.Millisecond).Sub(now))
+				Expect(s.Start()).To(Succeed())
+				time.Sleep(3*uploadRate + 100*time.Millisecond)
+				s.Stop()
+
+				u.m.Lock()
+				defer u.m.Unlock()
+				Expect(u.sampleRates).To(Equal([]uint32{100, 50, 25, 25}))
+				close(done)
+			}, 5)
+		})
+	})
+
+	Describe("adaptiveSampleRate", func() {
+		It("adjusts the rate to CPU usage within bounds", func() {
+			var cpu time.Duration
+			a := &adaptiveSampleRate{
+				min:      10,
+				max:      100,
+				numCPU:   2,
+				lastTime: time.Unix(0, 0),
+				cpuTime:  func() (time.Duration, error) { return cpu, nil },
+			}
+			next := func(rate uint32, usage float64) uint32 {
+				now := a.lastTime.Add(time.Second)
+				cpu += time.Duration(usage * 2 * float64(time.Second))
+				r, u := a.next(rate, now)
+				Expect(u).To(BeNumerically("~", usage, 0.001))
+				return r
+			}
+
+			Expect(next(100, 0.9)).To(Equal(uint32(50)))
+			Expect(next(50, 0.5)).To(Equal(uint32(50)))
+			Expect(next(15, 0.9)).To(Equal(uint32(10)))
+			Expect(next(10, 0.1)).To(Equal(uint32(20)))
+			Expect(next(80, 0.1)).To(Equal(uint32(100)))
 		})
 	})
 })
@@ -14,6 +14,11 @@ type Resettable interface {
 	Reset()
 }
 
+// Adjustable spies sample at their own rate, it can be changed while they're running
+type Adjustable interface {
+	SetSampleRate(sampleRate uint32)
+}
+
 type ProfileType string
 
 const (
@@ -22,12 +27,23 @@ const (
 	ProfileAllocObjects ProfileType = "alloc_objects"
 	ProfileInuseSpace   ProfileType = "inuse_space"
 	ProfileAllocSpace   ProfileType = "alloc_space"
+	// ProfileWall is wall-clock time, it includes time spent off-CPU, e.g blocked on I/O
+	ProfileWall ProfileType = "wall"
 
 	Go     = "gospy"
 	Python = "pyspy"
 	Ruby   = "rbspy"
 )
 
+// IsKnown tells whether t is one of the profile types above
+func (t ProfileType) IsKnown() bool {
+	switch t {
+	case ProfileCPU, ProfileInuseObjects, ProfileAllocObjects, ProfileInuseSpace, ProfileAllocSpace, ProfileWall:
+		return true
+	}
+	return false
+}
+
 func (t ProfileType) IsCumulative() bool {
 	return t == ProfileAllocObjects || t == ProfileAllocSpace
 }
@@ -0,0 +1,182 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+)
+
+// maxBatchSize caps profiles per batch request, well below the server limit of /ingest/batch
+const maxBatchSize = 100
+
+// batchProfileJSON is a profile of an /ingest/batch request, fields mirror /ingest query parameters
+type batchProfileJSON struct {
+	Name            string `json:"name"`
+	From            int64  `json:"from"`
+	Until           int64  `json:"until"`
+	Format          string `json:"format"`
+	SpyName         string `json:"spyName,omitempty"`
+	SampleRate      uint32 `json:"sampleRate,omitempty"`
+	Units           string `json:"units,omitempty"`
+	AggregationType string `json:"aggregationType,omitempty"`
+	Data            []byte `json:"data"`
+}
+
+type batchJSON struct {
+	Profiles []batchProfileJSON `json:"profiles"`
+}
+
+// batchResultsJSON has a result for each profile of the batch, in the same order
+type batchResultsJSON struct {
+	Results []struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+// batchJobs coalesces jobs that are ready within the batch window (e.g different profile types
+// of the same upload interval) into batches. Pending jobs are uploaded on stop.
+func (r *Remote) batchJobs() {
+	defer r.wg.Done()
+
+	var pending []*upstream.UploadJob
+	var window <-chan time.Time
+	for {
+		select {
+		case <-r.done:
+			for _, b := range splitByTenant(pending) {
+				r.safeUploadBatch(b)
+			}
+			return
+		case job := <-r.jobs:
+			r.updateQueueLength()
+			pending = append(pending, job)
+			if len(pending) == 1 {
+				window = time.After(r.cfg.BatchWindow)
+			}
+			if len(pending) < maxBatchSize {
+				continue
+			}
+		case <-window:
+		}
+		for _, b := range splitByTenant(pending) {
+			select {
+			case r.batches <- b:
+			case <-r.done:
+				r.safeUploadBatch(b)
+			}
+		}
+		pending = nil
+		window = nil
+	}
+}
+
+// splitByTenant groups jobs by tenant, a request can only carry profiles of a single tenant
+func splitByTenant(jobs []*upstream.UploadJob) [][]*upstream.UploadJob {
+	var batches [][]*upstream.UploadJob
+	index := make(map[string]int)
+	for _, j := range jobs {
+		i, ok := index[j.Tenant]
+		if !ok {
+			i = len(batches)
+			index[j.Tenant] = i
+			batches = append(batches, nil)
+		}
+		batches[i] = append(batches[i], j)
+	}
+	return batches
+}
+
+func (r *Remote) handleBatches() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.done:
+			return
+		case batch := <-r.batches:
+			if !r.waitHealthy() {
+				return
+			}
+			r.safeUploadBatch(batch)
+		}
+	}
+}
+
+func (r *Remote) safeUploadBatch(jobs []*upstream.UploadJob) {
+	defer func() {
+		if catch := recover(); catch != nil {
+			r.Logger.Errorf("recover stack: %v", debug.Stack())
+		}
+	}()
+
+	if err := r.uploadBatch(jobs); err != nil {
+		r.Logger.Errorf("upload batch of %d profiles: %v", len(jobs), err)
+	}
+}
+
+// uploadBatch uploads jobs of a single tenant in one request. A single job is uploaded
+// to /ingest, so that batching doesn't cost anything when there's nothing to batch.
+func (r *Remote) uploadBatch(jobs []*upstream.UploadJob) error {
+	if len(jobs) == 1 {
+		return r.uploadProfile(jobs[0])
+	}
+
+	b := batchJSON{Profiles: make([]batchProfileJSON, 0, len(jobs))}
+	for _, j := range jobs {
+		b.Profiles = append(b.Profiles, batchProfileJSON{
+			Name:            j.Name,
+			From:            j.StartTime.Unix(),
+			Until:           j.EndTime.Unix(),
+			Format:          "trie",
+			SpyName:         j.SpyName,
+			SampleRate:      j.SampleRate,
+			Units:           j.Units,
+			AggregationType: j.AggregationType,
+			Data:            j.Trie.Bytes(),
+		})
+	}
+	body, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("marshal batch: %v", err)
+	}
+
+	request, err := r.newRequest("/ingest/batch", nil, jobs[0].Tenant, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	r.Logger.Debugf("uploading a batch of %d profiles at %s", len(jobs), request.URL.String())
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("do http request: %v", err)
+	}
+	defer response.Body.Close()
+	respBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("read response body: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with status %d: %s", response.StatusCode, bytes.TrimSpace(respBody))
+	}
+
+	var res batchResultsJSON
+	if err = json.Unmarshal(respBody, &res); err != nil {
+		return fmt.Errorf("parse response body: %v", err)
+	}
+	if len(res.Results) != len(jobs) {
+		return fmt.Errorf("server returned %d results for %d profiles", len(res.Results), len(jobs))
+	}
+	for i, result := range res.Results {
+		if result.Status != http.StatusOK {
+			r.Logger.Errorf("upload profile %s: server responded with status %d: %s", jobs[i].Name, result.Status, result.Error)
+		}
+	}
+	return nil
+}
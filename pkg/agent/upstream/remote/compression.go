@@ -0,0 +1,42 @@
+package remote
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/util/compression"
+)
+
+// The ratio of the two byte counters is the bandwidth saved by compression,
+// the seconds counter is what it costs.
+var (
+	uploadUncompressedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_uncompressed_bytes_total",
+		Help: "size of uploaded payloads before compression",
+	}, []string{"compression"})
+	uploadCompressedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_compressed_bytes_total",
+		Help: "size of uploaded payloads after compression",
+	}, []string{"compression"})
+	uploadCompressionSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_compression_seconds_total",
+		Help: "time spent compressing uploaded payloads",
+	}, []string{"compression"})
+)
+
+func (r *Remote) compress(b []byte) ([]byte, error) {
+	c := r.cfg.Compression
+	if c == "" {
+		c = compression.None
+	}
+	start := time.Now()
+	res, err := compression.Compress(c, b)
+	if err != nil {
+		return nil, err
+	}
+	uploadCompressionSeconds.WithLabelValues(c).Add(time.Since(start).Seconds())
+	uploadUncompressedBytes.WithLabelValues(c).Add(float64(len(b)))
+	uploadCompressedBytes.WithLabelValues(c).Add(float64(len(res)))
+	return res, nil
+}
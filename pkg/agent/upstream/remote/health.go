@@ -0,0 +1,127 @@
+package remote
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// When health checks are enabled the server /healthz is polled and uploads are paused while it
+// fails, rather than failing every single upload. Paused jobs stay in the upload queue, once it's
+// full the queue policy applies, see queue.go. Uploads resume as soon as a check succeeds.
+//
+// The agent has no disk buffer, so data is only retained during an outage for as long as it fits
+// in the in-memory queue (QueueSize). Jobs dropped by the queue policy and jobs still queued when
+// the agent exits are lost.
+
+var upstreamHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pyroscope_agent_upstream_healthy",
+	Help: "1 if the last health check of the server profiles are uploaded to succeeded, 0 otherwise",
+}, []string{"host"})
+
+// health is the health state of the upstream, it's healthy until a check fails
+type health struct {
+	mu sync.Mutex
+	// healthy is closed while the upstream is healthy
+	healthy chan struct{}
+	gauge   prometheus.Gauge
+}
+
+func newHealth(host string) *health {
+	h := &health{
+		healthy: make(chan struct{}),
+		gauge:   upstreamHealthy.WithLabelValues(host),
+	}
+	close(h.healthy)
+	h.gauge.Set(1)
+	return h
+}
+
+// set updates the state, it returns true if it changed
+func (h *health) set(ok bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.healthy:
+		if ok {
+			return false
+		}
+		h.healthy = make(chan struct{})
+		h.gauge.Set(0)
+	default:
+		if !ok {
+			return false
+		}
+		close(h.healthy)
+		h.gauge.Set(1)
+	}
+	return true
+}
+
+func (h *health) wait() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+// waitHealthy blocks until the upstream is healthy, it returns false if the remote is stopped first
+func (r *Remote) waitHealthy() bool {
+	if r.health == nil {
+		return true
+	}
+	select {
+	case <-r.health.wait():
+		return true
+	case <-r.done:
+		return false
+	}
+}
+
+func (r *Remote) checkHealthLoop() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.cfg.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			err := r.checkHealth()
+			if !r.health.set(err == nil) {
+				continue
+			}
+			if err != nil {
+				r.Logger.Errorf("server is unhealthy, pausing uploads: %v", err)
+			} else {
+				r.Logger.Infof("server is healthy again, resuming uploads")
+			}
+		}
+	}
+}
+
+func (r *Remote) checkHealth() error {
+	u, err := url.Parse(r.cfg.UpstreamAddress)
+	if err != nil {
+		return fmt.Errorf("url parse: %v", err)
+	}
+	u.Path = path.Join(u.Path, "/healthz")
+	u.RawQuery = ""
+	response, err := r.client.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("do http request: %v", err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("server responded with status %d", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package remote
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+)
+
+// Profiles are handed over to upload workers through a bounded queue, so that a slow or unavailable
+// server doesn't make the agent buffer an unbounded amount of profiles. What happens once the queue
+// is full depends on the policy:
+//
+//   * drop-oldest (the default) drops the oldest queued profile to make room for the new one. Profiling
+//     is never slowed down by uploads and the most recent profiles are kept, at the cost of losing
+//     profiles under sustained backlogs.
+//   * block makes Upload wait for a free slot, i.e sessions stop collecting new profiles until uploads
+//     catch up. Nothing is dropped (unless the remote is stopping, see BeginStop), but profiles are
+//     delayed and sampling gaps can appear instead.
+//
+// A larger queue absorbs longer backlogs at the cost of memory, a profile job is roughly the size of
+// its serialized trie.
+
+const (
+	QueuePolicyDropOldest = "drop-oldest"
+	QueuePolicyBlock      = "block"
+
+	defaultQueueSize = 100
+)
+
+var (
+	uploadQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pyroscope_agent_upload_queue_length",
+		Help: "number of profiles waiting to be uploaded",
+	}, []string{"host"})
+	uploadQueueCapacity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pyroscope_agent_upload_queue_capacity",
+		Help: "max number of profiles waiting to be uploaded",
+	}, []string{"host"})
+	uploadQueueFull = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_queue_full_total",
+		Help: "number of profiles that were queued for upload while the queue was full",
+	}, []string{"host"})
+	uploadQueueDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_queue_dropped_total",
+		Help: "number of profiles dropped because the upload queue was full",
+	}, []string{"host"})
+	uploadQueueBlockedSeconds = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_agent_upload_queue_blocked_seconds_total",
+		Help: "time spent waiting for a free slot of the upload queue with the block policy",
+	}, []string{"host"})
+)
+
+func validateQueuePolicy(p string) error {
+	switch p {
+	case "", QueuePolicyDropOldest, QueuePolicyBlock:
+		return nil
+	}
+	return fmt.Errorf("unknown upload queue policy %q, supported ones are %s and %s", p, QueuePolicyDropOldest, QueuePolicyBlock)
+}
+
+// queueMetrics are metrics of the upload queue of a remote
+type queueMetrics struct {
+	length         prometheus.Gauge
+	full           prometheus.Counter
+	dropped        prometheus.Counter
+	blockedSeconds prometheus.Counter
+}
+
+func newQueueMetrics(host string, capacity int) queueMetrics {
+	uploadQueueCapacity.WithLabelValues(host).Set(float64(capacity))
+	return queueMetrics{
+		length:         uploadQueueLength.WithLabelValues(host),
+		full:           uploadQueueFull.WithLabelValues(host),
+		dropped:        uploadQueueDropped.WithLabelValues(host),
+		blockedSeconds: uploadQueueBlockedSeconds.WithLabelValues(host),
+	}
+}
+
+// enqueue adds the job to the upload queue according to the queue policy
+func (r *Remote) enqueue(job *upstream.UploadJob) {
+	defer r.updateQueueLength()
+	select {
+	case r.jobs <- job:
+		return
+	default:
+	}
+
+	r.queueMetrics.full.Inc()
+	if r.cfg.QueuePolicy == QueuePolicyBlock {
+		start := time.Now()
+		defer func() { r.queueMetrics.blockedSeconds.Add(time.Since(start).Seconds()) }()
+		select {
+		case r.jobs <- job:
+		case <-r.stopping:
+			r.queueMetrics.dropped.Inc()
+			r.Logger.Errorf("remote is stopping, dropping a profile job")
+		}
+		return
+	}
+
+	for {
+		select {
+		case r.jobs <- job:
+			return
+		default:
+		}
+		// workers may take the oldest job in the meantime, then there's room for the new one anyway
+		select {
+		case <-r.jobs:
+			r.queueMetrics.dropped.Inc()
+			r.Logger.Errorf("remote upload queue is full, dropping the oldest profile job")
+		default:
+		}
+	}
+}
+
+func (r *Remote) updateQueueLength() {
+	r.queueMetrics.length.Set(float64(len(r.jobs)))
+}
@@ -16,8 +16,12 @@ import (
 
 	"github.com/pyroscope-io/pyroscope/pkg/agent"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+	"github.com/pyroscope-io/pyroscope/pkg/util/compression"
 )
 
+// tenantHeader is the header the server uses to scope ingested profiles to a tenant
+const tenantHeader = "X-Scope-OrgID"
+
 var (
 	ErrCloudTokenRequired = errors.New("Please provide an authentication token. You can find it here: https://pyroscope.io/cloud")
 	cloudHostnameSuffix   = "pyroscope.cloud"
@@ -29,6 +33,19 @@ type Remote struct {
 	client *http.Client
 	Logger agent.Logger
 
+	// batches are only used when batching is enabled, see batch.go
+	batches chan []*upstream.UploadJob
+	// health is only set when health checks are enabled, see health.go
+	health *health
+	// queueMetrics are metrics of the jobs queue, see queue.go
+	queueMetrics queueMetrics
+
+	// stopping is closed once stopping begins, see BeginStop
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+	// stopM keeps uploads from queueing jobs after Stop drained the queue
+	stopM sync.RWMutex
+
 	done chan struct{}
 	wg   sync.WaitGroup
 }
@@ -38,20 +55,47 @@ type RemoteConfig struct {
 	UpstreamThreads        int
 	UpstreamAddress        string
 	UpstreamRequestTimeout time.Duration
+	// BatchWindow is how long profiles wait for other profiles to be uploaded with them
+	// in a single /ingest/batch request. 0 means every profile is uploaded separately
+	BatchWindow time.Duration
+	// HealthCheckInterval is how often the server health is checked, uploads are paused
+	// while it's unhealthy. 0 means health isn't checked
+	HealthCheckInterval time.Duration
+	// Compression of uploaded payloads: none, gzip or zstd, see the compression package.
+	// Empty means none, servers that don't support it reject compressed payloads
+	Compression string
+	// QueueSize is the max number of profiles waiting to be uploaded, 0 means 100
+	QueueSize int
+	// QueuePolicy is what happens to new profiles once the queue is full: drop-oldest or block,
+	// see queue.go. Empty means drop-oldest
+	QueuePolicy string
 }
 
 func New(cfg RemoteConfig, logger agent.Logger) (*Remote, error) {
+	if err := compression.Validate(cfg.Compression); err != nil {
+		return nil, err
+	}
+	if err := validateQueuePolicy(cfg.QueuePolicy); err != nil {
+		return nil, err
+	}
+	if cfg.QueueSize < 0 {
+		return nil, fmt.Errorf("invalid upload queue size %d", cfg.QueueSize)
+	}
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = defaultQueueSize
+	}
 	remote := &Remote{
 		cfg:  cfg,
-		jobs: make(chan *upstream.UploadJob, 100),
+		jobs: make(chan *upstream.UploadJob, cfg.QueueSize),
 		client: &http.Client{
 			Transport: &http.Transport{
 				MaxConnsPerHost: cfg.UpstreamThreads,
 			},
 			Timeout: cfg.UpstreamRequestTimeout,
 		},
-		Logger: logger,
-		done:   make(chan struct{}),
+		Logger:   logger,
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
 	}
 
 	// parse the upstream address
@@ -65,6 +109,11 @@ func New(cfg RemoteConfig, logger agent.Logger) (*Remote, error) {
 		return nil, ErrCloudTokenRequired
 	}
 
+	if cfg.HealthCheckInterval > 0 {
+		remote.health = newHealth(u.Host)
+	}
+	remote.queueMetrics = newQueueMetrics(u.Host, cfg.QueueSize)
+
 	// start goroutines for uploading profile data
 	remote.start()
 
@@ -72,26 +121,88 @@ func New(cfg RemoteConfig, logger agent.Logger) (*Remote, error) {
 }
 
 func (r *Remote) start() {
+	if r.health != nil {
+		r.wg.Add(1)
+		go r.checkHealthLoop()
+	}
+	if r.cfg.BatchWindow > 0 {
+		r.batches = make(chan []*upstream.UploadJob)
+		r.wg.Add(1)
+		go r.batchJobs()
+		r.wg.Add(r.cfg.UpstreamThreads)
+		for i := 0; i < r.cfg.UpstreamThreads; i++ {
+			go r.handleBatches()
+		}
+		return
+	}
+	r.wg.Add(r.cfg.UpstreamThreads)
 	for i := 0; i < r.cfg.UpstreamThreads; i++ {
 		go r.handleJobs()
 	}
 }
 
+// BeginStop makes uploads drop profiles instead of waiting for a free slot of the full queue with
+// the block policy. It's called before sessions uploading to the remote are stopped, so that their
+// last uploads can't hang the shutdown while the server is unavailable. Stop calls it too.
+func (r *Remote) BeginStop() {
+	r.stoppingOnce.Do(func() { close(r.stopping) })
+}
+
 func (r *Remote) Stop() {
+	// unblocks uploads waiting for a free slot, they hold stopM
+	r.BeginStop()
+	r.stopM.Lock()
 	if r.done != nil {
 		close(r.done)
 	}
+	r.stopM.Unlock()
 
 	// wait for uploading goroutines exit
 	r.wg.Wait()
+	r.drain()
+}
+
+// drain uploads profiles that are still queued once uploading goroutines exited, so that
+// profiles collected right before stop aren't lost. They're dropped if the server is unhealthy.
+func (r *Remote) drain() {
+	var jobs []*upstream.UploadJob
+	for len(r.jobs) > 0 {
+		jobs = append(jobs, <-r.jobs)
+	}
+	r.updateQueueLength()
+	if len(jobs) == 0 {
+		return
+	}
+	if r.health != nil {
+		select {
+		case <-r.health.wait():
+		default:
+			r.Logger.Errorf("upstream is unhealthy, dropping %d queued profile jobs", len(jobs))
+			return
+		}
+	}
+	if r.cfg.BatchWindow > 0 {
+		for _, b := range splitByTenant(jobs) {
+			r.safeUploadBatch(b)
+		}
+		return
+	}
+	for _, j := range jobs {
+		r.safeUpload(j)
+	}
 }
 
 func (r *Remote) Upload(job *upstream.UploadJob) {
+	r.stopM.RLock()
+	defer r.stopM.RUnlock()
 	select {
-	case r.jobs <- job:
+	case <-r.done:
+		r.queueMetrics.dropped.Inc()
+		r.Logger.Errorf("remote is stopped, dropping a profile job")
+		return
 	default:
-		r.Logger.Errorf("remote upload queue is full, dropping a profile job")
 	}
+	r.enqueue(job)
 }
 
 // UploadSync is only used in benchmarks right now
@@ -100,12 +211,7 @@ func (r *Remote) UploadSync(job *upstream.UploadJob) error {
 }
 
 func (r *Remote) uploadProfile(j *upstream.UploadJob) error {
-	u, err := url.Parse(r.cfg.UpstreamAddress)
-	if err != nil {
-		return fmt.Errorf("url parse: %v", err)
-	}
-
-	q := u.Query()
+	q := url.Values{}
 	q.Set("name", j.Name)
 	// TODO: I think these should be renamed to startTime / endTime
 	q.Set("from", strconv.Itoa(int(j.StartTime.Unix())))
@@ -115,20 +221,13 @@ func (r *Remote) uploadProfile(j *upstream.UploadJob) error {
 	q.Set("units", j.Units)
 	q.Set("aggregationType", j.AggregationType)
 
-	u.Path = path.Join(u.Path, "/ingest")
-	u.RawQuery = q.Encode()
-
-	r.Logger.Infof("uploading at %s", u.String())
 	// new a request for the job
-	request, err := http.NewRequest("POST", u.String(), bytes.NewReader(j.Trie.Bytes()))
+	request, err := r.newRequest("/ingest", q, j.Tenant, j.Trie.Bytes())
 	if err != nil {
-		return fmt.Errorf("new http request: %v", err)
+		return err
 	}
 	request.Header.Set("Content-Type", "binary/octet-stream+trie")
-
-	if r.cfg.AuthToken != "" {
-		request.Header.Set("Authorization", "Bearer "+r.cfg.AuthToken)
-	}
+	r.Logger.Infof("uploading at %s", request.URL.String())
 
 	// do the request and get the response
 	response, err := r.client.Do(request)
@@ -146,13 +245,52 @@ func (r *Remote) uploadProfile(j *upstream.UploadJob) error {
 	return nil
 }
 
+// newRequest creates an upload request to the given path of the upstream address,
+// the body is compressed according to the config
+func (r *Remote) newRequest(p string, q url.Values, tenant string, body []byte) (*http.Request, error) {
+	u, err := url.Parse(r.cfg.UpstreamAddress)
+	if err != nil {
+		return nil, fmt.Errorf("url parse: %v", err)
+	}
+	uq := u.Query()
+	for k, v := range q {
+		uq[k] = v
+	}
+	u.Path = path.Join(u.Path, p)
+	u.RawQuery = uq.Encode()
+
+	body, err = r.compress(body)
+	if err != nil {
+		return nil, fmt.Errorf("compress body: %v", err)
+	}
+	request, err := http.NewRequest("POST", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("new http request: %v", err)
+	}
+	if ce := compression.ContentEncoding(r.cfg.Compression); ce != "" {
+		request.Header.Set("Content-Encoding", ce)
+	}
+	if r.cfg.AuthToken != "" {
+		request.Header.Set("Authorization", "Bearer "+r.cfg.AuthToken)
+	}
+	if tenant != "" {
+		request.Header.Set(tenantHeader, tenant)
+	}
+	return request, nil
+}
+
 // handle the jobs
 func (r *Remote) handleJobs() {
+	defer r.wg.Done()
 	for {
 		select {
 		case <-r.done:
 			return
 		case job := <-r.jobs:
+			r.updateQueueLength()
+			if !r.waitHealthy() {
+				return
+			}
 			r.safeUpload(job)
 		}
 	}
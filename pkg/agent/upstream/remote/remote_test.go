@@ -1,18 +1,25 @@
 package remote
 
 import (
+	"encoding/json"
 	"fmt"
 	"html"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
 	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
 	"github.com/pyroscope-io/pyroscope/pkg/testing"
+	"github.com/pyroscope-io/pyroscope/pkg/util/compression"
 	"github.com/sirupsen/logrus"
 )
 
@@ -43,7 +50,11 @@ var _ = Describe("remote.Remote", func() {
 				WriteTimeout:   10 * time.Second,
 				MaxHeaderBytes: 1 << 20,
 			}
-			go mockServer.ListenAndServe()
+			// listen before uploading, otherwise the first uploads may be refused
+			l, err := net.Listen("tcp", mockServer.Addr)
+			Expect(err).ToNot(HaveOccurred())
+			go mockServer.Serve(l)
+			defer mockServer.Close()
 
 			cfg := RemoteConfig{
 				AuthToken:              "",
@@ -71,5 +82,308 @@ var _ = Describe("remote.Remote", func() {
 			r.Stop()
 			close(done)
 		}, 3)
+
+		It("uploads profiles ready within the batch window in a single request", func(done Done) {
+			var m sync.Mutex
+			requests := map[string][]string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				var b batchJSON
+				Expect(r.URL.Path).To(Equal("/ingest/batch"))
+				Expect(json.NewDecoder(r.Body).Decode(&b)).To(Succeed())
+				var res batchResultsJSON
+				names := []string{}
+				for _, p := range b.Profiles {
+					Expect(p.Format).To(Equal("trie"))
+					names = append(names, p.Name)
+					res.Results = append(res.Results, struct {
+						Status int    `json:"status"`
+						Error  string `json:"error"`
+					}{Status: 200})
+				}
+				m.Lock()
+				requests[r.Header.Get(tenantHeader)] = append(requests[r.Header.Get(tenantHeader)], names...)
+				m.Unlock()
+				json.NewEncoder(w).Encode(res)
+			}))
+			defer server.Close()
+
+			r, err := New(RemoteConfig{
+				UpstreamThreads:        2,
+				UpstreamAddress:        server.URL,
+				UpstreamRequestTimeout: 3 * time.Second,
+				BatchWindow:            50 * time.Millisecond,
+			}, logrus.New())
+			Expect(err).ToNot(HaveOccurred())
+
+			t := transporttrie.New()
+			t.Insert([]byte("a;b"), 1)
+			for _, j := range []struct{ name, tenant string }{{"foo.cpu{}", ""}, {"foo.alloc_objects{}", ""}, {"bar.cpu{}", "team-a"}, {"bar.alloc_objects{}", "team-a"}} {
+				r.Upload(&upstream.UploadJob{
+					Name:       j.name,
+					StartTime:  testing.SimpleTime(0),
+					EndTime:    testing.SimpleTime(10),
+					SpyName:    "debugspy",
+					SampleRate: 100,
+					Trie:       t,
+					Tenant:     j.tenant,
+				})
+			}
+			// 4 profiles of 2 tenants take 2 requests
+			Eventually(func() map[string][]string {
+				m.Lock()
+				defer m.Unlock()
+				res := map[string][]string{}
+				for k, v := range requests {
+					res[k] = v
+				}
+				return res
+			}).Should(Equal(map[string][]string{
+				"":       {"foo.cpu{}", "foo.alloc_objects{}"},
+				"team-a": {"bar.cpu{}", "bar.alloc_objects{}"},
+			}))
+			r.Stop()
+			close(done)
+		}, 3)
+		It("pauses uploads while the server is unhealthy", func(done Done) {
+			var healthy, uploads int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/healthz":
+					if atomic.LoadInt32(&healthy) == 0 {
+						w.WriteHeader(http.StatusServiceUnavailable)
+					}
+				case "/ingest":
+					atomic.AddInt32(&uploads, 1)
+				}
+			}))
+			defer server.Close()
+
+			r, err := New(RemoteConfig{
+				UpstreamThreads:        2,
+				UpstreamAddress:        server.URL,
+				UpstreamRequestTimeout: 3 * time.Second,
+				HealthCheckInterval:    10 * time.Millisecond,
+			}, logrus.New())
+			Expect(err).ToNot(HaveOccurred())
+			defer r.Stop()
+
+			u, _ := url.Parse(server.URL)
+			gauge := upstreamHealthy.WithLabelValues(u.Host)
+			Eventually(func() float64 { return testutil.ToFloat64(gauge) }).Should(Equal(0.0))
+
+			r.Upload(&upstream.UploadJob{
+				Name:       "foo.cpu{}",
+				StartTime:  testing.SimpleTime(0),
+				EndTime:    testing.SimpleTime(10),
+				SpyName:    "debugspy",
+				SampleRate: 100,
+				Trie:       transporttrie.New(),
+			})
+			Consistently(func() int32 { return atomic.LoadInt32(&uploads) }, 100*time.Millisecond).Should(BeZero())
+
+			atomic.StoreInt32(&healthy, 1)
+			Eventually(func() int32 { return atomic.LoadInt32(&uploads) }).Should(Equal(int32(1)))
+			Expect(testutil.ToFloat64(gauge)).To(Equal(1.0))
+			close(done)
+		}, 3)
+
+		It("compresses uploaded profiles", func(done Done) {
+			t := transporttrie.New()
+			t.Insert([]byte("a;b"), 1)
+			bodies := make(chan []byte, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Expect(r.Header.Get("Content-Encoding")).To(Equal("gzip"))
+				body, err := compression.NewReader(r.Header.Get("Content-Encoding"), r.Body)
+				Expect(err).ToNot(HaveOccurred())
+				b, err := ioutil.ReadAll(body)
+				Expect(err).ToNot(HaveOccurred())
+				bodies <- b
+			}))
+			defer server.Close()
+
+			r, err := New(RemoteConfig{
+				UpstreamThreads:        1,
+				UpstreamAddress:        server.URL,
+				UpstreamRequestTimeout: 3 * time.Second,
+				Compression:            compression.Gzip,
+			}, logrus.New())
+			Expect(err).ToNot(HaveOccurred())
+			defer r.Stop()
+
+			r.Upload(&upstream.UploadJob{
+				Name:       "foo.cpu{}",
+				StartTime:  testing.SimpleTime(0),
+				EndTime:    testing.SimpleTime(10),
+				SpyName:    "debugspy",
+				SampleRate: 100,
+				Trie:       t,
+			})
+			Expect(<-bodies).To(Equal(t.Bytes()))
+			Expect(testutil.ToFloat64(uploadUncompressedBytes.WithLabelValues(compression.Gzip))).To(Equal(float64(len(t.Bytes()))))
+			close(done)
+		}, 3)
+
+		It("uploads queued profiles before it stops", func(done Done) {
+			var uploads int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(20 * time.Millisecond)
+				atomic.AddInt32(&uploads, 1)
+			}))
+			defer server.Close()
+
+			r, err := New(RemoteConfig{
+				UpstreamThreads:        1,
+				UpstreamAddress:        server.URL,
+				UpstreamRequestTimeout: 3 * time.Second,
+			}, logrus.New())
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 5; i++ {
+				r.Upload(&upstream.UploadJob{
+					Name:       fmt.Sprintf("foo%d.cpu{}", i),
+					StartTime:  testing.SimpleTime(0),
+					EndTime:    testing.SimpleTime(10),
+					SpyName:    "debugspy",
+					SampleRate: 100,
+					Trie:       transporttrie.New(),
+				})
+			}
+			r.Stop()
+			Expect(atomic.LoadInt32(&uploads)).To(Equal(int32(5)))
+			close(done)
+		}, 3)
+
+		Context("upload queue", func() {
+			var (
+				server   *httptest.Server
+				received chan string
+				release  chan struct{}
+			)
+			BeforeEach(func() {
+				received = make(chan string, 10)
+				release = make(chan struct{})
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					received <- r.URL.Query().Get("name")
+					<-release
+				}))
+			})
+			AfterEach(func() {
+				server.Close()
+			})
+
+			newRemote := func(policy string) *Remote {
+				r, err := New(RemoteConfig{
+					UpstreamThreads:        1,
+					UpstreamAddress:        server.URL,
+					UpstreamRequestTimeout: 3 * time.Second,
+					QueueSize:              2,
+					QueuePolicy:            policy,
+				}, logrus.New())
+				Expect(err).ToNot(HaveOccurred())
+				return r
+			}
+			job := func(i int) *upstream.UploadJob {
+				return &upstream.UploadJob{
+					Name:       fmt.Sprintf("foo%d.cpu{}", i),
+					StartTime:  testing.SimpleTime(0),
+					EndTime:    testing.SimpleTime(10),
+					SpyName:    "debugspy",
+					SampleRate: 100,
+					Trie:       transporttrie.New(),
+				}
+			}
+			names := func(n int) []string {
+				var res []string
+				for i := 0; i < n; i++ {
+					res = append(res, <-received)
+				}
+				return res
+			}
+
+			It("drops the oldest queued profiles once it's full by default", func(done Done) {
+				r := newRemote("")
+				defer r.Stop()
+				r.Upload(job(0))
+				Expect(<-received).To(Equal("foo0.cpu{}"))
+				for i := 1; i < 4; i++ {
+					r.Upload(job(i))
+				}
+
+				u, _ := url.Parse(server.URL)
+				Expect(testutil.ToFloat64(uploadQueueLength.WithLabelValues(u.Host))).To(Equal(2.0))
+				Expect(testutil.ToFloat64(uploadQueueCapacity.WithLabelValues(u.Host))).To(Equal(2.0))
+				Expect(testutil.ToFloat64(uploadQueueFull.WithLabelValues(u.Host))).To(Equal(1.0))
+				Expect(testutil.ToFloat64(uploadQueueDropped.WithLabelValues(u.Host))).To(Equal(1.0))
+
+				close(release)
+				Expect(names(2)).To(Equal([]string{"foo2.cpu{}", "foo3.cpu{}"}))
+				close(done)
+			}, 3)
+
+			It("blocks until there's room with the block policy", func(done Done) {
+				r := newRemote(QueuePolicyBlock)
+				defer r.Stop()
+				r.Upload(job(0))
+				Expect(<-received).To(Equal("foo0.cpu{}"))
+				r.Upload(job(1))
+				r.Upload(job(2))
+
+				var uploaded int32
+				go func() {
+					r.Upload(job(3))
+					atomic.StoreInt32(&uploaded, 1)
+				}()
+				Consistently(func() int32 { return atomic.LoadInt32(&uploaded) }, 100*time.Millisecond).Should(BeZero())
+
+				close(release)
+				Eventually(func() int32 { return atomic.LoadInt32(&uploaded) }).Should(Equal(int32(1)))
+				Expect(names(3)).To(Equal([]string{"foo1.cpu{}", "foo2.cpu{}", "foo3.cpu{}"}))
+				u, _ := url.Parse(server.URL)
+				Expect(testutil.ToFloat64(uploadQueueDropped.WithLabelValues(u.Host))).To(BeZero())
+				Expect(testutil.ToFloat64(uploadQueueBlockedSeconds.WithLabelValues(u.Host))).To(BeNumerically(">", 0))
+				close(done)
+			}, 3)
+
+			It("stops blocking once stopping begins and drops profiles uploaded after stop", func(done Done) {
+				r := newRemote(QueuePolicyBlock)
+				r.Upload(job(0))
+				Expect(<-received).To(Equal("foo0.cpu{}"))
+				r.Upload(job(1))
+				r.Upload(job(2))
+
+				var uploaded int32
+				go func() {
+					r.Upload(job(3))
+					atomic.StoreInt32(&uploaded, 1)
+				}()
+				Consistently(func() int32 { return atomic.LoadInt32(&uploaded) }, 100*time.Millisecond).Should(BeZero())
+				r.BeginStop()
+				Eventually(func() int32 { return atomic.LoadInt32(&uploaded) }).Should(Equal(int32(1)))
+				u, _ := url.Parse(server.URL)
+				dropped := uploadQueueDropped.WithLabelValues(u.Host)
+				Expect(testutil.ToFloat64(dropped)).To(Equal(1.0))
+
+				close(release)
+				r.Stop()
+				Expect(names(2)).To(Equal([]string{"foo1.cpu{}", "foo2.cpu{}"}))
+				r.Upload(job(4))
+				Expect(testutil.ToFloat64(dropped)).To(Equal(2.0))
+				Expect(r.jobs).To(BeEmpty())
+				close(done)
+			}, 3)
+
+			It("rejects unknown policies", func() {
+				_, err := New(RemoteConfig{UpstreamAddress: "http://localhost:4040", QueuePolicy: "drop-newest"}, logrus.New())
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		It("rejects unsupported compressions", func() {
+			_, err := New(RemoteConfig{UpstreamAddress: "http://localhost:4040", Compression: "lz4"}, logrus.New())
+			Expect(err).To(HaveOccurred())
+		})
 	})
 })
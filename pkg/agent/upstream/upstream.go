@@ -15,6 +15,8 @@ type UploadJob struct {
 	Units           string
 	AggregationType string
 	Trie            *transporttrie.Trie
+	// Tenant is only set when a server forwards profiles to another server, agents use the default tenant
+	Tenant string
 }
 
 type Upstream interface {
@@ -22,3 +24,9 @@ type Upstream interface {
 	// TODO: too complex, fix it
 	Upload(u *UploadJob)
 }
+
+// StopBeginner is implemented by upstreams that need to know about a shutdown before sessions uploading
+// to them are stopped, e.g so that the last uploads of sessions don't wait for a server that is down
+type StopBeginner interface {
+	BeginStop()
+}
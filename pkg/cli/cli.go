@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -49,6 +50,30 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// mapFlags collects key=value pairs, each one is passed separately
+type mapFlags map[string]string
+
+func (m *mapFlags) String() string {
+	res := []string{}
+	for k, v := range *m {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return strings.Join(res, ", ")
+}
+
+func (m *mapFlags) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid key=value pair: %q", value)
+	}
+	if *m == nil {
+		*m = make(mapFlags)
+	}
+	(*m)[value[:i]] = value[i+1:]
+	return nil
+}
+
 type timeFlag time.Time
 
 func (tf *timeFlag) String() string {
@@ -104,6 +129,10 @@ func PopulateFlagSet(obj interface{}, flagSet *flag.FlagSet, skip ...string) *So
 			val := fieldV.Addr().Interface().(*[]string)
 			val2 := (*arrayFlags)(val)
 			flagSet.Var(val2, nameVal, descVal)
+		case reflect.TypeOf(map[string]string{}):
+			val := fieldV.Addr().Interface().(*map[string]string)
+			val2 := (*mapFlags)(val)
+			flagSet.Var(val2, nameVal, descVal)
 		case reflect.TypeOf(""):
 			val := fieldV.Addr().Interface().(*string)
 			defaultValStr := strings.ReplaceAll(defaultValStr, "<installPrefix>", installPrefix)
@@ -306,7 +335,7 @@ func generateRootCmd(cfg *config.Config) *ffcli.Command {
 		UsageFunc:  dbmanagerSortedFlags.printUsage,
 		Options:    options,
 		Name:       "dbmanager",
-		ShortUsage: "pyroscope dbmanager [flags] <args>",
+		ShortUsage: "pyroscope dbmanager [flags] <copy|check|repair|merge>",
 		ShortHelp:  "tools for managing database",
 		FlagSet:    dbmanagerFlagSet,
 	}
@@ -337,10 +366,7 @@ func generateRootCmd(cfg *config.Config) *ffcli.Command {
 
 	convertCmd.Exec = func(ctx context.Context, args []string) error {
 		logrus.SetOutput(os.Stderr)
-		logger := func(s string) {
-			logrus.Fatal(s)
-		}
-		return convert.Cli(&cfg.Convert, logger, args)
+		return convert.Cli(&cfg.Convert, args)
 	}
 	execCmd.Exec = func(_ context.Context, args []string) error {
 		if cfg.Exec.NoLogging {
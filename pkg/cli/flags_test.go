@@ -22,6 +22,7 @@ type FlagsStruct struct {
 	FooBar   string
 	FooFoo   float64
 	FooBytes bytesize.ByteSize
+	FooMap   map[string]string
 }
 
 var _ = Describe("flags", func() {
@@ -48,6 +49,8 @@ var _ = Describe("flags", func() {
 					"-foo-bar", "test-val-4",
 					"-foo-foo", "10.23",
 					"-foo-bytes", "100MB",
+					"-foo-map", "a=b",
+					"-foo-map", "c=d=e",
 				})
 
 				Expect(err).ToNot(HaveOccurred())
@@ -58,6 +61,7 @@ var _ = Describe("flags", func() {
 				Expect(cfg.FooBar).To(Equal("test-val-4"))
 				Expect(cfg.FooFoo).To(Equal(10.23))
 				Expect(cfg.FooBytes).To(Equal(100 * bytesize.MB))
+				Expect(cfg.FooMap).To(Equal(map[string]string{"a": "b", "c": "d=e"}))
 			})
 		})
 
@@ -90,6 +94,7 @@ var _ = Describe("flags", func() {
 				Expect(cfg.FooBar).To(Equal("test-val-4"))
 				Expect(cfg.FooFoo).To(Equal(10.23))
 				Expect(cfg.FooBytes).To(Equal(100 * bytesize.MB))
+				Expect(cfg.FooMap).To(Equal(map[string]string{"a": "b", "c": "d=e"}))
 			})
 
 			It("arguments take precendence", func() {
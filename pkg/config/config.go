@@ -27,7 +27,24 @@ type Agent struct {
 	AuthToken              string        `def:"" desc:"authorization token used to upload profiling data"`
 	UpstreamThreads        int           `def:"4"`
 	UpstreamRequestTimeout time.Duration `def:"10s"`
+	UpstreamBatchWindow    time.Duration `def:"0" desc:"how long profiles wait to be uploaded together in a single request. 0 means every profile is uploaded separately"`
 	UNIXSocketPath         string        `def:"<installPrefix>/var/run/pyroscope-agent.sock" desc:"path to a UNIX socket file"`
+
+	UpstreamHealthCheckInterval time.Duration `def:"0" desc:"how often the server /healthz is checked, uploads are paused while it fails. 0 means health isn't checked"`
+	UpstreamCompression         string        `def:"gzip" desc:"compression of uploaded profiles: none|gzip|zstd. Servers older than the agent may only accept none"`
+
+	UpstreamQueueSize   int    `def:"100" desc:"max number of profiles waiting to be uploaded, e.g while the server is slow or unavailable"`
+	UpstreamQueuePolicy string `def:"drop-oldest" desc:"what happens to new profiles once the upload queue is full: drop-oldest drops the oldest queued profile, block pauses profiling until there's room"`
+
+	SessionIdleTimeout time.Duration `def:"0" desc:"stops profiling sessions that weren't renewed by clients for this long, e.g because the client crashed. 0 means sessions run until stopped"`
+	WarmupDuration     time.Duration `def:"0" desc:"how long after a session starts profiles are collected but not uploaded, e.g to exclude noisy initialization. 0 means no warmup"`
+
+	HostLabel string `def:"host" desc:"name of the label set to the hostname on uploaded profiles, e.g host or instance. Empty means no host label"`
+	Hostname  string `def:"" desc:"hostname used for host-label. Empty means the hostname of the machine"`
+
+	MaxCaptureDuration time.Duration `def:"5m" desc:"max duration of one-shot profiles taken with the capture command"`
+
+	TargetsFile string `def:"" desc:"path to a YAML file listing processes (application-name, spy-name, pid, profile-types, sample-rate) that are profiled from startup, without clients starting sessions. It's re-read on SIGHUP. Empty means sessions are only started via the control socket"`
 }
 
 type Server struct {
@@ -41,6 +58,30 @@ type Server struct {
 	APIBindAddr string `def:":4040" desc:"port for the HTTP server used for data ingestion and web UI"`
 	BaseURL     string `def:"" desc:"base URL for when the server is behind a reverse proxy with a different path"`
 
+	DisableUI bool `def:"false" desc:"disables the web UI, only the API is served. Useful with custom frontends"`
+
+	MetricsBindAddr string `def:"" desc:"port for a separate HTTP server that exposes /metrics, so that it can be firewalled from the public API. Empty means /metrics is served on the API port"`
+	EnablePprof     bool   `def:"false" desc:"exposes Go runtime profiles of the server itself at /debug/pprof/ on the metrics port, requires metrics-bind-addr"`
+
+	ResponseHeaders map[string]string `def:"" desc:"HTTP headers added to every response, as Name=value pairs (e.g X-Frame-Options=DENY). Headers set by the server itself take precedence"`
+
+	DefaultQuery string        `def:"" desc:"query (e.g myapp.cpu{env=prod}) the UI opens with when the URL doesn't specify one"`
+	DefaultRange time.Duration `def:"0" desc:"time range the UI opens with when the URL doesn't specify one, e.g 24h. 0 means the UI default (1h)"`
+
+	AppNamesCacheTTL time.Duration `def:"10s" desc:"how long the list of apps shown in the UI is cached for, new apps invalidate it right away. 0 means no caching"`
+	IndexMaxApps     int           `def:"500" desc:"max number of apps sent with the UI page, most recently active first. The rest are available from /apps. 0 means no limit"`
+
+	InMemory         bool `def:"false" desc:"keeps all data in memory, nothing is written to disk and all data is lost on shutdown"`
+	SharedDictionary bool `def:"false" desc:"stores symbols of all apps in a single dictionary, saves space when apps share code. Can only be set for new storage"`
+
+	ColdStoragePath string        `def:"" desc:"directory profile data older than cold-storage-age is moved to, e.g on cheaper disk than storage-path. Empty means all data stays in storage-path"`
+	ColdStorageAge  time.Duration `def:"0" desc:"age after which profile data is moved to cold-storage-path, e.g 168h. Required with cold-storage-path"`
+
+	TrustedProxies []string `def:"" desc:"list of proxy CIDRs (e.g 10.0.0.0/8) whose X-Forwarded-For and X-Real-IP headers are trusted"`
+	AllowedApps    []string `def:"" desc:"list of app names or glob patterns (e.g myapp.*) accepted on ingestion. Empty means any app is accepted"`
+
+	NewAppWebhookURL string `def:"" desc:"URL that gets a POST request with app name and timestamp when a previously unseen app starts reporting"`
+
 	// These will eventually be replaced by some sort of a system that keeps track of RAM
 	//   and updates
 	CacheDimensionSize  int `def:"1000" desc:"max number of elements in LRU cache for dimensions"`
@@ -48,12 +89,73 @@ type Server struct {
 	CacheSegmentSize    int `def:"1000" desc:"max number of elements in LRU cache for segments"`
 	CacheTreeSize       int `def:"1000" desc:"max number of elements in LRU cache for trees"`
 
+	CacheFlushInterval time.Duration `def:"0" desc:"how often modified cache entries are persisted to disk. 0 means they're only persisted when evicted from cache or on shutdown"`
+
+	MemoryPressureHighWatermark bytesize.ByteSize `def:"0" desc:"heap size above which caches are evicted regardless of their size limits. 0 means disabled"`
+	MemoryPressureLowWatermark  bytesize.ByteSize `def:"0" desc:"heap size caches are evicted down to under memory pressure. 0 means 80% of memory-pressure-high-watermark"`
+
+	PreloadKeys       []string      `def:"" desc:"list of queries (e.g myapp.cpu{}) loaded into caches on startup"`
+	PreloadTopQueried int           `def:"0" desc:"number of most queried keys loaded into caches on startup, in addition to preload-keys"`
+	PreloadRange      time.Duration `def:"1h" desc:"time range of data loaded into caches on startup"`
+
 	// TODO: I don't think a lot of people will change these values.
 	//   I think these should just be constants.
 	BadgerNoTruncate bool `def:"false" desc:"indicates whether value log files should be truncated to delete corrupt data, if any"`
 
+	ForceUnlock bool `def:"false" desc:"removes storage lock files left by instances that are no longer running, e.g after a crash"`
+
+	BadgerNumCompactors    int               `def:"0" desc:"number of badger compaction workers, must be at least 2. 0 means badger default (2)"`
+	BadgerValueLogFileSize bytesize.ByteSize `def:"0" desc:"max size of a single badger value log file, between 1MB and 2GB. 0 means badger default (1GB)"`
+	BadgerMaxTableSize     bytesize.ByteSize `def:"0" desc:"max size of badger memtables and LSM tables. 0 means badger default (64MB)"`
+
 	MaxNodesSerialization int `def:"2048" desc:"max number of nodes used when saving profiles to disk"`
 	MaxNodesRender        int `def:"8192" desc:"max number of nodes used to display data on the frontend"`
+	MaxIngestDepth        int `def:"0" desc:"max stack depth of ingested profiles, deeper frames are collapsed into a (truncated) node. 0 means no limit"`
+	MaxIngestWidth        int `def:"0" desc:"max number of children of a node in ingested profiles, the rest are merged into an (other) node. 0 means no limit"`
+
+	MinIngestSamples          int               `def:"0" desc:"min total sample count of ingested profiles, sparser ones are dropped. 0 means no minimum"`
+	MinIngestSamplesOverrides map[string]string `def:"" desc:"per profile type min-ingest-samples, as type=count pairs (e.g cpu=10,inuse_space=1048576)"`
+
+	MaxKeyLabels int `def:"0" desc:"max number of labels of ingested profiles (app name excluded), profiles with more are rejected. 0 means no limit"`
+
+	MaxLabelValues          int               `def:"0" desc:"max number of distinct values of a label (app names excluded), profiles with new values beyond it are rejected. 0 means no limit"`
+	MaxLabelValuesOverrides map[string]string `def:"" desc:"per label max-label-values, as name=limit pairs (e.g env=10,__name__=500). 0 means no limit for that label"`
+
+	MaxConcurrentRenders int           `def:"0" desc:"max number of render requests processed at the same time. 0 means no limit"`
+	RenderQueueTimeout   time.Duration `def:"5s" desc:"how long render requests wait for a free slot before being rejected"`
+
+	TopFunctionsMaxApps int           `def:"100" desc:"max number of apps looked at by /top-functions, the rest are skipped. 0 means no limit"`
+	TopFunctionsTimeout time.Duration `def:"10s" desc:"max time spent on a /top-functions request, apps that weren't looked at by then are skipped. 0 means no limit"`
+
+	ClockSkewTolerance time.Duration `def:"0" desc:"max allowed difference between ingested profile timestamps and server time. 0 means no limit"`
+	ClockSkewPolicy    string        `def:"adjust" desc:"what to do with profiles outside of clock skew tolerance: adjust|reject. adjust shifts them to server time"`
+
+	MissingSampleRatePolicy string `def:"default" desc:"what to do with ingested profiles that don't specify a sample rate: default|reject. default applies ingest-default-sample-rate"`
+	IngestDefaultSampleRate uint   `def:"100" desc:"sample rate in Hz applied to ingested profiles that don't specify one"`
+
+	Retention time.Duration `def:"0" desc:"how long profiles are kept. Older data is deleted periodically and profiles that end before the retention window are rejected on ingestion. Can be overridden per app via /apps/retention. 0 means forever"`
+
+	QueryInactivityRetention time.Duration `def:"0" desc:"apps that weren't queried for this long are deleted entirely, regardless of retention. Apps that were never queried count from when they were first seen. 0 means disabled"`
+
+	MaxIngestStreamSubscribers int `def:"10" desc:"max number of clients watching ingested profiles live via /ingest/stream"`
+
+	IngestSampleRatio float64 `def:"1" desc:"share of ingested profiles that is stored, trades fidelity for lower storage costs. Values outside of (0, 1) store everything"`
+	IngestSampleMode  string  `def:"random" desc:"how ingested profiles are sampled: random|app. app stores all profiles of a subset of apps"`
+
+	IngestQueueURL     string `def:"" desc:"URL of a NATS server to consume profiles from in addition to the HTTP API, e.g nats://localhost:4222. Empty means disabled"`
+	IngestQueueSubject string `def:"pyroscope.ingest" desc:"NATS subject profiles are consumed from"`
+	IngestQueueGroup   string `def:"pyroscope" desc:"NATS queue group, servers in the same group share the messages"`
+
+	IngestAuthTokens []string `def:"" desc:"list of tokens accepted by ingestion endpoints and for changes of app settings, as bearer tokens or basic auth passwords. Empty means ingestion doesn't require authorization"`
+	QueryAuthTokens  []string `def:"" desc:"list of tokens accepted by the UI and query endpoints, as bearer tokens or basic auth passwords. Empty means queries don't require authorization"`
+
+	MirrorURL       string `def:"" desc:"URL of another pyroscope server that gets a copy of every ingested profile, e.g for migrations. Empty means disabled"`
+	MirrorAuthToken string `def:"" desc:"authorization token used when mirroring profiles"`
+
+	NormalizeSymbolsApps  []string `def:"" desc:"list of app names or glob patterns (e.g myapp.*) whose symbol names are normalized on ingestion"`
+	NormalizeSymbolsRules []string `def:"" desc:"symbol normalization rules: addresses|generics|lambdas. Empty means all of them"`
+
+	SymbolizeApps map[string]string `def:"" desc:"symbol sources of apps whose profiles have raw addresses (e.g 0x4a3f2c) instead of function names, as app=kind:path pairs (e.g myapp=elf:/usr/bin/myapp). Apps can be glob patterns. Kinds: perfmap|elf"`
 
 	// currently only used in our demo app
 	HideApplications []string `def:"" desc:"please don't use, this will soon be deprecated"`
@@ -63,18 +165,25 @@ type Server struct {
 }
 
 type Convert struct {
-	Format string `def:"tree"`
+	Format      string `def:"tree" desc:"output format: collapsed|pprof|tree|trie"`
+	InputFormat string `def:"collapsed" desc:"input format: collapsed|lines|pprof|tree|trie"`
+
+	Locations bool `def:"false" desc:"keeps source locations (file:line) of pprof frames, e.g main.work main.go:42"`
 }
 
 type DbManager struct {
 	LogLevel        string `def:"error" desc:"log level: debug|info|warn|error"`
 	StoragePath     string `def:"<installPrefix>/var/lib/pyroscope" desc:"directory where pyroscope stores profiling data"`
+	ColdStoragePath string `def:"" desc:"cold-storage-path of the server, if it's set"`
+	SrcStoragePath  string `def:"" desc:"directory the merge command merges data from into storage-path"`
 	DstStartTime    time.Time
 	DstEndTime      time.Time
 	SrcStartTime    time.Time
 	ApplicationName string
 
 	EnableProfiling bool `def:"false" desc:"enables profiling of dbmanager"`
+
+	Confirm bool `def:"false" desc:"confirms that the repair command can remove data, without it the command only reports what would be removed"`
 }
 
 type Exec struct {
@@ -87,10 +196,19 @@ type Exec struct {
 	AuthToken              string        `def:"" desc:"authorization token used to upload profiling data"`
 	UpstreamThreads        int           `def:"4" desc:"number of upload threads"`
 	UpstreamRequestTimeout time.Duration `def:"10s" desc:"profile upload timeout"`
+	UpstreamBatchWindow    time.Duration `def:"0" desc:"how long profiles wait to be uploaded together in a single request. 0 means every profile is uploaded separately"`
 	NoLogging              bool          `def:"false" desc:"disables logging from pyroscope"`
 	NoRootDrop             bool          `def:"false" desc:"disables permissions drop when ran under root. use this one if you want to run your command as root"`
 	Pid                    int           `def:"0" desc:"PID of the process you want to profile. Pass -1 to profile the whole system (only supported by ebpfspy)"`
 	UserName               string        `def:"" desc:"starts process under specified user name"`
 	GroupName              string        `def:"" desc:"starts process under specified group name"`
 	PyspyBlocking          bool          `def:"false" desc:"enables blocking mode for pyspy"`
+	HostLabel              string        `def:"host" desc:"name of the label set to the hostname on uploaded profiles, e.g host or instance. Empty means no host label"`
+	Hostname               string        `def:"" desc:"hostname used for host-label. Empty means the hostname of the machine"`
+
+	UpstreamHealthCheckInterval time.Duration `def:"0" desc:"how often the server /healthz is checked, uploads are paused while it fails. 0 means health isn't checked"`
+	UpstreamCompression         string        `def:"gzip" desc:"compression of uploaded profiles: none|gzip|zstd. Servers older than the agent may only accept none"`
+
+	UpstreamQueueSize   int    `def:"100" desc:"max number of profiles waiting to be uploaded, e.g while the server is slow or unavailable"`
+	UpstreamQueuePolicy string `def:"drop-oldest" desc:"what happens to new profiles once the upload queue is full: drop-oldest drops the oldest queued profile, block pauses profiling until there's room"`
 }
@@ -6,36 +6,34 @@ import (
 	"os"
 
 	"github.com/pyroscope-io/pyroscope/pkg/config"
-	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
-	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
 )
 
-func Cli(cfg *config.Convert, logger func(string), args []string) error {
+func Cli(cfg *config.Convert, args []string) error {
 	var input io.Reader
-	if len(args) == 0 {
+	switch len(args) {
+	case 0:
 		input = os.Stdin
-	} else {
-		logger("not implemented yet")
+	case 1:
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	default:
+		return fmt.Errorf("expected at most one input file, got %d", len(args))
 	}
 
-	parser := ParseGroups
-	switch cfg.Format {
-	case "tree":
-		t := tree.New()
-		parser(input, func(name []byte, val int) {
-			t.Insert(name, uint64(val))
-		})
-
-		t.SerializeNoDict(4096, os.Stdout)
-	case "trie":
-		t := transporttrie.New()
-		parser(input, func(name []byte, val int) {
-			t.Insert(name, uint64(val), true)
-		})
-
-		t.Serialize(os.Stdout)
-	default:
-		logger(fmt.Sprintf("unknown format: %s", cfg.Format))
+	read := ReadTree
+	if cfg.Locations {
+		read = ReadTreeWithLocations
+	}
+	t, err := read(cfg.InputFormat, input)
+	if err != nil {
+		return fmt.Errorf("read %s: %v", cfg.InputFormat, err)
+	}
+	if err := WriteTree(cfg.Format, t, os.Stdout); err != nil {
+		return fmt.Errorf("write %s: %v", cfg.Format, err)
 	}
 	return nil
 }
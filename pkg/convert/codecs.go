@@ -0,0 +1,205 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+	"google.golang.org/protobuf/proto"
+)
+
+// maxNodesSerialization is high enough to never drop nodes of a single profile
+const maxNodesSerialization = 1 << 24
+
+var (
+	InputFormats  = []string{"collapsed", "lines", "pprof", "tree", "trie"}
+	OutputFormats = []string{"collapsed", "pprof", "tree", "trie"}
+)
+
+// ReadTree reads a profile in one of InputFormats
+func ReadTree(format string, r io.Reader) (*tree.Tree, error) {
+	return readTree(format, false, r)
+}
+
+// ReadTreeWithLocations is ReadTree that keeps source locations of pprof frames, see tree.FrameWithLocation.
+// Other formats don't have locations apart from the ones that are already in frame names.
+func ReadTreeWithLocations(format string, r io.Reader) (*tree.Tree, error) {
+	return readTree(format, true, r)
+}
+
+func readTree(format string, withLocations bool, r io.Reader) (*tree.Tree, error) {
+	t := tree.New()
+	insert := func(name []byte, val int) {
+		t.Insert(name, uint64(val))
+	}
+
+	var err error
+	switch format {
+	case "collapsed":
+		err = ParseGroups(r, insert)
+	case "lines":
+		err = ParseIndividualLines(r, insert)
+	case "trie":
+		err = ParseTrie(r, insert)
+	case "tree":
+		return tree.DeserializeNoDict(r)
+	case "pprof":
+		err = readPprof(r, withLocations, insert)
+	default:
+		return nil, fmt.Errorf("unknown input format: %q, supported formats: %s", format, strings.Join(InputFormats, ", "))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WriteTree writes a profile in one of OutputFormats
+func WriteTree(format string, t *tree.Tree, w io.Writer) error {
+	switch format {
+	case "collapsed":
+		bw := bufio.NewWriter(w)
+		t.IterateStacks(func(stack []byte, val uint64) {
+			fmt.Fprintf(bw, "%s %d\n", stack, val)
+		})
+		return bw.Flush()
+	case "trie":
+		trie := transporttrie.New()
+		t.IterateStacks(func(stack []byte, val uint64) {
+			trie.Insert(stack, val, true)
+		})
+		return trie.Serialize(w)
+	case "tree":
+		return t.SerializeNoDict(maxNodesSerialization, w)
+	case "pprof":
+		return writePprof(t, w)
+	default:
+		return fmt.Errorf("unknown output format: %q, supported formats: %s", format, strings.Join(OutputFormats, ", "))
+	}
+}
+
+// readPprof reads both gzipped and plain pprof profiles, using the first sample type
+func readPprof(r io.Reader, withLocations bool, cb func(name []byte, val int)) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		g, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer g.Close()
+		r = g
+	} else {
+		r = br
+	}
+
+	p, err := ParsePprof(r)
+	if err != nil {
+		return err
+	}
+	if withLocations {
+		return p.GetWithLocations("", cb)
+	}
+	return p.Get("", cb)
+}
+
+func writePprof(t *tree.Tree, w io.Writer) error {
+	return writePprofSamples(func(cb func(stack []byte, val int64)) {
+		t.IterateStacks(func(stack []byte, val uint64) {
+			cb(stack, int64(val))
+		})
+	}, w)
+}
+
+// WriteDiffPprof writes a gzipped pprof profile of the difference between two profiles. Every stack gets
+// its value in t minus its value in base, so regressions are positive and improvements are negative.
+// It's the same profile go tool pprof builds with -diff_base, so pprof tooling displays it as a comparison.
+func WriteDiffPprof(base, t *tree.Tree, w io.Writer) error {
+	deltas := map[string]int64{}
+	stacks := []string{}
+	add := func(stack []byte, val int64) {
+		k := string(stack)
+		if _, ok := deltas[k]; !ok {
+			stacks = append(stacks, k)
+		}
+		deltas[k] += val
+	}
+	t.IterateStacks(func(stack []byte, val uint64) {
+		add(stack, int64(val))
+	})
+	base.IterateStacks(func(stack []byte, val uint64) {
+		add(stack, -int64(val))
+	})
+	return writePprofSamples(func(cb func(stack []byte, val int64)) {
+		for _, k := range stacks {
+			if d := deltas[k]; d != 0 {
+				cb([]byte(k), d)
+			}
+		}
+	}, w)
+}
+
+// writePprofSamples writes a gzipped pprof profile with the samples iterate reports
+func writePprofSamples(iterate func(cb func(stack []byte, val int64)), w io.Writer) error {
+	p := &Profile{
+		StringTable: []string{""},
+	}
+	stringIndexes := map[string]int64{}
+	str := func(s string) int64 {
+		if i, ok := stringIndexes[s]; ok {
+			return i
+		}
+		i := int64(len(p.StringTable))
+		p.StringTable = append(p.StringTable, s)
+		stringIndexes[s] = i
+		return i
+	}
+	p.SampleType = []*ValueType{{Type: str("samples"), Unit: str("count")}}
+
+	// every frame gets exactly one function and location, ids are shared.
+	// Frames carrying source locations are written with file names and lines
+	ids := map[string]uint64{}
+	iterate(func(stack []byte, val int64) {
+		frames := bytes.Split(stack, []byte(";"))
+		s := &Sample{
+			LocationId: make([]uint64, len(frames)),
+			Value:      []int64{val},
+		}
+		for i, f := range frames {
+			id, ok := ids[string(f)]
+			if !ok {
+				id = uint64(len(ids) + 1)
+				ids[string(f)] = id
+				fn := &Function{Id: id}
+				l := &Line{FunctionId: id}
+				name, loc := tree.SplitLocation(f)
+				fn.Name = str(string(name))
+				if loc != nil {
+					i := bytes.LastIndexByte(loc, ':')
+					fn.Filename = str(string(loc[:i]))
+					l.Line, _ = strconv.ParseInt(string(loc[i+1:]), 10, 64)
+				}
+				p.Function = append(p.Function, fn)
+				p.Location = append(p.Location, &Location{Id: id, Line: []*Line{l}})
+			}
+			// pprof stacks start with the leaf
+			s.LocationId[len(frames)-1-i] = id
+		}
+		p.Sample = append(p.Sample, s)
+	})
+
+	b, err := proto.Marshal(p)
+	if err != nil {
+		return err
+	}
+	g := gzip.NewWriter(w)
+	if _, err := g.Write(b); err != nil {
+		return err
+	}
+	return g.Close()
+}
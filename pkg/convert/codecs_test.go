@@ -0,0 +1,116 @@
+package convert
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+var _ = Describe("codecs", func() {
+	newTree := func() *tree.Tree {
+		t := tree.New()
+		t.Insert([]byte("foo;bar"), 2)
+		t.Insert([]byte("foo;baz"), 3)
+		t.Insert([]byte("foo"), 1)
+		t.Insert([]byte("qux;foo"), 4)
+		return t
+	}
+
+	roundTrip := func(from, to string) {
+		buf := &bytes.Buffer{}
+		Expect(WriteTree(from, newTree(), buf)).To(Succeed())
+		t, err := ReadTree(from, buf)
+		Expect(err).ToNot(HaveOccurred())
+
+		buf.Reset()
+		Expect(WriteTree(to, t, buf)).To(Succeed())
+		t, err = ReadTree(to, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t.String()).To(Equal(newTree().String()))
+	}
+
+	entries := []TableEntry{}
+	for _, from := range OutputFormats {
+		for _, to := range OutputFormats {
+			entries = append(entries, Entry(from+" -> "+to, from, to))
+		}
+	}
+	DescribeTable("round-trips between formats", roundTrip, entries...)
+
+	It("reads plain and gzipped pprof", func() {
+		b, err := ioutil.ReadFile("fixtures/cpu.pprof")
+		Expect(err).ToNot(HaveOccurred())
+		t, err := ReadTree("pprof", bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+
+		g, err := gzip.NewReader(bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+		plain, err := ioutil.ReadAll(g)
+		Expect(err).ToNot(HaveOccurred())
+		t2, err := ReadTree("pprof", bytes.NewReader(plain))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(t.String()).To(ContainSubstring("\"runtime.main;main.work\""))
+		Expect(t2.String()).To(Equal(t.String()))
+	})
+
+	It("keeps source locations of pprof frames when asked to", func() {
+		b, err := ioutil.ReadFile("fixtures/cpu.pprof")
+		Expect(err).ToNot(HaveOccurred())
+		t, err := ReadTree("pprof", bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+		withLocations, err := ReadTreeWithLocations("pprof", bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(withLocations.HasLocations()).To(BeTrue())
+		Expect(withLocations.String()).To(MatchRegexp(`main\.work [^ ;]+\.go:\d+`))
+		Expect(withLocations.WithoutLocations().String()).To(Equal(t.String()))
+	})
+
+	It("writes source locations to pprof", func() {
+		t := tree.New()
+		t.Insert([]byte("main main.go:3;foo foo.go:10"), 2)
+		t.Insert([]byte("main main.go:3;foo foo.go:12"), 3)
+		t.Insert([]byte("main main.go:3;bar"), 1)
+
+		var buf bytes.Buffer
+		Expect(WriteTree("pprof", t, &buf)).To(Succeed())
+		res, err := ReadTreeWithLocations("pprof", &buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res.String()).To(Equal(t.String()))
+	})
+
+	It("writes the difference of two profiles as pprof", func() {
+		base := tree.New()
+		base.Insert([]byte("main;foo"), 10)
+		base.Insert([]byte("main;bar"), 5)
+		base.Insert([]byte("main;baz"), 3)
+		t := tree.New()
+		t.Insert([]byte("main;foo"), 25)
+		t.Insert([]byte("main;bar"), 5)
+		t.Insert([]byte("main;qux"), 7)
+
+		var buf bytes.Buffer
+		Expect(WriteDiffPprof(base, t, &buf)).To(Succeed())
+		deltas := map[string]int{}
+		Expect(readPprof(&buf, false, func(name []byte, val int) {
+			deltas[string(name)] += val
+		})).To(Succeed())
+		Expect(deltas).To(Equal(map[string]int{
+			"main;foo": 15,
+			"main;baz": -3,
+			"main;qux": 7,
+		}))
+	})
+
+	It("rejects unknown formats", func() {
+		_, err := ReadTree("foo", &bytes.Buffer{})
+		Expect(err).To(HaveOccurred())
+		Expect(WriteTree("foo", tree.New(), &bytes.Buffer{})).ToNot(Succeed())
+	})
+})
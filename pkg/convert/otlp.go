@@ -0,0 +1,444 @@
+package convert
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP profiles are decoded by hand because the profiling signal is still in development and
+// its generated code isn't published in a stable Go module yet. Field numbers follow
+// opentelemetry/proto/profiles/v1development/profiles.proto as of opentelemetry-proto v1.5.0.
+//
+// Only CPU profiles (sample type "cpu" or "samples") are supported. The following is ignored:
+//   - sample attributes, links and timestamps
+//   - mappings, attribute units and comments
+//   - instrumentation scope and its attributes
+//   - resource attributes that are not strings, booleans or numbers
+//   - original_payload
+//
+// Profiles with other sample types (e.g alloc_space) are counted as rejected.
+
+// OTLPProfile is a single CPU profile from an OTLP ExportProfilesServiceRequest
+type OTLPProfile struct {
+	// Resource contains attributes of the resource the profile was collected from
+	Resource map[string]string
+	// StartTime and EndTime are zero if the profile doesn't set them
+	StartTime time.Time
+	EndTime   time.Time
+	// SampleRate is 0 if the profile doesn't set a sampling period
+	SampleRate uint32
+
+	stacks []otlpStack
+}
+
+type otlpStack struct {
+	name  string
+	value int
+}
+
+// Get calls cb for every sample in the profile, stacks are ordered from root to leaf
+func (p *OTLPProfile) Get(cb func(name []byte, val int)) {
+	for _, s := range p.stacks {
+		cb([]byte(s.name), s.value)
+	}
+}
+
+// ParseOTLP parses a protobuf-encoded OTLP ExportProfilesServiceRequest.
+// It returns the supported profiles and the number of profiles that were rejected.
+func ParseOTLP(b []byte) ([]*OTLPProfile, int, error) {
+	var res []*OTLPProfile
+	rejected := 0
+	err := otlpFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 { // resource_profiles
+			return nil
+		}
+		profiles, r, err := parseResourceProfiles(v)
+		if err != nil {
+			return fmt.Errorf("resource_profiles: %v", err)
+		}
+		res = append(res, profiles...)
+		rejected += r
+		return nil
+	})
+	return res, rejected, err
+}
+
+// AppendOTLPPartialSuccess encodes an ExportProfilesServiceResponse. Successful responses are empty.
+func AppendOTLPPartialSuccess(b []byte, rejected int, message string) []byte {
+	if rejected == 0 && message == "" {
+		return b
+	}
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType)
+	ps = protowire.AppendVarint(ps, uint64(rejected))
+	ps = protowire.AppendTag(ps, 2, protowire.BytesType)
+	ps = protowire.AppendString(ps, message)
+
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, ps)
+}
+
+func parseResourceProfiles(b []byte) ([]*OTLPProfile, int, error) {
+	resource := map[string]string{}
+	var scopes [][]byte
+	err := otlpFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1: // resource
+			return otlpFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num != 1 { // attributes
+					return nil
+				}
+				k, val, err := parseKeyValue(v)
+				if err != nil {
+					return fmt.Errorf("resource attributes: %v", err)
+				}
+				if k != "" && val != "" {
+					resource[k] = val
+				}
+				return nil
+			})
+		case 2: // scope_profiles
+			scopes = append(scopes, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var res []*OTLPProfile
+	rejected := 0
+	for _, scope := range scopes {
+		err := otlpFields(scope, func(num protowire.Number, v []byte, _ uint64) error {
+			if num != 2 { // profiles
+				return nil
+			}
+			p, err := parseProfile(v)
+			if err != nil {
+				return fmt.Errorf("profiles: %v", err)
+			}
+			if p == nil {
+				rejected++
+				return nil
+			}
+			p.Resource = resource
+			res = append(res, p)
+			return nil
+		})
+		if err != nil {
+			return nil, 0, fmt.Errorf("scope_profiles: %v", err)
+		}
+	}
+	return res, rejected, nil
+}
+
+// parseKeyValue returns the key and the value of KeyValue formatted as a string.
+// Values of unsupported types are returned as empty strings.
+func parseKeyValue(b []byte) (string, string, error) {
+	var key, val string
+	err := otlpFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1: // key
+			key = string(v)
+		case 2: // value
+			return otlpRawFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType: // string_value
+					val = string(v)
+				case num == 2 && typ == protowire.VarintType: // bool_value
+					val = strconv.FormatBool(n != 0)
+				case num == 3 && typ == protowire.VarintType: // int_value
+					val = strconv.FormatInt(int64(n), 10)
+				case num == 4 && typ == protowire.Fixed64Type: // double_value
+					val = strconv.FormatFloat(math.Float64frombits(n), 'g', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return key, val, err
+}
+
+type otlpValueType struct {
+	typ  int64
+	unit int64
+}
+
+type otlpSample struct {
+	locationsStart  int64
+	locationsLength int64
+	values          []int64
+}
+
+type otlpLocation struct {
+	address   uint64
+	functions []int64
+}
+
+// parseProfile returns nil if the profile doesn't have a supported sample type
+func parseProfile(b []byte) (*OTLPProfile, error) {
+	var (
+		sampleTypes     []otlpValueType
+		samples         []otlpSample
+		locations       []otlpLocation
+		locationIndices []int64
+		functionNames   []int64
+		strs            []string
+		timeNanos       int64
+		durationNanos   int64
+		periodType      otlpValueType
+		period          int64
+	)
+	err := otlpRawFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1: // sample_type
+			var vt otlpValueType
+			vt, err = parseValueType(v)
+			sampleTypes = append(sampleTypes, vt)
+		case 2: // sample
+			var s otlpSample
+			s, err = parseSample(v)
+			samples = append(samples, s)
+		case 4: // location_table
+			var l otlpLocation
+			l, err = parseLocation(v)
+			locations = append(locations, l)
+		case 5: // location_indices
+			locationIndices, err = appendVarints(locationIndices, typ, v, n)
+		case 6: // function_table
+			name := int64(0)
+			err = otlpFields(v, func(num protowire.Number, _ []byte, n uint64) error {
+				if num == 1 { // name_strindex
+					name = int64(n)
+				}
+				return nil
+			})
+			functionNames = append(functionNames, name)
+		case 10: // string_table
+			strs = append(strs, string(v))
+		case 11: // time_nanos
+			timeNanos = int64(n)
+		case 12: // duration_nanos
+			durationNanos = int64(n)
+		case 13: // period_type
+			periodType, err = parseValueType(v)
+		case 14: // period
+			period = int64(n)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	str := func(i int64) string {
+		if i < 0 || i >= int64(len(strs)) {
+			return ""
+		}
+		return strs[i]
+	}
+
+	valueIndex := -1
+	for i, st := range sampleTypes {
+		if t := str(st.typ); t == "cpu" || t == "samples" {
+			valueIndex = i
+			break
+		}
+	}
+	if valueIndex == -1 {
+		return nil, nil
+	}
+
+	p := &OTLPProfile{}
+	if timeNanos > 0 {
+		p.StartTime = time.Unix(0, timeNanos)
+		p.EndTime = p.StartTime.Add(time.Duration(durationNanos))
+	}
+	nanosPerSample := int64(0)
+	if period > 0 && str(periodType.unit) == "nanoseconds" {
+		p.SampleRate = uint32(time.Second.Nanoseconds() / period)
+		if str(sampleTypes[valueIndex].unit) == "nanoseconds" {
+			nanosPerSample = period
+		}
+	}
+
+	var sb strings.Builder
+	for _, s := range samples {
+		if valueIndex >= len(s.values) {
+			continue
+		}
+		value := s.values[valueIndex]
+		if nanosPerSample > 0 {
+			value /= nanosPerSample
+		}
+		if value <= 0 {
+			continue
+		}
+
+		sb.Reset()
+		// locations go from leaf to root, pyroscope stacks are the other way around
+		for i := s.locationsStart + s.locationsLength - 1; i >= s.locationsStart; i-- {
+			if i < 0 || i >= int64(len(locationIndices)) {
+				return nil, errors.New("sample refers to a location index out of bounds")
+			}
+			li := locationIndices[i]
+			if li < 0 || li >= int64(len(locations)) {
+				return nil, errors.New("location index refers to a location out of bounds")
+			}
+			l := locations[li]
+			if len(l.functions) == 0 {
+				appendFrame(&sb, fmt.Sprintf("0x%x", l.address))
+				continue
+			}
+			// the last line is the caller of inlined functions
+			for j := len(l.functions) - 1; j >= 0; j-- {
+				fi := l.functions[j]
+				name := ""
+				if fi >= 0 && fi < int64(len(functionNames)) {
+					name = str(functionNames[fi])
+				}
+				if name == "" {
+					name = fmt.Sprintf("0x%x", l.address)
+				}
+				appendFrame(&sb, name)
+			}
+		}
+		if sb.Len() == 0 {
+			continue
+		}
+		p.stacks = append(p.stacks, otlpStack{name: sb.String(), value: int(value)})
+	}
+	return p, nil
+}
+
+func appendFrame(sb *strings.Builder, name string) {
+	if sb.Len() > 0 {
+		sb.WriteByte(';')
+	}
+	sb.WriteString(name)
+}
+
+func parseValueType(b []byte) (otlpValueType, error) {
+	var vt otlpValueType
+	err := otlpFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		switch num {
+		case 1: // type_strindex
+			vt.typ = int64(n)
+		case 2: // unit_strindex
+			vt.unit = int64(n)
+		}
+		return nil
+	})
+	return vt, err
+}
+
+func parseSample(b []byte) (otlpSample, error) {
+	var s otlpSample
+	err := otlpRawFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		var err error
+		switch num {
+		case 1: // locations_start_index
+			s.locationsStart = int64(n)
+		case 2: // locations_length
+			s.locationsLength = int64(n)
+		case 3: // value
+			s.values, err = appendVarints(s.values, typ, v, n)
+		}
+		return err
+	})
+	return s, err
+}
+
+func parseLocation(b []byte) (otlpLocation, error) {
+	var l otlpLocation
+	err := otlpFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 2: // address
+			l.address = n
+		case 3: // line
+			fi := int64(0)
+			err := otlpFields(v, func(num protowire.Number, _ []byte, n uint64) error {
+				if num == 1 { // function_index
+					fi = int64(n)
+				}
+				return nil
+			})
+			l.functions = append(l.functions, fi)
+			return err
+		}
+		return nil
+	})
+	return l, err
+}
+
+// appendVarints handles both packed and unpacked encodings of repeated integer fields
+func appendVarints(dst []int64, typ protowire.Type, v []byte, n uint64) ([]int64, error) {
+	if typ == protowire.VarintType {
+		return append(dst, int64(n)), nil
+	}
+	for len(v) > 0 {
+		x, l := protowire.ConsumeVarint(v)
+		if l < 0 {
+			return nil, protowire.ParseError(l)
+		}
+		dst = append(dst, int64(x))
+		v = v[l:]
+	}
+	return dst, nil
+}
+
+// otlpFields is otlpRawFields for callers that don't care about wire types
+func otlpFields(b []byte, cb func(num protowire.Number, v []byte, n uint64) error) error {
+	return otlpRawFields(b, func(num protowire.Number, _ protowire.Type, v []byte, n uint64) error {
+		return cb(num, v, n)
+	})
+}
+
+// otlpRawFields calls cb for every field of a protobuf message. v is set for length-delimited fields,
+// n is set for numeric ones. Groups are skipped.
+func otlpRawFields(b []byte, cb func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, l = protowire.ConsumeFixed32(b)
+			n = uint64(x)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+			if l >= 0 {
+				b = b[l:]
+				continue
+			}
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		if err := cb(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,9 +2,22 @@ package convert
 
 // These functions are kept separately as profile.pb.go is a generated file
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
 
 func (profile *Profile) Get(sampleType string, cb func(name []byte, val int)) error {
+	return profile.get(sampleType, false, cb)
+}
+
+// GetWithLocations is Get with frames carrying their source locations, see tree.FrameWithLocation
+func (profile *Profile) GetWithLocations(sampleType string, cb func(name []byte, val int)) error {
+	return profile.get(sampleType, true, cb)
+}
+
+func (profile *Profile) get(sampleType string, withLocations bool, cb func(name []byte, val int)) error {
 	valueIndex := 0
 	if sampleType != "" {
 		for i, v := range profile.SampleType {
@@ -31,7 +44,11 @@ func (profile *Profile) Get(sampleType string, cb func(name []byte, val int)) er
 			l := locations[lID]
 			fID := l.Line[0].FunctionId
 			f := functions[fID]
-			stack = append([]string{profile.StringTable[f.Name]}, stack...)
+			name := profile.StringTable[f.Name]
+			if withLocations {
+				name = tree.FrameWithLocation(name, profile.StringTable[f.Filename], l.Line[0].Line)
+			}
+			stack = append([]string{name}, stack...)
 		}
 		name := strings.Join(stack, ";")
 		cb([]byte(name), int(s.Value[valueIndex]))
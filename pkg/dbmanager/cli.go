@@ -1,7 +1,9 @@
 package dbmanager
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/pyroscope-io/pyroscope/pkg/agent"
@@ -23,8 +25,24 @@ func Cli(db_cfg *config.DbManager, srv_cfg *config.Server, args []string) error
 	case "copy":
 		// TODO: this is meh, I think config.Config should be separate from storage config
 		srv_cfg.StoragePath = db_cfg.StoragePath
+		srv_cfg.ColdStoragePath = db_cfg.ColdStoragePath
 		srv_cfg.LogLevel = "error"
 		copyData(db_cfg, srv_cfg)
+	case "check":
+		srv_cfg.StoragePath = db_cfg.StoragePath
+		srv_cfg.ColdStoragePath = db_cfg.ColdStoragePath
+		srv_cfg.LogLevel = "error"
+		return checkIntegrity(srv_cfg)
+	case "repair":
+		srv_cfg.StoragePath = db_cfg.StoragePath
+		srv_cfg.ColdStoragePath = db_cfg.ColdStoragePath
+		srv_cfg.LogLevel = "error"
+		return repair(srv_cfg, db_cfg.Confirm)
+	case "merge":
+		srv_cfg.StoragePath = db_cfg.StoragePath
+		srv_cfg.ColdStoragePath = db_cfg.ColdStoragePath
+		srv_cfg.LogLevel = "error"
+		return merge(srv_cfg, db_cfg.SrcStoragePath)
 	default:
 		return fmt.Errorf("unknown command %q", args[0])
 	}
@@ -32,6 +50,84 @@ func Cli(db_cfg *config.DbManager, srv_cfg *config.Server, args []string) error
 	return nil
 }
 
+// checkIntegrity prints the integrity report as JSON, the command fails if any problems are found
+func checkIntegrity(srv_cfg *config.Server) error {
+	s, err := storage.New(srv_cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	report, err := s.CheckIntegrity()
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(report); err != nil {
+		return err
+	}
+	if !report.OK() {
+		return fmt.Errorf("found %d problems", len(report.Problems))
+	}
+	return nil
+}
+
+// repair prints the repair report as JSON. Data is only removed with confirm,
+// it's a good idea to run it on a copy of the storage first.
+func repair(srv_cfg *config.Server, confirm bool) error {
+	s, err := storage.New(srv_cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	report, err := s.Repair(!confirm)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	if err := e.Encode(report); err != nil {
+		return err
+	}
+	if !confirm && len(report.Removed)+len(report.Updated) > 0 {
+		return fmt.Errorf("nothing was changed, run with -confirm to remove %d and update %d entries", len(report.Removed), len(report.Updated))
+	}
+	return nil
+}
+
+// merge merges data of another storage directory into the storage, e.g to consolidate data of
+// multiple servers. Neither of them can be used by a running server.
+func merge(srv_cfg *config.Server, srcPath string) error {
+	if srcPath == "" {
+		return fmt.Errorf("please provide a storage directory to merge data from with -src-storage-path")
+	}
+	s, err := storage.New(srv_cfg)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	src_cfg := *srv_cfg
+	src_cfg.StoragePath = srcPath
+	src_cfg.ColdStoragePath = ""
+	src, err := storage.NewReadOnly(&src_cfg)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", srcPath, err)
+	}
+	defer src.Close()
+
+	report, err := s.Merge(src, func(segmentKey string) {
+		fmt.Fprintf(os.Stderr, "merging %s\n", segmentKey)
+	})
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(report)
+}
+
 // TODO: get this from config or something like that
 const resolution = 10 * time.Second
 
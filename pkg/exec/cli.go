@@ -130,6 +130,11 @@ func Cli(cfg *config.Exec, args []string) error {
 		UpstreamAddress:        cfg.ServerAddress,
 		UpstreamThreads:        cfg.UpstreamThreads,
 		UpstreamRequestTimeout: cfg.UpstreamRequestTimeout,
+		BatchWindow:            cfg.UpstreamBatchWindow,
+		HealthCheckInterval:    cfg.UpstreamHealthCheckInterval,
+		Compression:            cfg.UpstreamCompression,
+		QueueSize:              cfg.UpstreamQueueSize,
+		QueuePolicy:            cfg.UpstreamQueuePolicy,
 	}
 	u, err := remote.New(rc, logrus.StandardLogger())
 	if err != nil {
@@ -158,12 +163,18 @@ func Cli(cfg *config.Exec, args []string) error {
 		UploadRate:       10 * time.Second,
 		Pid:              pid,
 		WithSubprocesses: cfg.DetectSubprocesses,
+		HostLabel:        cfg.HostLabel,
+		Hostname:         cfg.Hostname,
 	}
 	session := agent.NewSession(&sc, logrus.StandardLogger())
 	if err := session.Start(); err != nil {
 		return fmt.Errorf("start session: %v", err)
 	}
-	defer session.Stop()
+	defer func() {
+		// the remote is stopped after the session, its last upload must not wait for a full queue
+		u.BeginStop()
+		session.Stop()
+	}()
 
 	if isExec {
 		waitForSpawnedProcessToExit(cmd)
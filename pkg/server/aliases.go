@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const maxAliasBodySize = 4 << 10
+
+type appAliasJSON struct {
+	Name  string `json:"name"`
+	Alias string `json:"alias"`
+}
+
+// appAliasesHandler manages aliases of apps, data stored under an alias shows up when querying the app.
+// It's meant to be used after renaming an app so that its history isn't split in two.
+// Changes require ingest authorization, see registerHandlers.
+func (ctrl *Controller) appAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		aliases, err := ctrl.s.AppAliases(tenant, name)
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve aliases: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(aliases)
+	case http.MethodPost, http.MethodDelete:
+		var a appAliasJSON
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAliasBodySize)).Decode(&a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err))
+			return
+		}
+		if a.Name == "" || a.Alias == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("name and alias are required"))
+			return
+		}
+		if a.Name == a.Alias {
+			writeJSONError(w, http.StatusBadRequest, errors.New("app can't be an alias of itself"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = ctrl.s.AddAppAlias(tenant, a.Name, a.Alias)
+		} else {
+			err = ctrl.s.DeleteAppAlias(tenant, a.Name, a.Alias)
+		}
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("update aliases: %v", err))
+			return
+		}
+		w.WriteHeader(200)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
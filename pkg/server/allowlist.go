@@ -0,0 +1,47 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// appAllowlist restricts which app names can be ingested. Entries are either exact names
+// or glob patterns (e.g "myapp.*"). An empty allowlist allows any app.
+type appAllowlist []string
+
+func newAppAllowlist(patterns []string) (appAllowlist, error) {
+	res := appAllowlist{}
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid allowed app pattern %q: %v", p, err)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+func (al appAllowlist) allows(appName string) bool {
+	if len(al) == 0 {
+		return true
+	}
+	for _, p := range al {
+		if ok, _ := path.Match(p, appName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// metricLabel returns the app label of per app metrics. Any app name could be ingested without an
+// allowlist, which would make the number of series unbounded, so all apps are reported as "other" then.
+func (al appAllowlist) metricLabel(appName string) string {
+	if len(al) == 0 {
+		return "other"
+	}
+	return appName
+}
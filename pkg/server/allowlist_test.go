@@ -0,0 +1,33 @@
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("appAllowlist", func() {
+	It("rejects invalid patterns", func() {
+		_, err := newAppAllowlist([]string{"app["})
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("allows",
+		func(patterns []string, appName string, expected bool) {
+			al, err := newAppAllowlist(patterns)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(al.allows(appName)).To(Equal(expected))
+		},
+		Entry("empty allowlist", []string{}, "foo", true),
+		Entry("exact match", []string{"foo", "bar"}, "bar", true),
+		Entry("pattern match", []string{"foo.*"}, "foo.cpu", true),
+		Entry("no match", []string{"foo.*"}, "fo.cpu", false),
+	)
+
+	It("labels metrics with app names only when the allowlist is set", func() {
+		al, _ := newAppAllowlist(nil)
+		Expect(al.metricLabel("foo.cpu")).To(Equal("other"))
+		al, _ = newAppAllowlist([]string{"foo.*"})
+		Expect(al.metricLabel("foo.cpu")).To(Equal("foo.cpu"))
+	})
+})
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/annotations"
+	"github.com/pyroscope-io/pyroscope/pkg/util/attime"
+)
+
+// maxAnnotationBodySize limits POST bodies, annotations are supposed to be short
+const maxAnnotationBodySize = 64 << 10
+
+type annotationJSON struct {
+	Time int64             `json:"time"`
+	Text string            `json:"text"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+func annotationsToJSON(as []*annotations.Annotation) []annotationJSON {
+	res := make([]annotationJSON, 0, len(as))
+	for _, a := range as {
+		res = append(res, annotationJSON{
+			Time: a.Time.Unix(),
+			Text: a.Text,
+			Tags: a.Tags,
+		})
+	}
+	return res
+}
+
+func (ctrl *Controller) annotationsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		as, err := ctrl.s.GetAnnotations(tenant, attime.Parse(q.Get("from")), attime.Parse(q.Get("until")))
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve annotations: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(annotationsToJSON(as))
+	case http.MethodPost:
+		var a annotationJSON
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnotationBodySize)).Decode(&a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err))
+			return
+		}
+		if a.Text == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("text is required"))
+			return
+		}
+		t := time.Now()
+		if a.Time != 0 {
+			t = time.Unix(a.Time, 0)
+		}
+		if err := ctrl.s.PutAnnotation(tenant, t, a.Text, a.Tags); err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("store annotation: %v", err))
+			return
+		}
+		ctrl.statsInc("annotation")
+		w.WriteHeader(200)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/annotations", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("stores and returns annotations", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			body := `{"time": 1600000000, "text": "deploy", "tags": {"version": "1.0"}}`
+			w := httptest.NewRecorder()
+			c.annotationsHandler(w, httptest.NewRequest("POST", "/annotations", bytes.NewBufferString(body)))
+			Expect(w.Code).To(Equal(200))
+
+			w = httptest.NewRecorder()
+			c.annotationsHandler(w, httptest.NewRequest("POST", "/annotations", bytes.NewBufferString(`{}`)))
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			w = httptest.NewRecorder()
+			c.annotationsHandler(w, httptest.NewRequest("GET", "/annotations?from=1599999990&until=1600000010", nil))
+			Expect(w.Code).To(Equal(200))
+			var res []annotationJSON
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal([]annotationJSON{
+				{Time: 1600000000, Text: "deploy", Tags: map[string]string{"version": "1.0"}},
+			}))
+		})
+
+		It("scopes annotations to the tenant", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			do := func(method, tenant, target, body string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(method, target, bytes.NewBufferString(body))
+				if tenant != "" {
+					r.Header.Set(tenantHeader, tenant)
+				}
+				c.annotationsHandler(w, r)
+				return w
+			}
+			Expect(do("POST", "team-a", "/annotations", `{"time": 1600000000, "text": "team-a deploy"}`).Code).To(Equal(200))
+			Expect(do("POST", "", "/annotations", `{"time": 1600000000, "text": "deploy"}`).Code).To(Equal(200))
+			Expect(do("POST", "bad tenant", "/annotations", `{"time": 1600000000, "text": "deploy"}`).Code).To(Equal(http.StatusBadRequest))
+
+			for tenant, text := range map[string]string{"": "deploy", "team-a": "team-a deploy"} {
+				w := do("GET", tenant, "/annotations?from=1599999990&until=1600000010", "")
+				Expect(w.Code).To(Equal(200))
+				var res []annotationJSON
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				Expect(res).To(Equal([]annotationJSON{{Time: 1600000000, Text: text}}), tenant)
+			}
+			w := do("GET", "team-b", "/annotations?from=1599999990&until=1600000010", "")
+			Expect(w.Body.String()).To(Equal("[]\n"))
+		})
+	})
+})
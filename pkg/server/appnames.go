@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAppsLimit = 100
+	maxAppsLimit     = 1000
+)
+
+type appJSON struct {
+	Name string `json:"name"`
+	// LastSeen is the end of the most recent data in unix seconds, 0 if there's no data
+	LastSeen int64 `json:"lastSeen"`
+	// LastQueried is when the app was last queried in unix seconds, 0 if it never was
+	LastQueried int64 `json:"lastQueried"`
+}
+
+type appsJSON struct {
+	Apps  []appJSON `json:"apps"`
+	Total int       `json:"total"`
+}
+
+// appNamesCache keeps apps of tenants for a short time, so that page loads don't scan labels and segments every time.
+// A tenant's entry is dropped as soon as an app that isn't in it is ingested, so new apps show up right away.
+type appNamesCache struct {
+	ttl time.Duration
+
+	m       sync.Mutex
+	entries map[string]*appNamesEntry
+}
+
+type appNamesEntry struct {
+	apps    []appJSON
+	set     map[string]struct{}
+	expires time.Time
+}
+
+// newAppNamesCache creates a cache, 0 ttl disables it
+func newAppNamesCache(ttl time.Duration) *appNamesCache {
+	return &appNamesCache{
+		ttl:     ttl,
+		entries: make(map[string]*appNamesEntry),
+	}
+}
+
+// get returns cached apps of the tenant, load is called when there are none or they're expired.
+// The returned slice must not be modified.
+func (c *appNamesCache) get(tenant string, now time.Time, load func() []appJSON) []appJSON {
+	if c.ttl <= 0 {
+		return load()
+	}
+	c.m.Lock()
+	e, ok := c.entries[tenant]
+	c.m.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.apps
+	}
+
+	// loading outside of the lock, concurrent misses load twice but don't block each other
+	apps := load()
+	e = &appNamesEntry{
+		apps:    apps,
+		set:     make(map[string]struct{}, len(apps)),
+		expires: now.Add(c.ttl),
+	}
+	for _, app := range apps {
+		e.set[app.Name] = struct{}{}
+	}
+	c.m.Lock()
+	c.entries[tenant] = e
+	c.m.Unlock()
+	return apps
+}
+
+// seen invalidates the tenant's entry if the app isn't in it
+func (c *appNamesCache) seen(tenant, app string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[tenant]; ok {
+		if _, ok = e.set[app]; !ok {
+			delete(c.entries, tenant)
+		}
+	}
+}
+
+// apps returns apps of the tenant, most recently active first
+func (ctrl *Controller) apps(tenant string) []appJSON {
+	return ctrl.appNames.get(tenant, time.Now(), func() []appJSON {
+		apps := []appJSON{}
+		ctrl.s.GetValues(tenant, "__name__", func(v string) bool {
+			apps = append(apps, appJSON{Name: v})
+			return true
+		})
+		for i := range apps {
+			k, err := storage.ParseKey(apps[i].Name)
+			if err != nil {
+				continue
+			}
+			k.SetTenant(tenant)
+			dr, err := ctrl.s.DataRange(k)
+			if err != nil {
+				logrus.WithError(err).WithField("app", apps[i].Name).Error("failed to retrieve data range")
+				continue
+			}
+			if dr != nil {
+				apps[i].LastSeen = dr.EndTime.Unix()
+			}
+		}
+		sort.SliceStable(apps, func(i, j int) bool {
+			return apps[i].LastSeen > apps[j].LastSeen
+		})
+		return apps
+	})
+}
+
+// appsHandler lists apps, most recently active first. It's paginated with offset and limit,
+// so that UIs can load the apps that don't fit into the index page lazily.
+func (ctrl *Controller) appsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	limit := defaultAppsLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxAppsLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q, must be between 1 and %d", v, maxAppsLimit))
+			return
+		}
+	}
+	offset := 0
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid offset: %q", v))
+			return
+		}
+	}
+
+	apps := ctrl.apps(tenant)
+	res := appsJSON{Apps: []appJSON{}, Total: len(apps)}
+	if offset < len(apps) {
+		apps = apps[offset:]
+		if len(apps) > limit {
+			apps = apps[:limit]
+		}
+		// apps are cached, query times change more often, so they're looked up on every request
+		res.Apps = make([]appJSON, len(apps))
+		for i, a := range apps {
+			if t, ok := ctrl.s.AppLastQueried(tenant, a.Name); ok {
+				a.LastQueried = t.Unix()
+			}
+			res.Apps[i] = a
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("appNamesCache", func() {
+	now := time.Unix(1600000000, 0)
+	apps := func(names ...string) []appJSON {
+		res := []appJSON{}
+		for _, name := range names {
+			res = append(res, appJSON{Name: name})
+		}
+		return res
+	}
+
+	It("caches apps of each tenant until they expire", func() {
+		c := newAppNamesCache(10 * time.Second)
+		loads := 0
+		load := func(names ...string) func() []appJSON {
+			return func() []appJSON {
+				loads++
+				return apps(names...)
+			}
+		}
+		Expect(c.get("", now, load("foo"))).To(Equal(apps("foo")))
+		Expect(c.get("", now.Add(5*time.Second), load("foo", "bar"))).To(Equal(apps("foo")))
+		Expect(c.get("team-a", now, load("baz"))).To(Equal(apps("baz")))
+		Expect(loads).To(Equal(2))
+
+		Expect(c.get("", now.Add(10*time.Second), load("foo", "bar"))).To(Equal(apps("foo", "bar")))
+		Expect(loads).To(Equal(3))
+	})
+
+	It("is invalidated by new apps", func() {
+		c := newAppNamesCache(time.Minute)
+		c.get("", now, func() []appJSON { return apps("foo") })
+		c.get("team-a", now, func() []appJSON { return apps("foo") })
+
+		c.seen("", "foo")
+		Expect(c.get("", now, func() []appJSON { return apps("foo", "bar") })).To(Equal(apps("foo")))
+		c.seen("", "bar")
+		Expect(c.get("", now, func() []appJSON { return apps("foo", "bar") })).To(Equal(apps("foo", "bar")))
+		Expect(c.get("team-a", now, func() []appJSON { return nil })).To(Equal(apps("foo")))
+	})
+
+	It("loads every time when disabled", func() {
+		c := newAppNamesCache(0)
+		c.get("", now, func() []appJSON { return apps("foo") })
+		c.seen("", "bar")
+		Expect(c.get("", now, func() []appJSON { return apps("bar") })).To(Equal(apps("bar")))
+	})
+})
+
+var _ = Describe("/apps", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("lists apps most recently active first", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for name, t := range map[string]int{"foo.cpu": 20, "bar.cpu": 100, "baz.cpu": 50} {
+				key, _ := storage.ParseKey(name + "{}")
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				tr.Insert([]byte("a;c"), uint64(2))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  testing.SimpleTime(t),
+					EndTime:    testing.SimpleTime(t + 9),
+					Key:        key,
+					Val:        tr,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+
+			get := func(q string) appsJSON {
+				w := httptest.NewRecorder()
+				c.appsHandler(w, httptest.NewRequest("GET", "/apps"+q, nil))
+				Expect(w.Code).To(Equal(200))
+				var res appsJSON
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				return res
+			}
+			Expect(get("")).To(Equal(appsJSON{
+				Apps: []appJSON{
+					{Name: "bar.cpu", LastSeen: testing.SimpleTime(110).Unix()},
+					{Name: "baz.cpu", LastSeen: testing.SimpleTime(60).Unix()},
+					{Name: "foo.cpu", LastSeen: testing.SimpleTime(30).Unix()},
+				},
+				Total: 3,
+			}))
+			Expect(get("?offset=1&limit=1")).To(Equal(appsJSON{
+				Apps:  []appJSON{{Name: "baz.cpu", LastSeen: testing.SimpleTime(60).Unix()}},
+				Total: 3,
+			}))
+			Expect(get("?offset=3")).To(Equal(appsJSON{Apps: []appJSON{}, Total: 3}))
+
+			for _, q := range []string{"?limit=0", "?limit=1001", "?offset=-1"} {
+				w := httptest.NewRecorder()
+				c.appsHandler(w, httptest.NewRequest("GET", "/apps"+q, nil))
+				Expect(w.Code).To(Equal(400), q)
+			}
+		})
+
+		It("reports when apps were last queried", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, name := range []string{"foo.cpu", "bar.cpu"} {
+				key, _ := storage.ParseKey(name + "{}")
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  testing.SimpleTime(10),
+					EndTime:    testing.SimpleTime(19),
+					Key:        key,
+					Val:        tr,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+			now := time.Now()
+			key, _ := storage.ParseKey("foo.cpu{}")
+			_, err = s.Get(&storage.GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.appsHandler(w, httptest.NewRequest("GET", "/apps", nil))
+			Expect(w.Code).To(Equal(200))
+			var res appsJSON
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			lastQueried := map[string]int64{}
+			for _, a := range res.Apps {
+				lastQueried[a.Name] = a.LastQueried
+			}
+			Expect(lastQueried["foo.cpu"]).To(BeNumerically(">=", now.Unix()))
+			Expect(lastQueried).To(HaveKeyWithValue("bar.cpu", BeZero()))
+		})
+	})
+})
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// authenticator protects a group of routes with a set of tokens. Clients pass a token either as
+// a bearer token (what agents do) or as the password of basic auth, so that browsers can prompt for it.
+// Ingest and query routes have authenticators of their own, so that e.g agents inside a cluster can
+// push without credentials while the UI requires them. A nil authenticator allows everything.
+type authenticator struct {
+	tokens [][]byte
+}
+
+func newAuthenticator(tokens []string) *authenticator {
+	a := &authenticator{}
+	for _, t := range tokens {
+		if t = strings.TrimSpace(t); t != "" {
+			a.tokens = append(a.tokens, []byte(t))
+		}
+	}
+	if len(a.tokens) == 0 {
+		return nil
+	}
+	return a
+}
+
+func (a *authenticator) allows(r *http.Request) bool {
+	token := ""
+	if _, p, ok := r.BasicAuth(); ok {
+		token = p
+	} else if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return false
+	}
+	ok := false
+	// compares against every token, so that timing doesn't tell which one is close
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare(t, []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// wrap returns a handler that responds with 401 to requests without a valid token
+func (a *authenticator) wrap(h http.HandlerFunc) http.HandlerFunc {
+	if a == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.allows(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="pyroscope"`)
+			writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid authorization token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// readWriteAuth protects routes that both serve queries and modify data: GET and HEAD requests
+// are authorized by read, any other method by write
+func readWriteAuth(read, write *authenticator, h http.HandlerFunc) http.HandlerFunc {
+	rh, wh := read.wrap(h), write.wrap(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			rh(w, r)
+		default:
+			wh(w, r)
+		}
+	}
+}
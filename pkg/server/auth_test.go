@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("authenticator", func() {
+	It("accepts bearer tokens and basic auth passwords", func() {
+		a := newAuthenticator([]string{"foo", " bar "})
+		for _, h := range []string{"Bearer foo", "Bearer bar"} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", h)
+			Expect(a.allows(r)).To(BeTrue(), h)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("anyone", "foo")
+		Expect(a.allows(r)).To(BeTrue())
+
+		for _, h := range []string{"", "Bearer", "Bearer baz", "foo"} {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set("Authorization", h)
+			Expect(a.allows(r)).To(BeFalse(), h)
+		}
+	})
+
+	It("is disabled without tokens", func() {
+		Expect(newAuthenticator([]string{"", " "})).To(BeNil())
+	})
+})
+
+var _ = Describe("route authorization", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("protects ingest and query routes independently", func() {
+			(*cfg).Server.DisableUI = true
+			(*cfg).Server.QueryAuthTokens = []string{"secret"}
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			do := func(method, path, token string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(method, path, nil)
+				if token != "" {
+					r.Header.Set("Authorization", "Bearer "+token)
+				}
+				mux.ServeHTTP(w, r)
+				return w
+			}
+
+			w := do("GET", "/labels", "")
+			Expect(w.Code).To(Equal(401))
+			Expect(w.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="pyroscope"`))
+			Expect(do("GET", "/labels", "wrong").Code).To(Equal(401))
+			Expect(do("GET", "/labels", "secret").Code).To(Equal(200))
+
+			// ingestion stays open, an empty body is rejected by the handler itself
+			Expect(do("POST", "/ingest?name=foo.cpu&from=1&until=2", "").Code).ToNot(Equal(401))
+
+			// changes of app settings are authorized like ingestion, they don't need query tokens
+			Expect(do("DELETE", "/apps/aliases", "secret").Code).ToNot(Equal(401))
+			// agents check server health without query tokens
+			w = do("GET", "/healthz", "")
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("ok\n"))
+		})
+
+		It("requires ingest tokens to change app settings", func() {
+			(*cfg).Server.DisableUI = true
+			(*cfg).Server.QueryAuthTokens = []string{"viewer"}
+			(*cfg).Server.IngestAuthTokens = []string{"agent"}
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			do := func(method, path, token, body string) int {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(method, path, strings.NewReader(body))
+				r.Header.Set("Authorization", "Bearer "+token)
+				mux.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			Expect(do("GET", "/apps/aliases?name=foo", "viewer", "")).To(Equal(200))
+			Expect(do("GET", "/apps/aliases?name=foo", "agent", "")).To(Equal(401))
+			for _, m := range []string{"POST", "DELETE"} {
+				Expect(do(m, "/apps/aliases", "viewer", `{"name":"foo","alias":"bar"}`)).To(Equal(401), m)
+				Expect(do(m, "/apps/aliases", "agent", `{"name":"foo","alias":"bar"}`)).To(Equal(200), m)
+			}
+
+			Expect(do("GET", "/apps/retention?name=foo", "viewer", "")).To(Equal(200))
+			Expect(do("GET", "/apps/retention?name=foo", "agent", "")).To(Equal(401))
+			for _, m := range []string{"POST", "DELETE"} {
+				Expect(do(m, "/apps/retention", "viewer", `{"name":"foo","retention":"1h"}`)).To(Equal(401), m)
+				Expect(do(m, "/apps/retention", "agent", `{"name":"foo","retention":"1h"}`)).To(Equal(200), m)
+			}
+		})
+	})
+})
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies decides whether headers set by a proxy (X-Forwarded-For, X-Real-IP)
+// can be used to determine the real client IP. Headers are never trusted unconditionally,
+// otherwise any client could spoof its address.
+type trustedProxies []*net.IPNet
+
+func newTrustedProxies(cidrs []string) (trustedProxies, error) {
+	res := trustedProxies{}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		// allows plain IPs to be passed as well
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", c, err)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+func (tp trustedProxies) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made the request. When the request
+// comes from a trusted proxy X-Forwarded-For is walked from right to left and the first
+// address that is not a trusted proxy is returned. X-Real-IP is used as a fallback.
+func (tp trustedProxies) clientIP(r *http.Request) string {
+	remote := remoteHost(r.RemoteAddr)
+	if !tp.contains(net.ParseIP(remote)) {
+		return remote
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			ip := net.ParseIP(hop)
+			if ip == nil {
+				// a malformed entry means we can't trust anything to the left of it
+				break
+			}
+			if i == 0 || !tp.contains(ip) {
+				return hop
+			}
+		}
+	}
+
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(xri) != nil {
+		return xri
+	}
+
+	return remote
+}
+
+func remoteHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
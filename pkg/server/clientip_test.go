@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("trustedProxies", func() {
+	It("rejects invalid CIDRs", func() {
+		_, err := newTrustedProxies([]string{"10.0.0.0/33"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("clientIP",
+		func(remoteAddr, xff, xri, expected string) {
+			tp, err := newTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+			Expect(err).ToNot(HaveOccurred())
+
+			r, _ := http.NewRequest("GET", "/render", nil)
+			r.RemoteAddr = remoteAddr
+			if xff != "" {
+				r.Header.Set("X-Forwarded-For", xff)
+			}
+			if xri != "" {
+				r.Header.Set("X-Real-IP", xri)
+			}
+			Expect(tp.clientIP(r)).To(Equal(expected))
+		},
+		Entry("no proxy", "1.2.3.4:5000", "", "", "1.2.3.4"),
+		Entry("untrusted proxy headers are ignored", "1.2.3.4:5000", "5.6.7.8", "5.6.7.8", "1.2.3.4"),
+		Entry("trusted proxy", "10.0.0.1:5000", "5.6.7.8", "", "5.6.7.8"),
+		Entry("chain of trusted proxies", "10.0.0.1:5000", "5.6.7.8, 192.168.1.1, 10.1.1.1", "", "5.6.7.8"),
+		Entry("spoofed leftmost entry", "10.0.0.1:5000", "9.9.9.9, 5.6.7.8", "", "5.6.7.8"),
+		Entry("X-Real-IP fallback", "192.168.1.1:5000", "", "5.6.7.8", "5.6.7.8"),
+		Entry("trusted proxy without headers", "10.0.0.1:5000", "", "", "10.0.0.1"),
+	)
+})
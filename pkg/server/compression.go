@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/compression"
+)
+
+// maxDecompressedBodySize bounds decompressed bodies, a small compressed body can expand to any size
+const maxDecompressedBodySize = 256 << 20
+
+// decompressBody decompresses bodies of ingest requests sent with a Content-Encoding,
+// agents compress profiles to save bandwidth. Handlers always read plain bodies.
+func decompressBody(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.Header.Get("Content-Encoding")
+		if encoding == "" {
+			h(w, r)
+			return
+		}
+		if err := compression.Validate(encoding); encoding != "identity" && err != nil {
+			writeJSONError(w, http.StatusUnsupportedMediaType, err)
+			return
+		}
+		body, err := compression.NewReader(encoding, r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("read %s body: %v", encoding, err))
+			return
+		}
+		defer body.Close()
+		r.Body = http.MaxBytesReader(w, body, maxDecompressedBodySize)
+		r.Header.Del("Content-Encoding")
+		h(w, r)
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	golog "log"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"runtime"
 	"sync"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/markbates/pkger"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
 	"github.com/pyroscope-io/pyroscope/pkg/build"
 	"github.com/pyroscope-io/pyroscope/pkg/config"
 	"github.com/pyroscope-io/pyroscope/pkg/storage"
@@ -26,11 +29,30 @@ type Controller struct {
 	cfg        *config.Server
 	s          *storage.Storage
 	httpServer *http.Server
+	// metricsServer is only used when metrics are served on a separate port
+	metricsServer *http.Server
 
-	statsMutex sync.Mutex
-	stats      map[string]int
+	stats counters
 
 	appStats *hyperloglog.HyperLogLogPlus
+	// seenApps holds seenAppKey of apps already checked against the persistent seen-set
+	seenApps sync.Map
+
+	trustedProxies trustedProxies
+	allowedApps    appAllowlist
+	renderSem      semaphore
+	ingestStream   *ingestStream
+	ingestSampler  *ingestSampler
+	minSamples     *minSamples
+	ingestSources  []ingestSource
+	mirror         upstream.Upstream
+
+	symbolNormalizer *symbolNormalizer
+	symbolizer       ingestSymbolizer
+	appNames         *appNamesCache
+
+	ingestAuth *authenticator
+	queryAuth  *authenticator
 }
 
 func New(cfg *config.Server, s *storage.Storage) (*Controller, error) {
@@ -39,19 +61,101 @@ func New(cfg *config.Server, s *storage.Storage) (*Controller, error) {
 		return nil, err
 	}
 
+	tp, err := newTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	al, err := newAppAllowlist(cfg.AllowedApps)
+	if err != nil {
+		return nil, err
+	}
+
+	is, err := newIngestSampler(cfg.IngestSampleRatio, cfg.IngestSampleMode)
+	if err != nil {
+		return nil, err
+	}
+
+	ms, err := newMinSamples(cfg.MinIngestSamples, cfg.MinIngestSamplesOverrides)
+	if err != nil {
+		return nil, err
+	}
+
+	sn, err := newSymbolNormalizer(cfg.NormalizeSymbolsApps, cfg.NormalizeSymbolsRules)
+	if err != nil {
+		return nil, err
+	}
+
+	symbolizer, err := newIngestSymbolizer(cfg.SymbolizeApps)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := newIngestSources(ingestQueueConfig{
+		url:     cfg.IngestQueueURL,
+		subject: cfg.IngestQueueSubject,
+		group:   cfg.IngestQueueGroup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mirror, err := newMirror(cfg.MirrorURL, cfg.MirrorAuthToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.ClockSkewTolerance > 0 && !isValidClockSkewPolicy(cfg.ClockSkewPolicy) {
+		return nil, fmt.Errorf("unsupported clock skew policy: %q", cfg.ClockSkewPolicy)
+	}
+	// the API server's write timeout is shorter than the default 30s CPU profile
+	if cfg.EnablePprof && cfg.MetricsBindAddr == "" {
+		return nil, fmt.Errorf("pprof can only be served on a separate metrics port, set metrics-bind-addr")
+	}
+	if !isValidMissingSampleRatePolicy(cfg.MissingSampleRatePolicy) {
+		return nil, fmt.Errorf("unsupported missing sample rate policy: %q", cfg.MissingSampleRatePolicy)
+	}
+
 	return &Controller{
-		cfg:      cfg,
-		s:        s,
-		stats:    make(map[string]int),
-		appStats: appStats,
+		cfg:            cfg,
+		s:              s,
+		appStats:       appStats,
+		trustedProxies: tp,
+		allowedApps:    al,
+		renderSem:      newSemaphore(cfg.MaxConcurrentRenders),
+		ingestStream:   newIngestStream(cfg.MaxIngestStreamSubscribers),
+		ingestSampler:  is,
+		minSamples:     ms,
+		ingestSources:  sources,
+		mirror:         mirror,
+
+		symbolNormalizer: sn,
+		symbolizer:       symbolizer,
+		appNames:         newAppNamesCache(cfg.AppNamesCacheTTL),
+
+		ingestAuth: newAuthenticator(cfg.IngestAuthTokens),
+		queryAuth:  newAuthenticator(cfg.QueryAuthTokens),
 	}, nil
 }
 
+// clientIP returns the real IP of the client, taking trusted proxies into account
+func (ctrl *Controller) clientIP(r *http.Request) string {
+	return ctrl.trustedProxies.clientIP(r)
+}
+
 func (ctrl *Controller) Stop() error {
+	ctrl.stopIngestSources()
+	if ctrl.mirror != nil {
+		ctrl.mirror.Stop()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if ctrl.metricsServer != nil {
+		if err := ctrl.metricsServer.Shutdown(ctx); err != nil {
+			logrus.WithError(err).Error("failed to shutdown metrics server")
+		}
+	}
 	if ctrl.httpServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-		defer cancel()
-
 		// shutdown the server gracefully
 		return ctrl.httpServer.Shutdown(ctx)
 	}
@@ -62,12 +166,87 @@ func (ctrl *Controller) Stop() error {
 func (ctrl *Controller) Start() error {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
-	mux.HandleFunc("/ingest", ctrl.ingestHandler)
-	mux.HandleFunc("/render", ctrl.renderHandler)
-	mux.HandleFunc("/labels", ctrl.labelsHandler)
-	mux.HandleFunc("/label-values", ctrl.labelValuesHandler)
+	if ctrl.cfg.MetricsBindAddr == "" {
+		ctrl.registerDebugHandlers(mux)
+	} else if err := ctrl.startMetricsServer(); err != nil {
+		return err
+	}
+	if err := ctrl.startIngestSources(); err != nil {
+		return err
+	}
+	ctrl.registerHandlers(mux)
+
+	logger := logrus.New()
+	w := logger.Writer()
+	defer w.Close()
+
+	ctrl.httpServer = &http.Server{
+		Addr:           ctrl.cfg.APIBindAddr,
+		Handler:        responseHeadersHandler(ctrl.cfg.ResponseHeaders, mux),
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		IdleTimeout:    30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+		ErrorLog:       golog.New(w, "", 0),
+		ConnContext:    withConn,
+	}
+	if err := ctrl.httpServer.ListenAndServe(); err != nil {
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		return fmt.Errorf("listen and serve: %v", err)
+	}
+
+	return nil
+}
+
+// registerHandlers registers the API and, unless it's disabled, the web UI.
+// Ingest and query routes are protected by separate authenticators, routes that modify app
+// settings require the ingest one for changes.
+func (ctrl *Controller) registerHandlers(mux *http.ServeMux) {
+	// polled by agents and load balancers, it doesn't require authorization
+	mux.HandleFunc("/healthz", instrumentRoute("/healthz", ctrl.healthzHandler))
+
+	ingest := func(route string, h http.HandlerFunc) {
+		mux.HandleFunc(route, instrumentRoute(route, ctrl.ingestAuth.wrap(decompressBody(h))))
+	}
+	ingest("/ingest", ctrl.ingestHandler)
+	ingest("/ingest/batch", ctrl.ingestBatchHandler)
+	ingest("/v1development/profiles", ctrl.otlpProfilesHandler)
+
+	query := func(route string, h http.HandlerFunc) {
+		mux.HandleFunc(route, instrumentRoute(route, ctrl.queryAuth.wrap(h)))
+	}
+	query("/ingest/stream", ctrl.ingestStreamHandler)
+	query("/render", ctrl.renderHandler)
+	query("/labels", ctrl.labelsHandler)
+	query("/label-values", ctrl.labelValuesHandler)
+	query("/annotations", ctrl.annotationsHandler)
+	query("/range", ctrl.rangeHandler)
+	query("/ready-for-queries", ctrl.readyForQueriesHandler)
+	query("/app/profile-types", ctrl.profileTypesHandler)
+	query("/apps", ctrl.appsHandler)
+	query("/keys", ctrl.keysHandler)
+	query("/trace-profiles", ctrl.traceProfilesHandler)
+	query("/storage/stats", ctrl.storageStatsHandler)
+	query("/top-functions", ctrl.topFunctionsHandler)
+	query("/profile-link", ctrl.profileLinkHandler)
+
+	// changes are authorized like ingestion, not like queries, the query token is often shared with
+	// viewers of the UI
+	manage := func(route string, h http.HandlerFunc) {
+		mux.HandleFunc(route, instrumentRoute(route, readWriteAuth(ctrl.queryAuth, ctrl.ingestAuth, h)))
+	}
+	manage("/apps/aliases", ctrl.appAliasesHandler)
+	manage("/apps/retention", ctrl.appRetentionHandler)
+
+	// the UI is served from /, without it unknown paths are 404
+	if !ctrl.cfg.DisableUI {
+		ctrl.registerUIHandlers(mux)
+	}
+}
 
+func (ctrl *Controller) registerUIHandlers(mux *http.ServeMux) {
 	var dir http.FileSystem
 	if build.UseEmbeddedAssets {
 		// for this to work you need to run `pkger` first. See Makefile for more information
@@ -77,7 +256,7 @@ func (ctrl *Controller) Start() error {
 	}
 
 	fs := http.FileServer(dir)
-	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/", instrumentRoute("/", ctrl.queryAuth.wrap(func(rw http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			ctrl.statsInc("index")
 			ctrl.renderIndexPage(dir, rw, r)
@@ -87,28 +266,66 @@ func (ctrl *Controller) Start() error {
 		} else {
 			fs.ServeHTTP(rw, r)
 		}
-	})
-
-	logger := logrus.New()
-	w := logger.Writer()
-	defer w.Close()
+	})))
+}
 
-	ctrl.httpServer = &http.Server{
-		Addr:           ctrl.cfg.APIBindAddr,
-		Handler:        mux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		IdleTimeout:    30 * time.Second,
-		MaxHeaderBytes: 1 << 20,
-		ErrorLog:       golog.New(w, "", 0),
+// relativeTime formats a duration as an attime offset from now, e.g "now-24h".
+// Returns an empty string for non-positive durations.
+func relativeTime(d time.Duration) string {
+	s := int64(d / time.Second)
+	switch {
+	case s <= 0:
+		return ""
+	case s%(24*3600) == 0:
+		return fmt.Sprintf("now-%dd", s/(24*3600))
+	case s%3600 == 0:
+		return fmt.Sprintf("now-%dh", s/3600)
+	case s%60 == 0:
+		return fmt.Sprintf("now-%dm", s/60)
 	}
-	if err := ctrl.httpServer.ListenAndServe(); err != nil {
-		if err == http.ErrServerClosed {
-			return nil
-		}
-		return fmt.Errorf("listen and serve: %v", err)
+	return fmt.Sprintf("now-%ds", s)
+}
+
+// healthzHandler reports that the server is up, agents pause uploads while it fails
+func (*Controller) healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// registerDebugHandlers registers endpoints used to monitor the server itself
+func (ctrl *Controller) registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", promhttp.Handler().ServeHTTP)
+	if ctrl.cfg.EnablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
+}
+
+// startMetricsServer serves debug endpoints on a separate port, see config.Server.MetricsBindAddr
+func (ctrl *Controller) startMetricsServer() error {
+	mux := http.NewServeMux()
+	ctrl.registerDebugHandlers(mux)
 
+	// listening synchronously reports errors like a busy port right away
+	l, err := net.Listen("tcp", ctrl.cfg.MetricsBindAddr)
+	if err != nil {
+		return fmt.Errorf("metrics listen: %v", err)
+	}
+	ctrl.metricsServer = &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+		// long enough for the default 30s CPU profile
+		WriteTimeout: time.Minute,
+		IdleTimeout:  30 * time.Second,
+	}
+	go func() {
+		if err := ctrl.metricsServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).Error("metrics server failed")
+		}
+	}()
 	return nil
 }
 
@@ -120,6 +337,10 @@ func renderServerError(rw http.ResponseWriter, text string) {
 
 type indexPageJSON struct {
 	AppNames []string `json:"appNames"`
+	// AppNamesTotal is the number of apps, including the ones that didn't fit into AppNames
+	AppNamesTotal int    `json:"appNamesTotal"`
+	DefaultQuery  string `json:"defaultQuery,omitempty"`
+	DefaultFrom   string `json:"defaultFrom,omitempty"`
 }
 
 type buildInfoJSON struct {
@@ -140,7 +361,7 @@ type indexPage struct {
 	BaseURL       string
 }
 
-func (ctrl *Controller) renderIndexPage(dir http.FileSystem, rw http.ResponseWriter, _ *http.Request) {
+func (ctrl *Controller) renderIndexPage(dir http.FileSystem, rw http.ResponseWriter, r *http.Request) {
 	f, err := dir.Open("/index.html")
 	if err != nil {
 		renderServerError(rw, fmt.Sprintf("could not find file index.html: %q", err))
@@ -159,11 +380,24 @@ func (ctrl *Controller) renderIndexPage(dir http.FileSystem, rw http.ResponseWri
 		return
 	}
 
-	initialStateObj := indexPageJSON{}
-	ctrl.s.GetValues("__name__", func(v string) bool {
-		initialStateObj.AppNames = append(initialStateObj.AppNames, v)
-		return true
-	})
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err)
+		return
+	}
+	initialStateObj := indexPageJSON{
+		DefaultQuery: ctrl.cfg.DefaultQuery,
+		DefaultFrom:  relativeTime(ctrl.cfg.DefaultRange),
+	}
+	// with many apps only the most recently active ones are sent, the rest can be loaded from /apps
+	apps := ctrl.apps(tenant)
+	initialStateObj.AppNamesTotal = len(apps)
+	if max := ctrl.cfg.IndexMaxApps; max > 0 && len(apps) > max {
+		apps = apps[:max]
+	}
+	for _, app := range apps {
+		initialStateObj.AppNames = append(initialStateObj.AppNames, app.Name)
+	}
 	b, err = json.Marshal(initialStateObj)
 	if err != nil {
 		renderServerError(rw, fmt.Sprintf("could not marshal initialStateObj json: %q", err))
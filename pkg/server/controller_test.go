@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("index page", func() {
+	DescribeTable("relativeTime",
+		func(d time.Duration, expected string) {
+			Expect(relativeTime(d)).To(Equal(expected))
+		},
+		Entry("not set", time.Duration(0), ""),
+		Entry("days", 48*time.Hour, "now-2d"),
+		Entry("hours", 3*time.Hour, "now-3h"),
+		Entry("minutes", 90*time.Minute, "now-90m"),
+		Entry("seconds", 90*time.Second, "now-90s"),
+	)
+})
+
+var _ = Describe("metrics", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		BeforeEach(func() {
+			(*cfg).Server.APIBindAddr = ":10044"
+			(*cfg).Server.MetricsBindAddr = ":10045"
+			(*cfg).Server.EnablePprof = true
+		})
+
+		It("are served on a separate port together with pprof", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			go func() {
+				defer GinkgoRecover()
+				Expect(c.Start()).To(Succeed())
+			}()
+			defer c.Stop()
+			retryUntilServerIsUp("http://localhost:10044/")
+
+			res, err := http.Get("http://localhost:10045/metrics")
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(200))
+
+			res, err = http.Get("http://localhost:10045/debug/pprof/")
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(200))
+
+			res, err = http.Get("http://localhost:10044/metrics")
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(404))
+		})
+
+		It("requires a separate port for pprof", func() {
+			(*cfg).Server.MetricsBindAddr = ""
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			_, err = New(&(*cfg).Server, s)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("web UI", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("can be disabled", func() {
+			(*cfg).Server.DisableUI = true
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			for path, code := range map[string]int{"/": 404, "/comparison": 404, "/assets/app.js": 404, "/labels": 200} {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+				Expect(w.Code).To(Equal(code), path)
+			}
+		})
+	})
+})
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/sirupsen/logrus"
+)
+
+type errorJSON struct {
+	Error errorBodyJSON `json:"error"`
+}
+
+type errorBodyJSON struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+}
+
+// writeJSONError is what all API handlers use to report errors to clients.
+// The index page has its own HTML error path, see renderServerError.
+func writeJSONError(rw http.ResponseWriter, status int, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	b, jsonErr := json.Marshal(errorJSON{
+		Error: errorBodyJSON{
+			Message: err.Error(),
+			Code:    status,
+		},
+	})
+	if jsonErr != nil {
+		logrus.WithField("err", jsonErr).Error("failed to marshal error json")
+		return
+	}
+	rw.Write(b)
+	rw.Write([]byte("\n"))
+}
+
+// storageErrorStatus maps errors returned by storage to HTTP status codes
+func storageErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrClosing):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, storage.ErrOutOfSpace):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrUnsupportedMetadataFilter), errors.Is(err, storage.ErrTooManyGroups):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrTooManyLabelValues):
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
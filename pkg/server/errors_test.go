@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+var _ = Describe("errors", func() {
+	Describe("writeJSONError", func() {
+		It("writes a JSON error envelope with the status code", func() {
+			rec := httptest.NewRecorder()
+			writeJSONError(rec, http.StatusBadRequest, errors.New("invalid name"))
+
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+			Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var res errorJSON
+			Expect(json.Unmarshal(rec.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Error.Message).To(Equal("invalid name"))
+			Expect(res.Error.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("storageErrorStatus", func() {
+		It("maps storage errors to status codes", func() {
+			Expect(storageErrorStatus(storage.ErrClosing)).To(Equal(http.StatusServiceUnavailable))
+			Expect(storageErrorStatus(fmt.Errorf("put: %w", storage.ErrOutOfSpace))).To(Equal(http.StatusInsufficientStorage))
+			Expect(storageErrorStatus(errors.New("other"))).To(Equal(http.StatusInternalServerError))
+		})
+	})
+})
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/twmb/murmur3"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+const (
+	// historicalRenderLag is how long after its end a range can still get data, e.g from agents with skewed clocks
+	historicalRenderLag = 5 * time.Minute
+	// historicalRenderMaxAge is how long clients can reuse renders of historical ranges without revalidating them
+	historicalRenderMaxAge = time.Hour
+)
+
+// renderETag identifies a rendered response. Hashing the tree is much cheaper than rendering it,
+// so unchanged data doesn't have to be rendered at all. The rest of the response (e.g query parameters,
+// the timeline and annotations) is hashed as JSON.
+func renderETag(t *tree.Tree, rest ...interface{}) string {
+	h := murmur3.SeedNew64(seed)
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, t.Hash())
+	h.Write(b)
+	for _, v := range rest {
+		j, _ := json.Marshal(v)
+		h.Write(j)
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf(`"%016x"`, h.Sum64())
+}
+
+// etagMatches tells whether the If-None-Match header value matches the ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// setRenderCacheHeaders sets caching headers and tells whether the client already has the response.
+// Data of historical ranges doesn't change, so clients can cache it. Ranges touching now
+// have to be revalidated every time.
+func setRenderCacheHeaders(w http.ResponseWriter, r *http.Request, etag string, endTime, now time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if endTime.Before(now.Add(-historicalRenderLag)) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(historicalRenderMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+)
+
+// responseHeadersHandler adds configured headers (e.g security headers) to every response
+func responseHeadersHandler(headers map[string]string, next http.Handler) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headersWriter{ResponseWriter: w, headers: headers}, r)
+	})
+}
+
+// headersWriter adds headers right before they are sent, so that it doesn't clobber
+// headers set by handlers, like Content-Type
+type headersWriter struct {
+	http.ResponseWriter
+	headers     map[string]string
+	wroteHeader bool
+}
+
+func (w *headersWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		for k, v := range w.headers {
+			if _, ok := h[http.CanonicalHeaderKey(k)]; !ok {
+				h.Set(k, v)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush is needed for streaming handlers, see ingestStreamHandler
+func (w *headersWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
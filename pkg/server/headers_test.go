@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("response headers", func() {
+	It("adds configured headers without overriding the ones set by handlers", func() {
+		h := responseHeadersHandler(map[string]string{
+			"X-Frame-Options": "DENY",
+			"content-type":    "text/plain",
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}"))
+		}))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		Expect(w.Code).To(Equal(200))
+		Expect(w.Header().Get("X-Frame-Options")).To(Equal("DENY"))
+		Expect(w.Header().Values("Content-Type")).To(Equal([]string{"application/json"}))
+	})
+})
@@ -1,12 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"time"
 
-	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
 	"github.com/pyroscope-io/pyroscope/pkg/convert"
 	"github.com/pyroscope-io/pyroscope/pkg/storage"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
@@ -14,6 +21,60 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	ingestTruncated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_truncated_total",
+		Help: "number of ingested profiles that exceeded configured limits and were truncated",
+	}, []string{"app"})
+	ingestTruncatedLogThrottle = newThrottle(time.Minute)
+
+	ingestRejectedKeys = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_too_many_labels_total",
+		Help: "number of ingested profiles rejected because their keys have more labels than max-key-labels",
+	})
+
+	ingestBodyBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "pyroscope_ingest_body_bytes",
+		Help: "size of ingested request bodies, by app when app names are restricted by allowed-apps",
+		// 1KB to 256MB
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	}, []string{"app"})
+	ingestBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_bytes_total",
+		Help: "total size of ingested request bodies",
+	}, []string{"app"})
+
+	ingestClockSkew = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "pyroscope_ingest_clock_skew_seconds",
+		Help: "absolute difference between the end of ingested profiles and server time, by app when app names are restricted by allowed-apps",
+		// 1s to ~4.5h
+		Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+	}, []string{"app"})
+	ingestClockSkewLogThrottle = newThrottle(time.Minute)
+
+	ingestOutsideRetention = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_outside_retention_total",
+		Help: "number of ingested profiles rejected because they are older than the retention window, by app when app names are restricted by allowed-apps",
+	}, []string{"app"})
+
+	ingestSampled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_sampled_total",
+		Help: "number of ingested profiles accepted or dropped by ingest sampling, by app when app names are restricted by allowed-apps",
+	}, []string{"app", "result"})
+)
+
+// countingReader counts bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
 type ingestParams struct {
 	parserFunc      func(io.Reader) (*tree.Tree, error)
 	storageKey      *storage.Key
@@ -24,6 +85,10 @@ type ingestParams struct {
 	modifiers       []string
 	from            time.Time
 	until           time.Time
+	metadata        map[string]string
+	// bodySize is the size of the request body of profiles that are decoded before ingest, e.g OTLP ones.
+	// Otherwise it's 0 and the size is what the parser reads
+	bodySize int64
 }
 
 func wrapConvertFunction(convertFunc func(r io.Reader, cb func(name []byte, val int)) error) func(io.Reader) (*tree.Tree, error) {
@@ -39,22 +104,73 @@ func wrapConvertFunction(convertFunc func(r io.Reader, cb func(name []byte, val
 	}
 }
 
-func ingestParamsFromRequest(r *http.Request) *ingestParams {
+func ingestParamsFromRequest(r *http.Request, maxLabels int) (*ingestParams, error) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		return nil, err
+	}
+	return ingestParamsFromQuery(r.URL.Query(), r.Header.Get("Content-Type"), tenant, maxLabels)
+}
+
+// parseIngestKey parses keys of ingested profiles, keys with more than maxLabels labels are rejected
+func parseIngestKey(name string, maxLabels int) (*storage.Key, error) {
+	k, err := storage.ParseKeyMaxLabels(name, maxLabels)
+	if errors.Is(err, storage.ErrTooManyLabels) {
+		ingestRejectedKeys.Inc()
+	}
+	return k, err
+}
+
+func ingestParamsFromQuery(q url.Values, contentType, tenant string, maxLabels int) (*ingestParams, error) {
 	ip := &ingestParams{}
-	q := r.URL.Query()
+
+	var err error
+	ip.storageKey, err = parseIngestKey(q.Get("name"), maxLabels)
+	if err != nil {
+		return nil, fmt.Errorf("name: %v", err)
+	}
+	ip.storageKey.SetTenant(tenant)
+	// units and aggregation default to the ones of the profile type, e.g bytes for myapp.inuse_space
+	pt := spy.ProfileType(ip.storageKey.ProfileType())
 
 	format := q.Get("format")
 
-	if format == "tree" || r.Header.Get("Content-Type") == "binary/octet-stream+tree" {
+	if format == "tree" || contentType == "binary/octet-stream+tree" {
 		ip.parserFunc = tree.DeserializeNoDict
-	} else if format == "trie" || r.Header.Get("Content-Type") == "binary/octet-stream+trie" {
+	} else if format == "columnar" || contentType == "binary/octet-stream+columnar" {
+		// compact and fast to decode, meant for very large profiles, see tree.DeserializeColumnar
+		ip.parserFunc = tree.DeserializeColumnar
+	} else if format == "trie" || contentType == "binary/octet-stream+trie" {
 		ip.parserFunc = wrapConvertFunction(convert.ParseTrie)
 	} else if format == "lines" {
 		ip.parserFunc = wrapConvertFunction(convert.ParseIndividualLines)
+	} else if format == "pprof" {
+		// source locations are opt-in, they make trees and dictionaries a lot bigger
+		read := convert.ReadTree
+		if q.Get("locations") == "true" {
+			read = convert.ReadTreeWithLocations
+		}
+		ip.parserFunc = func(r io.Reader) (*tree.Tree, error) {
+			return read("pprof", r)
+		}
 	} else {
 		ip.parserFunc = wrapConvertFunction(convert.ParseGroups)
 	}
 
+	if ip.metadata, err = parseUploadMetadata(q.Get("metadata")); err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	// links the profile to a trace, it's a shorthand for the traceID metadata tag
+	if traceID := q.Get("traceID"); traceID != "" {
+		if err = validateTraceID(traceID); err != nil {
+			return nil, err
+		}
+		if ip.metadata == nil {
+			ip.metadata = make(map[string]string)
+		}
+		ip.metadata[storage.TraceIDMetadata] = traceID
+	}
+
 	if qt := q.Get("from"); qt != "" {
 		ip.from = attime.Parse(qt)
 	} else {
@@ -70,13 +186,11 @@ func ingestParamsFromRequest(r *http.Request) *ingestParams {
 	if sr := q.Get("sampleRate"); sr != "" {
 		sampleRate, err := strconv.Atoi(sr)
 		if err != nil {
+			// handled like a missing sample rate, see applyMissingSampleRatePolicy
 			logrus.WithField("err", err).Errorf("invalid sample rate: %v", sr)
-			ip.sampleRate = types.DefaultSampleRate
 		} else {
 			ip.sampleRate = uint32(sampleRate)
 		}
-	} else {
-		ip.sampleRate = types.DefaultSampleRate
 	}
 
 	if sn := q.Get("spyName"); sn != "" {
@@ -88,36 +202,176 @@ func ingestParamsFromRequest(r *http.Request) *ingestParams {
 
 	if u := q.Get("units"); u != "" {
 		ip.units = u
+	} else if pt.IsKnown() {
+		ip.units = pt.Units()
 	} else {
 		ip.units = "samples"
 	}
 
 	if at := q.Get("aggregationType"); at != "" {
+		if !storage.IsValidAggregationType(at) {
+			return nil, fmt.Errorf("unsupported aggregation type: %q", at)
+		}
 		ip.aggregationType = at
+	} else if pt.IsKnown() {
+		ip.aggregationType = pt.AggregationType()
 	} else {
-		ip.aggregationType = "sum"
+		ip.aggregationType = storage.AggregationSum
 	}
 
-	var err error
-	ip.storageKey, err = storage.ParseKey(q.Get("name"))
+	return ip, nil
+}
+
+func (ctrl *Controller) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	ip, err := ingestParamsFromRequest(r, ctrl.cfg.MaxKeyLabels)
 	if err != nil {
-		logrus.Error("parsing error:", err)
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var body io.Reader = r.Body
+	if isIngestEnvelope(r) {
+		profile, err := readIngestEnvelope(r.Body, ip, ctrl.cfg.MaxKeyLabels)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		body = bytes.NewReader(profile)
+	}
+	if status, err := ctrl.ingest(ip, body, ctrl.clientIP(r)); err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// ingest stores a single profile. On failure it returns the error together with the HTTP status
+// code that describes it best.
+func (ctrl *Controller) ingest(ip *ingestParams, r io.Reader, client string) (int, error) {
+	p, status, err := ctrl.prepareIngest(ip, r, client)
+	if err != nil || p == nil {
+		return status, err
 	}
+	return ctrl.storeIngested(p, client)
+}
 
-	return ip
+// ingestedProfile is a profile that was validated and parsed, and is ready to be stored
+type ingestedProfile struct {
+	ip       *ingestParams
+	tree     *tree.Tree
+	bodySize int64
 }
 
-func (ctrl *Controller) ingestHandler(w http.ResponseWriter, r *http.Request) {
-	ip := ingestParamsFromRequest(r)
+// prepareIngest validates and parses a profile without storing it. It returns a nil profile
+// and no error for profiles that are accepted but not stored, e.g sampled out ones.
+func (ctrl *Controller) prepareIngest(ip *ingestParams, r io.Reader, client string) (*ingestedProfile, int, error) {
+	appName := ip.storageKey.AppName()
+	if !ctrl.allowedApps.allows(appName) {
+		logrus.WithFields(logrus.Fields{
+			"app":    appName,
+			"client": client,
+		}).Warn("rejected profile from an app that is not allowed")
+		return nil, http.StatusForbidden, fmt.Errorf("app %q is not allowed", appName)
+	}
+
+	if ctrl.ingestSampler.enabled() {
+		if !ctrl.ingestSampler.accepts(appName) {
+			ingestSampled.WithLabelValues(ctrl.allowedApps.metricLabel(appName), "dropped").Inc()
+			// agents retry on errors, dropped profiles have to look like stored ones
+			return nil, http.StatusOK, nil
+		}
+		ingestSampled.WithLabelValues(ctrl.allowedApps.metricLabel(appName), "accepted").Inc()
+	}
+
+	if err := ctrl.applyMissingSampleRatePolicy(ip, appName, client); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	// agents send their own timestamps, skewed clocks put data in wrong buckets or in the future
+	skew := clockSkew(ip.until, time.Now())
+	ingestClockSkew.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Observe(math.Abs(skew.Seconds()))
+	if skewExceeds(skew, ctrl.cfg.ClockSkewTolerance) {
+		if ingestClockSkewLogThrottle.allow(appName, time.Now()) {
+			logrus.WithFields(logrus.Fields{
+				"app":    appName,
+				"skew":   skew,
+				"policy": ctrl.cfg.ClockSkewPolicy,
+				"client": client,
+			}).Warn("ingested profile timestamps are too far from server time")
+		}
+		if ctrl.cfg.ClockSkewPolicy == clockSkewPolicyReject {
+			return nil, http.StatusBadRequest, fmt.Errorf("timestamps are %v away from server time, max allowed is %v", skew, ctrl.cfg.ClockSkewTolerance)
+		}
+		adjustForSkew(ip, skew)
+	}
+
+	// such data would be expired right away, storing it is wasted work
+	if retention := ctrl.retention(ip.storageKey.Tenant(), appName); outsideRetention(ip.until, time.Now(), retention) {
+		ingestOutsideRetention.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Inc()
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("profile ends at %v, which is outside of the %v retention window", ip.until.UTC(), retention)
+	}
 
-	var t *tree.Tree
-	t, err := ip.parserFunc(r.Body)
+	body := &countingReader{r: r}
+	t, err := ip.parserFunc(body)
+	bodySize := body.n
+	if ip.bodySize > 0 {
+		bodySize = ip.bodySize
+	}
+	ingestBodyBytes.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Observe(float64(bodySize))
+	ingestBytesTotal.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Add(float64(bodySize))
 	if err != nil {
-		logrus.WithField("err", err).Error("error happened while parsing data")
-		return
+		logrus.WithFields(logrus.Fields{
+			"err":    err,
+			"client": client,
+		}).Error("error happened while parsing data")
+		return nil, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err)
+	}
+
+	// sparse profiles are dropped like sampled out ones, they aren't worth retrying
+	if !ctrl.minSamples.accepts(ip.storageKey.ProfileType(), t.Samples()) {
+		ingestBelowMinSamples.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Inc()
+		return nil, http.StatusOK, nil
+	}
+
+	// before normalization, which strips address suffixes
+	if sym := ctrl.symbolizer.forApp(appName); sym != nil {
+		t = symbolize(t, sym, ctrl.allowedApps.metricLabel(appName))
+	}
+	if ctrl.symbolNormalizer.enabledFor(appName) {
+		t = ctrl.symbolNormalizer.normalize(t)
+	}
+
+	// bounds worst-case tree size for profiles with runaway recursion
+	if t.TruncateDepth(ctrl.cfg.MaxIngestDepth) {
+		ingestTruncated.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Inc()
+		if ingestTruncatedLogThrottle.allow(appName, time.Now()) {
+			logrus.WithFields(logrus.Fields{
+				"app":      appName,
+				"maxDepth": ctrl.cfg.MaxIngestDepth,
+				"client":   client,
+			}).Warn("ingested profile exceeds max depth and was truncated")
+		}
+	}
+	// bounds worst-case tree size for profiles with lots of diverse call sites
+	if t.CapWidth(ctrl.cfg.MaxIngestWidth) {
+		ingestTruncated.WithLabelValues(ctrl.allowedApps.metricLabel(appName)).Inc()
+		if ingestTruncatedLogThrottle.allow(appName, time.Now()) {
+			logrus.WithFields(logrus.Fields{
+				"app":      appName,
+				"maxWidth": ctrl.cfg.MaxIngestWidth,
+				"client":   client,
+			}).Warn("ingested profile exceeds max width and was truncated")
+		}
 	}
 
-	err = ctrl.s.Put(&storage.PutInput{
+	return &ingestedProfile{ip: ip, tree: t, bodySize: body.n}, http.StatusOK, nil
+}
+
+// storeIngested stores a profile returned by prepareIngest
+func (ctrl *Controller) storeIngested(p *ingestedProfile, client string) (int, error) {
+	ip, t := p.ip, p.tree
+	appName := ip.storageKey.AppName()
+	mirrorJob := ctrl.mirrorJob(ip, t)
+	err := ctrl.s.Put(&storage.PutInput{
 		StartTime:       ip.from,
 		EndTime:         ip.until,
 		Key:             ip.storageKey,
@@ -126,14 +380,28 @@ func (ctrl *Controller) ingestHandler(w http.ResponseWriter, r *http.Request) {
 		SampleRate:      ip.sampleRate,
 		Units:           ip.units,
 		AggregationType: ip.aggregationType,
+		Metadata:        ip.metadata,
 	})
 	if err != nil {
-		logrus.WithField("err", err).Error("error happened while inserting data")
-		return
+		logrus.WithFields(logrus.Fields{
+			"err":    err,
+			"client": client,
+		}).Error("error happened while inserting data")
+		return storageErrorStatus(err), fmt.Errorf("store profile: %v", err)
+	}
+	if mirrorJob != nil {
+		ctrl.mirror.Upload(mirrorJob)
 	}
 	ctrl.statsInc("ingest")
 	ctrl.statsInc("ingest:" + ip.spyName)
 	k := *ip.storageKey
-	ctrl.appStats.Add(hashString(k.AppName()))
-	w.WriteHeader(200)
+	ctrl.trackApp(k.Tenant(), k.AppName())
+	ctrl.appNames.seen(k.Tenant(), k.AppName())
+	ctrl.publishIngestEvent(k.Tenant(), appName, p.bodySize, t)
+	return http.StatusOK, nil
+}
+
+// outsideRetention tells whether a profile that ends at until is entirely older than the retention window
+func outsideRetention(until, now time.Time, retention time.Duration) bool {
+	return retention > 0 && until.Before(now.Add(-retention))
 }
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// maxIngestBatchProfiles bounds the amount of work a single batch request can cause
+	maxIngestBatchProfiles = 1000
+	// maxIngestBatchBodySize bounds the memory a single batch request can use, the whole body is decoded at once
+	maxIngestBatchBodySize = 64 << 20
+)
+
+// ingestBatchItemJSON mirrors query parameters of /ingest, data is the request body
+// of a single profile (base64 encoded in JSON, see readLengthPrefixedBatch for the other format)
+type ingestBatchItemJSON struct {
+	Name            string `json:"name"`
+	From            int64  `json:"from,omitempty"`
+	Until           int64  `json:"until,omitempty"`
+	Format          string `json:"format,omitempty"`
+	SpyName         string `json:"spyName,omitempty"`
+	SampleRate      uint32 `json:"sampleRate,omitempty"`
+	Units           string `json:"units,omitempty"`
+	AggregationType string `json:"aggregationType,omitempty"`
+	Data            []byte `json:"data"`
+}
+
+type ingestBatchJSON struct {
+	Profiles []ingestBatchItemJSON `json:"profiles"`
+}
+
+type ingestBatchResultJSON struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (item *ingestBatchItemJSON) query() url.Values {
+	q := url.Values{}
+	q.Set("name", item.Name)
+	if item.From != 0 {
+		q.Set("from", strconv.FormatInt(item.From, 10))
+	}
+	if item.Until != 0 {
+		q.Set("until", strconv.FormatInt(item.Until, 10))
+	}
+	if item.SampleRate != 0 {
+		q.Set("sampleRate", strconv.FormatUint(uint64(item.SampleRate), 10))
+	}
+	for k, v := range map[string]string{
+		"format":          item.Format,
+		"spyName":         item.SpyName,
+		"units":           item.Units,
+		"aggregationType": item.AggregationType,
+	} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
+
+// ingestBatchHandler stores multiple profiles sent in a single request, either as JSON or length-prefixed
+// (see readLengthPrefixedBatch). All profiles are validated and parsed before the first one is stored:
+// if any of them is invalid, none is stored and the request fails with the status of the first invalid one.
+// Storage failures can still leave a batch partially stored, the response has a result for each of the
+// profiles, in the same order, and the number of stored profiles, which is less than their count then.
+func (ctrl *Controller) ingestBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var items []ingestBatchItemJSON
+	body := &countingReader{r: r.Body}
+	limited := http.MaxBytesReader(w, ioutil.NopCloser(body), maxIngestBatchBodySize)
+	if r.Header.Get("Content-Type") == lengthPrefixedBatchContentType {
+		items, err = readLengthPrefixedBatch(limited)
+	} else {
+		var batch ingestBatchJSON
+		err = json.NewDecoder(limited).Decode(&batch)
+		items = batch.Profiles
+	}
+	if err != nil {
+		// MaxBytesReader reads one byte past the limit to tell it's exceeded
+		if body.n > maxIngestBatchBodySize {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("batch body is larger than %d bytes", maxIngestBatchBodySize))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err))
+		return
+	}
+	if len(items) > maxIngestBatchProfiles {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("batch has %d profiles, max allowed is %d", len(items), maxIngestBatchProfiles))
+		return
+	}
+
+	client := ctrl.clientIP(r)
+	results := make([]ingestBatchResultJSON, len(items))
+	profiles := make([]*ingestedProfile, len(items))
+	invalid := -1
+	for i := range items {
+		item := &items[i]
+		results[i].Status = http.StatusOK
+		ip, err := ingestParamsFromQuery(item.query(), "", tenant, ctrl.cfg.MaxKeyLabels)
+		if err != nil {
+			results[i] = ingestBatchResultJSON{Status: http.StatusBadRequest, Error: err.Error()}
+		} else if profiles[i], results[i].Status, err = ctrl.prepareIngest(ip, bytes.NewReader(item.Data), client); err != nil {
+			results[i].Error = err.Error()
+		}
+		if results[i].Error != "" && invalid == -1 {
+			invalid = i
+		}
+	}
+	ctrl.statsInc("ingest-batch")
+
+	if invalid != -1 {
+		for i := range results {
+			if results[i].Error == "" {
+				results[i] = ingestBatchResultJSON{Status: http.StatusFailedDependency, Error: "not stored because the batch has invalid profiles"}
+			}
+		}
+		writeIngestBatchResponse(w, results[invalid].Status, &ingestBatchResponseJSON{
+			Error:   &errorBodyJSON{Message: fmt.Sprintf("profile %d: %s", invalid, results[invalid].Error), Code: results[invalid].Status},
+			Results: results,
+		})
+		return
+	}
+
+	stored := 0
+	for i, p := range profiles {
+		// nil profiles are accepted but not stored on purpose, e.g sampled out ones
+		if p != nil {
+			if status, err := ctrl.storeIngested(p, client); err != nil {
+				results[i] = ingestBatchResultJSON{Status: status, Error: err.Error()}
+				continue
+			}
+		}
+		stored++
+	}
+	writeIngestBatchResponse(w, http.StatusOK, &ingestBatchResponseJSON{Results: results, Stored: stored})
+}
+
+type ingestBatchResponseJSON struct {
+	// Error is only set when the batch was rejected, in the same format as other API errors
+	Error   *errorBodyJSON          `json:"error,omitempty"`
+	Results []ingestBatchResultJSON `json:"results"`
+	Stored  int                     `json:"stored"`
+}
+
+func writeIngestBatchResponse(w http.ResponseWriter, status int, res *ingestBatchResponseJSON) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// lengthPrefixedBatchContentType is the content type of length-prefixed batches
+const lengthPrefixedBatchContentType = "binary/octet-stream+batch"
+
+// readLengthPrefixedBatch reads a batch of profiles that are sent without JSON and base64 encoding of
+// their data. Every profile is a JSON encoded ingestBatchItemJSON without data followed by the data,
+// both prefixed with their length as a 4 bytes big endian integer:
+//
+//	<header length><header JSON><data length><data>...
+func readLengthPrefixedBatch(r io.Reader) ([]ingestBatchItemJSON, error) {
+	var items []ingestBatchItemJSON
+	br := bufio.NewReader(r)
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return items, nil
+		}
+		if len(items) == maxIngestBatchProfiles {
+			return nil, fmt.Errorf("batch has more than %d profiles", maxIngestBatchProfiles)
+		}
+		header, err := readLengthPrefixed(br)
+		if err != nil {
+			return nil, fmt.Errorf("profile %d header: %v", len(items), err)
+		}
+		var item ingestBatchItemJSON
+		if err = json.Unmarshal(header, &item); err != nil {
+			return nil, fmt.Errorf("profile %d header: %v", len(items), err)
+		}
+		if item.Data, err = readLengthPrefixed(br); err != nil {
+			return nil, fmt.Errorf("profile %d data: %v", len(items), err)
+		}
+		items = append(items, item)
+	}
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	// the body is bounded anyway, this keeps corrupted lengths from allocating a lot
+	if n > maxIngestBatchBodySize {
+		return nil, fmt.Errorf("length %d is larger than the max batch size", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/ingest/batch", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("stores profiles and reports failures per profile", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			profiles := []ingestBatchItemJSON{
+				{Name: "foo.cpu", From: 1600000000, Until: 1600000010, Data: []byte("a;b 1\n")},
+				{Name: "foo.alloc_objects", From: 1600000000, Until: 1600000010, Data: []byte("c 2\n"), Units: "objects"},
+				{Name: "foo.inuse_space", AggregationType: "foo", Data: []byte("d 3\n")},
+			}
+			ingestBatch := func(profiles []ingestBatchItemJSON) (int, ingestBatchResponseJSON) {
+				b, _ := json.Marshal(ingestBatchJSON{Profiles: profiles})
+				w := httptest.NewRecorder()
+				c.ingestBatchHandler(w, httptest.NewRequest("POST", "/ingest/batch", bytes.NewReader(b)))
+				var res ingestBatchResponseJSON
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				return w.Code, res
+			}
+			get := func(name string) *storage.GetOutput {
+				key, _ := storage.ParseKey(name)
+				gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000010, 0), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				return gOut
+			}
+
+			// a batch with an invalid profile isn't stored at all
+			code, res := ingestBatch(profiles)
+			Expect(code).To(Equal(400))
+			Expect(res.Error.Code).To(Equal(400))
+			Expect(res.Stored).To(BeZero())
+			Expect(res.Results).To(HaveLen(3))
+			Expect(res.Results[0].Status).To(Equal(424))
+			Expect(res.Results[1].Status).To(Equal(424))
+			Expect(res.Results[2].Status).To(Equal(400))
+			Expect(res.Results[2].Error).ToNot(BeEmpty())
+			Expect(get("foo.cpu{}")).To(BeNil())
+
+			code, res = ingestBatch(profiles[:2])
+			Expect(code).To(Equal(200))
+			Expect(res.Error).To(BeNil())
+			Expect(res.Stored).To(Equal(2))
+			Expect(res.Results).To(Equal([]ingestBatchResultJSON{{Status: 200}, {Status: 200}}))
+			gOut := get("foo.alloc_objects{}")
+			Expect(gOut.Tree.String()).To(Equal("\"c\" 2\n"))
+			Expect(gOut.Units).To(Equal("objects"))
+		})
+
+		It("stores length-prefixed batches", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			var b bytes.Buffer
+			frame := func(p []byte) {
+				Expect(binary.Write(&b, binary.BigEndian, uint32(len(p)))).To(Succeed())
+				b.Write(p)
+			}
+			for _, name := range []string{"foo.cpu", "bar.cpu"} {
+				header, _ := json.Marshal(ingestBatchItemJSON{Name: name, From: 1600000000, Until: 1600000010})
+				frame(header)
+				frame([]byte("a;b 1\n"))
+			}
+			r := httptest.NewRequest("POST", "/ingest/batch", bytes.NewReader(b.Bytes()))
+			r.Header.Set("Content-Type", lengthPrefixedBatchContentType)
+			w := httptest.NewRecorder()
+			c.ingestBatchHandler(w, r)
+			Expect(w.Code).To(Equal(200))
+			var res ingestBatchResponseJSON
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Stored).To(Equal(2))
+
+			key, _ := storage.ParseKey("bar.cpu{}")
+			gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000010, 0), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut.Tree.String()).To(Equal("\"a;b\" 1\n"))
+
+			// a truncated frame
+			r = httptest.NewRequest("POST", "/ingest/batch", bytes.NewReader(b.Bytes()[:b.Len()-1]))
+			r.Header.Set("Content-Type", lengthPrefixedBatchContentType)
+			w = httptest.NewRecorder()
+			c.ingestBatchHandler(w, r)
+			Expect(w.Code).To(Equal(400))
+		})
+
+		It("rejects bodies larger than the limit", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			b, _ := json.Marshal(ingestBatchJSON{Profiles: []ingestBatchItemJSON{
+				{Name: "foo.cpu", Data: bytes.Repeat([]byte("a"), maxIngestBatchBodySize)},
+			}})
+			w := httptest.NewRecorder()
+			c.ingestBatchHandler(w, httptest.NewRequest("POST", "/ingest/batch", bytes.NewReader(b)))
+			Expect(w.Code).To(Equal(413))
+
+			w = httptest.NewRecorder()
+			c.ingestBatchHandler(w, httptest.NewRequest("POST", "/ingest/batch", bytes.NewBufferString("{")))
+			Expect(w.Code).To(Equal(400))
+		})
+	})
+})
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// maxEnvelopeLabels caps labels attached per upload, every distinct label set is a separate series
+const maxEnvelopeLabels = 16
+
+// ingestEnvelope wraps a profile together with labels, so that agents can attach dynamic labels
+// (e.g a git commit) without building the key themselves. Profile is base64 encoded in JSON,
+// its format is set with query parameters as for plain uploads.
+type ingestEnvelope struct {
+	Labels map[string]string `json:"labels"`
+	// Metadata are tags of this upload only, see storage.PutInput
+	Metadata map[string]string `json:"metadata"`
+	Profile  []byte            `json:"profile"`
+}
+
+func isIngestEnvelope(r *http.Request) bool {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt == "application/json"
+}
+
+// readIngestEnvelope decodes the envelope and merges its labels and metadata into ingest parameters,
+// envelope labels override labels of the same name set in the key. Keys with more than maxLabels
+// labels after the merge are rejected, as they are by parseIngestKey.
+func readIngestEnvelope(r io.Reader, ip *ingestParams, maxLabels int) ([]byte, error) {
+	var e ingestEnvelope
+	if err := json.NewDecoder(r).Decode(&e); err != nil {
+		return nil, fmt.Errorf("parse envelope: %v", err)
+	}
+	if len(e.Labels) > maxEnvelopeLabels {
+		return nil, fmt.Errorf("too many labels: %d, max is %d", len(e.Labels), maxEnvelopeLabels)
+	}
+	for name, value := range e.Labels {
+		if !storage.IsValidLabelName(name) {
+			return nil, fmt.Errorf("invalid label name: %q", name)
+		}
+		if !storage.IsValidLabelValue(value) {
+			return nil, fmt.Errorf("invalid value of label %s: %q", name, value)
+		}
+	}
+	if len(e.Metadata) > 0 {
+		md := make(map[string]string, len(ip.metadata)+len(e.Metadata))
+		for name, value := range ip.metadata {
+			md[name] = value
+		}
+		for name, value := range e.Metadata {
+			md[name] = value
+		}
+		if err := validateUploadMetadata(md); err != nil {
+			return nil, fmt.Errorf("metadata: %v", err)
+		}
+		ip.metadata = md
+	}
+	for name, value := range e.Labels {
+		ip.storageKey.SetLabel(name, value)
+	}
+	if err := ip.storageKey.CheckMaxLabels(maxLabels); err != nil {
+		ingestRejectedKeys.Inc()
+		return nil, err
+	}
+	return e.Profile, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("ingest envelope", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		ingestEnvelopeJSON := func(c *Controller, e ingestEnvelope) int {
+			b, err := json.Marshal(e)
+			Expect(err).ToNot(HaveOccurred())
+			r := httptest.NewRequest("POST", "/ingest?name=foo.cpu{env=prod,commit=old}&from=1600000010&until=1600000019", bytes.NewReader(b))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, r)
+			return w.Code
+		}
+
+		It("merges envelope labels with labels of the key", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ingestEnvelopeJSON(c, ingestEnvelope{
+				Labels:  map[string]string{"commit": "abc123", "feature.flag": "on"},
+				Profile: []byte("a;b 2\n"),
+			})).To(Equal(200))
+
+			key, _ := storage.ParseKey("foo.cpu{env=prod,commit=abc123,feature.flag=on}")
+			gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000030, 0), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut).ToNot(BeNil())
+			Expect(gOut.Tree.String()).To(Equal("\"a;b\" 2\n"))
+		})
+
+		It("rejects invalid labels", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, labels := range []map[string]string{
+				{"__name__": "bar"},
+				{"1commit": "abc"},
+				{"commit": "a,b=c"},
+			} {
+				Expect(ingestEnvelopeJSON(c, ingestEnvelope{Labels: labels, Profile: []byte("a;b 2\n")})).To(Equal(400))
+			}
+
+			tooMany := map[string]string{}
+			for i := 0; i <= maxEnvelopeLabels; i++ {
+				tooMany[fmt.Sprintf("l%d", i)] = "v"
+			}
+			Expect(ingestEnvelopeJSON(c, ingestEnvelope{Labels: tooMany, Profile: []byte("a;b 2\n")})).To(Equal(400))
+		})
+
+		It("applies the label limit to the merged key", func() {
+			(*cfg).Server.MaxKeyLabels = 2
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			// overriding a label of the key doesn't add one
+			Expect(ingestEnvelopeJSON(c, ingestEnvelope{
+				Labels:  map[string]string{"commit": "abc123"},
+				Profile: []byte("a;b 2\n"),
+			})).To(Equal(200))
+			Expect(ingestEnvelopeJSON(c, ingestEnvelope{
+				Labels:  map[string]string{"feature.flag": "on"},
+				Profile: []byte("a;b 2\n"),
+			})).To(Equal(400))
+		})
+	})
+})
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+var ingestQueueMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pyroscope_ingest_queue_messages_total",
+	Help: "number of messages consumed from the ingest queue, by result",
+}, []string{"result"})
+
+// ingestSource delivers profiles to the server in addition to the HTTP API, e.g from a message queue.
+// Sources parse nothing themselves, every message goes through ingestMessage.
+type ingestSource interface {
+	// Start connects to the source and delivers messages to handle in the background
+	Start(handle func(msg []byte) error) error
+	// Stop stops consuming, messages that are already delivered are processed first
+	Stop() error
+}
+
+func newIngestSources(cfg ingestQueueConfig) ([]ingestSource, error) {
+	if cfg.url == "" {
+		return nil, nil
+	}
+	if cfg.subject == "" {
+		return nil, errors.New("ingest queue subject can't be empty")
+	}
+	return []ingestSource{&natsIngestSource{cfg: cfg, done: make(chan struct{})}}, nil
+}
+
+type ingestQueueConfig struct {
+	url     string
+	subject string
+	group   string
+}
+
+// natsIngestSource consumes a NATS subject. Messages are pulled one by one,
+// so the server drains the subject at its own pace and NATS buffers the rest.
+type natsIngestSource struct {
+	cfg  ingestQueueConfig
+	nc   *nats.Conn
+	sub  *nats.Subscription
+	done chan struct{}
+}
+
+func (s *natsIngestSource) Start(handle func([]byte) error) error {
+	nc, err := nats.Connect(s.cfg.url, nats.Name("pyroscope-server"), nats.MaxReconnects(-1))
+	if err != nil {
+		return fmt.Errorf("connect to %s: %v", s.cfg.url, err)
+	}
+	sub, err := nc.QueueSubscribeSync(s.cfg.subject, s.cfg.group)
+	if err != nil {
+		nc.Close()
+		return fmt.Errorf("subscribe to %s: %v", s.cfg.subject, err)
+	}
+	s.nc, s.sub = nc, sub
+	go s.run(handle)
+	return nil
+}
+
+func (s *natsIngestSource) run(handle func([]byte) error) {
+	defer close(s.done)
+	for {
+		msg, err := s.sub.NextMsg(time.Minute)
+		switch {
+		case err == nats.ErrTimeout:
+			continue
+		case err != nil:
+			// the subscription is closed on Stop
+			if err != nats.ErrBadSubscription && err != nats.ErrConnectionClosed {
+				logrus.WithError(err).Error("failed to consume the ingest queue")
+			}
+			return
+		}
+		if err := handle(msg.Data); err != nil {
+			ingestQueueMessages.WithLabelValues("error").Inc()
+			logrus.WithFields(logrus.Fields{
+				"subject": msg.Subject,
+				"err":     err,
+			}).Error("failed to ingest a message from the queue")
+			continue
+		}
+		ingestQueueMessages.WithLabelValues("ok").Inc()
+	}
+}
+
+func (s *natsIngestSource) Stop() error {
+	if s.nc == nil {
+		return nil
+	}
+	s.nc.Close()
+	<-s.done
+	return nil
+}
+
+func (ctrl *Controller) startIngestSources() error {
+	for i, src := range ctrl.ingestSources {
+		if err := src.Start(ctrl.ingestMessage); err != nil {
+			for _, started := range ctrl.ingestSources[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctrl *Controller) stopIngestSources() {
+	var wg sync.WaitGroup
+	for _, src := range ctrl.ingestSources {
+		wg.Add(1)
+		go func(src ingestSource) {
+			defer wg.Done()
+			if err := src.Stop(); err != nil {
+				logrus.WithError(err).Error("failed to stop ingest source")
+			}
+		}(src)
+	}
+	wg.Wait()
+}
+
+// ingestMessage ingests a profile delivered by an ingest source. A message is the query string
+// of an /ingest request, a newline and the request body, e.g "name=myapp.cpu&from=1600000000&until=1600000010\nfoo;bar 1".
+// The tenant is set with the tenant parameter instead of a header.
+func (ctrl *Controller) ingestMessage(msg []byte) error {
+	i := bytes.IndexByte(msg, '\n')
+	if i < 0 {
+		return errors.New("message has no query string line")
+	}
+	q, err := url.ParseQuery(string(msg[:i]))
+	if err != nil {
+		return fmt.Errorf("parse query string: %v", err)
+	}
+	tenant := q.Get("tenant")
+	if !validTenantID(tenant) {
+		return fmt.Errorf("invalid tenant %q", tenant)
+	}
+	ip, err := ingestParamsFromQuery(q, "", tenant, ctrl.cfg.MaxKeyLabels)
+	if err != nil {
+		return err
+	}
+	_, err = ctrl.ingest(ip, bytes.NewReader(msg[i+1:]), "queue")
+	return err
+}
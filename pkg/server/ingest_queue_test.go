@@ -0,0 +1,46 @@
+package server
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("ingest queue", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("ingests messages the same way as /ingest requests", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.ingestMessage([]byte("name=foo.cpu&from=1600000010&until=1600000019&spyName=gospy&tenant=t1\na;b 2\na 1\n"))).To(Succeed())
+
+			key, _ := storage.ParseKey("foo.cpu")
+			key.SetTenant("t1")
+			gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000030, 0), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut).ToNot(BeNil())
+			Expect(gOut.Tree.String()).To(Equal("\"a\" 1\n\"a;b\" 2\n"))
+			Expect(gOut.SpyName).To(Equal("gospy"))
+		})
+
+		It("rejects malformed messages", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(c.ingestMessage([]byte("name=foo.cpu"))).ToNot(Succeed())
+			Expect(c.ingestMessage([]byte("name=foo.cpu&aggregationType=foo\na 1"))).ToNot(Succeed())
+			Expect(c.ingestMessage([]byte("name=foo.cpu&tenant=a/b\na 1"))).ToNot(Succeed())
+		})
+	})
+})
@@ -4,16 +4,22 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	"github.com/avast/retry-go"
 	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
 	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
 	"github.com/pyroscope-io/pyroscope/pkg/testing"
+	"github.com/pyroscope-io/pyroscope/pkg/util/compression"
 )
 
 func retryUntilServerIsUp(urlStr string) {
@@ -89,6 +95,7 @@ var _ = Describe("server", func() {
 					Expect(gOut.Tree.String()).To(Equal("\"foo;bar\" 2\n\"foo;baz\" 3\n"))
 
 					c.Stop()
+					Expect(s.Close()).To(Succeed())
 
 					close(done)
 				}, 2)
@@ -153,6 +160,231 @@ var _ = Describe("server", func() {
 
 				ItCorrectlyParsesIncomingData()
 			})
+
+			Context("columnar format", func() {
+				BeforeEach(func() {
+					buf = bytes.NewBuffer([]byte("\x01\x03\x03foo\x03bar\x03baz\x03\x00\x01\x01\x00\x01\x02\x02\x01\x02\x02\x03"))
+					format = "columnar"
+					contentType = ""
+				})
+
+				ItCorrectlyParsesIncomingData()
+			})
+
+			Context("columnar format", func() {
+				BeforeEach(func() {
+					buf = bytes.NewBuffer([]byte("\x01\x03\x03foo\x03bar\x03baz\x03\x00\x01\x01\x00\x01\x02\x02\x01\x02\x02\x03"))
+					format = ""
+					contentType = "binary/octet-stream+columnar"
+				})
+
+				ItCorrectlyParsesIncomingData()
+			})
+		})
+	})
+})
+
+var _ = Describe("ingest label limits", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("rejects keys with more labels than allowed", func() {
+			(*cfg).Server.MaxKeyLabels = 2
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			ingest := func(name string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				q := "/ingest?from=1600000000&until=1600000010&name=" + url.QueryEscape(name)
+				c.ingestHandler(w, httptest.NewRequest("POST", q, strings.NewReader("foo;bar 1")))
+				return w
+			}
+			Expect(ingest("foo.cpu{a=1,b=2}").Code).To(Equal(200))
+			w := ingest("foo.cpu{a=1,b=2,c=3}")
+			Expect(w.Code).To(Equal(400))
+			Expect(w.Body.String()).To(ContainSubstring("too many labels: at most 2 are allowed"))
+		})
+	})
+})
+
+var _ = Describe("ingest without a sample rate", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		ingest := func(c *Controller, q string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			q = "/ingest?from=1600000000&until=1600000010&name=foo.cpu" + q
+			c.ingestHandler(w, httptest.NewRequest("POST", q, strings.NewReader("foo;bar 1")))
+			return w
+		}
+		sampleRate := func(s *storage.Storage) uint32 {
+			sk, _ := storage.ParseKey("foo.cpu")
+			gOut, err := s.Get(&storage.GetInput{
+				StartTime: time.Unix(1600000000, 0),
+				EndTime:   time.Unix(1600000010, 0),
+				Key:       sk,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut).ToNot(BeNil())
+			return gOut.SampleRate
+		}
+
+		It("applies the default sample rate", func() {
+			(*cfg).Server.IngestDefaultSampleRate = 250
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ingest(c, "").Code).To(Equal(200))
+			Expect(sampleRate(s)).To(Equal(uint32(250)))
+		})
+
+		It("rejects profiles with reject policy", func() {
+			(*cfg).Server.MissingSampleRatePolicy = "reject"
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := ingest(c, "")
+			Expect(w.Code).To(Equal(400))
+			Expect(w.Body.String()).To(ContainSubstring("doesn't specify a sample rate"))
+			Expect(ingest(c, "&sampleRate=0").Code).To(Equal(400))
+			Expect(ingest(c, "&sampleRate=99").Code).To(Equal(200))
+			Expect(sampleRate(s)).To(Equal(uint32(99)))
+		})
+
+		It("rejects unknown policies", func() {
+			(*cfg).Server.MissingSampleRatePolicy = "guess"
+			_, err := New(&(*cfg).Server, nil)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("ingest min samples", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("drops profiles with fewer samples than the minimum of their type", func() {
+			(*cfg).Server.MinIngestSamples = 5
+			(*cfg).Server.MinIngestSamplesOverrides = map[string]string{"inuse_space": "1024"}
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			stored := func(name, body string) bool {
+				w := httptest.NewRecorder()
+				q := "/ingest?from=1600000000&until=1600000010&name=" + name
+				c.ingestHandler(w, httptest.NewRequest("POST", q, strings.NewReader(body)))
+				Expect(w.Code).To(Equal(200))
+				sk, _ := storage.ParseKey(name)
+				gOut, err := s.Get(&storage.GetInput{
+					StartTime: time.Unix(1600000000, 0),
+					EndTime:   time.Unix(1600000010, 0),
+					Key:       sk,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				return gOut != nil
+			}
+			Expect(stored("foo.cpu", "a;b 2\na;c 2\n")).To(BeFalse())
+			Expect(stored("bar.cpu", "a;b 2\na;c 3\n")).To(BeTrue())
+			Expect(stored("foo.inuse_space", "a;b 1000\n")).To(BeFalse())
+			Expect(stored("bar.inuse_space", "a;b 2048\n")).To(BeTrue())
+		})
+
+		It("rejects invalid overrides", func() {
+			(*cfg).Server.MinIngestSamplesOverrides = map[string]string{"cpu": "-1"}
+			_, err := New(&(*cfg).Server, nil)
+			Expect(err).To(MatchError(ContainSubstring("min-ingest-samples-overrides")))
+		})
+	})
+})
+
+var _ = Describe("compressed ingest", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("decompresses bodies according to Content-Encoding", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			ingest := func(name, encoding string) int {
+				body := []byte("a;b 2\na;c 3\n")
+				if compression.Validate(encoding) == nil {
+					body, err = compression.Compress(encoding, body)
+					Expect(err).ToNot(HaveOccurred())
+				}
+				r := httptest.NewRequest("POST", "/ingest?from=1600000000&until=1600000010&name="+name, bytes.NewReader(body))
+				r.Header.Set("Content-Encoding", encoding)
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				return w.Code
+			}
+			samples := func(name string) uint64 {
+				sk, _ := storage.ParseKey(name)
+				gOut, err := s.Get(&storage.GetInput{
+					StartTime: time.Unix(1600000000, 0),
+					EndTime:   time.Unix(1600000010, 0),
+					Key:       sk,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut).ToNot(BeNil())
+				return gOut.Tree.Samples()
+			}
+
+			Expect(ingest("gzipped", compression.Gzip)).To(Equal(200))
+			Expect(samples("gzipped")).To(Equal(uint64(5)))
+			if compression.Validate(compression.Zstd) == nil {
+				Expect(ingest("zstd", compression.Zstd)).To(Equal(200))
+				Expect(samples("zstd")).To(Equal(uint64(5)))
+			}
+			Expect(ingest("brotli", "br")).To(Equal(http.StatusUnsupportedMediaType))
+		})
+	})
+})
+
+var _ = Describe("pprof ingest", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("keeps source locations of frames when asked to", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			t := tree.New()
+			t.Insert([]byte("main main.go:3;foo foo.go:10"), 2)
+			t.Insert([]byte("main main.go:3;foo foo.go:12"), 3)
+			var body bytes.Buffer
+			Expect(convert.WriteTree("pprof", t, &body)).To(Succeed())
+
+			ingest := func(name, q string) {
+				r := httptest.NewRequest("POST", "/ingest?format=pprof&from=1600000000&until=1600000010&name="+name+q, bytes.NewReader(body.Bytes()))
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				Expect(w.Code).To(Equal(200))
+			}
+			render := func(name, q string) string {
+				r := httptest.NewRequest("GET", "/render?format=collapsed&from=1600000000&until=1600000010&name="+name+q, nil)
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, r)
+				Expect(w.Code).To(Equal(200))
+				return w.Body.String()
+			}
+
+			ingest("lines.cpu", "&locations=true")
+			ingest("functions.cpu", "")
+			Expect(render("lines.cpu", "&locations=true")).To(Equal("main main.go:3;foo foo.go:10 2\nmain main.go:3;foo foo.go:12 3\n"))
+			Expect(render("lines.cpu", "")).To(Equal("main;foo 5\n"))
+			Expect(render("functions.cpu", "&locations=true")).To(Equal("main;foo 5\n"))
 		})
 	})
 })
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pyroscope_http_request_duration_seconds",
+	Help:    "duration of HTTP requests by route and status code class",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "code"})
+
+// instrumentRoute records request durations of the route. Routes are the patterns handlers are
+// registered with rather than request paths, so that cardinality is bounded, e.g every UI asset is "/".
+func instrumentRoute(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h(sw, r)
+		httpRequestDuration.WithLabelValues(route, statusClass(sw.code)).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statusClass returns the class of the status code, e.g 4xx
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// statusWriter remembers the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush is needed for streaming handlers, see ingestStreamHandler
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("route instrumentation", func() {
+	It("groups status codes into classes", func() {
+		Expect(statusClass(200)).To(Equal("2xx"))
+		Expect(statusClass(404)).To(Equal("4xx"))
+		Expect(statusClass(503)).To(Equal("5xx"))
+		Expect(statusClass(0)).To(Equal("unknown"))
+	})
+
+	testing.WithConfig(func(cfg **config.Config) {
+		It("records request durations by route and status code class", func() {
+			(*cfg).Server.DisableUI = true
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			mux := http.NewServeMux()
+			c.registerHandlers(mux)
+
+			for _, path := range []string{"/labels", "/label-values?label=foo", "/render?name=foo{"} {
+				mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+
+			w := httptest.NewRecorder()
+			promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(w.Body.String()).To(ContainSubstring(`pyroscope_http_request_duration_seconds_count{code="2xx",route="/labels"}`))
+			Expect(w.Body.String()).To(ContainSubstring(`pyroscope_http_request_duration_seconds_count{code="2xx",route="/label-values"}`))
+			Expect(w.Body.String()).To(ContainSubstring(`pyroscope_http_request_duration_seconds_count{code="4xx",route="/render"}`))
+		})
+	})
+})
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+const (
+	defaultKeysLimit = 100
+	maxKeysLimit     = 1000
+)
+
+type keyJSON struct {
+	Key string `json:"key"`
+	// LastSeen is the end of the most recent data in unix seconds, 0 if there's no data
+	LastSeen int64 `json:"lastSeen"`
+}
+
+type keysJSON struct {
+	Keys []keyJSON `json:"keys"`
+	// Truncated is true if more keys match than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// keysHandler lists stored series matching a matcher (e.g myapp.cpu{env=prod}), ordered by name.
+// It's a diagnostic for queries that unexpectedly return nothing: it shows what's actually
+// stored, app aliases aren't resolved.
+func (ctrl *Controller) keysHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	matcher, err := storage.ParseKey(q.Get("matcher"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("matcher: %v", err))
+		return
+	}
+	matcher.SetTenant(tenant)
+	limit := defaultKeysLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxKeysLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q, must be between 1 and %d", v, maxKeysLimit))
+			return
+		}
+	}
+
+	keys, truncated, err := ctrl.s.Keys(matcher, limit)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve keys: %v", err))
+		return
+	}
+	res := keysJSON{Keys: make([]keyJSON, len(keys)), Truncated: truncated}
+	for i, k := range keys {
+		// the tenant is implied by the request
+		k.Key.SetTenant("")
+		res.Keys[i].Key = k.Key.Normalized()
+		if !k.LastSeen.IsZero() {
+			res.Keys[i].LastSeen = k.LastSeen.Unix()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
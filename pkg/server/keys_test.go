@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/keys", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("lists stored keys matching the matcher", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, name := range []string{"foo.cpu{env=prod,host=a}", "foo.cpu{env=prod,host=b}", "foo.cpu{env=dev}", "bar.cpu{env=prod}"} {
+				w := httptest.NewRecorder()
+				c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?from=1600000000&until=1600000010&name="+name, strings.NewReader("a;b 1\n")))
+				Expect(w.Code).To(Equal(200))
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/ingest?from=1600000000&until=1600000010&name=foo.cpu{env=prod}", strings.NewReader("a;b 1\n"))
+			r.Header.Set(tenantHeader, "team-a")
+			c.ingestHandler(w, r)
+			Expect(w.Code).To(Equal(200))
+
+			keys := func(q string) (int, keysJSON) {
+				w := httptest.NewRecorder()
+				c.keysHandler(w, httptest.NewRequest("GET", "/keys?"+q, nil))
+				var res keysJSON
+				if w.Code == http.StatusOK {
+					Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				}
+				return w.Code, res
+			}
+
+			code, res := keys("matcher=foo.cpu{env=prod}")
+			Expect(code).To(Equal(200))
+			Expect(res).To(Equal(keysJSON{Keys: []keyJSON{
+				{Key: "foo.cpu{env=prod,host=a}", LastSeen: 1600000010},
+				{Key: "foo.cpu{env=prod,host=b}", LastSeen: 1600000010},
+			}}))
+
+			_, res = keys("matcher=foo.cpu{}&limit=2")
+			Expect(res.Keys).To(HaveLen(2))
+			Expect(res.Truncated).To(BeTrue())
+
+			_, res = keys("matcher=foo.cpu{env=staging}")
+			Expect(res.Keys).To(BeEmpty())
+
+			code, _ = keys("matcher=foo.cpu{env=prod}&limit=5000")
+			Expect(code).To(Equal(http.StatusBadRequest))
+			code, _ = keys("matcher=foo{")
+			Expect(code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -5,30 +5,42 @@ import (
 	"net/http"
 )
 
-func (ctrl *Controller) labelsHandler(w http.ResponseWriter, _ *http.Request) {
+func (ctrl *Controller) labelsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
 	res := []string{}
-	ctrl.s.GetKeys(func(k string) bool {
+	ctrl.s.GetKeys(tenant, func(k string) bool {
 		res = append(res, k)
 		return true
 	})
 	b, err := json.Marshal(res)
 	if err != nil {
-		panic(err) // TODO: handle
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
 	}
 	w.WriteHeader(200)
 	w.Write(b)
 }
 
 func (ctrl *Controller) labelValuesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
 	res := []string{}
 	labelName := r.URL.Query().Get("label")
-	ctrl.s.GetValues(labelName, func(v string) bool {
+	ctrl.s.GetValues(tenant, labelName, func(v string) bool {
 		res = append(res, v)
 		return true
 	})
 	b, err := json.Marshal(res)
 	if err != nil {
-		panic(err) // TODO: handle
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
 	}
 	w.WriteHeader(200)
 	w.Write(b)
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// maxUploadMetadata caps metadata tags per upload, every upload stores its own copy of them
+const maxUploadMetadata = 16
+
+// traceIDRe matches trace IDs, e.g hex encoded OpenTelemetry and Zipkin ones. They're a part of
+// trace index keys, so separators aren't allowed
+var traceIDRe = regexp.MustCompile(`^[0-9A-Za-z_-]{1,128}$`)
+
+func validateTraceID(id string) error {
+	if !traceIDRe.MatchString(id) {
+		return fmt.Errorf("invalid trace ID: %q", id)
+	}
+	return nil
+}
+
+// parseUploadMetadata parses upload metadata tags in the same format as key labels,
+// e.g buildID=1234,env=prod. An empty string means no metadata.
+func parseUploadMetadata(v string) (map[string]string, error) {
+	if v == "" {
+		return nil, nil
+	}
+	md := make(map[string]string)
+	for _, tag := range strings.Split(v, ",") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tag %q, expected name=value", tag)
+		}
+		md[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	if err := validateUploadMetadata(md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// validateUploadMetadata checks metadata tags with the same rules as labels
+func validateUploadMetadata(md map[string]string) error {
+	if len(md) > maxUploadMetadata {
+		return fmt.Errorf("too many tags: %d, max is %d", len(md), maxUploadMetadata)
+	}
+	for name, value := range md {
+		if !storage.IsValidLabelName(name) {
+			return fmt.Errorf("invalid tag name: %q", name)
+		}
+		if !storage.IsValidLabelValue(value) {
+			return fmt.Errorf("invalid value of tag %s: %q", name, value)
+		}
+		if name == storage.TraceIDMetadata {
+			if err := validateTraceID(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
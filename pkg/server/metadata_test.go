@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("upload metadata", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("renders only uploads with matching metadata", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.cpu&from=1600000000&until=1600000010&metadata=buildID=1", strings.NewReader("a;b 1\na;c 2\n")))
+			Expect(w.Code).To(Equal(200))
+
+			b, err := json.Marshal(ingestEnvelope{
+				Metadata: map[string]string{"buildID": "2"},
+				Profile:  []byte("a;b 5\na;c 2\n"),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			r := httptest.NewRequest("POST", "/ingest?name=foo.cpu&from=1600000010&until=1600000020", bytes.NewReader(b))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			c.ingestHandler(w, r)
+			Expect(w.Code).To(Equal(200))
+
+			render := func(metadata string) string {
+				w := httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?format=pprof&name=foo.cpu&from=1600000000&until=1600000020&metadata="+metadata, nil))
+				Expect(w.Code).To(Equal(200))
+				t, err := convert.ReadTree("pprof", w.Body)
+				Expect(err).ToNot(HaveOccurred())
+				return t.String()
+			}
+			Expect(render("buildID=1")).To(Equal("\"a;b\" 1\n\"a;c\" 2\n"))
+			Expect(render("buildID=2")).To(Equal("\"a;b\" 5\n\"a;c\" 2\n"))
+			Expect(render("")).To(Equal("\"a;b\" 6\n\"a;c\" 4\n"))
+		})
+
+		It("rejects invalid metadata", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, md := range []string{"buildID", "1build=1", "buildID=", "__name__=foo"} {
+				w := httptest.NewRecorder()
+				c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.cpu&metadata="+md, strings.NewReader("a;b 1\n")))
+				Expect(w.Code).To(Equal(400), md)
+			}
+
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo.cpu&reduce=p95&metadata=buildID=1", nil))
+			Expect(w.Code).To(Equal(400))
+		})
+	})
+})
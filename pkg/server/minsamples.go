@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ingestBelowMinSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pyroscope_ingest_below_min_samples_total",
+	Help: "number of ingested profiles dropped because they have fewer samples than min-ingest-samples",
+}, []string{"app"})
+
+// minSamples drops ingested profiles that are too sparse to be meaningful, flamegraphs of
+// a handful of samples are mostly noise. Floors differ between profile types, e.g a few CPU
+// samples vs a few bytes of heap, so they can be set per type.
+type minSamples struct {
+	global    uint64
+	overrides map[string]uint64
+}
+
+func newMinSamples(global int, overrides map[string]string) (*minSamples, error) {
+	if global < 0 {
+		return nil, fmt.Errorf("invalid min-ingest-samples %d: must not be negative", global)
+	}
+	ms := &minSamples{
+		global:    uint64(global),
+		overrides: make(map[string]uint64, len(overrides)),
+	}
+	for pt, v := range overrides {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min-ingest-samples-overrides count of %s: %q", pt, v)
+		}
+		ms.overrides[pt] = n
+	}
+	return ms, nil
+}
+
+// accepts returns false if the profile of the type has fewer samples than required,
+// 0 means no minimum
+func (ms *minSamples) accepts(profileType string, samples uint64) bool {
+	min, ok := ms.overrides[profileType]
+	if !ok {
+		min = ms.global
+	}
+	return samples >= min
+}
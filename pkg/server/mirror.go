@@ -0,0 +1,69 @@
+package server
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/upstream/remote"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+)
+
+const (
+	mirrorThreads        = 4
+	mirrorRequestTimeout = 10 * time.Second
+)
+
+// newMirror returns the upstream that gets a copy of every stored profile, nil if mirroring is disabled.
+// Uploads are asynchronous and best effort: when the other server is slow or down profiles
+// are dropped, the primary ingestion is never affected.
+func newMirror(url, authToken string) (upstream.Upstream, error) {
+	if url == "" {
+		return nil, nil
+	}
+	return remote.New(remote.RemoteConfig{
+		AuthToken:              authToken,
+		UpstreamThreads:        mirrorThreads,
+		UpstreamAddress:        url,
+		UpstreamRequestTimeout: mirrorRequestTimeout,
+	}, mirrorLogger{logrus.WithField("mirror", url)})
+}
+
+// mirrorLogger demotes the per upload messages of the remote client to debug level
+type mirrorLogger struct {
+	*logrus.Entry
+}
+
+func (l mirrorLogger) Infof(format string, args ...interface{}) {
+	l.Debugf(format, args...)
+}
+
+// mirrorJob returns the upload job that forwards the profile to the mirror, nil if mirroring is disabled.
+// It has to be created before the tree is stored, storage may merge other profiles into it.
+func (ctrl *Controller) mirrorJob(ip *ingestParams, t *tree.Tree) *upstream.UploadJob {
+	if ctrl.mirror == nil {
+		return nil
+	}
+	// the tenant is sent in a header, the other server ignores it in the name
+	k := ip.storageKey.Clone()
+	tenant := k.Tenant()
+	k.SetTenant("")
+
+	trie := transporttrie.New()
+	t.IterateStacks(func(stack []byte, val uint64) {
+		trie.Insert(stack, val, true)
+	})
+	return &upstream.UploadJob{
+		Name:            k.Normalized(),
+		StartTime:       ip.from,
+		EndTime:         ip.until,
+		SpyName:         ip.spyName,
+		SampleRate:      ip.sampleRate,
+		Units:           ip.units,
+		AggregationType: ip.aggregationType,
+		Trie:            trie,
+		Tenant:          tenant,
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+type mirroredRequest struct {
+	r    *http.Request
+	body []byte
+}
+
+var _ = Describe("mirror", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("forwards stored profiles to the mirror", func() {
+			received := make(chan mirroredRequest, 1)
+			mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := ioutil.ReadAll(r.Body)
+				received <- mirroredRequest{r: r, body: b}
+			}))
+			defer mirror.Close()
+			(*cfg).Server.MirrorURL = mirror.URL
+			(*cfg).Server.MirrorAuthToken = "secret"
+
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			defer c.Stop()
+
+			r := httptest.NewRequest("POST", "/ingest?name=foo.cpu{env=prod}&from=1600000000&until=1600000010&spyName=gospy&sampleRate=100", bytes.NewReader([]byte("a;b 2\n")))
+			r.Header.Set(tenantHeader, "t1")
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, r)
+			Expect(w.Code).To(Equal(200))
+
+			var m mirroredRequest
+			Eventually(received).Should(Receive(&m))
+			Expect(m.r.URL.Path).To(Equal("/ingest"))
+			q := m.r.URL.Query()
+			Expect(q.Get("name")).To(Equal("foo.cpu{env=prod}"))
+			Expect(q.Get("from")).To(Equal("1600000000"))
+			Expect(q.Get("until")).To(Equal("1600000010"))
+			Expect(q.Get("spyName")).To(Equal("gospy"))
+			Expect(q.Get("sampleRate")).To(Equal("100"))
+			Expect(m.r.Header.Get(tenantHeader)).To(Equal("t1"))
+			Expect(m.r.Header.Get("Authorization")).To(Equal("Bearer secret"))
+
+			trie, err := transporttrie.Deserialize(bytes.NewReader(m.body))
+			Expect(err).ToNot(HaveOccurred())
+			stacks := map[string]uint64{}
+			trie.Iterate(func(name []byte, val uint64) {
+				stacks[string(name)] = val
+			})
+			Expect(stacks).To(Equal(map[string]uint64{"a;b": 2}))
+		})
+
+		It("doesn't fail ingestion when the mirror is down", func() {
+			mirror := httptest.NewServer(http.NotFoundHandler())
+			mirror.Close()
+			(*cfg).Server.MirrorURL = mirror.URL
+
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			defer c.Stop()
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.cpu&from=1600000000&until=1600000010", bytes.NewReader([]byte("a;b 2\n"))))
+			Expect(w.Code).To(Equal(200))
+
+			key, _ := storage.ParseKey("foo.cpu")
+			gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000010, 0), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut.Tree.String()).To(Equal("\"a;b\" 2\n"))
+		})
+	})
+})
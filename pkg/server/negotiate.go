@@ -0,0 +1,40 @@
+package server
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// renderMediaTypes maps media types clients can ask for in the Accept header to render formats
+var renderMediaTypes = map[string]string{
+	"application/json":             "json",
+	"text/plain":                   "collapsed",
+	"application/vnd.google.pprof": "pprof",
+}
+
+// negotiateRenderFormat picks the render format with the highest quality in the Accept header,
+// earlier media types win ties. Wildcards and unsupported or missing Accept headers mean json.
+func negotiateRenderFormat(accept string) string {
+	format, bestQ := "json", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		f, ok := renderMediaTypes[mt]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			format, bestQ = f, q
+		}
+	}
+	return format
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("negotiateRenderFormat", func() {
+	DescribeTable("picks the format",
+		func(accept, expected string) {
+			Expect(negotiateRenderFormat(accept)).To(Equal(expected))
+		},
+		Entry("no header", "", "json"),
+		Entry("wildcard", "*/*", "json"),
+		Entry("unsupported type", "image/png", "json"),
+		Entry("json", "application/json", "json"),
+		Entry("folded", "text/plain", "collapsed"),
+		Entry("pprof", "application/vnd.google.pprof", "pprof"),
+		Entry("first of equal quality", "text/plain, application/json", "collapsed"),
+		Entry("highest quality", "text/plain;q=0.5, application/vnd.google.pprof;q=0.9, */*;q=0.1", "pprof"),
+		Entry("parameters", "text/plain; charset=utf-8", "collapsed"),
+		Entry("malformed quality", "text/plain;q=x, application/json;q=0.1", "json"),
+		Entry("zero quality", "text/plain;q=0", "json"),
+	)
+})
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+const (
+	// otlpServiceNameAttr is the resource attribute that becomes the app name
+	otlpServiceNameAttr = "service.name"
+	// otlpUnknownService is what OTel SDKs report when service.name isn't configured
+	otlpUnknownService = "unknown_service"
+	// maxOTLPBodySize bounds the memory a single request can use, the whole body is decoded at once
+	maxOTLPBodySize = 64 << 20
+)
+
+// otlpProfilesHandler implements the OTLP/HTTP endpoint for profiles (binary protobuf only).
+// Every profile is stored as <service.name>.cpu, other resource attributes become labels.
+// See convert.ParseOTLP for the list of unsupported fields.
+func (ctrl *Controller) otlpProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type: %q", ct))
+		return
+	}
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// gzipped bodies are decompressed by decompressBody
+	body := &countingReader{r: r.Body}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, ioutil.NopCloser(body), maxOTLPBodySize))
+	if err != nil {
+		// MaxBytesReader reads one byte past the limit to tell it's exceeded
+		if body.n > maxOTLPBodySize {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Errorf("request body is larger than %d bytes", maxOTLPBodySize))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("read request body: %v", err))
+		return
+	}
+	profiles, rejected, err := convert.ParseOTLP(b)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err))
+		return
+	}
+
+	var message string
+	if rejected > 0 {
+		message = "only cpu profiles are supported"
+	}
+	for i, p := range profiles {
+		ip, err := otlpIngestParams(p, tenant, ctrl.cfg.MaxKeyLabels)
+		if err != nil {
+			rejected++
+			message = err.Error()
+			continue
+		}
+		ip.bodySize = otlpBodyShare(len(b), len(profiles), i)
+		status, err := ctrl.ingest(ip, bytes.NewReader(nil), ctrl.clientIP(r))
+		if err != nil {
+			// retryable errors fail the whole request, so that exporters retry it
+			if status >= 500 {
+				writeJSONError(w, status, err)
+				return
+			}
+			rejected++
+			message = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+	w.Write(convert.AppendOTLPPartialSuccess(nil, rejected, message))
+}
+
+// otlpBodyShare splits the body size between profiles of a request for ingest metrics,
+// the remainder goes to the first one so that shares add up to the body size
+func otlpBodyShare(size, profiles, i int) int64 {
+	share := size / profiles
+	if i == 0 {
+		share += size % profiles
+	}
+	return int64(share)
+}
+
+func otlpIngestParams(p *convert.OTLPProfile, tenant string, maxLabels int) (*ingestParams, error) {
+	appName := p.Resource[otlpServiceNameAttr]
+	if appName == "" {
+		appName = otlpUnknownService
+	}
+
+	labels := []string{}
+	for k, v := range p.Resource {
+		if k != otlpServiceNameAttr {
+			labels = append(labels, otlpLabelName(k)+"="+otlpLabelValue(v))
+		}
+	}
+	sort.Strings(labels)
+	key, err := parseIngestKey(otlpLabelValue(appName)+".cpu{"+strings.Join(labels, ",")+"}", maxLabels)
+	if err != nil {
+		return nil, fmt.Errorf("resource attributes: %v", err)
+	}
+	key.SetTenant(tenant)
+
+	ip := &ingestParams{
+		parserFunc: func(io.Reader) (*tree.Tree, error) {
+			t := tree.New()
+			p.Get(func(name []byte, val int) {
+				t.Insert(name, uint64(val))
+			})
+			return t, nil
+		},
+		storageKey:      key,
+		spyName:         "otel",
+		sampleRate:      p.SampleRate,
+		units:           "samples",
+		aggregationType: storage.AggregationSum,
+		from:            p.StartTime,
+		until:           p.EndTime,
+	}
+	if ip.from.IsZero() {
+		ip.from = time.Now()
+		ip.until = ip.from
+	}
+	return ip, nil
+}
+
+// otlpLabelName maps OTel attribute names (e.g host.name) to label names (e.g host_name)
+func otlpLabelName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// otlpLabelValue replaces characters that have special meaning in keys
+func otlpLabelValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '{', '}', ',', '=', ':':
+			return '_'
+		}
+		return r
+	}, s)
+}
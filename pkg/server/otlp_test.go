@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+func pbMessage(num protowire.Number, fields ...[]byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, bytes.Join(fields, nil))
+}
+
+func pbString(num protowire.Number, s string) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func pbVarint(num protowire.Number, v uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func otlpTestProfile(sampleType string) []byte {
+	strs := [][]byte{}
+	for _, s := range []string{"", sampleType, "nanoseconds", "main", "work"} {
+		strs = append(strs, pbString(10, s))
+	}
+	return pbMessage(2, // profiles
+		pbMessage(1, pbVarint(1, 1), pbVarint(2, 2)),  // sample_type
+		pbMessage(13, pbVarint(1, 1), pbVarint(2, 2)), // period_type
+		pbVarint(14, 10000000),                        // period, 100Hz
+		pbMessage(6, pbVarint(1, 3)),                  // function_table: main
+		pbMessage(6, pbVarint(1, 4)),                  // function_table: work
+		pbMessage(4, pbMessage(3, pbVarint(1, 1))),    // location_table: work
+		pbMessage(4, pbMessage(3, pbVarint(1, 0))),    // location_table: main
+		pbVarint(5, 0), pbVarint(5, 1),                // location_indices
+		pbMessage(2, pbVarint(1, 0), pbVarint(2, 2), pbVarint(3, 30000000)), // main;work
+		pbMessage(2, pbVarint(1, 1), pbVarint(2, 1), pbVarint(3, 10000000)), // main
+		bytes.Join(strs, nil),
+		pbVarint(11, uint64(time.Unix(1600000000, 0).UnixNano())),
+		pbVarint(12, uint64(10*time.Second)),
+	)
+}
+
+var _ = Describe("OTLP profiles ingestion", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("stores cpu profiles with resource attributes as labels", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			req := pbMessage(1, // resource_profiles
+				pbMessage(1, // resource
+					pbMessage(1, pbString(1, "service.name"), pbMessage(2, pbString(1, "foo"))),
+					pbMessage(1, pbString(1, "host.name"), pbMessage(2, pbString(1, "h1"))),
+				),
+				pbMessage(2, otlpTestProfile("cpu"), otlpTestProfile("alloc_space")), // scope_profiles
+			)
+			bytesTotal := ingestBytesTotal.WithLabelValues(c.allowedApps.metricLabel("foo.cpu"))
+			bytesBefore := testutil.ToFloat64(bytesTotal)
+			r := httptest.NewRequest("POST", "/v1development/profiles", bytes.NewReader(req))
+			r.Header.Set("Content-Type", "application/x-protobuf")
+			w := httptest.NewRecorder()
+			c.otlpProfilesHandler(w, r)
+			Expect(w.Code).To(Equal(200))
+			// the only stored profile accounts for the whole body
+			Expect(testutil.ToFloat64(bytesTotal) - bytesBefore).To(Equal(float64(len(req))))
+			// partial_success reports the rejected allocation profile
+			Expect(w.Body.String()).To(ContainSubstring(string(pbVarint(1, 1))))
+
+			key, _ := storage.ParseKey("foo.cpu{host_name=h1}")
+			gOut, err := s.Get(&storage.GetInput{StartTime: time.Unix(1600000000, 0), EndTime: time.Unix(1600000010, 0), Key: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut).ToNot(BeNil())
+			Expect(gOut.Tree.String()).To(Equal("\"main\" 1\n\"main;work\" 3\n"))
+			Expect(gOut.SampleRate).To(Equal(uint32(100)))
+			Expect(gOut.SpyName).To(Equal("otel"))
+		})
+
+		It("rejects non-protobuf payloads", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			r := httptest.NewRequest("POST", "/v1development/profiles", bytes.NewReader([]byte("{}")))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			c.otlpProfilesHandler(w, r)
+			Expect(w.Code).To(Equal(415))
+		})
+
+		It("rejects bodies that are too large once decompressed", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			var buf bytes.Buffer
+			gw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+			_, err = gw.Write(make([]byte, maxOTLPBodySize+1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gw.Close()).To(Succeed())
+			r := httptest.NewRequest("POST", "/v1development/profiles", &buf)
+			r.Header.Set("Content-Type", "application/x-protobuf")
+			r.Header.Set("Content-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			decompressBody(c.otlpProfilesHandler)(w, r)
+			Expect(w.Code).To(Equal(413))
+		})
+	})
+})
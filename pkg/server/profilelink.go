@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// defaultProfileLinkWindow is how far from the requested time data is looked for when the request doesn't specify it
+const defaultProfileLinkWindow = 5 * time.Minute
+
+type profileLinkJSON struct {
+	Name  string `json:"name"`
+	From  int64  `json:"from"`
+	Until int64  `json:"until"`
+	URL   string `json:"url"`
+}
+
+// profileLinkHandler maps a point in time (e.g of a metric exemplar) to a render URL of the profile
+// closest to it, so that dashboards can link from metrics to profiles. See docs/profile-links.md.
+func (ctrl *Controller) profileLinkHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	storageKey, err := storage.ParseKey(q.Get("name"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name: %v", err))
+		return
+	}
+	storageKey.SetTenant(tenant)
+	t, err := parseUnixTime(q.Get("time"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	window := defaultProfileLinkWindow
+	if v := q.Get("window"); v != "" {
+		if window, err = time.ParseDuration(v); err != nil || window < 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid window: %q", v))
+			return
+		}
+	}
+
+	dr, err := ctrl.s.NearestData(storageKey, t, window)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("find nearest data: %v", err))
+		return
+	}
+	if dr == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no data for %q within %s of %d", storageKey.Normalized(), window, t.Unix()))
+		return
+	}
+
+	res := profileLinkJSON{
+		Name:  q.Get("name"),
+		From:  dr.StartTime.Unix(),
+		Until: dr.EndTime.Unix(),
+	}
+	params := url.Values{}
+	params.Set("name", res.Name)
+	params.Set("from", strconv.FormatInt(res.From, 10))
+	params.Set("until", strconv.FormatInt(res.Until, 10))
+	if v := q.Get("format"); v != "" {
+		params.Set("format", v)
+	}
+	res.URL = strings.TrimSuffix(ctrl.cfg.BaseURL, "/") + "/render?" + params.Encode()
+
+	if q.Get("redirect") == "true" {
+		http.Redirect(w, r, res.URL, http.StatusFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
+
+// parseUnixTime parses unix time in seconds, fractions are allowed as in Prometheus exemplars
+func parseUnixTime(v string) (time.Time, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return time.Time{}, fmt.Errorf("invalid time: %q, expected unix time in seconds", v)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/profile-link", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("links to the profile closest to the given time", func() {
+			(*cfg).Server.BaseURL = "/pyroscope/"
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			// exemplar timestamps are real unix times, unlike testing.SimpleTime
+			at := func(t int) string {
+				return strconv.Itoa(1600000000 + t)
+			}
+			for _, t := range []int{20, 300} {
+				key, _ := storage.ParseKey("foo{env=prod}")
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				tr.Insert([]byte("a;c"), uint64(2))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  time.Unix(int64(1600000000+t), 0),
+					EndTime:    time.Unix(int64(1600000000+t+9), 0),
+					Key:        key,
+					Val:        tr,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+
+			w := httptest.NewRecorder()
+			c.profileLinkHandler(w, httptest.NewRequest("GET", "/profile-link?name=foo{}&time="+at(250)+".5", nil))
+			Expect(w.Code).To(Equal(200))
+			var res profileLinkJSON
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(profileLinkJSON{
+				Name:  "foo{}",
+				From:  1600000300,
+				Until: 1600000310,
+				URL:   "/pyroscope/render?from=" + at(300) + "&name=foo%7B%7D&until=" + at(310),
+			}))
+
+			w = httptest.NewRecorder()
+			c.profileLinkHandler(w, httptest.NewRequest("GET", "/profile-link?name=foo{env=prod}&format=pprof&redirect=true&time="+at(45), nil))
+			Expect(w.Code).To(Equal(http.StatusFound))
+			Expect(w.Header().Get("Location")).To(Equal("/pyroscope/render?format=pprof&from=" + at(20) + "&name=foo%7Benv%3Dprod%7D&until=" + at(30)))
+
+			w = httptest.NewRecorder()
+			c.profileLinkHandler(w, httptest.NewRequest("GET", "/profile-link?name=foo{}&window=10s&time="+at(150), nil))
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+
+			for _, q := range []string{"name=foo{}", "name=foo{}&time=now", "name=foo{}&time=" + at(20) + "&window=-1s"} {
+				w = httptest.NewRecorder()
+				c.profileLinkHandler(w, httptest.NewRequest("GET", "/profile-link?"+q, nil))
+				Expect(w.Code).To(Equal(http.StatusBadRequest), q)
+			}
+		})
+	})
+})
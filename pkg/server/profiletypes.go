@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+type profileTypeJSON struct {
+	Name            string `json:"name"`
+	Units           string `json:"units"`
+	AggregationType string `json:"aggregationType"`
+}
+
+// profileTypesHandler lists profile types stored for an app, e.g cpu and alloc_space for myapp.cpu
+// and myapp.alloc_space, so that clients can build queries without guessing app names.
+// Apps stored without a profile type suffix and unknown apps have an empty list.
+func (ctrl *Controller) profileTypesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	types := []string{}
+	ctrl.s.GetValues(tenant, "__name__", func(v string) bool {
+		// dots are allowed in app names, myapp.foo.cpu isn't a profile type of myapp
+		if pt := strings.TrimPrefix(v, name+"."); pt != v && pt != "" && !strings.Contains(pt, ".") {
+			types = append(types, pt)
+		}
+		return true
+	})
+	sort.Strings(types)
+
+	res := []profileTypeJSON{}
+	for _, pt := range types {
+		key, err := storage.ParseKey(name + "." + pt)
+		if err != nil {
+			continue
+		}
+		key.SetTenant(tenant)
+		md, err := ctrl.s.Metadata(key)
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve metadata: %v", err))
+			return
+		}
+		if md == nil {
+			continue
+		}
+		res = append(res, profileTypeJSON{
+			Name:            pt,
+			Units:           md.Units,
+			AggregationType: md.AggregationType,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
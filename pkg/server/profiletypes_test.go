@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/app/profile-types", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("lists profile types of the app with their units", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, p := range []struct{ name, units, aggregationType string }{
+				{"foo.cpu{}", "samples", storage.AggregationSum},
+				{"foo.inuse_space{}", "bytes", storage.AggregationAverage},
+				{"foo.bar.cpu{}", "samples", storage.AggregationSum},
+				{"bar{}", "samples", storage.AggregationSum},
+			} {
+				key, _ := storage.ParseKey(p.name)
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:       testing.SimpleTime(10),
+					EndTime:         testing.SimpleTime(19),
+					Key:             key,
+					Val:             tr,
+					SpyName:         "gospy",
+					SampleRate:      100,
+					Units:           p.units,
+					AggregationType: p.aggregationType,
+				})).To(Succeed())
+			}
+
+			profileTypes := func(name string) []profileTypeJSON {
+				w := httptest.NewRecorder()
+				c.profileTypesHandler(w, httptest.NewRequest("GET", "/app/profile-types?name="+name, nil))
+				Expect(w.Code).To(Equal(200))
+				var res []profileTypeJSON
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				return res
+			}
+
+			Expect(profileTypes("foo")).To(Equal([]profileTypeJSON{
+				{Name: "cpu", Units: "samples", AggregationType: "sum"},
+				{Name: "inuse_space", Units: "bytes", AggregationType: "average"},
+			}))
+			Expect(profileTypes("bar")).To(BeEmpty())
+			Expect(profileTypes("baz")).To(BeEmpty())
+		})
+	})
+})
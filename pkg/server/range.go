@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+// defaultReadyWithin is how recent the data has to be when the request doesn't specify it
+const defaultReadyWithin = time.Minute
+
+type rangeJSON struct {
+	StartTime int64 `json:"startTime"`
+	EndTime   int64 `json:"endTime"`
+}
+
+// rangeHandler returns the time range of stored data for a key,
+// so that the UI can default to a window that actually contains data
+func (ctrl *Controller) rangeHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	storageKey, err := storage.ParseKey(r.URL.Query().Get("name"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name: %v", err))
+		return
+	}
+	storageKey.SetTenant(tenant)
+
+	dr, err := ctrl.s.DataRange(storageKey)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve data range: %v", err))
+		return
+	}
+	if dr == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no data for %q", storageKey.Normalized()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(rangeJSON{
+		StartTime: dr.StartTime.Unix(),
+		EndTime:   dr.EndTime.Unix(),
+	})
+}
+
+type readyJSON struct {
+	Ready bool `json:"ready"`
+	// LastSeen is the end of the most recent data in unix seconds, 0 if there's no data at all
+	LastSeen int64 `json:"lastSeen"`
+}
+
+// readyForQueriesHandler reports whether the app has data within the last "within" period (e.g 5m).
+// Unlike server readiness it is about a single app: it responds with 503 when there's no recent data,
+// and lastSeen lets alerting tell apart an idle app from an agent that stopped reporting.
+func (ctrl *Controller) readyForQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	storageKey, err := storage.ParseKey(q.Get("name"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name: %v", err))
+		return
+	}
+	storageKey.SetTenant(tenant)
+	within := defaultReadyWithin
+	if v := q.Get("within"); v != "" {
+		if within, err = time.ParseDuration(v); err != nil || within <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid within: %q", v))
+			return
+		}
+	}
+
+	dr, err := ctrl.s.DataRange(storageKey)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve data range: %v", err))
+		return
+	}
+	res := readyJSON{}
+	if dr != nil {
+		res.LastSeen = dr.EndTime.Unix()
+		res.Ready = !dr.EndTime.Before(time.Now().Add(-within))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if res.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/range", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("returns the range of stored data", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			key, _ := storage.ParseKey("foo{}")
+			for _, t := range []int{20, 100} {
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  testing.SimpleTime(t),
+					EndTime:    testing.SimpleTime(t + 9),
+					Key:        key,
+					Val:        tr,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+
+			w := httptest.NewRecorder()
+			c.rangeHandler(w, httptest.NewRequest("GET", "/range?name=foo", nil))
+			Expect(w.Code).To(Equal(200))
+			var res rangeJSON
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(rangeJSON{
+				StartTime: testing.SimpleTime(20).Unix(),
+				EndTime:   testing.SimpleTime(110).Unix(),
+			}))
+
+			w = httptest.NewRecorder()
+			c.rangeHandler(w, httptest.NewRequest("GET", "/range?name=bar", nil))
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("reports whether an app has recent data", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			now := time.Now().Truncate(10 * time.Second)
+			for _, name := range []string{"recent{}", "idle{}"} {
+				st := now.Add(-10 * time.Second)
+				if name == "idle{}" {
+					st = now.Add(-time.Hour)
+				}
+				key, _ := storage.ParseKey(name)
+				tr := tree.New()
+				tr.Insert([]byte("a;b"), uint64(1))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  st,
+					EndTime:    st.Add(9 * time.Second),
+					Key:        key,
+					Val:        tr,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+
+			var res readyJSON
+			w := httptest.NewRecorder()
+			c.readyForQueriesHandler(w, httptest.NewRequest("GET", "/ready-for-queries?name=recent&within=5m", nil))
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(readyJSON{Ready: true, LastSeen: now.Unix()}))
+
+			w = httptest.NewRecorder()
+			c.readyForQueriesHandler(w, httptest.NewRequest("GET", "/ready-for-queries?name=idle&within=5m", nil))
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(readyJSON{Ready: false, LastSeen: now.Add(-time.Hour + 10*time.Second).Unix()}))
+
+			w = httptest.NewRecorder()
+			c.readyForQueriesHandler(w, httptest.NewRequest("GET", "/ready-for-queries?name=bar", nil))
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(readyJSON{}))
+
+			w = httptest.NewRecorder()
+			c.readyForQueriesHandler(w, httptest.NewRequest("GET", "/ready-for-queries?name=recent&within=foo", nil))
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
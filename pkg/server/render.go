@@ -1,39 +1,342 @@
 package server
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
 	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
 	"github.com/pyroscope-io/pyroscope/pkg/util/attime"
+	"github.com/sirupsen/logrus"
 )
 
+var rendersInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "pyroscope_render_in_flight",
+	Help: "number of render requests currently being processed",
+})
+
 type samplesEntry struct {
 	Ts      time.Time `json:"ts"`
 	Samples uint16    `json:"samples"`
 }
 
 func (ctrl *Controller) renderHandler(w http.ResponseWriter, r *http.Request) {
+	// each render builds a full tree in memory, so bursts of them can exhaust it
+	if !ctrl.renderSem.acquire(r.Context(), ctrl.cfg.RenderQueueTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusTooManyRequests, errors.New("too many concurrent render requests"))
+		return
+	}
+	defer ctrl.renderSem.release()
+	rendersInFlight.Inc()
+	defer rendersInFlight.Dec()
+
 	q := r.URL.Query()
-	startTime := attime.Parse(q.Get("from"))
-	endTime := attime.Parse(q.Get("until"))
-	var err error
-	storageKey, err := storage.ParseKey(q.Get("name"))
+	// days of from and until and step boundaries are in the client's time zone, data is still in UTC
+	loc, err := parseTimeZone(q.Get("tz"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	startTime := attime.ParseInLocation(q.Get("from"), loc)
+	endTime := attime.ParseInLocation(q.Get("until"), loc)
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	quantile, err := parseReduce(q.Get("reduce"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// edge buckets only count the part that overlaps the range, otherwise the range is rounded to 10s
+	trim := q.Get("trim") == "true"
+
+	step, err := parseStep(q.Get("step"))
 	if err != nil {
-		panic(err) // TODO: handle
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// trend lines for dashboards, the raw timeline is returned as well
+	smooth, err := parseSmooth(q.Get("smooth"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// long ranges don't need every 10s bucket, coarser timelines keep payloads small
+	shapeTimeline := func(tl *segment.Timeline) {
+		if tl == nil {
+			return
+		}
+		if step > 0 {
+			tl.ResampleInLocation(step, loc)
+		}
+		tl.Smooth(smooth)
+	}
+
+	// only uploads with these metadata tags are rendered, e.g metadata=buildID=1234
+	metadata, err := parseUploadMetadata(q.Get("metadata"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("metadata: %v", err))
+		return
+	}
+
+	// the format param overrides the Accept header, e.g for links opened in a browser
+	format := q.Get("format")
+	if format == "" {
+		format = negotiateRenderFormat(r.Header.Get("Accept"))
+	}
+	w.Header().Set("Vary", "Accept")
+
+	// pprof renders can be a comparison with a base time window, see convert.WriteDiffPprof
+	var baseStartTime, baseEndTime time.Time
+	diff := q.Get("baseFrom") != "" || q.Get("baseUntil") != ""
+	if diff {
+		if format != "pprof" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("baseFrom and baseUntil can only be used with format=pprof"))
+			return
+		}
+		baseStartTime = attime.ParseInLocation(q.Get("baseFrom"), loc)
+		baseEndTime = attime.ParseInLocation(q.Get("baseUntil"), loc)
+	}
+
+	// zooms into the function server-side so that clients don't have to fetch the whole tree
+	root := q.Get("root")
+
+	// overview renders (e.g thumbnails) only need the top few levels
+	maxDepth := 0
+	if md := q.Get("maxDepth"); md != "" {
+		maxDepth, err = strconv.Atoi(md)
+		if err != nil || maxDepth <= 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid maxDepth: %q", md))
+			return
+		}
+	}
+
+	// frames carrying source locations are per line, they're merged into per function frames
+	// unless line level views ask for them
+	locations := q.Get("locations") == "true"
+
+	shapeTree := func(t *tree.Tree) *tree.Tree {
+		if !locations {
+			t = t.WithoutLocations()
+		}
+		if root != "" {
+			t = t.Subtree(root)
+		}
+		if maxDepth > 0 {
+			t = t.TrimDepth(maxDepth)
+		}
+		return t
+	}
+
+	maxNodes := ctrl.cfg.MaxNodesRender
+	if mn, err := strconv.Atoi(q.Get("max-nodes")); err == nil && mn > 0 {
+		maxNodes = mn
+	}
+
+	// children are ordered by name by default, as they always were. Self ordering puts the
+	// heaviest frames first, ties are still ordered by name, so output stays reproducible
+	order := tree.OrderByName
+	switch q.Get("sort") {
+	case "", "name":
+	case "self":
+		order = tree.OrderBySelf
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unsupported sort: %q", q.Get("sort")))
+		return
+	}
+
+	// percentages make profiles of different durations comparable, absolute values are kept as well
+	normalize := q.Get("normalize")
+	switch normalize {
+	case "":
+	case "percent":
+		if format != "json" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("normalize can only be used with format=json"))
+			return
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unsupported normalize: %q", normalize))
+		return
+	}
+
+	// a flamegraph per value of the label rather than a single one, e.g to break down CPU by region
+	groupBy := q.Get("groupBy")
+	if groupBy != "" {
+		if !storage.IsValidLabelName(groupBy) {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid groupBy: %q", groupBy))
+			return
+		}
+		if format != "json" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("groupBy can only be used with format=json"))
+			return
+		}
+		if q.Get("names") != "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("groupBy can't be used with names"))
+			return
+		}
+		if q.Get("traceID") != "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("groupBy can't be used with traceID"))
+			return
+		}
 	}
 
-	gOut, err := ctrl.s.Get(&storage.GetInput{
-		StartTime: startTime,
-		EndTime:   endTime,
-		Key:       storageKey,
-	})
+	var get func(startTime, endTime time.Time) (*storage.GetOutput, error)
+	var profileType spy.ProfileType
+	if traceID := q.Get("traceID"); traceID != "" {
+		// profiles linked to a trace, e.g to navigate from a span. They're merged, the time range
+		// is the one they span, name optionally narrows them down, e.g to a single app
+		if quantile > 0 || diff {
+			writeJSONError(w, http.StatusBadRequest, errors.New("reduce and baseFrom/baseUntil can't be used with traceID"))
+			return
+		}
+		if err = validateTraceID(traceID); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		var matcher *storage.Key
+		if name := q.Get("name"); name != "" {
+			if matcher, err = storage.ParseKey(name); err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name: %v", err))
+				return
+			}
+			matcher.SetTenant(tenant)
+		}
+		sources, st, et, err := ctrl.traceSources(tenant, traceID, matcher)
+		if err != nil {
+			writeJSONError(w, traceSourcesStatus(err), err)
+			return
+		}
+		startTime, endTime = st, et
+		profileType = spy.ProfileType(sources[0].key.ProfileType())
+		traceMetadata := map[string]string{storage.TraceIDMetadata: traceID}
+		for k, v := range metadata {
+			traceMetadata[k] = v
+		}
+		prefix := q.Get("prefix") == "true"
+		get = func(startTime, endTime time.Time) (*storage.GetOutput, error) {
+			return ctrl.getMerged(sources, storage.GetInput{
+				StartTime: startTime,
+				EndTime:   endTime,
+				Trim:      trim,
+				Metadata:  traceMetadata,
+			}, prefix)
+		}
+	} else if names := q.Get("names"); names != "" {
+		if quantile > 0 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("reduce can't be used with names"))
+			return
+		}
+		// merges profiles of several apps into a single flamegraph
+		sources := []mergeSource{}
+		for _, name := range splitQueries(names) {
+			storageKey, err := storage.ParseKey(name)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("names: %q: %v", name, err))
+				return
+			}
+			storageKey.SetTenant(tenant)
+			sources = append(sources, mergeSource{name: name, key: storageKey})
+			// merged profiles only have a type if all of them are of the same type
+			if pt := spy.ProfileType(storageKey.ProfileType()); len(sources) == 1 || pt == profileType {
+				profileType = pt
+			} else {
+				profileType = ""
+			}
+		}
+		prefix := q.Get("prefix") == "true"
+		get = func(startTime, endTime time.Time) (*storage.GetOutput, error) {
+			return ctrl.getMerged(sources, storage.GetInput{
+				StartTime: startTime,
+				EndTime:   endTime,
+				Trim:      trim,
+				Metadata:  metadata,
+			}, prefix)
+		}
+	} else {
+		storageKey, err := storage.ParseKey(q.Get("name"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("name: %v", err))
+			return
+		}
+		storageKey.SetTenant(tenant)
+		profileType = spy.ProfileType(storageKey.ProfileType())
+		get = func(startTime, endTime time.Time) (*storage.GetOutput, error) {
+			return ctrl.s.Get(&storage.GetInput{
+				StartTime: startTime,
+				EndTime:   endTime,
+				Key:       storageKey,
+				Quantile:  quantile,
+				Trim:      trim,
+				Metadata:  metadata,
+			})
+		}
+
+		if groupBy != "" {
+			groups, err := ctrl.s.GetGrouped(&storage.GetInput{
+				StartTime: startTime,
+				EndTime:   endTime,
+				Key:       storageKey,
+				Quantile:  quantile,
+				Trim:      trim,
+				Metadata:  metadata,
+			}, groupBy, maxRenderGroups)
+			ctrl.statsInc("render")
+			if err != nil {
+				writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve profiles: %v", err))
+				return
+			}
+			res := groupedRenderJSON{
+				GroupBy: groupBy,
+				Groups:  make(map[string]renderGroupJSON, len(groups)),
+			}
+			for v, out := range groups {
+				shapeTimeline(out.Timeline)
+				fb := shapeTree(out.Tree).FlamebearerStructWithOrder(maxNodes, order)
+				fb.SpyName = out.SpyName
+				fb.SampleRate = out.SampleRate
+				fb.Units = out.Units
+				if normalize == "percent" {
+					fb.AddPercents()
+				}
+				res.Groups[v] = renderGroupJSON{
+					Flamebearer: fb,
+					Timeline:    out.Timeline,
+					Metadata:    renderMetadata(out, profileType, normalize),
+				}
+			}
+			as, err := ctrl.s.GetAnnotations(tenant, startTime, endTime)
+			if err != nil {
+				logrus.WithField("err", err).Error("error happened while retrieving annotations")
+			}
+			res.Annotations = annotationsToJSON(as)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
+			return
+		}
+	}
+	gOut, err := get(startTime, endTime)
 	ctrl.statsInc("render")
 	if err != nil {
-		panic(err) // TODO: handle
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve profile: %v", err))
+		return
 	}
 
 	// TODO: handle properly
@@ -43,36 +346,173 @@ func (ctrl *Controller) renderHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	maxNodes := ctrl.cfg.MaxNodesRender
-	if mn, err := strconv.Atoi(q.Get("max-nodes")); err == nil && mn > 0 {
-		maxNodes = mn
+	var baseTree *tree.Tree
+	if diff {
+		baseOut, err := get(baseStartTime, baseEndTime)
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve base profile: %v", err))
+			return
+		}
+		baseTree = tree.New()
+		if baseOut != nil {
+			baseTree = baseOut.Tree
+		}
+	}
+
+	shapeTimeline(gOut.Timeline)
+
+	gOut.Tree = shapeTree(gOut.Tree)
+	if baseTree != nil {
+		baseTree = shapeTree(baseTree)
 	}
 
-	switch q.Get("format") {
+	switch format {
 	case "json":
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(200)
+		// annotations are only an overlay, failing to get them shouldn't fail the whole render
+		as, err := ctrl.s.GetAnnotations(tenant, startTime, endTime)
+		if err != nil {
+			logrus.WithField("err", err).Error("error happened while retrieving annotations")
+		}
+
+		metadata := renderMetadata(gOut, profileType, normalize)
+		annotationsJSON := annotationsToJSON(as)
 
-		fs := gOut.Tree.FlamebearerStruct(maxNodes)
-		// TODO remove this duplication? We're already adding this to metadata
-		fs.SpyName = gOut.SpyName
-		fs.SampleRate = gOut.SampleRate
-		fs.Units = gOut.Units
-		res := map[string]interface{}{
+		// dashboards poll the same ranges over and over, unchanged data isn't rendered again
+		etag := renderETag(gOut.Tree, tenant, r.URL.RawQuery, gOut.Timeline, annotationsJSON, metadata)
+		if setRenderCacheHeaders(w, r, etag, endTime, time.Now()) {
+			return
+		}
+
+		// everything but the flamegraph is small, it's encoded upfront so that errors can still be reported
+		head, err := json.Marshal(map[string]interface{}{
 			"timeline":    gOut.Timeline,
-			"flamebearer": fs,
-			"metadata": map[string]interface{}{
-				"spyName":    gOut.SpyName,
-				"sampleRate": gOut.SampleRate,
-				"units":      gOut.Units,
-			},
+			"annotations": annotationsJSON,
+			"metadata":    metadata,
+		})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("marshal response: %v", err))
+			return
 		}
 
-		encoder := json.NewEncoder(w)
-		encoder.Encode(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+
+		// the flamegraph is streamed, huge trees aren't buffered as a whole.
+		// The status is already sent, so failures only leave the client with incomplete JSON.
+		// TODO remove spyName, sampleRate and units duplication? We're already adding them to metadata
+		w.Write(head[:len(head)-1])
+		w.Write([]byte(`,"flamebearer":`))
+		err = gOut.Tree.WriteFlamebearerJSON(w, maxNodes, order, tree.FlamebearerJSONOptions{
+			SpyName:    gOut.SpyName,
+			SampleRate: gOut.SampleRate,
+			Units:      gOut.Units,
+			Percents:   normalize == "percent",
+		})
+		if err != nil {
+			logrus.WithError(err).Warn("failed to write flamegraph")
+			return
+		}
+		w.Write([]byte("}\n"))
+		return
+	case "pprof":
+		// e.g for go tool pprof, either as is or with two windows downloaded separately and -diff_base
+		var buf bytes.Buffer
+		if baseTree != nil {
+			err = convert.WriteDiffPprof(baseTree, gOut.Tree, &buf)
+		} else {
+			err = convert.WriteTree("pprof", gOut.Tree, &buf)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("write pprof: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.google.pprof")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile.pb.gz"`)
+		w.Write(buf.Bytes())
+		return
+	case "collapsed":
+		// folded stacks, e.g for flamegraph.pl
+		var buf bytes.Buffer
+		if err := convert.WriteTree("collapsed", gOut.Tree, &buf); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, fmt.Errorf("write collapsed: %v", err))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+		return
+	case "fingerprint":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newRenderFingerprint(gOut.Tree))
 		return
 	default:
 		// TODO: add handling for other cases
-		w.WriteHeader(422)
+		writeJSONError(w, http.StatusUnprocessableEntity, fmt.Errorf("unsupported format: %q", format))
+	}
+}
+
+// parseReduce parses the reduce render parameter. "sum" (the default) merges all time buckets,
+// "pNN" (e.g p95) returns the tree of the bucket at the NN-th percentile of activity and
+// "max" is an alias for p100. Returns the quantile, 0 means sum.
+func parseReduce(v string) (float64, error) {
+	switch v {
+	case "", "sum":
+		return 0, nil
+	case "max":
+		return 1, nil
+	}
+	if strings.HasPrefix(v, "p") {
+		if p, err := strconv.ParseFloat(v[1:], 64); err == nil && p > 0 && p <= 100 {
+			return p / 100, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported reduce: %q", v)
+}
+
+// parseTimeZone parses the tz render parameter, an IANA time zone name (e.g Europe/Berlin).
+// Returns UTC if it isn't set.
+func parseTimeZone(v string) (*time.Location, error) {
+	if v == "" {
+		return time.UTC, nil
+	}
+	// Local would be the time zone of the server, which is never what clients mean
+	if v == "Local" {
+		return nil, fmt.Errorf("invalid tz: %q", v)
+	}
+	loc, err := time.LoadLocation(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tz: %q", v)
+	}
+	return loc, nil
+}
+
+// parseSmooth parses the smooth render parameter, the number of timeline buckets
+// averaged together. Returns 0 if timelines aren't smoothed.
+func parseSmooth(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	window, err := strconv.Atoi(v)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid smooth: %q", v)
+	}
+	return window, nil
+}
+
+// parseStep parses the step render parameter, either a duration (e.g 1m) or a number of seconds.
+// Returns 0 if the step isn't set.
+func parseStep(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	step, err := time.ParseDuration(v)
+	if err != nil {
+		var seconds int
+		if seconds, err = strconv.Atoi(v); err == nil {
+			step = time.Duration(seconds) * time.Second
+		}
+	}
+	if err != nil || step < time.Second {
+		return 0, fmt.Errorf("invalid step: %q", v)
 	}
+	return step, nil
 }
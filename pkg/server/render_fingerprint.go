@@ -0,0 +1,27 @@
+package server
+
+import (
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// fingerprintTopFunctions is the number of functions with the highest self values in fingerprints
+const fingerprintTopFunctions = 3
+
+// renderFingerprint is a summary of the shape of a profile, monitoring systems poll it to
+// notice changes (e.g a new hot function) without downloading whole flamegraphs
+type renderFingerprint struct {
+	TotalSamples uint64              `json:"totalSamples"`
+	Nodes        int                 `json:"nodes"`
+	MaxDepth     int                 `json:"maxDepth"`
+	TopFunctions []tree.FunctionSelf `json:"topFunctions"`
+}
+
+func newRenderFingerprint(t *tree.Tree) renderFingerprint {
+	nodes, maxDepth := t.Stats()
+	return renderFingerprint{
+		TotalSamples: t.Samples(),
+		Nodes:        nodes,
+		MaxDepth:     maxDepth,
+		TopFunctions: t.TopFunctions(fingerprintTopFunctions),
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// maxRenderGroups caps the number of flamegraphs of a groupBy render, high cardinality labels
+// (e.g pod names) would make responses huge
+const maxRenderGroups = 100
+
+// groupedRenderJSON is the response of /render with groupBy, it has a flamegraph per label value.
+// Series without the label are under an empty value.
+type groupedRenderJSON struct {
+	GroupBy     string                     `json:"groupBy"`
+	Groups      map[string]renderGroupJSON `json:"groups"`
+	Annotations []annotationJSON           `json:"annotations"`
+}
+
+type renderGroupJSON struct {
+	Flamebearer *tree.Flamebearer      `json:"flamebearer"`
+	Timeline    *segment.Timeline      `json:"timeline"`
+	Metadata    map[string]interface{} `json:"metadata"`
+}
+
+func renderMetadata(gOut *storage.GetOutput, profileType spy.ProfileType, normalize string) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"spyName":         gOut.SpyName,
+		"sampleRate":      gOut.SampleRate,
+		"units":           gOut.Units,
+		"aggregationType": gOut.AggregationType,
+	}
+	// lets the UI tell apart e.g on-CPU and wall-clock time, both are measured in samples
+	if profileType.IsKnown() {
+		metadata["profileType"] = profileType
+	}
+	if normalize != "" {
+		metadata["normalize"] = normalize
+	}
+	return metadata
+}
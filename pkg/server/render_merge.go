@@ -0,0 +1,112 @@
+package server
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// splitQueries splits a comma-separated list of queries,
+// ignoring commas inside of label selectors (e.g "app1{foo=bar,baz=qux},app2")
+func splitQueries(s string) []string {
+	res := []string{}
+	depth := 0
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				res = appendQuery(res, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return appendQuery(res, s[start:])
+}
+
+func appendQuery(res []string, q string) []string {
+	if q = strings.TrimSpace(q); q != "" {
+		res = append(res, q)
+	}
+	return res
+}
+
+type mergeSource struct {
+	name string
+	key  *storage.Key
+	// startTime and endTime override the time range of the query when set,
+	// e.g profiles of a trace are only queried within their uploads
+	startTime time.Time
+	endTime   time.Time
+}
+
+// getMerged fetches profiles for each of the sources and merges them into a single tree.
+// Sources can have different sample rates, so all trees are scaled to the highest one.
+// gi is used for every source, only Key (and the time range if the source has one) is set to the one of the source.
+// When prefix is true each source gets its own root frame named after the query.
+func (ctrl *Controller) getMerged(sources []mergeSource, gi storage.GetInput, prefix bool) (*storage.GetOutput, error) {
+	outputs := []*storage.GetOutput{}
+	names := []string{}
+	var sampleRate uint32
+	for _, src := range sources {
+		sgi := gi
+		sgi.Key = src.key
+		if !src.startTime.IsZero() {
+			sgi.StartTime, sgi.EndTime = src.startTime, src.endTime
+		}
+		gOut, err := ctrl.s.Get(&sgi)
+		if err != nil {
+			return nil, err
+		}
+		if gOut == nil {
+			continue
+		}
+		outputs = append(outputs, gOut)
+		names = append(names, src.name)
+		if gOut.SampleRate > sampleRate {
+			sampleRate = gOut.SampleRate
+		}
+	}
+
+	res := &storage.GetOutput{
+		Tree:       tree.New(),
+		Timeline:   segment.GenerateTimeline(gi.StartTime, gi.EndTime),
+		SampleRate: sampleRate,
+	}
+	for i, gOut := range outputs {
+		if res.SpyName == "" {
+			res.SpyName = gOut.SpyName
+			res.Units = gOut.Units
+			res.AggregationType = gOut.AggregationType
+		}
+
+		t := gOut.Tree
+		r := big.NewRat(1, 1)
+		if gOut.SampleRate != 0 && gOut.SampleRate != sampleRate {
+			r = big.NewRat(int64(sampleRate), int64(gOut.SampleRate))
+			t = t.Clone(r)
+		}
+		if prefix {
+			t = t.Prefix(names[i])
+		}
+		res.Tree.Merge(t)
+
+		if gOut.Timeline != nil && len(gOut.Timeline.Samples) == len(res.Timeline.Samples) {
+			m, d := r.Num().Uint64(), r.Denom().Uint64()
+			for j, v := range gOut.Timeline.Samples {
+				res.Timeline.Samples[j] += v * m / d
+			}
+		}
+	}
+	return res, nil
+}
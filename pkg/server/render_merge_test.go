@@ -0,0 +1,60 @@
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("merged render", func() {
+	DescribeTable("splitQueries",
+		func(s string, expected []string) {
+			Expect(splitQueries(s)).To(Equal(expected))
+		},
+		Entry("single query", "app1", []string{"app1"}),
+		Entry("multiple queries", "app1, app2{}", []string{"app1", "app2{}"}),
+		Entry("commas in label selectors", "app1{foo=bar,baz=qux},app2{env=prod}", []string{"app1{foo=bar,baz=qux}", "app2{env=prod}"}),
+		Entry("empty entries", ",app1,,", []string{"app1"}),
+	)
+
+	testing.WithConfig(func(cfg **config.Config) {
+		It("merges profiles normalizing sample rates", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			st := testing.SimpleTime(10)
+			et := testing.SimpleTime(19)
+			put := func(name, stack string, sampleRate uint32) mergeSource {
+				t := tree.New()
+				t.Insert([]byte(stack), uint64(1))
+				key, _ := storage.ParseKey(name)
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  st,
+					EndTime:    et,
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: sampleRate,
+				})).To(Succeed())
+				return mergeSource{name: name, key: key}
+			}
+			sources := []mergeSource{
+				put("app1{}", "a;b", 100),
+				put("app2{}", "c", 50),
+			}
+
+			gOut, err := c.getMerged(sources, storage.GetInput{StartTime: st, EndTime: et}, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gOut.SampleRate).To(Equal(uint32(100)))
+			Expect(gOut.Tree.String()).To(Equal("\"app1{};a;b\" 1\n\"app2{};c\" 2\n"))
+		})
+	})
+})
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/convert"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/render", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("returns metadata of stored profiles", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			t := tree.New()
+			t.Insert([]byte("a;b"), uint64(1))
+			key, _ := storage.ParseKey("foo{}")
+			Expect(s.Put(&storage.PutInput{
+				StartTime:       time.Unix(1600000010, 0),
+				EndTime:         time.Unix(1600000019, 0),
+				Key:             key,
+				Val:             t,
+				SpyName:         "gospy",
+				SampleRate:      97,
+				Units:           "bytes",
+				AggregationType: storage.AggregationAverage,
+			})).To(Succeed())
+			// metadata has to survive a restart
+			Expect(s.Close()).To(Succeed())
+			s, err = storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&from=1600000000&until=1600000030", nil))
+			Expect(w.Code).To(Equal(200))
+
+			var res struct {
+				Metadata map[string]interface{} `json:"metadata"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Metadata).To(Equal(map[string]interface{}{
+				"spyName":         "gospy",
+				"sampleRate":      float64(97),
+				"units":           "bytes",
+				"aggregationType": "average",
+			}))
+		})
+
+		It("ingests and renders wall profiles", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, body := range []string{"main;work 2\nmain;sleep 5\n", "main;sleep 3\n"} {
+				w := httptest.NewRecorder()
+				c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.wall&from=1600000010&until=1600000019", bytes.NewBufferString(body)))
+				Expect(w.Code).To(Equal(200))
+			}
+
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo.wall&from=1600000000&until=1600000030", nil))
+			Expect(w.Code).To(Equal(200))
+
+			var res struct {
+				Flamebearer tree.Flamebearer       `json:"flamebearer"`
+				Metadata    map[string]interface{} `json:"metadata"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Flamebearer.NumTicks).To(Equal(10))
+			Expect(res.Metadata).To(Equal(map[string]interface{}{
+				"spyName":         "unknown",
+				"sampleRate":      float64(100),
+				"units":           "samples",
+				"aggregationType": "sum",
+				"profileType":     "wall",
+			}))
+		})
+
+		It("supports conditional requests", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			put := func(st time.Time) {
+				t := tree.New()
+				t.Insert([]byte("a;b"), uint64(1))
+				key, _ := storage.ParseKey("foo{}")
+				Expect(s.Put(&storage.PutInput{StartTime: st, EndTime: st.Add(9 * time.Second), Key: key, Val: t, SpyName: "gospy", SampleRate: 100})).To(Succeed())
+			}
+			render := func(url, etag string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", url, nil)
+				if etag != "" {
+					r.Header.Set("If-None-Match", etag)
+				}
+				c.renderHandler(w, r)
+				return w
+			}
+
+			put(time.Unix(1600000010, 0))
+			const historical = "/render?format=json&name=foo&from=1600000000&until=1600000030"
+			w := render(historical, "")
+			Expect(w.Code).To(Equal(200))
+			etag := w.Header().Get("ETag")
+			Expect(etag).ToNot(BeEmpty())
+			Expect(w.Header().Get("Cache-Control")).To(Equal("private, max-age=3600"))
+
+			w = render(historical, etag)
+			Expect(w.Code).To(Equal(304))
+			Expect(w.Body.Len()).To(BeZero())
+
+			// new data changes the ETag
+			put(time.Unix(1600000020, 0))
+			w = render(historical, etag)
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Header().Get("ETag")).ToNot(Equal(etag))
+
+			w = render("/render?format=json&name=foo&from=now-1h&until=now", "")
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Header().Get("Cache-Control")).To(Equal("no-cache"))
+		})
+
+		It("aggregates the timeline into steps", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			key, _ := storage.ParseKey("foo{}")
+			for i := 0; i < 6; i++ {
+				t := tree.New()
+				t.Insert([]byte("a"), uint64(1))
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  time.Unix(1600000020+int64(i)*10, 0),
+					EndTime:    time.Unix(1600000029+int64(i)*10, 0),
+					Key:        key,
+					Val:        t,
+					SpyName:    "gospy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&from=1600000000&until=1600000120&step=1m", nil))
+			Expect(w.Code).To(Equal(200))
+
+			var res struct {
+				Timeline segment.Timeline `json:"timeline"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Timeline.StartTime).To(Equal(int64(1599999960)))
+			Expect(res.Timeline.DurationDelta).To(Equal(int64(60)))
+			// all profiles fall into the 1600000020-1600000079 minute, non-empty buckets are offset by 1
+			Expect(res.Timeline.Samples).To(Equal([]uint64{0, 7, 0}))
+
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&step=foo", nil))
+			Expect(w.Code).To(Equal(400))
+
+			// hours start at :30 in UTC+05:30
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&from=1600000000&until=1600000120&step=1h&tz=Asia/Kolkata", nil))
+			Expect(w.Code).To(Equal(200))
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Timeline.StartTime).To(Equal(int64(1599996600)))
+
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&tz=Mars/Olympus", nil))
+			Expect(w.Code).To(Equal(400))
+
+			// smoothing is applied to steps, raw samples are still there
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&from=1600000000&until=1600000120&step=1m&smooth=2", nil))
+			Expect(w.Code).To(Equal(200))
+			res.Timeline = segment.Timeline{}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Timeline.Samples).To(Equal([]uint64{0, 7, 0}))
+			Expect(res.Timeline.SmoothedSamples).To(Equal([]float64{0, 3, 3}))
+
+			for _, smooth := range []string{"0", "-1", "foo"} {
+				w = httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo&smooth="+smooth, nil))
+				Expect(w.Code).To(Equal(400))
+			}
+		})
+
+		It("renders pprof and pprof comparisons of two windows", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			key, _ := storage.ParseKey("foo.cpu{}")
+			for st, b := range map[int64]uint64{1600000000: 10, 1600000100: 25} {
+				t := tree.New()
+				t.Insert([]byte("a;b"), b)
+				t.Insert([]byte("a;c"), 5)
+				Expect(s.Put(&storage.PutInput{
+					StartTime:  time.Unix(st, 0),
+					EndTime:    time.Unix(st+9, 0),
+					Key:        key,
+					Val:        t,
+					SpyName:    "gospy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=pprof&name=foo.cpu&from=1600000100&until=1600000110", nil))
+			Expect(w.Code).To(Equal(200))
+			t, err := convert.ReadTree("pprof", w.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal("\"a;b\" 25\n\"a;c\" 5\n"))
+
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=pprof&name=foo.cpu&from=1600000100&until=1600000110&baseFrom=1600000000&baseUntil=1600000010", nil))
+			Expect(w.Code).To(Equal(200))
+			g, err := gzip.NewReader(w.Body)
+			Expect(err).ToNot(HaveOccurred())
+			p, err := convert.ParsePprof(g)
+			Expect(err).ToNot(HaveOccurred())
+			// a;c didn't change, so only a;b is left
+			Expect(p.Sample).To(HaveLen(1))
+			Expect(p.Sample[0].Value).To(Equal([]int64{15}))
+
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo.cpu&baseFrom=1600000000", nil))
+			Expect(w.Code).To(Equal(400))
+		})
+
+		It("negotiates the format with the Accept header", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.cpu&from=1600000000&until=1600000010", strings.NewReader("a;b 1\na;c 2\n")))
+			Expect(w.Code).To(Equal(200))
+
+			render := func(query, accept string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("GET", "/render?name=foo.cpu&from=1600000000&until=1600000010"+query, nil)
+				if accept != "" {
+					r.Header.Set("Accept", accept)
+				}
+				w := httptest.NewRecorder()
+				c.renderHandler(w, r)
+				Expect(w.Code).To(Equal(200))
+				Expect(w.Header().Get("Vary")).To(Equal("Accept"))
+				return w
+			}
+
+			w = render("", "text/plain")
+			Expect(w.Header().Get("Content-Type")).To(Equal("text/plain; charset=utf-8"))
+			Expect(w.Body.String()).To(Equal("a;b 1\na;c 2\n"))
+
+			w = render("", "text/plain;q=0.5, application/vnd.google.pprof")
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/vnd.google.pprof"))
+			t, err := convert.ReadTree("pprof", w.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.String()).To(Equal("\"a;b\" 1\n\"a;c\" 2\n"))
+
+			for _, accept := range []string{"", "*/*", "image/png", "application/json"} {
+				Expect(render("", accept).Header().Get("Content-Type")).To(Equal("application/json"), accept)
+			}
+
+			// format overrides the header
+			w = render("&format=collapsed", "application/json")
+			Expect(w.Body.String()).To(Equal("a;b 1\na;c 2\n"))
+		})
+
+		It("normalizes values to percentages of the total", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			t := tree.New()
+			t.Insert([]byte("a;b"), uint64(1))
+			t.Insert([]byte("a;c"), uint64(3))
+			key, _ := storage.ParseKey("foo{}")
+			Expect(s.Put(&storage.PutInput{
+				StartTime:  time.Unix(1600000010, 0),
+				EndTime:    time.Unix(1600000019, 0),
+				Key:        key,
+				Val:        t,
+				SpyName:    "gospy",
+				SampleRate: 100,
+			})).To(Succeed())
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			render := func(q string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?name=foo&from=1600000000&until=1600000030"+q, nil))
+				return w
+			}
+			w := render("&format=json&normalize=percent")
+			Expect(w.Code).To(Equal(200))
+			var res struct {
+				Flamebearer tree.Flamebearer       `json:"flamebearer"`
+				Metadata    map[string]interface{} `json:"metadata"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.Metadata["normalize"]).To(Equal("percent"))
+			Expect(res.Flamebearer.NumTicks).To(Equal(4))
+			Expect(res.Flamebearer.Percents[2]).To(ConsistOf(25.0, 25.0, 75.0, 75.0))
+
+			Expect(render("&format=collapsed&normalize=percent").Code).To(Equal(400))
+			Expect(render("&format=json&normalize=ratio").Code).To(Equal(400))
+		})
+
+		It("renders fingerprints of profiles", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo&from=1600000010&until=1600000019",
+				bytes.NewBufferString("main;work;a 5\nmain;work;b 3\nmain;c 2\nmain;d 1\n")))
+			Expect(w.Code).To(Equal(200))
+
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=fingerprint&name=foo&from=1600000000&until=1600000030", nil))
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+			var res renderFingerprint
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res).To(Equal(renderFingerprint{
+				TotalSamples: 11,
+				Nodes:        6,
+				MaxDepth:     3,
+				TopFunctions: []tree.FunctionSelf{
+					{Name: "a", Self: 5},
+					{Name: "b", Self: 3},
+					{Name: "c", Self: 2},
+				},
+			}))
+		})
+
+		It("renders a flamegraph per label value with groupBy", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for name, body := range map[string]string{
+				"foo.cpu{region=eu,host=a}": "main;work 2\n",
+				"foo.cpu{region=eu,host=b}": "main;work 3\n",
+				"foo.cpu{region=us,host=c}": "main;idle 7\n",
+			} {
+				w := httptest.NewRecorder()
+				q := "/ingest?from=1600000010&until=1600000019&sampleRate=100&name=" + url.QueryEscape(name)
+				c.ingestHandler(w, httptest.NewRequest("POST", q, strings.NewReader(body)))
+				Expect(w.Code).To(Equal(200))
+			}
+
+			render := func(q string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?name=foo.cpu&from=1600000000&until=1600000030"+q, nil))
+				return w
+			}
+			w := render("&format=json&groupBy=region")
+			Expect(w.Code).To(Equal(200))
+			var res struct {
+				GroupBy string `json:"groupBy"`
+				Groups  map[string]struct {
+					Flamebearer tree.Flamebearer       `json:"flamebearer"`
+					Timeline    *segment.Timeline      `json:"timeline"`
+					Metadata    map[string]interface{} `json:"metadata"`
+				} `json:"groups"`
+			}
+			Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+			Expect(res.GroupBy).To(Equal("region"))
+			Expect(res.Groups).To(HaveLen(2))
+			Expect(res.Groups["eu"].Flamebearer.NumTicks).To(Equal(5))
+			Expect(res.Groups["eu"].Flamebearer.Names).To(ContainElement("work"))
+			Expect(res.Groups["us"].Flamebearer.NumTicks).To(Equal(7))
+			Expect(res.Groups["us"].Flamebearer.Names).ToNot(ContainElement("work"))
+			Expect(res.Groups["us"].Metadata["profileType"]).To(Equal("cpu"))
+			Expect(res.Groups["us"].Timeline).ToNot(BeNil())
+
+			Expect(render("&format=collapsed&groupBy=region").Code).To(Equal(400))
+			Expect(render("&format=json&groupBy=1region").Code).To(Equal(400))
+		})
+
+		It("orders children by name unless sort=self is set", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo.cpu&from=1600000010&until=1600000019", bytes.NewBufferString("main;a 1\nmain;b 5\n")))
+			Expect(w.Code).To(Equal(200))
+			names := func(params string) []string {
+				w := httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo.cpu&from=1600000000&until=1600000030"+params, nil))
+				Expect(w.Code).To(Equal(200))
+				var res struct {
+					Flamebearer tree.Flamebearer `json:"flamebearer"`
+				}
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				return res.Flamebearer.Names
+			}
+
+			Expect(names("")).To(Equal([]string{"total", "main", "a", "b"}))
+			Expect(names("&sort=name")).To(Equal([]string{"total", "main", "a", "b"}))
+			Expect(names("&sort=self")).To(Equal([]string{"total", "main", "b", "a"}))
+			w = httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name=foo.cpu&sort=foo", nil))
+			Expect(w.Code).To(Equal(400))
+		})
+
+		It("rejects malformed keys", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			name := url.QueryEscape("foo{bar=1")
+			w := httptest.NewRecorder()
+			c.renderHandler(w, httptest.NewRequest("GET", "/render?format=json&name="+name, nil))
+			Expect(w.Code).To(Equal(400))
+			Expect(w.Body.String()).To(ContainSubstring("missing closing }"))
+
+			w = httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name="+url.QueryEscape("foo{1bar=1}"), strings.NewReader("foo;bar 1")))
+			Expect(w.Code).To(Equal(400))
+			Expect(w.Body.String()).To(ContainSubstring(`invalid label name \"1bar\"`))
+		})
+	})
+})
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+)
+
+const (
+	defaultTraceProfilesLimit = 100
+	maxTraceProfilesLimit     = 1000
+)
+
+// errNoTraceProfiles means no profiles are linked to the trace
+type errNoTraceProfiles string
+
+func (e errNoTraceProfiles) Error() string {
+	return fmt.Sprintf("no profiles of trace %s", string(e))
+}
+
+// errMixedTraceProfiles means profiles of the trace are of different types, so they can't be merged
+type errMixedTraceProfiles struct {
+	traceID string
+	a, b    string
+}
+
+func (e errMixedTraceProfiles) Error() string {
+	return fmt.Sprintf("profiles of trace %s are of different types, e.g %s and %s, use name to pick one", e.traceID, e.a, e.b)
+}
+
+// traceSourcesStatus returns the response status of traceSources errors
+func traceSourcesStatus(err error) int {
+	switch err.(type) {
+	case errNoTraceProfiles:
+		return http.StatusNotFound
+	case errMixedTraceProfiles:
+		return http.StatusBadRequest
+	}
+	return storageErrorStatus(err)
+}
+
+// traceSources returns profiles of the trace that match the matcher (nil means all of them) as merge
+// sources, and the time range they span. Only profiles of the same type can be merged.
+func (ctrl *Controller) traceSources(tenant, traceID string, matcher *storage.Key) ([]mergeSource, time.Time, time.Time, error) {
+	var startTime, endTime time.Time
+	profiles, _, err := ctrl.s.TraceProfiles(tenant, traceID, maxTraceProfilesLimit)
+	if err != nil {
+		return nil, startTime, endTime, fmt.Errorf("retrieve profiles of trace: %w", err)
+	}
+
+	sources := []mergeSource{}
+	for _, p := range profiles {
+		if matcher != nil && !p.Key.Matches(matcher) {
+			continue
+		}
+		if len(sources) > 0 && p.Key.ProfileType() != sources[0].key.ProfileType() {
+			return nil, startTime, endTime, errMixedTraceProfiles{traceID: traceID, a: sources[0].key.AppName(), b: p.Key.AppName()}
+		}
+		if startTime.IsZero() || p.StartTime.Before(startTime) {
+			startTime = p.StartTime
+		}
+		if p.EndTime.After(endTime) {
+			endTime = p.EndTime
+		}
+		sources = append(sources, mergeSource{
+			name:      p.Key.AppName(),
+			key:       p.Key,
+			startTime: p.StartTime,
+			endTime:   p.EndTime,
+		})
+	}
+	if len(sources) == 0 {
+		return nil, startTime, endTime, errNoTraceProfiles(traceID)
+	}
+	return sources, startTime, endTime, nil
+}
+
+type traceProfileJSON struct {
+	Name string `json:"name"`
+	// From and Until are the time range of the upload in unix seconds
+	From  int64 `json:"from"`
+	Until int64 `json:"until"`
+}
+
+type traceProfilesJSON struct {
+	Profiles []traceProfileJSON `json:"profiles"`
+	// Truncated is true if more profiles are linked to the trace than the limit
+	Truncated bool `json:"truncated"`
+}
+
+// traceProfilesHandler lists profiles linked to a trace, each of them can be rendered on its own
+// with /render?name=&from=&until=&metadata=traceID=<id>, /render?traceID=<id> merges them
+func (ctrl *Controller) traceProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	q := r.URL.Query()
+	traceID := q.Get("traceID")
+	if err = validateTraceID(traceID); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultTraceProfilesLimit
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxTraceProfilesLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q, must be between 1 and %d", v, maxTraceProfilesLimit))
+			return
+		}
+	}
+
+	profiles, truncated, err := ctrl.s.TraceProfiles(tenant, traceID, limit)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve profiles of trace: %v", err))
+		return
+	}
+	res := traceProfilesJSON{Profiles: make([]traceProfileJSON, len(profiles)), Truncated: truncated}
+	for i, p := range profiles {
+		// the tenant is implied by the request
+		p.Key.SetTenant("")
+		res.Profiles[i] = traceProfileJSON{
+			Name:  p.Key.Normalized(),
+			From:  p.StartTime.Unix(),
+			Until: p.EndTime.Unix(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(res)
+}
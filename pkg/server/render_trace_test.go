@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("trace profiles", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("renders and lists profiles linked to a trace", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			ingest := func(query, body string) int {
+				w := httptest.NewRecorder()
+				c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?"+query, strings.NewReader(body)))
+				return w.Code
+			}
+			Expect(ingest("name=app1.cpu&from=1600000000&until=1600000010&traceID=abc", "a;b 1\n")).To(Equal(200))
+			Expect(ingest("name=app2.cpu&from=1600000020&until=1600000030&traceID=abc", "c 2\n")).To(Equal(200))
+			// same series, but not linked to the trace
+			Expect(ingest("name=app1.cpu&from=1600000020&until=1600000030", "a;d 5\n")).To(Equal(200))
+			Expect(ingest("name=app1.cpu&from=1600000040&until=1600000050&traceID=def", "y 1\n")).To(Equal(200))
+			Expect(ingest("name=app1.inuse_space&from=1600000040&until=1600000050&traceID=def", "x 1\n")).To(Equal(200))
+			Expect(ingest("name=app1.cpu&from=1600000000&until=1600000010&traceID=a:b", "a 1\n")).To(Equal(400))
+
+			render := func(query string) *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				c.renderHandler(w, httptest.NewRequest("GET", "/render?format=collapsed&"+query, nil))
+				return w
+			}
+
+			w := render("traceID=abc")
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("a;b 1\nc 2\n"))
+
+			w = render("traceID=abc&prefix=true")
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("app1.cpu;a;b 1\napp2.cpu;c 2\n"))
+
+			w = render("traceID=abc&name=" + url.QueryEscape("app2.cpu{}"))
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("c 2\n"))
+
+			Expect(render("traceID=def").Code).To(Equal(http.StatusBadRequest))
+			w = render("traceID=def&name=" + url.QueryEscape("app1.inuse_space{}"))
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).To(Equal("x 1\n"))
+
+			Expect(render("traceID=unknown").Code).To(Equal(http.StatusNotFound))
+			Expect(render("traceID=abc&name=" + url.QueryEscape("app3.cpu{}")).Code).To(Equal(http.StatusNotFound))
+			Expect(render("traceID=a:b").Code).To(Equal(http.StatusBadRequest))
+			Expect(render("traceID=abc&groupBy=env").Code).To(Equal(http.StatusBadRequest))
+
+			list := func(query string) (int, traceProfilesJSON) {
+				w := httptest.NewRecorder()
+				c.traceProfilesHandler(w, httptest.NewRequest("GET", "/trace-profiles?"+query, nil))
+				var res traceProfilesJSON
+				if w.Code == http.StatusOK {
+					Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				}
+				return w.Code, res
+			}
+
+			code, res := list("traceID=abc")
+			Expect(code).To(Equal(200))
+			Expect(res).To(Equal(traceProfilesJSON{Profiles: []traceProfileJSON{
+				{Name: "app1.cpu{}", From: 1600000000, Until: 1600000010},
+				{Name: "app2.cpu{}", From: 1600000020, Until: 1600000030},
+			}}))
+
+			code, res = list("traceID=abc&limit=1")
+			Expect(code).To(Equal(200))
+			Expect(res.Profiles).To(HaveLen(1))
+			Expect(res.Truncated).To(BeTrue())
+
+			code, _ = list("traceID=abc&limit=0")
+			Expect(code).To(Equal(http.StatusBadRequest))
+			code, _ = list("traceID=")
+			Expect(code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const maxRetentionBodySize = 4 << 10
+
+type appRetentionJSON struct {
+	Name      string `json:"name"`
+	Retention string `json:"retention,omitempty"`
+	// Override is false when the app uses the global retention
+	Override bool `json:"override"`
+}
+
+// retention returns the retention of the app, the per app override or the global one
+func (ctrl *Controller) retention(tenant, appName string) time.Duration {
+	if d, ok := ctrl.s.AppRetention(tenant, appName); ok {
+		return d
+	}
+	return ctrl.cfg.Retention
+}
+
+// appRetentionHandler manages per app retention overrides. POST sets an override,
+// DELETE makes the app use the global retention again. 0 retention means forever.
+// Changes require ingest authorization, see registerHandlers.
+func (ctrl *Controller) appRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		_, override := ctrl.s.AppRetention(tenant, name)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(appRetentionJSON{
+			Name:      name,
+			Retention: ctrl.retention(tenant, name).String(),
+			Override:  override,
+		})
+	case http.MethodPost, http.MethodDelete:
+		var a appRetentionJSON
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRetentionBodySize)).Decode(&a); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("parse request body: %v", err))
+			return
+		}
+		if a.Name == "" {
+			writeJSONError(w, http.StatusBadRequest, errors.New("name is required"))
+			return
+		}
+		if r.Method == http.MethodPost {
+			d, err := time.ParseDuration(a.Retention)
+			if err != nil || d < 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid retention: %q", a.Retention))
+				return
+			}
+			err = ctrl.s.SetAppRetention(tenant, a.Name, d)
+		} else {
+			err = ctrl.s.DeleteAppRetention(tenant, a.Name)
+		}
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("update retention: %v", err))
+			return
+		}
+		w.WriteHeader(200)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	}
+}
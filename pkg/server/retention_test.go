@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("/apps/retention", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		BeforeEach(func() {
+			(*cfg).Server.Retention = 24 * time.Hour
+		})
+
+		It("overrides the global retention per app", func() {
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			update := func(method, body string) int {
+				w := httptest.NewRecorder()
+				c.appRetentionHandler(w, httptest.NewRequest(method, "/apps/retention", bytes.NewBufferString(body)))
+				return w.Code
+			}
+			get := func(name string) appRetentionJSON {
+				w := httptest.NewRecorder()
+				c.appRetentionHandler(w, httptest.NewRequest("GET", "/apps/retention?name="+name, nil))
+				Expect(w.Code).To(Equal(200))
+				var res appRetentionJSON
+				Expect(json.Unmarshal(w.Body.Bytes(), &res)).To(Succeed())
+				return res
+			}
+			ingest := func(name string) int {
+				until := time.Now().Add(-48 * time.Hour).Unix()
+				w := httptest.NewRecorder()
+				url := fmt.Sprintf("/ingest?name=%s&from=%d&until=%d", name, until-10, until)
+				c.ingestHandler(w, httptest.NewRequest("POST", url, bytes.NewBufferString("a 1\n")))
+				return w.Code
+			}
+
+			Expect(update("POST", `{"name":"critical.cpu","retention":"0s"}`)).To(Equal(200))
+			Expect(update("POST", `{"name":"critical.cpu","retention":"foo"}`)).To(Equal(400))
+			Expect(get("critical.cpu")).To(Equal(appRetentionJSON{Name: "critical.cpu", Retention: "0s", Override: true}))
+			Expect(get("noisy.cpu")).To(Equal(appRetentionJSON{Name: "noisy.cpu", Retention: "24h0m0s"}))
+
+			Expect(ingest("critical.cpu")).To(Equal(200))
+			Expect(ingest("noisy.cpu")).To(Equal(422))
+
+			Expect(update("DELETE", `{"name":"critical.cpu"}`)).To(Equal(200))
+			Expect(get("critical.cpu").Override).To(BeFalse())
+			Expect(ingest("critical.cpu")).To(Equal(422))
+		})
+	})
+})
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/sirupsen/logrus"
+)
+
+// Profiles ingested by third-party tools may not carry a sample rate, without it values
+// can't be interpreted (e.g converted to CPU time). Such profiles are either rejected or
+// get a configured default sample rate.
+
+const (
+	missingSampleRatePolicyDefault = "default"
+	missingSampleRatePolicyReject  = "reject"
+)
+
+var (
+	ingestMissingSampleRate = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_missing_sample_rate_total",
+		Help: "number of ingested profiles without a sample rate, by what was done with them",
+	}, []string{"app", "result"})
+	ingestMissingSampleRateLogThrottle = newThrottle(time.Minute)
+
+	errMissingSampleRate = errors.New("profile doesn't specify a sample rate")
+)
+
+func isValidMissingSampleRatePolicy(p string) bool {
+	return p == "" || p == missingSampleRatePolicyDefault || p == missingSampleRatePolicyReject
+}
+
+// defaultSampleRate is the sample rate of profiles that don't specify one
+func (ctrl *Controller) defaultSampleRate() uint32 {
+	if ctrl.cfg.IngestDefaultSampleRate == 0 {
+		return types.DefaultSampleRate
+	}
+	return uint32(ctrl.cfg.IngestDefaultSampleRate)
+}
+
+// applyMissingSampleRatePolicy makes sure the profile has a sample rate,
+// it returns an error if the profile has to be rejected
+func (ctrl *Controller) applyMissingSampleRatePolicy(ip *ingestParams, appName, client string) error {
+	if ip.sampleRate != 0 {
+		return nil
+	}
+	if ctrl.cfg.MissingSampleRatePolicy == missingSampleRatePolicyReject {
+		ingestMissingSampleRate.WithLabelValues(ctrl.allowedApps.metricLabel(appName), "rejected").Inc()
+		return errMissingSampleRate
+	}
+	ip.sampleRate = ctrl.defaultSampleRate()
+	ingestMissingSampleRate.WithLabelValues(ctrl.allowedApps.metricLabel(appName), "default").Inc()
+	if ingestMissingSampleRateLogThrottle.allow(appName, time.Now()) {
+		logrus.WithFields(logrus.Fields{
+			"app":        appName,
+			"sampleRate": ip.sampleRate,
+			"client":     client,
+		}).Info("ingested profile doesn't specify a sample rate, applied the default one")
+	}
+	return nil
+}
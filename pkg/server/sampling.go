@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/spy"
+)
+
+const (
+	ingestSampleModeRandom = "random"
+	ingestSampleModeApp    = "app"
+)
+
+// ingestSampler decides which ingested profiles are stored. Sampling trades fidelity for cost:
+// with the random mode every app keeps roughly the given share of its profiles, with the app mode
+// the given share of apps keeps all of its profiles and other apps are not stored at all.
+type ingestSampler struct {
+	ratio float64
+	mode  string
+}
+
+func newIngestSampler(ratio float64, mode string) (*ingestSampler, error) {
+	is := &ingestSampler{ratio: ratio, mode: mode}
+	if is.enabled() && mode != ingestSampleModeRandom && mode != ingestSampleModeApp {
+		return nil, fmt.Errorf("unsupported ingest sample mode: %q", mode)
+	}
+	return is, nil
+}
+
+// enabled returns false for ratios outside of (0, 1), in which case all profiles are stored
+func (is *ingestSampler) enabled() bool {
+	return is.ratio > 0 && is.ratio < 1
+}
+
+func (is *ingestSampler) accepts(appName string) bool {
+	if !is.enabled() {
+		return true
+	}
+	if is.mode == ingestSampleModeApp {
+		return float64(hashString(sampledApp(appName)).Sum64()) < is.ratio*math.MaxUint64
+	}
+	return rand.Float64() < is.ratio
+}
+
+// sampledApp strips the profile type suffix (e.g .cpu) from the app name,
+// so that all profile types of an app are either stored or dropped together
+func sampledApp(appName string) string {
+	if i := strings.LastIndex(appName, "."); i != -1 && spy.ProfileType(appName[i+1:]).IsKnown() {
+		return appName[:i]
+	}
+	return appName
+}
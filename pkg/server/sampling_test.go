@@ -0,0 +1,66 @@
+package server
+
+import (
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ingestSampler", func() {
+	It("rejects unsupported modes", func() {
+		_, err := newIngestSampler(0.5, "foo")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("accepts everything when disabled", func() {
+		for _, ratio := range []float64{0, 1} {
+			is, err := newIngestSampler(ratio, "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(is.accepts("foo")).To(BeTrue())
+		}
+	})
+
+	It("keeps roughly the configured share of profiles", func() {
+		is, err := newIngestSampler(0.25, ingestSampleModeRandom)
+		Expect(err).ToNot(HaveOccurred())
+		accepted := 0
+		for i := 0; i < 10000; i++ {
+			if is.accepts("foo") {
+				accepted++
+			}
+		}
+		Expect(accepted).To(BeNumerically("~", 2500, 250))
+	})
+
+	It("makes the same decision for all profiles of an app in app mode", func() {
+		is, err := newIngestSampler(0.25, ingestSampleModeApp)
+		Expect(err).ToNot(HaveOccurred())
+		accepted := 0
+		for i := 0; i < 1000; i++ {
+			app := "app-" + strconv.Itoa(i)
+			decision := is.accepts(app)
+			Expect(is.accepts(app)).To(Equal(decision))
+			if decision {
+				accepted++
+			}
+		}
+		Expect(accepted).To(BeNumerically("~", 250, 60))
+	})
+
+	It("makes the same decision for all profile types of an app in app mode", func() {
+		is, err := newIngestSampler(0.5, ingestSampleModeApp)
+		Expect(err).ToNot(HaveOccurred())
+		decisions := map[bool]int{}
+		for i := 0; i < 100; i++ {
+			app := "app-" + strconv.Itoa(i)
+			decision := is.accepts(app + ".cpu")
+			for _, pt := range []string{"alloc_objects", "alloc_space", "inuse_objects", "inuse_space"} {
+				Expect(is.accepts(app + "." + pt)).To(Equal(decision))
+			}
+			decisions[decision]++
+		}
+		// both decisions happen, i.e apps aren't all sampled the same way
+		Expect(decisions).To(HaveLen(2))
+	})
+})
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// semaphore limits the number of concurrent operations. A nil semaphore doesn't limit anything.
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n <= 0 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot for at most timeout. It returns false if it couldn't get one.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
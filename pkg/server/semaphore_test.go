@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("semaphore", func() {
+	It("limits the number of concurrent operations", func() {
+		s := newSemaphore(1)
+		Expect(s.acquire(context.Background(), time.Millisecond)).To(BeTrue())
+		Expect(s.acquire(context.Background(), time.Millisecond)).To(BeFalse())
+		s.release()
+		Expect(s.acquire(context.Background(), time.Millisecond)).To(BeTrue())
+	})
+
+	It("doesn't limit anything when the limit is 0", func() {
+		s := newSemaphore(0)
+		for i := 0; i < 10; i++ {
+			Expect(s.acquire(context.Background(), 0)).To(BeTrue())
+		}
+	})
+})
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"time"
+)
+
+const (
+	clockSkewPolicyAdjust = "adjust"
+	clockSkewPolicyReject = "reject"
+)
+
+// clockSkew returns how far ahead of the server clock the end of the profile is.
+// Negative values mean the profile ends in the past.
+func clockSkew(until, now time.Time) time.Duration {
+	return until.Sub(now)
+}
+
+func isValidClockSkewPolicy(p string) bool {
+	return p == clockSkewPolicyAdjust || p == clockSkewPolicyReject
+}
+
+// skewExceeds returns true if the skew is outside of the tolerance. Zero tolerance disables the check.
+func skewExceeds(skew, tolerance time.Duration) bool {
+	if tolerance <= 0 {
+		return false
+	}
+	return skew > tolerance || skew < -tolerance
+}
+
+// adjustForSkew shifts the profile time range so that it ends at server time, preserving its duration
+func adjustForSkew(ip *ingestParams, skew time.Duration) {
+	ip.from = ip.from.Add(-skew)
+	ip.until = ip.until.Add(-skew)
+}
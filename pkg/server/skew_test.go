@@ -0,0 +1,39 @@
+package server
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("clock skew", func() {
+	DescribeTable("skewExceeds",
+		func(skew, tolerance time.Duration, expected bool) {
+			Expect(skewExceeds(skew, tolerance)).To(Equal(expected))
+		},
+		Entry("disabled", time.Hour, time.Duration(0), false),
+		Entry("within tolerance", time.Minute, time.Hour, false),
+		Entry("in the future", 2*time.Hour, time.Hour, true),
+		Entry("in the past", -2*time.Hour, time.Hour, true),
+	)
+
+	It("adjusts timestamps preserving duration", func() {
+		now := time.Unix(1000, 0)
+		ip := &ingestParams{from: time.Unix(4590, 0), until: time.Unix(4600, 0)}
+		adjustForSkew(ip, clockSkew(ip.until, now))
+		Expect(ip.from).To(Equal(time.Unix(990, 0)))
+		Expect(ip.until).To(Equal(now))
+	})
+
+	DescribeTable("outsideRetention",
+		func(age, retention time.Duration, expected bool) {
+			now := time.Unix(100000, 0)
+			Expect(outsideRetention(now.Add(-age), now, retention)).To(Equal(expected))
+		},
+		Entry("disabled", 24*time.Hour, time.Duration(0), false),
+		Entry("within retention", time.Hour, 24*time.Hour, false),
+		Entry("older than retention", 25*time.Hour, 24*time.Hour, true),
+	)
+})
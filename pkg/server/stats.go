@@ -1,6 +1,11 @@
 package server
 
-import "github.com/twmb/murmur3"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/twmb/murmur3"
+)
 
 const seed = 6231912
 
@@ -10,15 +15,37 @@ func (hs hashString) Sum64() uint64 {
 	return murmur3.SeedSum64(seed, []byte(hs))
 }
 
-func (ctrl *Controller) statsInc(name string) {
-	ctrl.statsMutex.Lock()
-	defer ctrl.statsMutex.Unlock()
+// counters is a set of named counters safe for concurrent use.
+// Incrementing an existing counter doesn't take any locks, so that hot counters (e.g ingest)
+// don't serialize concurrent requests. New names are rare, they only appear once per spy name or handler.
+type counters struct {
+	m sync.Map // name -> *int64
+}
+
+func (c *counters) inc(name string) {
+	v, ok := c.m.Load(name)
+	if !ok {
+		v, _ = c.m.LoadOrStore(name, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+}
+
+func (c *counters) snapshot() map[string]int {
+	res := make(map[string]int)
+	c.m.Range(func(k, v interface{}) bool {
+		res[k.(string)] = int(atomic.LoadInt64(v.(*int64)))
+		return true
+	})
+	return res
+}
 
-	ctrl.stats[name]++
+func (ctrl *Controller) statsInc(name string) {
+	ctrl.stats.inc(name)
 }
 
+// Stats returns a copy of the request counters
 func (ctrl *Controller) Stats() map[string]int {
-	return ctrl.stats
+	return ctrl.stats.snapshot()
 }
 
 func (ctrl *Controller) AppsCount() int {
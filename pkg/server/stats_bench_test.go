@@ -0,0 +1,38 @@
+package server
+
+import (
+	"sync"
+	"testing"
+)
+
+// mutexCounters is how request counters used to be implemented, kept as a baseline
+type mutexCounters struct {
+	m     sync.Mutex
+	stats map[string]int
+}
+
+func (c *mutexCounters) inc(name string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.stats[name]++
+}
+
+var benchStatsNames = []string{"ingest", "ingest:gospy", "render", "index"}
+
+func BenchmarkStatsIncMutex(b *testing.B) {
+	c := &mutexCounters{stats: make(map[string]int)}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.inc(benchStatsNames[i%len(benchStatsNames)])
+		}
+	})
+}
+
+func BenchmarkStatsInc(b *testing.B) {
+	c := &counters{}
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			c.inc(benchStatsNames[i%len(benchStatsNames)])
+		}
+	})
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("counters", func() {
+	It("counts concurrent increments", func() {
+		c := &counters{}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					c.inc("ingest")
+					if j%10 == 0 {
+						c.inc("render")
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(c.snapshot()).To(Equal(map[string]int{"ingest": 8000, "render": 800}))
+	})
+})
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+type appStorageStatsJSON struct {
+	App   string `json:"app"`
+	Bytes uint64 `json:"bytes"`
+}
+
+func (ctrl *Controller) storageStatsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	app := r.URL.Query().Get("app")
+	if app == "" {
+		writeJSONError(w, http.StatusBadRequest, errors.New("app is required"))
+		return
+	}
+	n, err := ctrl.s.AppDiskUsage(tenant, app)
+	if err != nil {
+		writeJSONError(w, storageErrorStatus(err), fmt.Errorf("compute disk usage: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(appStorageStatsJSON{App: app, Bytes: n})
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+const (
+	// subscribers that don't keep up lose events instead of slowing down ingestion
+	ingestStreamBufferSize = 64
+	// heartbeats keep idle connections from being closed by proxies and detect clients that are gone
+	ingestStreamHeartbeatInterval = 15 * time.Second
+	// the server write timeout would cut streams, every write gets this much time instead
+	ingestStreamWriteTimeout = 10 * time.Second
+)
+
+type ingestEvent struct {
+	App         string `json:"app"`
+	Size        int64  `json:"size"`
+	Timestamp   int64  `json:"timestamp"`
+	TopFunction string `json:"topFunction"`
+
+	tenant string
+}
+
+type ingestSubscriber struct {
+	tenant string
+	ch     chan *ingestEvent
+}
+
+// ingestStream fans out events about ingested profiles to live subscribers
+type ingestStream struct {
+	m    sync.RWMutex
+	max  int
+	subs map[*ingestSubscriber]struct{}
+
+	heartbeatInterval time.Duration
+}
+
+func newIngestStream(maxSubscribers int) *ingestStream {
+	return &ingestStream{
+		max:  maxSubscribers,
+		subs: make(map[*ingestSubscriber]struct{}),
+
+		heartbeatInterval: ingestStreamHeartbeatInterval,
+	}
+}
+
+// subscribe returns nil if there are too many subscribers already
+func (is *ingestStream) subscribe(tenant string) *ingestSubscriber {
+	is.m.Lock()
+	defer is.m.Unlock()
+	if len(is.subs) >= is.max {
+		return nil
+	}
+	s := &ingestSubscriber{
+		tenant: tenant,
+		ch:     make(chan *ingestEvent, ingestStreamBufferSize),
+	}
+	is.subs[s] = struct{}{}
+	return s
+}
+
+func (is *ingestStream) unsubscribe(s *ingestSubscriber) {
+	is.m.Lock()
+	defer is.m.Unlock()
+	delete(is.subs, s)
+}
+
+// active is a cheap check that allows to skip building events when nobody is listening
+func (is *ingestStream) active() bool {
+	is.m.RLock()
+	defer is.m.RUnlock()
+	return len(is.subs) > 0
+}
+
+// publish never blocks, events are dropped for subscribers with full buffers
+func (is *ingestStream) publish(ev *ingestEvent) {
+	is.m.RLock()
+	defer is.m.RUnlock()
+	for s := range is.subs {
+		if s.tenant != ev.tenant {
+			continue
+		}
+		select {
+		case s.ch <- ev:
+		default:
+		}
+	}
+}
+
+// topFunction returns the function with the highest self value
+func topFunction(t *tree.Tree) string {
+	if top := t.TopFunctions(1); len(top) > 0 {
+		return top[0].Name
+	}
+	return ""
+}
+
+func (ctrl *Controller) ingestStreamHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	sub := ctrl.ingestStream.subscribe(tenant)
+	if sub == nil {
+		writeJSONError(w, http.StatusTooManyRequests, errors.New("too many ingest stream subscribers"))
+		return
+	}
+	defer ctrl.ingestStream.unsubscribe(sub)
+
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	// write sends a message, failed writes end the stream and so drop the subscriber
+	write := func(format string, a ...interface{}) bool {
+		if conn != nil {
+			conn.SetWriteDeadline(time.Now().Add(ingestStreamWriteTimeout))
+		}
+		if _, err := fmt.Fprintf(w, format, a...); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// EventSource clients reconnect on their own if the connection is closed anyway
+	if !write("retry: 1000\n\n") {
+		return
+	}
+
+	heartbeat := time.NewTicker(ctrl.ingestStream.heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// comments are ignored by EventSource clients
+			if !write(": heartbeat\n\n") {
+				return
+			}
+		case ev := <-sub.ch:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				return
+			}
+			if !write("event: ingest\ndata: %s\n\n", b) {
+				return
+			}
+		}
+	}
+}
+
+type connContextKey struct{}
+
+// withConn makes the connection available to handlers of long lived responses, so that they can manage
+// its write deadline instead of being cut by the server write timeout
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+func (ctrl *Controller) publishIngestEvent(tenant, app string, size int64, t *tree.Tree) {
+	if !ctrl.ingestStream.active() {
+		return
+	}
+	ctrl.ingestStream.publish(&ingestEvent{
+		App:         app,
+		Size:        size,
+		Timestamp:   time.Now().Unix(),
+		TopFunction: topFunction(t),
+		tenant:      tenant,
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("ingestStream", func() {
+	It("limits the number of subscribers", func() {
+		is := newIngestStream(1)
+		s := is.subscribe("")
+		Expect(s).ToNot(BeNil())
+		Expect(is.subscribe("")).To(BeNil())
+		is.unsubscribe(s)
+		Expect(is.subscribe("")).ToNot(BeNil())
+	})
+
+	It("doesn't block on slow subscribers", func() {
+		is := newIngestStream(1)
+		s := is.subscribe("")
+		for i := 0; i < ingestStreamBufferSize*2; i++ {
+			is.publish(&ingestEvent{App: "foo"})
+		}
+		Expect(s.ch).To(HaveLen(ingestStreamBufferSize))
+	})
+
+	It("only sends events of the subscriber's tenant", func() {
+		is := newIngestStream(2)
+		s := is.subscribe("team-a")
+		is.publish(&ingestEvent{App: "foo"})
+		is.publish(&ingestEvent{App: "bar", tenant: "team-a"})
+		Expect(s.ch).To(HaveLen(1))
+		Expect((<-s.ch).App).To(Equal("bar"))
+	})
+
+	testing.WithConfig(func(cfg **config.Config) {
+		It("streams ingested profiles", func() {
+			(*cfg).Server.MaxIngestStreamSubscribers = 1
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			srv := httptest.NewServer(http.HandlerFunc(c.ingestStreamHandler))
+			defer srv.Close()
+			resp, err := http.Get(srv.URL)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+			Eventually(c.ingestStream.active).Should(BeTrue())
+
+			body := "a;b 1\na;c 3\n"
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo&from=1&until=10", strings.NewReader(body)))
+			Expect(w.Code).To(Equal(200))
+
+			sc := bufio.NewScanner(resp.Body)
+			var data string
+			for sc.Scan() {
+				if strings.HasPrefix(sc.Text(), "data: ") {
+					data = strings.TrimPrefix(sc.Text(), "data: ")
+					break
+				}
+			}
+			var ev ingestEvent
+			Expect(json.Unmarshal([]byte(data), &ev)).To(Succeed())
+			Expect(ev.App).To(Equal("foo"))
+			Expect(ev.Size).To(Equal(int64(len(body))))
+			Expect(ev.TopFunction).To(Equal("c"))
+		})
+
+		It("keeps streaming past the server write timeout", func() {
+			(*cfg).Server.MaxIngestStreamSubscribers = 1
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			c.ingestStream.heartbeatInterval = 20 * time.Millisecond
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(c.ingestStreamHandler))
+			srv.Config.WriteTimeout = 100 * time.Millisecond
+			srv.Config.ConnContext = withConn
+			srv.Start()
+			defer srv.Close()
+			resp, err := http.Get(srv.URL)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(c.ingestStream.active).Should(BeTrue())
+
+			sc := bufio.NewScanner(resp.Body)
+			start := time.Now()
+			heartbeats := 0
+			for time.Since(start) < 300*time.Millisecond && sc.Scan() {
+				if sc.Text() == ": heartbeat" {
+					heartbeats++
+				}
+			}
+			Expect(heartbeats).To(BeNumerically(">", 1))
+
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo&from=1&until=10", strings.NewReader("a;b 1\n")))
+			Expect(w.Code).To(Equal(200))
+			for sc.Scan() && sc.Text() != "event: ingest" {
+			}
+			Expect(sc.Text()).To(Equal("event: ingest"))
+
+			// the subscriber is dropped once the client is gone
+			resp.Body.Close()
+			Eventually(c.ingestStream.active).Should(BeFalse())
+		})
+	})
+})
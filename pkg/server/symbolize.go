@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+	"github.com/pyroscope-io/pyroscope/pkg/symbolizer"
+)
+
+// symbolizeCacheSize is the number of addresses resolutions cached per symbolizer
+const symbolizeCacheSize = 1 << 16
+
+var (
+	// frames that are nothing but an address, e.g "0x4a3f2c"
+	rawAddressRe = regexp.MustCompile(`^0x[0-9a-fA-F]{1,16}$`)
+
+	ingestSymbolizedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pyroscope_ingest_symbolized_frames_total",
+		Help: "number of raw address frames of ingested profiles, by whether they were resolved to a function name",
+	}, []string{"app", "result"})
+)
+
+type appSymbolizer struct {
+	pattern appAllowlist
+	s       symbolizer.Symbolizer
+}
+
+// ingestSymbolizer resolves raw addresses in profiles of some apps, e.g of stripped binaries,
+// to function names. Addresses that can't be resolved are kept as is.
+type ingestSymbolizer []appSymbolizer
+
+// newIngestSymbolizer takes symbolizers of apps as app pattern to <kind>:<source> pairs,
+// see symbolizer.Open
+func newIngestSymbolizer(sources map[string]string) (ingestSymbolizer, error) {
+	patterns := make([]string, 0, len(sources))
+	for p := range sources {
+		patterns = append(patterns, p)
+	}
+	// the first matching pattern wins, sorting makes it deterministic
+	sort.Strings(patterns)
+
+	var res ingestSymbolizer
+	for _, p := range patterns {
+		al, err := newAppAllowlist([]string{p})
+		if err != nil {
+			return nil, err
+		}
+		if len(al) == 0 {
+			continue
+		}
+		s, err := symbolizer.Open(sources[p])
+		if err != nil {
+			return nil, fmt.Errorf("symbolizer of %q: %v", p, err)
+		}
+		res = append(res, appSymbolizer{pattern: al, s: symbolizer.NewCache(s, symbolizeCacheSize)})
+	}
+	return res, nil
+}
+
+// forApp returns the symbolizer of the app, nil if it doesn't have one
+func (is ingestSymbolizer) forApp(appName string) symbolizer.Symbolizer {
+	for _, as := range is {
+		if as.pattern.allows(appName) {
+			return as.s
+		}
+	}
+	return nil
+}
+
+// symbolize resolves raw addresses in frame names, appLabel is the app label of the symbolization metrics
+func symbolize(t *tree.Tree, s symbolizer.Symbolizer, appLabel string) *tree.Tree {
+	resolved, unresolved := 0, 0
+	res := t.MapNames(func(name []byte) []byte {
+		if !rawAddressRe.Match(name) {
+			return name
+		}
+		addr, err := strconv.ParseUint(string(name[2:]), 16, 64)
+		if err != nil {
+			unresolved++
+			return name
+		}
+		fn, ok := s.Symbolize(addr)
+		if !ok {
+			unresolved++
+			return name
+		}
+		resolved++
+		return []byte(fn)
+	})
+	ingestSymbolizedFrames.WithLabelValues(appLabel, "resolved").Add(float64(resolved))
+	ingestSymbolizedFrames.WithLabelValues(appLabel, "unresolved").Add(float64(unresolved))
+	return res
+}
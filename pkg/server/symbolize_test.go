@@ -0,0 +1,59 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("ingestSymbolizer", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("resolves raw addresses of ingested profiles", func() {
+			path := filepath.Join((*cfg).Server.StoragePath, "perf-1.map")
+			Expect(ioutil.WriteFile(path, []byte("1000 100 foo\n1100 100 bar\n"), 0644)).To(Succeed())
+			(*cfg).Server.SymbolizeApps = map[string]string{"native.*": "perfmap:" + path}
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			body := "0x1010;0x1104 1\n0x10ff;0x1104 2\n0x1010;0x9999 3\n"
+			for _, name := range []string{"native.cpu", "other.cpu"} {
+				w := httptest.NewRecorder()
+				q := "/ingest?from=1600000000&until=1600000010&name=" + name
+				c.ingestHandler(w, httptest.NewRequest("POST", q, strings.NewReader(body)))
+				Expect(w.Code).To(Equal(200))
+			}
+
+			get := func(name string) string {
+				sk, _ := storage.ParseKey(name)
+				gOut, err := s.Get(&storage.GetInput{
+					StartTime: time.Unix(1600000000, 0),
+					EndTime:   time.Unix(1600000010, 0),
+					Key:       sk,
+				})
+				Expect(err).ToNot(HaveOccurred())
+				return gOut.Tree.String()
+			}
+			Expect(get("native.cpu")).To(Equal("\"foo;0x9999\" 3\n\"foo;bar\" 3\n"))
+			Expect(get("other.cpu")).To(Equal("\"0x1010;0x1104\" 1\n\"0x1010;0x9999\" 3\n\"0x10ff;0x1104\" 2\n"))
+		})
+
+		It("fails on invalid sources", func() {
+			(*cfg).Server.SymbolizeApps = map[string]string{"native.*": "perfmap:" + filepath.Join(os.TempDir(), "missing.map")}
+			_, err := New(&(*cfg).Server, nil)
+			Expect(err).To(MatchError(ContainSubstring(`symbolizer of "native.*"`)))
+		})
+	})
+})
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// Symbol normalization rules. Names of the same function can differ between profiles
+// (or even within a single profile), which fragments flamegraphs.
+const (
+	// strips address suffixes, e.g "foo+0x1a" or "foo @ 0x7f3a"
+	symbolRuleAddresses = "addresses"
+	// collapses generic instantiations, e.g "Foo[int]" and "Foo[string]" both become "Foo[...]"
+	symbolRuleGenerics = "generics"
+	// collapses numbered closures and lambdas, e.g "main.foo.func2" becomes "main.foo.func"
+	symbolRuleLambdas = "lambdas"
+)
+
+var (
+	addressSuffixRe = regexp.MustCompile(`\s*(\+|@\s*)0x[0-9a-fA-F]+$`)
+	goClosureRe     = regexp.MustCompile(`\.func\d+(\.\d+)*$`)
+	javaLambdaRe    = regexp.MustCompile(`\$\$Lambda\$\d+(/0x[0-9a-fA-F]+)?`)
+)
+
+var symbolRules = map[string]func(string) string{
+	symbolRuleAddresses: func(s string) string {
+		return addressSuffixRe.ReplaceAllString(s, "")
+	},
+	symbolRuleGenerics: collapseGenerics,
+	symbolRuleLambdas: func(s string) string {
+		s = goClosureRe.ReplaceAllString(s, ".func")
+		return javaLambdaRe.ReplaceAllString(s, "$$$$Lambda")
+	},
+}
+
+// symbolNormalizer rewrites symbol names of ingested profiles. It's opt-in per app.
+type symbolNormalizer struct {
+	apps  appAllowlist
+	rules []func(string) string
+}
+
+// newSymbolNormalizer returns a normalizer for apps matching the patterns. An empty list
+// of rules means all of them.
+func newSymbolNormalizer(apps, rules []string) (*symbolNormalizer, error) {
+	al, err := newAppAllowlist(apps)
+	if err != nil {
+		return nil, err
+	}
+	sn := &symbolNormalizer{apps: al}
+	if len(rules) == 0 {
+		rules = []string{symbolRuleAddresses, symbolRuleGenerics, symbolRuleLambdas}
+	}
+	for _, r := range rules {
+		fn, ok := symbolRules[strings.TrimSpace(r)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported symbol normalization rule: %q", r)
+		}
+		sn.rules = append(sn.rules, fn)
+	}
+	return sn, nil
+}
+
+func (sn *symbolNormalizer) enabledFor(appName string) bool {
+	// unlike with the allowlist an empty list means no apps
+	return len(sn.apps) > 0 && sn.apps.allows(appName)
+}
+
+func (sn *symbolNormalizer) normalizeName(name string) string {
+	for _, fn := range sn.rules {
+		name = fn(name)
+	}
+	return name
+}
+
+func (sn *symbolNormalizer) normalize(t *tree.Tree) *tree.Tree {
+	return t.MapNames(func(name []byte) []byte {
+		return []byte(sn.normalizeName(string(name)))
+	})
+}
+
+// collapseGenerics replaces contents of balanced top level [] and <> groups with "...".
+// Unbalanced brackets, e.g in "operator<", are left as is.
+func collapseGenerics(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '[' && c != '<' {
+			sb.WriteByte(c)
+			continue
+		}
+		end := matchingBracket(s, i)
+		if end == -1 {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte(c)
+		sb.WriteString("...")
+		sb.WriteByte(s[end])
+		i = end
+	}
+	return sb.String()
+}
+
+// matchingBracket returns the index of the bracket closing the one at i, or -1
+func matchingBracket(s string, i int) int {
+	stack := []byte{}
+	for j := i; j < len(s); j++ {
+		switch s[j] {
+		case '[', '<':
+			stack = append(stack, s[j])
+		case ']', '>':
+			if len(stack) == 0 {
+				return -1
+			}
+			open := stack[len(stack)-1]
+			if (open == '[' && s[j] != ']') || (open == '<' && s[j] != '>') {
+				return -1
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return j
+			}
+		}
+	}
+	return -1
+}
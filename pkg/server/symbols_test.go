@@ -0,0 +1,52 @@
+package server
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+var _ = Describe("symbolNormalizer", func() {
+	It("rejects unknown rules", func() {
+		_, err := newSymbolNormalizer([]string{"*"}, []string{"foo"})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("is opt-in per app", func() {
+		sn, err := newSymbolNormalizer([]string{"foo.*"}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sn.enabledFor("foo.cpu")).To(BeTrue())
+		Expect(sn.enabledFor("bar.cpu")).To(BeFalse())
+
+		sn, err = newSymbolNormalizer(nil, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sn.enabledFor("foo.cpu")).To(BeFalse())
+	})
+
+	DescribeTable("normalizeName",
+		func(rules []string, name, expected string) {
+			sn, err := newSymbolNormalizer([]string{"*"}, rules)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(sn.normalizeName(name)).To(Equal(expected))
+		},
+		Entry("address suffix", []string{"addresses"}, "foo+0x1a", "foo"),
+		Entry("address with at", []string{"addresses"}, "libc.so @ 0x7f3a", "libc.so"),
+		Entry("go generics", []string{"generics"}, "main.Foo[int]", "main.Foo[...]"),
+		Entry("nested generics", []string{"generics"}, "Map<String, List<Integer>>.get", "Map<...>.get"),
+		Entry("unbalanced brackets", []string{"generics"}, "operator<", "operator<"),
+		Entry("go closures", []string{"lambdas"}, "main.foo.func2.1", "main.foo.func"),
+		Entry("java lambdas", []string{"lambdas"}, "Foo$$Lambda$123/0x0000000800c0b000.run", "Foo$$Lambda.run"),
+		Entry("all rules", nil, "main.Foo[int].func1", "main.Foo[...].func"),
+	)
+
+	It("merges frames that normalize to the same name", func() {
+		sn, err := newSymbolNormalizer([]string{"*"}, []string{"generics"})
+		Expect(err).ToNot(HaveOccurred())
+		t := tree.New()
+		t.Insert([]byte("main;Foo[int]"), uint64(1))
+		t.Insert([]byte("main;Foo[string]"), uint64(2))
+		Expect(sn.normalize(t).String()).To(Equal("\"main;Foo[...]\" 3\n"))
+	})
+})
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// tenantHeader is the header used to scope ingestion and queries to a tenant.
+// The name is the same as in Cortex and Loki, so existing proxies can be reused.
+const tenantHeader = "X-Scope-OrgID"
+
+const maxTenantIDLength = 150
+
+var tenantIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.\-]+$`)
+
+// tenantID returns the tenant of the request. Requests without the header belong to the default tenant.
+func tenantID(r *http.Request) (string, error) {
+	id := r.Header.Get(tenantHeader)
+	if !validTenantID(id) {
+		return "", fmt.Errorf("invalid %s header %q", tenantHeader, id)
+	}
+	return id, nil
+}
+
+// validTenantID tells whether id can be used as a tenant ID, an empty id is the default tenant
+func validTenantID(id string) bool {
+	return id == "" || len(id) <= maxTenantIDLength && tenantIDRegexp.MatchString(id)
+}
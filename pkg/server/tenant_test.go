@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tenantID", func() {
+	DescribeTable("parses the tenant header",
+		func(header, expected string, valid bool) {
+			r, _ := http.NewRequest("GET", "/render", nil)
+			if header != "" {
+				r.Header.Set(tenantHeader, header)
+			}
+			id, err := tenantID(r)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal(expected))
+		},
+		Entry("no header", "", "", true),
+		Entry("valid tenant", "team-a", "team-a", true),
+		Entry("invalid characters", "team:a", "", false),
+		Entry("too long", strings.Repeat("a", maxTenantIDLength+1), "", false),
+	)
+})
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle allows an action at most once per interval for each key.
+// It's used to keep noisy per-app warnings from flooding the logs.
+type throttle struct {
+	interval time.Duration
+
+	m          sync.Mutex
+	last       map[string]time.Time
+	lastPruned time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	return &throttle{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+func (t *throttle) allow(key string, now time.Time) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if l, ok := t.last[key]; ok && now.Sub(l) < t.interval {
+		return false
+	}
+	t.last[key] = now
+	t.prune(now)
+	return true
+}
+
+// prune drops keys that haven't been seen for longer than the interval so that
+// keys which stop showing up don't accumulate. Sweeps at most once per interval.
+func (t *throttle) prune(now time.Time) {
+	if now.Sub(t.lastPruned) < t.interval {
+		return
+	}
+	t.lastPruned = now
+	for k, l := range t.last {
+		if now.Sub(l) >= t.interval {
+			delete(t.last, k)
+		}
+	}
+}
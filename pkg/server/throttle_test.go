@@ -0,0 +1,31 @@
+package server
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("throttle", func() {
+	It("allows an action once per interval for each key", func() {
+		t := newThrottle(time.Minute)
+		now := time.Now()
+
+		Expect(t.allow("foo", now)).To(BeTrue())
+		Expect(t.allow("foo", now.Add(time.Second))).To(BeFalse())
+		Expect(t.allow("bar", now.Add(time.Second))).To(BeTrue())
+		Expect(t.allow("foo", now.Add(time.Minute))).To(BeTrue())
+	})
+
+	It("forgets keys that are no longer seen", func() {
+		t := newThrottle(time.Minute)
+		now := time.Now()
+
+		Expect(t.allow("foo", now)).To(BeTrue())
+		Expect(t.allow("bar", now.Add(30*time.Second))).To(BeTrue())
+		Expect(t.allow("baz", now.Add(2*time.Minute))).To(BeTrue())
+		Expect(t.last).To(HaveLen(1))
+		Expect(t.last).To(HaveKey("baz"))
+	})
+})
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pyroscope-io/pyroscope/pkg/agent/types"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/util/attime"
+)
+
+const (
+	defaultTopFunctionsLimit = 10
+	maxTopFunctionsLimit     = 1000
+	// every app contributes only its hottest functions, so that merging stays cheap with many apps
+	topFunctionsPerApp = 1000
+)
+
+type topFunctionAppJSON struct {
+	App  string `json:"app"`
+	Self uint64 `json:"self"`
+}
+
+type topFunctionJSON struct {
+	Name string               `json:"name"`
+	Self uint64               `json:"self"`
+	Apps []topFunctionAppJSON `json:"apps"`
+}
+
+type topFunctionsJSON struct {
+	Functions []topFunctionJSON `json:"functions"`
+	// Apps is the number of apps that were looked at
+	Apps int `json:"apps"`
+	// Truncated is true when the app limit or the timeout was hit and not every app was looked at
+	Truncated bool `json:"truncated"`
+}
+
+// topFunctionsHandler ranks functions by self value across all apps of a profile type (e.g cpu),
+// with the share of every app. Values are normalized to the default sample rate.
+func (ctrl *Controller) topFunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ctrl.renderSem.acquire(r.Context(), ctrl.cfg.RenderQueueTimeout) {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusTooManyRequests, errors.New("too many concurrent render requests"))
+		return
+	}
+	defer ctrl.renderSem.release()
+
+	q := r.URL.Query()
+	tenant, err := tenantID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	profileType := q.Get("profileType")
+	if profileType == "" {
+		profileType = "cpu"
+	}
+	limit := defaultTopFunctionsLimit
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxTopFunctionsLimit {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %q, must be between 1 and %d", l, maxTopFunctionsLimit))
+			return
+		}
+	}
+	startTime := attime.Parse(q.Get("from"))
+	endTime := attime.Parse(q.Get("until"))
+
+	var apps []string
+	ctrl.s.GetValues(tenant, "__name__", func(v string) bool {
+		if strings.HasSuffix(v, "."+profileType) {
+			apps = append(apps, v)
+		}
+		return true
+	})
+	sort.Strings(apps)
+
+	res := topFunctionsJSON{Functions: []topFunctionJSON{}}
+	if max := ctrl.cfg.TopFunctionsMaxApps; max > 0 && len(apps) > max {
+		apps = apps[:max]
+		res.Truncated = true
+	}
+
+	ctx := r.Context()
+	if ctrl.cfg.TopFunctionsTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ctrl.cfg.TopFunctionsTimeout)
+		defer cancel()
+	}
+
+	functions := map[string]*topFunctionJSON{}
+	for _, app := range apps {
+		if ctx.Err() != nil {
+			res.Truncated = true
+			break
+		}
+		key, err := storage.ParseKey(app)
+		if err != nil {
+			continue
+		}
+		key.SetTenant(tenant)
+		gOut, err := ctrl.s.Get(&storage.GetInput{
+			StartTime: startTime,
+			EndTime:   endTime,
+			Key:       key,
+		})
+		if err != nil {
+			writeJSONError(w, storageErrorStatus(err), fmt.Errorf("retrieve profile of %s: %v", app, err))
+			return
+		}
+		res.Apps++
+		if gOut == nil {
+			continue
+		}
+		for _, fn := range gOut.Tree.TopFunctions(topFunctionsPerApp) {
+			if gOut.SampleRate != 0 && gOut.SampleRate != types.DefaultSampleRate {
+				fn.Self = fn.Self * types.DefaultSampleRate / uint64(gOut.SampleRate)
+			}
+			f, ok := functions[fn.Name]
+			if !ok {
+				f = &topFunctionJSON{Name: fn.Name}
+				functions[fn.Name] = f
+			}
+			f.Self += fn.Self
+			f.Apps = append(f.Apps, topFunctionAppJSON{App: app, Self: fn.Self})
+		}
+	}
+
+	for _, f := range functions {
+		sort.SliceStable(f.Apps, func(i, j int) bool {
+			return f.Apps[i].Self > f.Apps[j].Self
+		})
+		res.Functions = append(res.Functions, *f)
+	}
+	sort.Slice(res.Functions, func(i, j int) bool {
+		a, b := res.Functions[i], res.Functions[j]
+		return a.Self > b.Self || (a.Self == b.Self && a.Name < b.Name)
+	})
+	if len(res.Functions) > limit {
+		res.Functions = res.Functions[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(res)
+}
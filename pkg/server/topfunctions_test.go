@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("top functions", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		var c *Controller
+		withController := func(f func()) func() {
+			return func() {
+				s, err := storage.New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+				c, err = New(&(*cfg).Server, s)
+				Expect(err).ToNot(HaveOccurred())
+				f()
+			}
+		}
+
+		ingest := func(query, body string) {
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?from=1600000000&until=1600000010&"+query, strings.NewReader(body)))
+			Expect(w.Code).To(Equal(200))
+		}
+		topFunctions := func(query string) topFunctionsJSON {
+			w := httptest.NewRecorder()
+			c.topFunctionsHandler(w, httptest.NewRequest("GET", "/top-functions?from=1600000000&until=1600000010&"+query, nil))
+			Expect(w.Code).To(Equal(200))
+			var res topFunctionsJSON
+			Expect(json.NewDecoder(w.Body).Decode(&res)).To(Succeed())
+			return res
+		}
+
+		It("ranks functions across apps", withController(func() {
+			ingest("name=app1.cpu", "a;foo 3\na;bar 1\n")
+			// half the sample rate, values count twice
+			ingest("name=app2.cpu&sampleRate=50", "b;foo 1\nb;baz 4\n")
+			ingest("name=app3.alloc_space", "c;huge 1000\nc;bar 1\n")
+
+			res := topFunctions("limit=2")
+			Expect(res.Apps).To(Equal(2))
+			Expect(res.Truncated).To(BeFalse())
+			Expect(res.Functions).To(Equal([]topFunctionJSON{
+				{Name: "baz", Self: 8, Apps: []topFunctionAppJSON{{App: "app2.cpu", Self: 8}}},
+				{Name: "foo", Self: 5, Apps: []topFunctionAppJSON{
+					{App: "app1.cpu", Self: 3},
+					{App: "app2.cpu", Self: 2},
+				}},
+			}))
+
+			res = topFunctions("profileType=alloc_space&limit=1")
+			Expect(res.Functions).To(HaveLen(1))
+			Expect(res.Functions[0].Name).To(Equal("huge"))
+		}))
+
+		It("stops at the app limit", withController(func() {
+			c.cfg.TopFunctionsMaxApps = 1
+			ingest("name=app1.cpu", "a;foo 3\na;bar 1\n")
+			ingest("name=app2.cpu", "b;baz 5\nb;bar 1\n")
+
+			res := topFunctions("")
+			Expect(res.Apps).To(Equal(1))
+			Expect(res.Truncated).To(BeTrue())
+			Expect(res.Functions[0].Name).To(Equal("foo"))
+		}))
+
+		It("stops at the timeout", withController(func() {
+			c.cfg.TopFunctionsTimeout = time.Nanosecond
+			ingest("name=app1.cpu", "a;foo 3\na;bar 1\n")
+
+			res := topFunctions("")
+			Expect(res.Apps).To(Equal(0))
+			Expect(res.Truncated).To(BeTrue())
+		}))
+
+		It("rejects invalid limits", withController(func() {
+			w := httptest.NewRecorder()
+			c.topFunctionsHandler(w, httptest.NewRequest("GET", "/top-functions?limit=0", nil))
+			Expect(w.Code).To(Equal(400))
+		}))
+	})
+})
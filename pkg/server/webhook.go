@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const newAppWebhookTimeout = 10 * time.Second
+
+type seenAppKey struct {
+	tenant string
+	app    string
+}
+
+type newAppEvent struct {
+	App       string `json:"app"`
+	Tenant    string `json:"tenant,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// trackApp counts the app in appStats and posts to the new app webhook if the app hasn't been seen before.
+// seenApps is an exact in-memory set that avoids hitting the db on every ingestion,
+// the persistent seen-set makes sure apps aren't reported again after restarts.
+func (ctrl *Controller) trackApp(tenant, app string) {
+	ctrl.appStats.Add(hashString(app))
+	if ctrl.cfg.NewAppWebhookURL == "" {
+		return
+	}
+	k := seenAppKey{tenant: tenant, app: app}
+	if _, loaded := ctrl.seenApps.LoadOrStore(k, struct{}{}); loaded {
+		return
+	}
+	isNew, err := ctrl.s.MarkAppSeen(tenant, app)
+	if err != nil {
+		logrus.WithError(err).WithField("app", app).Error("failed to mark app as seen")
+		// forget the app so that the next ingestion retries
+		ctrl.seenApps.Delete(k)
+		return
+	}
+	if !isNew {
+		return
+	}
+	ev := newAppEvent{
+		App:       app,
+		Tenant:    tenant,
+		Timestamp: time.Now().Unix(),
+	}
+	go func() {
+		if err := postWebhook(ctrl.cfg.NewAppWebhookURL, ev); err != nil {
+			logrus.WithError(err).WithField("app", app).Error("failed to send new app webhook")
+		}
+	}()
+}
+
+func postWebhook(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: newAppWebhookTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
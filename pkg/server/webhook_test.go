@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("new app webhook", func() {
+	testing.WithConfig(func(cfg **config.Config) {
+		It("notifies only once per app", func() {
+			events := make(chan newAppEvent, 10)
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ev newAppEvent
+				Expect(json.NewDecoder(r.Body).Decode(&ev)).To(Succeed())
+				events <- ev
+			}))
+			defer hook.Close()
+
+			(*cfg).Server.NewAppWebhookURL = hook.URL
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for i := 0; i < 2; i++ {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("POST", "/ingest?name=foo&from=1&until=10", strings.NewReader("a;b 1"))
+				c.ingestHandler(w, r)
+				Expect(w.Code).To(Equal(200))
+			}
+
+			var ev newAppEvent
+			Eventually(events).Should(Receive(&ev))
+			Expect(ev.App).To(Equal("foo"))
+			Expect(ev.Timestamp).ToNot(BeZero())
+			Consistently(events).ShouldNot(Receive())
+
+			// the seen-set is persistent, a fresh controller doesn't report the app again
+			c, err = New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+			w := httptest.NewRecorder()
+			c.ingestHandler(w, httptest.NewRequest("POST", "/ingest?name=foo&from=1&until=10", strings.NewReader("a;b 1")))
+			Expect(w.Code).To(Equal(200))
+			Consistently(events).ShouldNot(Receive())
+		})
+
+		It("notifies separately per tenant", func() {
+			events := make(chan newAppEvent, 10)
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var ev newAppEvent
+				Expect(json.NewDecoder(r.Body).Decode(&ev)).To(Succeed())
+				events <- ev
+			}))
+			defer hook.Close()
+
+			(*cfg).Server.NewAppWebhookURL = hook.URL
+			s, err := storage.New(&(*cfg).Server)
+			Expect(err).ToNot(HaveOccurred())
+			defer s.Close()
+			c, err := New(&(*cfg).Server, s)
+			Expect(err).ToNot(HaveOccurred())
+
+			for _, tenant := range []string{"team-a", "team-b"} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("POST", "/ingest?name=foo&from=1&until=10", strings.NewReader("a;b 1"))
+				r.Header.Set(tenantHeader, tenant)
+				c.ingestHandler(w, r)
+				Expect(w.Code).To(Equal(200))
+
+				var ev newAppEvent
+				Eventually(events).Should(Receive(&ev))
+				Expect(ev.App).To(Equal("foo"))
+				Expect(ev.Tenant).To(Equal(tenant))
+			}
+			Consistently(events).ShouldNot(Receive())
+		})
+	})
+})
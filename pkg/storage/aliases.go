@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// App aliases keep data of renamed apps queryable under the new name.
+//
+// Data is not rewritten: an alias is a record in the main db that is consulted at query time,
+// when querying an app, data of all of its aliases is merged in. This makes renames instant
+// and reversible, the downside is that the old name keeps showing up in the list of apps
+// and that aliases have to be resolved on every query. Aliases are resolved transitively,
+// so that data survives multiple renames (a -> b -> c).
+
+const aliasPrefix = "n:"
+
+var errInvalidAlias = errors.New("app can't be an alias of itself")
+
+// aliasKeyPrefix returns the prefix of alias records of the app. App names may contain ':',
+// the name is length-prefixed so that the prefix of one app is never a prefix of another's.
+func aliasKeyPrefix(tenant, name string) string {
+	return aliasPrefix + tenant + ":" + strconv.Itoa(len(name)) + ":" + name + ":"
+}
+
+// AddAppAlias makes data stored under alias show up when querying name
+func (s *Storage) AddAppAlias(tenant, name, alias string) error {
+	if name == alias {
+		return errInvalidAlias
+	}
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return ErrClosing
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(aliasKeyPrefix(tenant, name)+alias), []byte{}))
+	})
+}
+
+func (s *Storage) DeleteAppAlias(tenant, name, alias string) error {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return ErrClosing
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(aliasKeyPrefix(tenant, name) + alias))
+	})
+}
+
+// AppAliases returns direct aliases of the app
+func (s *Storage) AppAliases(tenant, name string) ([]string, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	return s.appAliases(tenant, name)
+}
+
+func (s *Storage) appAliases(tenant, name string) ([]string, error) {
+	res := []string{}
+	prefix := aliasKeyPrefix(tenant, name)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			res = append(res, strings.TrimPrefix(string(it.Item().Key()), prefix))
+		}
+		return nil
+	})
+	return res, err
+}
+
+// aliasedKeys returns copies of the key for every alias of the queried app, directly or not
+func (s *Storage) aliasedKeys(k *Key) []*Key {
+	name := k.AppName()
+	visited := map[string]bool{name: true}
+	queue := []string{name}
+	res := []*Key{}
+	for len(queue) > 0 {
+		aliases, err := s.appAliases(k.Tenant(), queue[0])
+		queue = queue[1:]
+		if err != nil {
+			continue
+		}
+		for _, a := range aliases {
+			if visited[a] {
+				continue
+			}
+			visited[a] = true
+			queue = append(queue, a)
+			res = append(res, k.withAppName(a))
+		}
+	}
+	return res
+}
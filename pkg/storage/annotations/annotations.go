@@ -0,0 +1,98 @@
+package annotations
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+const prefix = "a:"
+
+// Annotation is a timestamped event (e.g a deploy or an incident) shown alongside profiling data
+type Annotation struct {
+	Time time.Time         `json:"time"`
+	Text string            `json:"text"`
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+type Annotations struct {
+	db *badger.DB
+	// prefix namespaces annotations of a tenant, the same way labels are
+	prefix string
+}
+
+func New(db *badger.DB) *Annotations {
+	return &Annotations{
+		db:     db,
+		prefix: prefix,
+	}
+}
+
+// ForTenant returns annotations scoped to the given tenant. An empty tenant is the default one.
+func (as *Annotations) ForTenant(tenant string) *Annotations {
+	if tenant == "" {
+		return as
+	}
+	return &Annotations{
+		db:     as.db,
+		prefix: "t:" + tenant + ":" + prefix,
+	}
+}
+
+// keys are ordered by time so that range queries are a single seek.
+// A random suffix prevents annotations with the same timestamp from overwriting each other.
+func (as *Annotations) key(t time.Time, suffix uint32) []byte {
+	k := make([]byte, len(as.prefix)+12)
+	copy(k, as.prefix)
+	binary.BigEndian.PutUint64(k[len(as.prefix):], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(k[len(as.prefix)+8:], suffix)
+	return k
+}
+
+func (as *Annotations) Put(a *Annotation) error {
+	v, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return as.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(as.key(a.Time, rand.Uint32()), v))
+	})
+}
+
+// Get returns annotations with startTime <= t < endTime ordered by time
+func (as *Annotations) Get(startTime, endTime time.Time) ([]*Annotation, error) {
+	res := []*Annotation{}
+	end := as.key(endTime, 0)
+	err := as.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(as.prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(as.key(startTime, 0)); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.Compare(item.Key(), end) >= 0 {
+				return nil
+			}
+			err := item.Value(func(v []byte) error {
+				a := &Annotation{}
+				if err := json.Unmarshal(v, a); err != nil {
+					return err
+				}
+				res = append(res, a)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,13 @@
+package annotations_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestAnnotations(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Annotations Suite")
+}
@@ -0,0 +1,96 @@
+package annotations
+
+import (
+	"github.com/dgraph-io/badger/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("annotations", func() {
+	var (
+		db *badger.DB
+		as *Annotations
+	)
+	BeforeEach(func() {
+		var err error
+		db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		Expect(err).ToNot(HaveOccurred())
+		as = New(db)
+	})
+	AfterEach(func() {
+		Expect(db.Close()).To(Succeed())
+	})
+
+	texts := func(res []*Annotation) []string {
+		var t []string
+		for _, a := range res {
+			t = append(t, a.Text)
+		}
+		return t
+	}
+
+	It("returns annotations within the range ordered by time", func() {
+		for _, a := range []*Annotation{
+			{Time: testing.SimpleTime(20), Text: "c"},
+			{Time: testing.SimpleTime(0), Text: "a"},
+			{Time: testing.SimpleTime(10), Text: "b"},
+			{Time: testing.SimpleTime(30), Text: "d"},
+		} {
+			Expect(as.Put(a)).To(Succeed())
+		}
+
+		res, err := as.Get(testing.SimpleTime(0), testing.SimpleTime(40))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(texts(res)).To(Equal([]string{"a", "b", "c", "d"}))
+
+		// the start is inclusive, the end is exclusive
+		res, err = as.Get(testing.SimpleTime(10), testing.SimpleTime(30))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(texts(res)).To(Equal([]string{"b", "c"}))
+	})
+
+	It("keeps annotations with the same timestamp", func() {
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(10), Text: "a"})).To(Succeed())
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(10), Text: "b"})).To(Succeed())
+
+		res, err := as.Get(testing.SimpleTime(10), testing.SimpleTime(11))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(texts(res)).To(ConsistOf("a", "b"))
+	})
+
+	It("stores tags", func() {
+		tags := map[string]string{"env": "staging", "version": "1.2.3"}
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(10), Text: "deploy", Tags: tags})).To(Succeed())
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(20), Text: "incident"})).To(Succeed())
+
+		res, err := as.Get(testing.SimpleTime(0), testing.SimpleTime(30))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(HaveLen(2))
+		Expect(res[0].Tags).To(Equal(tags))
+		Expect(res[0].Time.Unix()).To(Equal(testing.SimpleTime(10).Unix()))
+		Expect(res[1].Tags).To(BeNil())
+	})
+
+	It("keeps annotations of tenants apart", func() {
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(10), Text: "default"})).To(Succeed())
+		Expect(as.ForTenant("team-a").Put(&Annotation{Time: testing.SimpleTime(10), Text: "team-a"})).To(Succeed())
+
+		for tenant, text := range map[string]string{"": "default", "team-a": "team-a"} {
+			res, err := as.ForTenant(tenant).Get(testing.SimpleTime(0), testing.SimpleTime(20))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(texts(res)).To(Equal([]string{text}), tenant)
+		}
+	})
+
+	It("returns an empty list for ranges without annotations", func() {
+		Expect(as.Put(&Annotation{Time: testing.SimpleTime(10), Text: "a"})).To(Succeed())
+
+		for _, r := range [][2]int{{0, 10}, {11, 20}, {20, 10}} {
+			res, err := as.Get(testing.SimpleTime(r[0]), testing.SimpleTime(r[1]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).ToNot(BeNil())
+			Expect(res).To(BeEmpty(), "%v", r)
+		}
+	})
+})
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger/v2"
+)
+
+// AppDiskUsage returns the number of bytes segments, trees and dictionaries of an app take on disk.
+// Data that's only in caches and hasn't been flushed yet is not counted. Sizes are of keys and values
+// as stored by badger, before compression, so the total doesn't add up to DiskUsage exactly.
+// With SharedDictionary enabled dictionaries aren't attributed to any app.
+func (s *Storage) AppDiskUsage(tenant, name string) (uint64, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return 0, ErrClosing
+	}
+
+	// all keys of an app start with the app name, see Key.Normalized. The brace makes sure
+	// apps which names start with this app's name (e.g foo and foobar) don't match
+	prefix := name + "{"
+	var total uint64
+	type prefixDB struct {
+		db     *badger.DB
+		prefix string
+		// converts stored keys to segment keys
+		mainKey func(string) string
+	}
+	dbs := []prefixDB{
+		{s.dbSegments, "s:", func(k string) string { return k }},
+		{s.dbTrees, "t:", FromTreeToMainKey},
+		{s.dbDicts, "d:", func(k string) string { return k }},
+	}
+	if s.dbTreesCold != nil {
+		dbs = append(dbs, prefixDB{s.dbTreesCold, "t:", FromTreeToMainKey})
+	}
+	for _, d := range dbs {
+		if d.db == s.dbDicts && s.cfg.SharedDictionary {
+			continue
+		}
+		n, err := prefixUsage(d.db, d.prefix+prefix, func(k string) bool {
+			pk, err := parseStoredKey(d.mainKey(k[len(d.prefix):]))
+			return err == nil && pk.Tenant() == tenant
+		})
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func prefixUsage(db *badger.DB, prefix string, match func(k string) bool) (uint64, error) {
+	var total uint64
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if match(string(item.Key())) {
+				total += uint64(item.KeySize()) + uint64(item.ValueSize())
+			}
+		}
+		return nil
+	})
+	return total, err
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+	"github.com/sirupsen/logrus"
+)
+
+// these limits come from badger itself, we check them upfront to give a better error message
+var (
+	minValueLogFileSize = bytesize.MB
+	maxValueLogFileSize = 2 * bytesize.GB
+)
+
+// validateBadgerOptions checks tuning options from the config. Zero values mean badger defaults are used.
+func validateBadgerOptions(cfg *config.Server) error {
+	if cfg.BadgerNumCompactors < 0 || cfg.BadgerNumCompactors == 1 {
+		return fmt.Errorf("invalid badger-num-compactors %d: must be 0 (default) or at least 2", cfg.BadgerNumCompactors)
+	}
+	if s := cfg.BadgerValueLogFileSize; s != 0 && (s < minValueLogFileSize || s > maxValueLogFileSize) {
+		return fmt.Errorf("invalid badger-value-log-file-size %s: must be between %s and %s", s, minValueLogFileSize, maxValueLogFileSize)
+	}
+	if cfg.BadgerMaxTableSize < 0 {
+		return fmt.Errorf("invalid badger-max-table-size %s: must not be negative", cfg.BadgerMaxTableSize)
+	}
+	return nil
+}
+
+func applyBadgerOptions(cfg *config.Server, opts badger.Options) badger.Options {
+	if cfg.BadgerNumCompactors != 0 {
+		opts = opts.WithNumCompactors(cfg.BadgerNumCompactors)
+	}
+	if cfg.BadgerValueLogFileSize != 0 {
+		opts = opts.WithValueLogFileSize(int64(cfg.BadgerValueLogFileSize))
+	}
+	if cfg.BadgerMaxTableSize != 0 {
+		opts = opts.WithMaxTableSize(int64(cfg.BadgerMaxTableSize))
+	}
+	return opts
+}
+
+func logBadgerOptions(cfg *config.Server) {
+	opts := applyBadgerOptions(cfg, badger.DefaultOptions(""))
+	logrus.WithFields(logrus.Fields{
+		"num-compactors":      opts.NumCompactors,
+		"value-log-file-size": bytesize.ByteSize(opts.ValueLogFileSize).String(),
+		"max-table-size":      bytesize.ByteSize(opts.MaxTableSize).String(),
+		"truncate":            !cfg.BadgerNoTruncate,
+	}).Info("badger options")
+}
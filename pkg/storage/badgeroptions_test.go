@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger/v2"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+)
+
+var _ = Describe("badger options", func() {
+	It("keeps badger defaults for zero values", func() {
+		cfg := &config.Server{}
+		Expect(validateBadgerOptions(cfg)).To(Succeed())
+	})
+
+	It("applies configured values", func() {
+		cfg := &config.Server{
+			BadgerNumCompactors:    4,
+			BadgerValueLogFileSize: 256 * bytesize.MB,
+			BadgerMaxTableSize:     16 * bytesize.MB,
+		}
+		Expect(validateBadgerOptions(cfg)).To(Succeed())
+
+		opts := applyBadgerOptions(cfg, badger.DefaultOptions(""))
+		Expect(opts.NumCompactors).To(Equal(4))
+		Expect(opts.ValueLogFileSize).To(Equal(int64(256 * bytesize.MB)))
+		Expect(opts.MaxTableSize).To(Equal(int64(16 * bytesize.MB)))
+	})
+
+	It("rejects invalid values", func() {
+		Expect(validateBadgerOptions(&config.Server{BadgerNumCompactors: 1})).ToNot(Succeed())
+		Expect(validateBadgerOptions(&config.Server{BadgerValueLogFileSize: bytesize.KB})).ToNot(Succeed())
+		Expect(validateBadgerOptions(&config.Server{BadgerMaxTableSize: -1})).ToNot(Succeed())
+	})
+})
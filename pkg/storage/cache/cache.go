@@ -3,6 +3,9 @@ package cache
 import (
 	"errors"
 	"fmt"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -17,12 +20,28 @@ type Cache struct {
 	alwaysSave  bool
 	cleanupDone chan struct{}
 
+	// dirty holds entries that were modified since they were last persisted
+	dirtyMutex sync.Mutex
+	dirty      map[string]dirtyEntry
+	// cold holds entries read from Cold that weren't modified since, they aren't saved to db
+	// when evicted, otherwise reading old data would move it back to the hot tier
+	cold map[string]interface{}
+
 	// Bytes serializes objects before they go into storage. Users are required to define this one
 	Bytes func(k string, v interface{}) ([]byte, error)
 	// FromBytes deserializes object coming from storage. Users are required to define this one
 	FromBytes func(k string, v []byte) (interface{}, error)
 	// New creates a new object when there's no object in cache or storage. Optional
 	New func(k string) interface{}
+	// Cold is an optional db entries are read from when they're not in db, e.g older data moved
+	// to cheaper disk. Modified entries are always written to db, unmodified ones stay in Cold.
+	Cold *badger.DB
+}
+
+type dirtyEntry struct {
+	val interface{}
+	// since is when the entry was first modified after it was last persisted
+	since time.Time
 }
 
 func New(db *badger.DB, bound int, prefix string) *Cache {
@@ -37,6 +56,8 @@ func New(db *badger.DB, bound int, prefix string) *Cache {
 		lfu:         l,
 		prefix:      prefix,
 		cleanupDone: make(chan struct{}),
+		dirty:       make(map[string]dirtyEntry),
+		cold:        make(map[string]interface{}),
 	}
 	go func() {
 		for {
@@ -44,6 +65,14 @@ func New(db *badger.DB, bound int, prefix string) *Cache {
 			if !ok {
 				break
 			}
+			if b, ok := e.Value.(evictionBarrier); ok {
+				close(b)
+				continue
+			}
+			cache.markClean(e.Key, e.Value)
+			if cache.evictCold(e.Key, e.Value) {
+				continue
+			}
 			cache.saveToDisk(e.Key, e.Value)
 		}
 		cache.cleanupDone <- struct{}{}
@@ -53,12 +82,86 @@ func New(db *badger.DB, bound int, prefix string) *Cache {
 
 func (cache *Cache) Put(key string, val interface{}) {
 	cache.lfu.Set(key, val)
+	cache.dirtyMutex.Lock()
+	delete(cache.cold, key)
+	cache.dirtyMutex.Unlock()
 	if cache.alwaysSave {
 		cache.saveToDisk(key, val)
+		return
+	}
+	cache.dirtyMutex.Lock()
+	since := time.Now()
+	if e, ok := cache.dirty[key]; ok {
+		since = e.since
+	}
+	cache.dirty[key] = dirtyEntry{val: val, since: since}
+	cache.dirtyMutex.Unlock()
+}
+
+// markClean removes the entry from the dirty set, unless it was replaced with a different value
+func (cache *Cache) markClean(key string, val interface{}) {
+	cache.dirtyMutex.Lock()
+	if e, ok := cache.dirty[key]; ok && e.val == val {
+		delete(cache.dirty, key)
+	}
+	cache.dirtyMutex.Unlock()
+}
+
+// evictCold forgets the entry if it was read from Cold and wasn't modified since,
+// returns true if so, i.e if it doesn't need to be saved
+func (cache *Cache) evictCold(key string, val interface{}) bool {
+	cache.dirtyMutex.Lock()
+	defer cache.dirtyMutex.Unlock()
+	if v, ok := cache.cold[key]; ok && v == val {
+		delete(cache.cold, key)
+		return true
+	}
+	return false
+}
+
+// FlushDirty persists entries that were modified since they were last persisted, without evicting
+// them from cache. Returns the number of bytes written.
+func (cache *Cache) FlushDirty() (uint64, error) {
+	cache.dirtyMutex.Lock()
+	dirty := cache.dirty
+	cache.dirty = make(map[string]dirtyEntry)
+	cache.dirtyMutex.Unlock()
+
+	var written uint64
+	var lastErr error
+	for key, e := range dirty {
+		n, err := cache.saveToDisk(key, e.val)
+		if err != nil {
+			lastErr = err
+			// keeps the entry around so that the next flush retries it
+			cache.dirtyMutex.Lock()
+			if e2, ok := cache.dirty[key]; ok {
+				e.val = e2.val
+			}
+			cache.dirty[key] = e
+			cache.dirtyMutex.Unlock()
+			continue
+		}
+		written += uint64(n)
+	}
+	return written, lastErr
+}
+
+// OldestDirty returns when the oldest entry that isn't persisted yet was modified,
+// or zero time if all entries are persisted
+func (cache *Cache) OldestDirty() time.Time {
+	cache.dirtyMutex.Lock()
+	defer cache.dirtyMutex.Unlock()
+	var oldest time.Time
+	for _, e := range cache.dirty {
+		if oldest.IsZero() || e.since.Before(oldest) {
+			oldest = e.since
+		}
 	}
+	return oldest
 }
 
-func (cache *Cache) saveToDisk(key string, val interface{}) error {
+func (cache *Cache) saveToDisk(key string, val interface{}) (int, error) {
 	logrus.WithFields(logrus.Fields{
 		"prefix": cache.prefix,
 		"key":    key,
@@ -67,16 +170,16 @@ func (cache *Cache) saveToDisk(key string, val interface{}) error {
 	// serialize the key and value
 	buf, err := cache.Bytes(key, val)
 	if err != nil {
-		return fmt.Errorf("serialize key and value: %v", err)
+		return 0, fmt.Errorf("serialize key and value: %v", err)
 	}
 
 	// update the kv to badger
 	if err := cache.db.Update(func(txn *badger.Txn) error {
 		return txn.SetEntry(badger.NewEntry([]byte(cache.prefix+key), buf))
 	}); err != nil {
-		return fmt.Errorf("save to disk: %v", err)
+		return 0, fmt.Errorf("save to disk: %v", err)
 	}
-	return nil
+	return len(buf), nil
 }
 
 func (cache *Cache) Flush() {
@@ -85,12 +188,39 @@ func (cache *Cache) Flush() {
 	<-cache.cleanupDone
 }
 
+// evictionBarrier is sent through the eviction channel after evicted entries,
+// it's closed once all of them are persisted
+type evictionBarrier chan struct{}
+
+// EvictRatio evicts the given share of entries and waits until they're persisted,
+// so that they can be read back right away. Returns the number of evicted entries.
+func (cache *Cache) EvictRatio(ratio float64) int {
+	n := int(math.Ceil(float64(cache.lfu.Len()) * ratio))
+	if n <= 0 {
+		return 0
+	}
+	n = cache.lfu.Evict(n)
+	b := make(evictionBarrier)
+	cache.lfu.EvictionChannel <- lfu.Eviction{Value: b}
+	<-b
+	return n
+}
+
 func (cache *Cache) Delete(key string) error {
 	cache.lfu.Delete(key)
+	cache.dirtyMutex.Lock()
+	delete(cache.dirty, key)
+	delete(cache.cold, key)
+	cache.dirtyMutex.Unlock()
 
 	err := cache.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete([]byte(cache.prefix + key))
 	})
+	if err == nil && cache.Cold != nil {
+		err = cache.Cold.Update(func(txn *badger.Txn) error {
+			return txn.Delete([]byte(cache.prefix + key))
+		})
+	}
 
 	return err
 }
@@ -107,27 +237,17 @@ func (cache *Cache) Get(key string) (interface{}, error) {
 	}
 	logrus.WithField("key", key).Debug("lfu miss")
 
-	var copied []byte
 	// read the value from badger
-	if err := cache.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(cache.prefix + key))
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
-
-			return fmt.Errorf("read from badger: %v", err)
-		}
-
-		if err := item.Value(func(val []byte) error {
-			copied = append([]byte{}, val...)
-			return nil
-		}); err != nil {
-			return fmt.Errorf("retrieve value from item: %v", err)
+	copied, err := cache.read(cache.db, key)
+	if err != nil {
+		return nil, err
+	}
+	fromCold := false
+	if copied == nil && cache.Cold != nil {
+		if copied, err = cache.read(cache.Cold, key); err != nil {
+			return nil, err
 		}
-		return nil
-	}); err != nil {
-		return nil, fmt.Errorf("badger view: %v", err)
+		fromCold = copied != nil
 	}
 
 	// if it's not found from badger, create a new object
@@ -146,11 +266,16 @@ func (cache *Cache) Get(key string) (interface{}, error) {
 	// deserialize the object from storage
 	val, err := cache.FromBytes(key, copied)
 	if err != nil {
-		return nil, fmt.Errorf("deserialize the object: %v", err)
+		return nil, fmt.Errorf("deserialize the object: %w", err)
+	}
+	if fromCold {
+		cache.dirtyMutex.Lock()
+		cache.cold[key] = val
+		cache.dirtyMutex.Unlock()
 	}
 	cache.lfu.Set(key, val)
 	// if it needs to save to disk
-	if cache.alwaysSave {
+	if cache.alwaysSave && !fromCold {
 		cache.saveToDisk(key, val)
 	}
 
@@ -158,6 +283,56 @@ func (cache *Cache) Get(key string) (interface{}, error) {
 	return val, nil
 }
 
+// Contains tells whether there's an entry for the key in cache or storage.
+// Unlike Get, it doesn't create missing entries.
+func (cache *Cache) Contains(key string) (bool, error) {
+	if cache.lfu.Get(key) != nil {
+		return true, nil
+	}
+	for _, db := range []*badger.DB{cache.db, cache.Cold} {
+		if db == nil {
+			continue
+		}
+		err := db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(cache.prefix + key))
+			return err
+		})
+		if err == nil {
+			return true, nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return false, fmt.Errorf("badger view: %v", err)
+		}
+	}
+	return false, nil
+}
+
+// read returns nil if there's no value for the key in db
+func (cache *Cache) read(db *badger.DB, key string) ([]byte, error) {
+	var copied []byte
+	if err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(cache.prefix + key))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+
+			return fmt.Errorf("read from badger: %v", err)
+		}
+
+		if err := item.Value(func(val []byte) error {
+			copied = append([]byte{}, val...)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("retrieve value from item: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("badger view: %v", err)
+	}
+	return copied, nil
+}
+
 func (cache *Cache) Size() uint64 {
 	return uint64(cache.lfu.Len())
 }
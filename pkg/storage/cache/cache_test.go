@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
@@ -56,4 +57,90 @@ var _ = Describe("cache", func() {
 
 		close(done)
 	}, 3)
+
+	It("persists modified entries without evicting them", func(done Done) {
+		tdir := testing.TmpDirSync()
+		badgerOptions := badger.DefaultOptions(tdir.Path)
+		badgerOptions = badgerOptions.WithTruncate(false)
+		badgerOptions = badgerOptions.WithSyncWrites(false)
+
+		db, err := badger.Open(badgerOptions)
+		Expect(err).ToNot(HaveOccurred())
+
+		cache := New(db, 10, "prefix:")
+		cache.Bytes = func(k string, v interface{}) ([]byte, error) {
+			return []byte(v.(string)), nil
+		}
+		before := time.Now()
+		cache.Put("foo", "bar")
+		cache.Put("baz", "qux")
+		Expect(cache.OldestDirty()).To(BeTemporally(">=", before))
+
+		n, err := cache.FlushDirty()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(uint64(6)))
+		Expect(cache.Size()).To(Equal(uint64(2)))
+		Expect(db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte("prefix:foo"))
+			return err
+		})).To(Succeed())
+
+		n, err = cache.FlushDirty()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeZero())
+		Expect(cache.OldestDirty().IsZero()).To(BeTrue())
+
+		cache.Flush()
+		close(done)
+	}, 3)
+
+	It("doesn't move unmodified entries read from the cold db to db", func(done Done) {
+		open := func() *badger.DB {
+			badgerOptions := badger.DefaultOptions(testing.TmpDirSync().Path)
+			badgerOptions = badgerOptions.WithTruncate(false)
+			badgerOptions = badgerOptions.WithSyncWrites(false)
+			db, err := badger.Open(badgerOptions)
+			Expect(err).ToNot(HaveOccurred())
+			return db
+		}
+		db, cold := open(), open()
+		Expect(cold.Update(func(txn *badger.Txn) error {
+			if err := txn.Set([]byte("prefix:foo"), []byte("bar")); err != nil {
+				return err
+			}
+			return txn.Set([]byte("prefix:baz"), []byte("qux"))
+		})).To(Succeed())
+
+		cache := New(db, 10, "prefix:")
+		cache.Cold = cold
+		cache.Bytes = func(k string, v interface{}) ([]byte, error) {
+			return []byte(v.(string)), nil
+		}
+		cache.FromBytes = func(k string, v []byte) (interface{}, error) {
+			return string(v), nil
+		}
+		v, err := cache.Get("foo")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(v).To(Equal("bar"))
+		v, err = cache.Get("baz")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(v).To(Equal("qux"))
+		cache.Put("baz", "quux")
+		cache.Flush()
+
+		inDB := func(k string) bool {
+			err := db.View(func(txn *badger.Txn) error {
+				_, err := txn.Get([]byte(k))
+				return err
+			})
+			if err == badger.ErrKeyNotFound {
+				return false
+			}
+			Expect(err).ToNot(HaveOccurred())
+			return true
+		}
+		Expect(inDB("prefix:foo")).To(BeFalse())
+		Expect(inDB("prefix:baz")).To(BeTrue())
+		close(done)
+	}, 3)
 })
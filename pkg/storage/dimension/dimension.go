@@ -39,6 +39,30 @@ func (d *Dimension) Insert(key key) {
 	}
 }
 
+func (d *Dimension) Delete(key key) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	i := sort.Search(len(d.keys), func(i int) bool {
+		return bytes.Compare(d.keys[i], key) >= 0
+	})
+	if i < len(d.keys) && bytes.Equal(d.keys[i], key) {
+		d.keys = append(d.keys[:i], d.keys[i+1:]...)
+	}
+}
+
+// Keys returns the keys of the dimension in sorted order
+func (d *Dimension) Keys() [][]byte {
+	d.m.RLock()
+	defer d.m.RUnlock()
+
+	res := make([][]byte, len(d.keys))
+	for i, k := range d.keys {
+		res[i] = k
+	}
+	return res
+}
+
 type advanceResult int
 
 const (
@@ -132,10 +156,13 @@ func Intersection(input ...*Dimension) []key {
 			}
 		}
 
-		// step 3: if all series are on the same matching element, add it to result
-		if allMatch {
-			result = append(result, val)
+		// step 3: if all series are on the same matching element, add it to result.
+		// Otherwise some dimension is already past it, the next round starts from its element
+		// without moving the others, they may still match it.
+		if !allMatch {
+			continue
 		}
+		result = append(result, val)
 		for _, dim := range sd {
 			dim.i++
 			if dim.i == dim.l {
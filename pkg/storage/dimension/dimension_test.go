@@ -31,5 +31,19 @@ var _ = Describe("dimension", func() {
 				key("foo"),
 			}))
 		})
+
+		It("doesn't skip keys after a mismatch", func() {
+			d1 := New()
+			d1.Insert(key("a"))
+			d1.Insert(key("c"))
+			d1.Insert(key("d"))
+
+			d2 := New()
+			d2.Insert(key("b"))
+			d2.Insert(key("c"))
+			d2.Insert(key("d"))
+
+			Expect(Intersection(d1, d2)).To(Equal([]key{key("c"), key("d")}))
+		})
 	})
 })
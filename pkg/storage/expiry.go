@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/dimension"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/sirupsen/logrus"
+)
+
+// Data older than the retention is deleted periodically, apps with a retention override
+// (see retention.go) are expired according to it. Trees of segment nodes that end before
+// the retention window are deleted together with the nodes, aggregated trees of nodes that span the
+// window start are kept until they are entirely out of it. Series without any data left are deleted
+// altogether, and so are apps without any series left, they are no longer listed afterwards.
+
+// retentionInterval is how often data older than the retention is looked for
+const retentionInterval = 10 * time.Minute
+
+var expiredTrees = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pyroscope_storage_expired_trees_total",
+	Help: "number of trees deleted because they are older than the retention",
+})
+
+// retentionOf returns how long data of the app is kept, the per app override or the global retention.
+// 0 means forever
+func (s *Storage) retentionOf(tenant, app string) time.Duration {
+	if d, ok := s.AppRetention(tenant, app); ok {
+		return d
+	}
+	return s.cfg.Retention
+}
+
+func (s *Storage) retentionLoop() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.retentionStop:
+			close(s.retentionDone)
+			return
+		case now := <-ticker.C:
+			n, err := s.expireOldData(now)
+			if err != nil {
+				logrus.WithError(err).Error("failed to delete data older than the retention")
+			}
+			if n > 0 {
+				logrus.WithField("trees", n).Debug("deleted trees older than the retention")
+			}
+		}
+	}
+}
+
+// expireOldData deletes data of every app that is older than the app's retention as of now.
+// Returns the number of deleted trees.
+func (s *Storage) expireOldData(now time.Time) (int, error) {
+	var apps []*Key
+	collect := func(tenant string) {
+		s.labels.ForTenant(tenant).GetValues("__name__", func(app string) bool {
+			if r := s.retentionOf(tenant, app); r > 0 {
+				if k, err := parseStoredKey(app); err == nil {
+					k.SetTenant(tenant)
+					apps = append(apps, k)
+				}
+			}
+			return true
+		})
+	}
+	collect("")
+	s.labels.Tenants(func(tenant string) bool {
+		collect(tenant)
+		return true
+	})
+
+	n := 0
+	for _, k := range apps {
+		m, err := s.expireApp(k, now.Add(-s.retentionOf(k.Tenant(), k.AppName())))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// expireApp deletes data of all series of the app that ends before the cutoff,
+// the app is deleted if nothing is left. Returns the number of deleted trees.
+func (s *Storage) expireApp(key *Key, cutoff time.Time) (int, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return 0, ErrClosing
+	}
+	s.expiryMutex.Lock()
+	defer s.expiryMutex.Unlock()
+
+	dimensions := []*dimension.Dimension{}
+	for k, v := range key.labels {
+		dInt, err := s.dimensions.Get(k + ":" + v)
+		if err != nil {
+			return 0, err
+		}
+		dimensions = append(dimensions, dInt.(*dimension.Dimension))
+	}
+
+	n, left := 0, 0
+	for _, sk := range dimension.Intersection(dimensions...) {
+		skk, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			// the app isn't deleted while it may still have data
+			left++
+			continue
+		}
+		if skk.Tenant() != key.Tenant() {
+			continue
+		}
+		stInt, err := s.segments.Get(skk.SegmentKey())
+		if err != nil {
+			return n, err
+		}
+		st := stInt.(*segment.Segment)
+		if st == nil {
+			continue
+		}
+
+		empty := st.DeleteNodesBefore(cutoff, func(depth int, t time.Time) {
+			s.trees.Delete(skk.TreeKey(depth, t))
+			expiredTrees.Inc()
+			n++
+		})
+		if empty {
+			// the dictionary is used by all trees of the series, and the shared one by other keys too
+			if !s.cfg.SharedDictionary {
+				s.dicts.Delete(FromTreeToMainKey(skk.TreeKey(0, cutoff)))
+			}
+			s.deleteSeries(skk)
+			continue
+		}
+		s.segments.Put(skk.SegmentKey(), st)
+		if err = s.deleteUploadMetadataBefore(skk.SegmentKey(), cutoff); err != nil {
+			return n, err
+		}
+		left++
+	}
+
+	if left == 0 {
+		logrus.WithFields(logrus.Fields{
+			"tenant": key.Tenant(),
+			"app":    key.AppName(),
+		}).Info("deleted app that has no data within the retention")
+		s.queryActivity.forget(appRef{Tenant: key.Tenant(), App: key.AppName()})
+		return n, s.labels.ForTenant(key.Tenant()).DeleteValue("__name__", key.AppName())
+	}
+	return n, nil
+}
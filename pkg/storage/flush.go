@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/cache"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	cacheFlushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "pyroscope_storage_cache_flush_duration_seconds",
+		Help: "time it takes to persist modified cache entries to disk",
+	})
+	cacheFlushBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "pyroscope_storage_cache_flush_bytes",
+		Help: "number of bytes written to disk per cache flush",
+		// 1KB to 256MB
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	// this is the worst-case data loss window, it should stay close to the flush interval
+	cacheOldestDirtyAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pyroscope_storage_cache_oldest_dirty_age_seconds",
+		Help: "age of the oldest segments or trees cache entry that isn't persisted yet",
+	})
+)
+
+// dirtyAgeInterval is how often cacheOldestDirtyAge is updated. It's independent of the flush interval,
+// without periodic flushes the age keeps growing, which is what the gauge has to show then.
+const dirtyAgeInterval = 10 * time.Second
+
+// flushLoop periodically persists modified cache entries so that a crash loses at most
+// one interval worth of data. Caches are still flushed in full on shutdown.
+func (s *Storage) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.flushStop:
+			close(s.flushDone)
+			return
+		case <-ticker.C:
+			s.flushDirty()
+		}
+	}
+}
+
+func (s *Storage) dirtyAgeLoop() {
+	ticker := time.NewTicker(dirtyAgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.dirtyAgeStop:
+			close(s.dirtyAgeDone)
+			return
+		case now := <-ticker.C:
+			s.updateOldestDirtyAge(now)
+		}
+	}
+}
+
+func (s *Storage) updateOldestDirtyAge(now time.Time) {
+	cacheOldestDirtyAge.Set(oldestDirtyAge(now, s.segments, s.trees).Seconds())
+}
+
+func (s *Storage) flushDirty() {
+	startTime := time.Now()
+	var written uint64
+	var writtenMutex sync.Mutex
+
+	wg := sync.WaitGroup{}
+	for name, c := range map[string]*cache.Cache{
+		"dimensions": s.dimensions,
+		"segments":   s.segments,
+		"trees":      s.trees,
+	} {
+		wg.Add(1)
+		go func(name string, c *cache.Cache) {
+			defer wg.Done()
+			n := flushCache(name, c)
+			writtenMutex.Lock()
+			written += n
+			writtenMutex.Unlock()
+		}(name, c)
+	}
+	wg.Wait()
+	// dictionary has to flush last because trees write to dictionaries
+	written += flushCache("dicts", s.dicts)
+
+	cacheFlushDuration.Observe(time.Since(startTime).Seconds())
+	cacheFlushBytes.Observe(float64(written))
+}
+
+func flushCache(name string, c *cache.Cache) uint64 {
+	n, err := c.FlushDirty()
+	if err != nil {
+		logrus.WithError(err).WithField("cache", name).Error("failed to flush cache")
+	}
+	return n
+}
+
+func oldestDirtyAge(now time.Time, caches ...*cache.Cache) time.Duration {
+	var age time.Duration
+	for _, c := range caches {
+		if oldest := c.OldestDirty(); !oldest.IsZero() && now.Sub(oldest) > age {
+			age = now.Sub(oldest)
+		}
+	}
+	return age
+}
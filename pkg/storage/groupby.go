@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrTooManyGroups is returned by GetGrouped when the label has more distinct values than allowed
+var ErrTooManyGroups = errors.New("too many groups")
+
+// GetGrouped is Get that merges matched series per distinct value of the label rather than into
+// a single result, e.g to break down CPU usage by region. Series without the label are grouped
+// under an empty value. Groups without data in the time range are omitted.
+// maxGroups caps the number of groups, 0 means no limit.
+func (s *Storage) GetGrouped(gi *GetInput, label string, maxGroups int) (map[string]*GetOutput, error) {
+	s.queries.inc(gi.Key.Normalized())
+
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+	s.markQueried(gi.Key)
+
+	logrus.WithFields(logrus.Fields{
+		"startTime": gi.StartTime.String(),
+		"endTime":   gi.EndTime.String(),
+		"key":       gi.Key.Normalized(),
+		"groupBy":   label,
+	}).Info("storage.GetGrouped")
+
+	groups := make(map[string][]*Key)
+	for _, k := range s.matchingKeys(gi.Key) {
+		v := k.labels[label]
+		groups[v] = append(groups[v], k)
+	}
+	if maxGroups > 0 && len(groups) > maxGroups {
+		return nil, ErrTooManyGroups
+	}
+
+	res := make(map[string]*GetOutput, len(groups))
+	for v, keys := range groups {
+		out, err := s.getKeys(gi, keys)
+		if err != nil {
+			return nil, err
+		}
+		if out != nil {
+			res[v] = out
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/cache"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/dict"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/dimension"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+const (
+	// IntegrityUnreadable means the entry exists but can't be deserialized
+	IntegrityUnreadable = "unreadable"
+	// IntegrityDangling means the entry is referenced by another one but doesn't exist
+	IntegrityDangling = "dangling"
+)
+
+// IntegrityProblem is a single entry that failed the integrity check. Keys are db keys, e.g t:app.cpu{}:0:1600000000
+type IntegrityProblem struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	// Ref is the key of the entry referencing a dangling one
+	Ref string `json:"ref,omitempty"`
+	Err string `json:"error,omitempty"`
+}
+
+type IntegrityReport struct {
+	Segments   int                `json:"segments"`
+	Trees      int                `json:"trees"`
+	Dicts      int                `json:"dicts"`
+	Dimensions int                `json:"dimensions"`
+	Problems   []IntegrityProblem `json:"problems"`
+}
+
+func (r *IntegrityReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// CheckIntegrity verifies that every segment, tree, dictionary and dimension on disk deserializes
+// and that every entry referenced by segments and dimensions exists. Data isn't modified and caches
+// aren't used, so entries that haven't been flushed yet are not checked: it's meant to be run
+// e.g after an unclean shutdown, before the storage is used by a server.
+func (s *Storage) CheckIntegrity() (*IntegrityReport, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	c, err := s.checkIntegrity()
+	if err != nil {
+		return nil, err
+	}
+	return c.report, nil
+}
+
+func (s *Storage) checkIntegrity() (*integrityCheck, error) {
+	c := &integrityCheck{
+		s:              s,
+		report:         &IntegrityReport{Problems: []IntegrityProblem{}},
+		dicts:          make(map[string]*dict.Dict),
+		badSegments:    make(map[string]bool),
+		usedTrees:      make(map[string]bool),
+		usedDicts:      make(map[string]bool),
+		dimensionDrops: make(map[string][][]byte),
+	}
+	if err := iteratePrefix(s.dbSegments, "s:", c.checkSegment); err != nil {
+		return nil, err
+	}
+	if err := iteratePrefix(s.dbDimensions, "i:", c.checkDimension); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type integrityCheck struct {
+	s      *Storage
+	report *IntegrityReport
+	// dictionaries that have been read, nil ones are missing or unreadable
+	dicts map[string]*dict.Dict
+
+	// the rest is what Repair needs to know, keys are cache keys, i.e without db prefixes
+	badSegments map[string]bool
+	// trees and dictionaries used by good segments
+	usedTrees map[string]bool
+	usedDicts map[string]bool
+	// segment keys of missing or bad segments, by dimension
+	dimensionDrops map[string][][]byte
+}
+
+func (c *integrityCheck) problem(kind, key, ref string, err error) {
+	p := IntegrityProblem{Kind: kind, Key: key, Ref: ref}
+	if err != nil {
+		p.Err = err.Error()
+	}
+	c.report.Problems = append(c.report.Problems, p)
+}
+
+func (c *integrityCheck) checkSegment(k, v []byte) error {
+	c.report.Segments++
+	dbKey := string(k)
+	segmentKey := dbKey[len("s:"):]
+	st, err := segment.FromBytes(v)
+	if err != nil {
+		c.problem(IntegrityUnreadable, dbKey, "", err)
+		c.badSegments[segmentKey] = true
+		return nil
+	}
+	key, err := parseStoredKey(segmentKey)
+	if err != nil {
+		c.problem(IntegrityUnreadable, dbKey, "", err)
+		c.badSegments[segmentKey] = true
+		return nil
+	}
+
+	var treeKeys []string
+	var walkErr error
+	ok := true
+	st.WalkNodes(func(depth int, t time.Time) {
+		if walkErr != nil {
+			return
+		}
+		treeKey := key.TreeKey(depth, t)
+		treeOK, err := c.checkTree(treeKey, dbKey)
+		ok, walkErr = ok && treeOK, err
+		treeKeys = append(treeKeys, treeKey)
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+	if !ok {
+		c.badSegments[segmentKey] = true
+		return nil
+	}
+	for _, treeKey := range treeKeys {
+		c.usedTrees[treeKey] = true
+		c.usedDicts[c.s.dictKey(treeKey)] = true
+	}
+	return nil
+}
+
+// checkTree returns false if the tree or its dictionary is missing or unreadable
+func (c *integrityCheck) checkTree(treeKey, ref string) (bool, error) {
+	c.report.Trees++
+	dbKey := "t:" + treeKey
+	v, found, err := c.s.readTree(dbKey)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		c.problem(IntegrityDangling, dbKey, ref, nil)
+		return false, nil
+	}
+	d, err := c.dict(c.s.dictKey(treeKey), dbKey)
+	if err != nil || d == nil {
+		return false, err
+	}
+	if _, err := tree.FromBytes(d, v); err != nil {
+		c.problem(IntegrityUnreadable, dbKey, "", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// dict reads a dictionary once, problems with it are reported for the first tree that uses it
+func (c *integrityCheck) dict(dictKey, ref string) (*dict.Dict, error) {
+	if d, ok := c.dicts[dictKey]; ok {
+		return d, nil
+	}
+	c.dicts[dictKey] = nil
+	dbKey := "d:" + dictKey
+	v, found, err := readValue(c.s.dbDicts, dbKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		c.problem(IntegrityDangling, dbKey, ref, nil)
+		return nil, nil
+	}
+	c.report.Dicts++
+	d, err := dict.FromBytes(v)
+	if err != nil {
+		c.problem(IntegrityUnreadable, dbKey, "", err)
+		return nil, nil
+	}
+	c.dicts[dictKey] = d
+	return d, nil
+}
+
+func (c *integrityCheck) checkDimension(k, v []byte) error {
+	c.report.Dimensions++
+	dbKey := string(k)
+	d, err := dimension.FromBytes(v)
+	if err != nil {
+		c.problem(IntegrityUnreadable, dbKey, "", err)
+		return nil
+	}
+	for _, sk := range d.Keys() {
+		segmentDBKey := "s:" + string(sk)
+		ok, err := hasKey(c.s.dbSegments, segmentDBKey)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			c.problem(IntegrityDangling, segmentDBKey, dbKey, nil)
+		}
+		if !ok || c.badSegments[string(sk)] {
+			c.dimensionDrops[dbKey] = append(c.dimensionDrops[dbKey], sk)
+		}
+	}
+	return nil
+}
+
+// RepairReport lists db keys of entries removed by Repair, or that would be removed in a dry run
+type RepairReport struct {
+	DryRun bool `json:"dryRun"`
+	// Removed are unreadable segments, segments with missing or unreadable trees or dictionaries
+	// and trees and dictionaries no remaining segment uses
+	Removed []string `json:"removed"`
+	// Updated are dimensions that referenced missing or removed segments
+	Updated []string `json:"updated"`
+}
+
+// Repair brings the storage to a consistent state after CheckIntegrity found problems, so that
+// it can be queried again: the data of broken segments is lost, the rest is kept. As with
+// CheckIntegrity, only persisted data is looked at. Removed data can't be recovered, run it with
+// dryRun or on a copy of the storage first.
+func (s *Storage) Repair(dryRun bool) (*RepairReport, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	c, err := s.checkIntegrity()
+	if err != nil {
+		return nil, err
+	}
+	r := &RepairReport{DryRun: dryRun, Removed: []string{}, Updated: []string{}}
+	remove := func(ch *cache.Cache, prefix, key string) error {
+		r.Removed = append(r.Removed, prefix+key)
+		if dryRun {
+			return nil
+		}
+		return ch.Delete(key)
+	}
+
+	for _, key := range sortedKeys(c.badSegments) {
+		if err := remove(s.segments, "s:", key); err != nil {
+			return nil, err
+		}
+		if !dryRun {
+			if err := s.deleteUploadMetadata(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	orphans, err := unusedKeys(s.dbTrees, "t:", c.usedTrees)
+	if err != nil {
+		return nil, err
+	}
+	if s.dbTreesCold != nil {
+		coldOrphans, err := unusedKeys(s.dbTreesCold, "t:", c.usedTrees)
+		if err != nil {
+			return nil, err
+		}
+		// a tree can be in both tiers, see tiering.go
+		orphans = uniqueStrings(append(orphans, coldOrphans...))
+	}
+	for _, key := range orphans {
+		if err := remove(s.trees, "t:", key); err != nil {
+			return nil, err
+		}
+	}
+	if orphans, err = unusedKeys(s.dbDicts, "d:", c.usedDicts); err != nil {
+		return nil, err
+	}
+	for _, key := range orphans {
+		if err := remove(s.dicts, "d:", key); err != nil {
+			return nil, err
+		}
+	}
+
+	dimensionKeys := make(map[string]bool, len(c.dimensionDrops))
+	for dbKey := range c.dimensionDrops {
+		dimensionKeys[dbKey] = true
+	}
+	for _, dbKey := range sortedKeys(dimensionKeys) {
+		if dryRun {
+			r.Updated = append(r.Updated, dbKey)
+			continue
+		}
+		if err := s.dropDimensionKeys(dbKey, c.dimensionDrops[dbKey]); err != nil {
+			return nil, err
+		}
+		r.Updated = append(r.Updated, dbKey)
+	}
+	return r, nil
+}
+
+// dropDimensionKeys removes segment keys from the dimension, empty dimensions are removed altogether
+func (s *Storage) dropDimensionKeys(dbKey string, keys [][]byte) error {
+	v, found, err := readValue(s.dbDimensions, dbKey)
+	if err != nil || !found {
+		return err
+	}
+	d, err := dimension.FromBytes(v)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		d.Delete(k)
+	}
+	// the cached dimension is stale either way
+	if err := s.dimensions.Delete(dbKey[len("i:"):]); err != nil {
+		return err
+	}
+	if len(d.Keys()) == 0 {
+		return nil
+	}
+	b, err := d.Bytes()
+	if err != nil {
+		return err
+	}
+	return s.dbDimensions.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(dbKey), b)
+	})
+}
+
+// unusedKeys returns keys with the prefix that aren't used, without the prefix
+func unusedKeys(db *badger.DB, prefix string, used map[string]bool) ([]string, error) {
+	var res []string
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if key := string(it.Item().Key()[len(prefix):]); !used[key] {
+				res = append(res, key)
+			}
+		}
+		return nil
+	})
+	return res, err
+}
+
+func uniqueStrings(s []string) []string {
+	m := make(map[string]bool, len(s))
+	for _, v := range s {
+		m[v] = true
+	}
+	return sortedKeys(m)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func iteratePrefix(db *badger.DB, prefix string, cb func(k, v []byte) error) error {
+	return db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := cb(item.KeyCopy(nil), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func readValue(db *badger.DB, key string) (v []byte, found bool, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		v, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	return v, err == nil, err
+}
+
+func hasKey(db *badger.DB, key string) (bool, error) {
+	err := db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(key))
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
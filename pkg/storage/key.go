@@ -2,10 +2,13 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/pyroscope-io/pyroscope/pkg/structs/sortedmap"
 	"github.com/twmb/murmur3"
@@ -32,8 +35,28 @@ const (
 	doneParserState
 )
 
+// ErrTooManyLabels is returned by ParseKeyMaxLabels for keys with more labels than allowed
+var ErrTooManyLabels = errors.New("too many labels")
+
 // TODO: should rewrite this at some point to not rely on regular expressions & splits
 func ParseKey(name string) (*Key, error) {
+	return ParseKeyMaxLabels(name, 0)
+}
+
+// parseStoredKey parses keys read from the database. Keys stored before ParseKey got strict
+// can have label names it rejects now, e.g with dashes, so only the structure is checked.
+func parseStoredKey(name string) (*Key, error) {
+	return parseKey(name, 0, true)
+}
+
+// ParseKeyMaxLabels is ParseKey that rejects keys with more than maxLabels labels, app name excluded.
+// Parsing stops at the first label beyond the limit, so pathological keys are cheap to reject.
+// maxLabels <= 0 means no limit.
+func ParseKeyMaxLabels(name string, maxLabels int) (*Key, error) {
+	return parseKey(name, maxLabels, false)
+}
+
+func parseKey(name string, maxLabels int, lenient bool) (*Key, error) {
 	k := &Key{
 		labels: make(map[string]string),
 	}
@@ -42,18 +65,35 @@ func ParseKey(name string) (*Key, error) {
 		parserState: nameParserState,
 		key:         "",
 		value:       "",
+		maxLabels:   maxLabels,
+		lenient:     lenient,
 	}
 
-	for _, r := range name + "{" {
+	for _, r := range name {
+		var err error
 		switch p.parserState {
 		case nameParserState:
-			p.nameParserCase(r, k)
+			err = p.nameParserCase(r, k)
 		case tagKeyParserState:
-			p.tagKeyParserCase(r)
+			err = p.tagKeyParserCase(r)
 		case tagValueParserState:
-			p.tagValueParserCase(r, k)
+			err = p.tagValueParserCase(r, k)
+		case doneParserState:
+			err = p.doneParserCase(r)
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
+
+	switch p.parserState {
+	case nameParserState:
+		if err := p.setName(k); err != nil {
+			return nil, err
+		}
+	case tagKeyParserState, tagValueParserState:
+		return nil, errors.New("missing closing }")
+	}
 	return k, nil
 }
 
@@ -61,42 +101,89 @@ type parser struct {
 	parserState ParserState
 	key         string
 	value       string
+	maxLabels   int
+	lenient     bool
+}
+
+func (p *parser) setName(k *Key) error {
+	name := strings.TrimSpace(p.value)
+	if name == "" && !p.lenient {
+		return errors.New("app name is empty")
+	}
+	k.labels["__name__"] = name
+	return nil
 }
 
 // ParseKey's nameParserState switch case
-func (p *parser) nameParserCase(r int32, k *Key) {
+func (p *parser) nameParserCase(r int32, k *Key) error {
 	switch r {
 	case '{':
 		p.parserState = tagKeyParserState
-		k.labels["__name__"] = strings.TrimSpace(p.value)
+		return p.setName(k)
+	case '}':
+		return errors.New("unexpected } without matching {")
 	default:
 		p.value += string(r)
 	}
+	return nil
 }
 
 // ParseKey's tagKeyParserState switch case
-func (p *parser) tagKeyParserCase(r int32) {
+func (p *parser) tagKeyParserCase(r int32) error {
 	switch r {
-	case '}':
-		p.parserState = doneParserState
+	case '}', ',':
+		// a trailing comma is fine, a label without a value isn't
+		if key := strings.TrimSpace(p.key); key != "" {
+			return fmt.Errorf("label %q has no value", key)
+		}
+		if r == '}' {
+			p.parserState = doneParserState
+		}
 	case '=':
+		key := strings.TrimSpace(p.key)
+		// __name__ and __tenant__ are stored in keys too, so reserved names are allowed here
+		if !p.lenient && !labelNameRegexp.MatchString(key) {
+			return fmt.Errorf("invalid label name %q", key)
+		}
+		p.key = key
 		p.parserState = tagValueParserState
 		p.value = ""
+	case '{':
+		return errors.New("unexpected { in labels")
 	default:
 		p.key += string(r)
 	}
+	return nil
 }
 
 // ParseKey's tagValueParserState switch case
-func (p *parser) tagValueParserCase(r int32, k *Key) {
+func (p *parser) tagValueParserCase(r int32, k *Key) error {
 	switch r {
 	case ',', '}':
 		p.parserState = tagKeyParserState
-		k.labels[strings.TrimSpace(p.key)] = strings.TrimSpace(p.value)
+		if r == '}' {
+			p.parserState = doneParserState
+		}
+		k.labels[p.key] = strings.TrimSpace(p.value)
+		// __name__ is always there, it's set before labels are parsed
+		if p.maxLabels > 0 && len(k.labels)-1 > p.maxLabels {
+			return fmt.Errorf("%w: at most %d are allowed", ErrTooManyLabels, p.maxLabels)
+		}
 		p.key = ""
+	case '{':
+		return fmt.Errorf("unexpected { in the value of label %q", p.key)
 	default:
 		p.value += string(r)
 	}
+	return nil
+}
+
+// ParseKey's doneParserState switch case
+func (p *parser) doneParserCase(r int32) error {
+	if !unicode.IsSpace(r) {
+		return fmt.Errorf("unexpected %q after }", r)
+	}
+	return nil
 }
 
 func (k *Key) SegmentKey() string {
@@ -153,6 +240,98 @@ func (k *Key) Hashed() []byte {
 	return b
 }
 
+// tenantLabel is a reserved label that namespaces keys of different tenants
+const tenantLabel = "__tenant__"
+
+// Tenant returns the tenant the key belongs to, empty string means the default tenant
+func (k *Key) Tenant() string {
+	return k.labels[tenantLabel]
+}
+
+// SetTenant scopes the key to a tenant. It overrides any tenant set in the parsed name,
+// so that clients can't access other tenants' data by adding the label themselves.
+func (k *Key) SetTenant(tenant string) {
+	if tenant == "" {
+		delete(k.labels, tenantLabel)
+	} else {
+		k.labels[tenantLabel] = tenant
+	}
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+// IsValidLabelName tells whether name can be used as a label name.
+// Names starting with __ are reserved, e.g __name__ holds the app name.
+func IsValidLabelName(name string) bool {
+	return !strings.HasPrefix(name, "__") && labelNameRegexp.MatchString(name)
+}
+
+// IsValidLabelValue tells whether v can be used as a label value, i.e it has no characters
+// that have special meaning in keys
+func IsValidLabelValue(v string) bool {
+	return v != "" && !strings.ContainsAny(v, "{},=")
+}
+
+// SetLabel adds a label to the key or replaces its value. Callers are expected to validate it first.
+func (k *Key) SetLabel(name, value string) {
+	k.labels[name] = value
+}
+
+// CheckMaxLabels returns ErrTooManyLabels if the key has more than maxLabels labels, reserved ones
+// (app name, tenant) excluded. It's meant for keys that got labels added after ParseKeyMaxLabels.
+// maxLabels <= 0 means no limit.
+func (k *Key) CheckMaxLabels(maxLabels int) error {
+	if maxLabels <= 0 {
+		return nil
+	}
+	n := 0
+	for name := range k.labels {
+		if !strings.HasPrefix(name, "__") {
+			n++
+		}
+	}
+	if n > maxLabels {
+		return fmt.Errorf("%w: at most %d are allowed", ErrTooManyLabels, maxLabels)
+	}
+	return nil
+}
+
 func (k *Key) AppName() string {
 	return k.labels["__name__"]
 }
+
+// ProfileType returns the app name suffix that by convention tells the type of the profile,
+// e.g cpu for myapp.cpu. Returns an empty string if the app name doesn't have a suffix.
+func (k *Key) ProfileType() string {
+	name := k.AppName()
+	if i := strings.LastIndex(name, "."); i != -1 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// Clone returns a copy of the key that can be modified independently
+func (k *Key) Clone() *Key {
+	res := &Key{labels: make(map[string]string, len(k.labels))}
+	for lk, lv := range k.labels {
+		res.labels[lk] = lv
+	}
+	return res
+}
+
+// Matches tells whether the key has all labels of the matcher, the app name and the tenant included
+func (k *Key) Matches(matcher *Key) bool {
+	for lk, lv := range matcher.labels {
+		if k.labels[lk] != lv {
+			return false
+		}
+	}
+	return true
+}
+
+// withAppName returns a copy of the key with a different app name
+func (k *Key) withAppName(name string) *Key {
+	res := k.Clone()
+	res.labels["__name__"] = name
+	return res
+}
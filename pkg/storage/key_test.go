@@ -2,6 +2,7 @@ package storage
 
 import (
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 )
 
@@ -24,9 +25,98 @@ var _ = Describe("storage package", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(k.labels).To(Equal(map[string]string{"__name__": "foo", "bar": "1", "baz": "2"}))
 		})
+
+		DescribeTable("valid keys",
+			func(name, normalized string) {
+				k, err := ParseKey(name)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(k.Normalized()).To(Equal(normalized))
+			},
+			Entry("empty labels", "foo{}", "foo{}"),
+			Entry("trailing comma", "foo{bar=1,}", "foo{bar=1}"),
+			Entry("empty value", "foo{bar=}", "foo{bar=}"),
+			Entry("dots in label names", "foo{host.name=a}", "foo{host.name=a}"),
+			Entry("reserved labels", "foo{__tenant__=t1}", "foo{__tenant__=t1}"),
+			Entry("trailing spaces", "foo{bar=1} ", "foo{bar=1}"),
+		)
+
+		DescribeTable("invalid keys",
+			func(name, msg string) {
+				_, err := ParseKey(name)
+				Expect(err).To(MatchError(msg))
+			},
+			Entry("empty string", "", "app name is empty"),
+			Entry("empty app name", " {bar=1}", "app name is empty"),
+			Entry("missing closing brace", "foo{bar=1", "missing closing }"),
+			Entry("missing closing brace after a label name", "foo{bar", "missing closing }"),
+			Entry("missing opening brace", "foo}", "unexpected } without matching {"),
+			Entry("nested braces", "foo{bar={baz=1}}", `unexpected { in the value of label "bar"`),
+			Entry("brace in a label name", "foo{b{ar=1}", "unexpected { in labels"),
+			Entry("text after the closing brace", "foo{bar=1}baz", `unexpected 'b' after }`),
+			Entry("label without a value", "foo{bar}", `label "bar" has no value`),
+			Entry("empty label name", "foo{=1}", `invalid label name ""`),
+			Entry("invalid label name", "foo{1bar=1}", `invalid label name "1bar"`),
+			Entry("dash in a label name", "foo{bar-baz=1}", `invalid label name "bar-baz"`),
+		)
+
+		DescribeTable("label limits",
+			func(name string, valid bool) {
+				k, err := ParseKeyMaxLabels(name, 2)
+				if valid {
+					Expect(err).ToNot(HaveOccurred())
+					Expect(k.Normalized()).ToNot(BeEmpty())
+				} else {
+					Expect(err).To(MatchError(ErrTooManyLabels))
+				}
+			},
+			Entry("below the cap", "foo{bar=1}", true),
+			Entry("at the cap", "foo{bar=1,baz=2}", true),
+			Entry("at the cap with a trailing comma", "foo{bar=1,baz=2,}", true),
+			Entry("beyond the cap", "foo{bar=1,baz=2,qux=3}", false),
+			Entry("beyond the cap before a syntax error", "foo{bar=1,baz=2,qux=3,{", false),
+		)
+
+		DescribeTable("stored keys",
+			func(name, normalized string) {
+				k, err := parseStoredKey(name)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(k.Normalized()).To(Equal(normalized))
+			},
+			Entry("valid key", "foo{bar=1}", "foo{bar=1}"),
+			Entry("dash in a label name", "foo{bar-baz=1}", "foo{bar-baz=1}"),
+			Entry("empty app name", "{bar=1}", "{bar=1}"),
+		)
+
+		It("rejects malformed stored keys", func() {
+			_, err := parseStoredKey("foo{bar=1")
+			Expect(err).To(MatchError("missing closing }"))
+		})
+
+		It("doesn't limit labels by default", func() {
+			k, err := ParseKeyMaxLabels("foo{a=1,b=2,c=3}", 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(k.Normalized()).To(Equal("foo{a=1,b=2,c=3}"))
+		})
 	})
 
 	Context("Key", func() {
+		It("CheckMaxLabels counts labels added after parsing, reserved ones excluded", func() {
+			k, _ := ParseKey("foo{bar=1}")
+			k.SetTenant("t1")
+			k.SetLabel("baz", "2")
+			Expect(k.CheckMaxLabels(2)).To(Succeed())
+			Expect(k.CheckMaxLabels(0)).To(Succeed())
+			k.SetLabel("qux", "3")
+			Expect(k.CheckMaxLabels(2)).To(MatchError(ErrTooManyLabels))
+		})
+
+		It("ProfileType returns the app name suffix", func() {
+			k, _ := ParseKey("foo.bar.wall{baz=1}")
+			Expect(k.ProfileType()).To(Equal("wall"))
+			k, _ = ParseKey("foo{baz=1.2}")
+			Expect(k.ProfileType()).To(Equal(""))
+		})
+
 		Context("Normalize", func() {
 			It("no tags version works", func() {
 				k, err := ParseKey("foo")
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/dimension"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/sirupsen/logrus"
+)
+
+// KeyInfo is a stored series
+type KeyInfo struct {
+	Key *Key
+	// LastSeen is the end of the most recent data of the series, zero if it has none,
+	// e.g when all of it was deleted by retention
+	LastSeen time.Time
+}
+
+// Keys returns up to max stored series that match the key, ordered by name, and whether there
+// were more of them. Unlike queries it doesn't resolve app aliases, it shows what's actually
+// stored, e.g to find out why a query returns nothing.
+func (s *Storage) Keys(key *Key, max int) ([]KeyInfo, bool, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, false, ErrClosing
+	}
+
+	dimensions := make([]*dimension.Dimension, 0, len(key.labels))
+	for k, v := range key.labels {
+		res, err := s.dimensions.Get(k + ":" + v)
+		if err != nil {
+			return nil, false, fmt.Errorf("dimensions cache for %v: %v", k+":"+v, err)
+		}
+		// no series has the label, so none can match all of them
+		if res == nil {
+			return []KeyInfo{}, false, nil
+		}
+		dimensions = append(dimensions, res.(*dimension.Dimension))
+	}
+
+	keys := []*Key{}
+	for _, sk := range dimension.Intersection(dimensions...) {
+		parsedKey, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			continue
+		}
+		if parsedKey.Tenant() != key.Tenant() {
+			continue
+		}
+		keys = append(keys, parsedKey)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Normalized() < keys[j].Normalized() })
+	truncated := len(keys) > max
+	if truncated {
+		keys = keys[:max]
+	}
+
+	res := make([]KeyInfo, len(keys))
+	for i, k := range keys {
+		res[i].Key = k
+		st, err := s.segments.Get(k.SegmentKey())
+		if err != nil {
+			return nil, false, fmt.Errorf("segments cache for %v: %v", k.SegmentKey(), err)
+		}
+		if st == nil {
+			continue
+		}
+		if _, endTime, ok := st.(*segment.Segment).Bounds(); ok {
+			res[i].LastSeen = endTime
+		}
+	}
+	return res, truncated, nil
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/labels"
+	"github.com/sirupsen/logrus"
+)
+
+// every distinct label value gets its own dimension, so a label with unbounded values
+// (e.g a request ID) makes the dimensions index grow forever
+var ErrTooManyLabelValues = errors.New("too many distinct label values")
+
+var rejectedLabelValues = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "pyroscope_storage_rejected_label_values_total",
+	Help: "number of profiles rejected because of a new value of a label that reached max-label-values",
+}, []string{"label"})
+
+type labelValueLimits struct {
+	global    int
+	overrides map[string]int
+
+	m sync.Mutex
+	// counts are numbers of distinct values by tenant and label, loaded from labels on first use
+	counts map[string]int
+}
+
+func newLabelValueLimits(cfg *config.Server) (*labelValueLimits, error) {
+	if cfg.MaxLabelValues < 0 {
+		return nil, fmt.Errorf("invalid max-label-values %d: must not be negative", cfg.MaxLabelValues)
+	}
+	l := &labelValueLimits{
+		global:    cfg.MaxLabelValues,
+		overrides: make(map[string]int, len(cfg.MaxLabelValuesOverrides)),
+		counts:    make(map[string]int),
+	}
+	for name, v := range cfg.MaxLabelValuesOverrides {
+		if !IsValidLabelName(name) {
+			return nil, fmt.Errorf("invalid max-label-values-overrides label name: %q", name)
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid max-label-values-overrides limit of %s: %q", name, v)
+		}
+		l.overrides[name] = n
+	}
+	return l, nil
+}
+
+// limit returns max number of values of the label, 0 means no limit.
+// App names are only limited by an override, global limit doesn't apply to them.
+func (l *labelValueLimits) limit(label string) int {
+	if n, ok := l.overrides[label]; ok {
+		return n
+	}
+	if label == "__name__" {
+		return 0
+	}
+	return l.global
+}
+
+func (l *labelValueLimits) enabled() bool {
+	return l.global > 0 || len(l.overrides) > 0
+}
+
+// putLabels stores labels of the key unless one of them has a new value and its label has
+// reached the limit, in which case none of them are stored
+func (s *Storage) putLabels(k *Key) error {
+	tenant := k.Tenant()
+	ll := s.labels.ForTenant(tenant)
+	l := s.labelLimits
+	if !l.enabled() {
+		for name, v := range k.labels {
+			if name != tenantLabel {
+				ll.Put(name, v)
+			}
+		}
+		return nil
+	}
+
+	// checking and storing has to be atomic, otherwise concurrent uploads could all take the last slot
+	l.m.Lock()
+	defer l.m.Unlock()
+	var added []string
+	for name, v := range k.labels {
+		limit := l.limit(name)
+		if name == tenantLabel || limit == 0 || ll.HasValue(name, v) {
+			continue
+		}
+		if n := l.count(ll, tenant, name); n >= limit {
+			rejectedLabelValues.WithLabelValues(name).Inc()
+			logrus.WithFields(logrus.Fields{
+				"tenant": tenant,
+				"label":  name,
+				"value":  v,
+				"limit":  limit,
+			}).Warn("rejected a profile with a new value of a label that has too many values")
+			return fmt.Errorf("%w: label %s has reached the limit of %d values", ErrTooManyLabelValues, name, limit)
+		}
+		added = append(added, name)
+	}
+	for name, v := range k.labels {
+		if name != tenantLabel {
+			ll.Put(name, v)
+		}
+	}
+	for _, name := range added {
+		l.counts[tenant+":"+name]++
+	}
+	return nil
+}
+
+func (l *labelValueLimits) count(ll *labels.Labels, tenant, label string) int {
+	ck := tenant + ":" + label
+	n, ok := l.counts[ck]
+	if !ok {
+		ll.GetValues(label, func(string) bool {
+			n++
+			return true
+		})
+		l.counts[ck] = n
+	}
+	return n
+}
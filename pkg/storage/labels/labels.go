@@ -8,6 +8,8 @@ import (
 
 type Labels struct {
 	db *badger.DB
+	// prefix namespaces labels of a tenant, it's empty for the default tenant
+	prefix string
 }
 
 func New(db *badger.DB) *Labels {
@@ -17,9 +19,20 @@ func New(db *badger.DB) *Labels {
 	return ll
 }
 
+// ForTenant returns labels scoped to the given tenant. An empty tenant is the default one.
+func (ll *Labels) ForTenant(tenant string) *Labels {
+	if tenant == "" {
+		return ll
+	}
+	return &Labels{
+		db:     ll.db,
+		prefix: "t:" + tenant + ":",
+	}
+}
+
 func (ll *Labels) Put(key, val string) {
-	kk := "l:" + key
-	kv := "v:" + key + ":" + val
+	kk := ll.prefix + "l:" + key
+	kv := ll.prefix + "v:" + key + ":" + val
 	// ks := "h:" + key + ":" + val + ":" + stree
 	err := ll.db.Update(func(txn *badger.Txn) error {
 		return txn.SetEntry(badger.NewEntry([]byte(kk), []byte{}))
@@ -47,14 +60,14 @@ func (ll *Labels) Put(key, val string) {
 func (ll *Labels) GetKeys(cb func(k string) bool) {
 	err := ll.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.Prefix = []byte("l:")
+		opts.Prefix = []byte(ll.prefix + "l:")
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		for it.Rewind(); it.Valid(); it.Next() {
 			item := it.Item()
 			k := item.Key()
-			shouldContinue := cb(string(k[2:]))
+			shouldContinue := cb(string(k[len(opts.Prefix):]))
 			if !shouldContinue {
 				return nil
 			}
@@ -70,7 +83,7 @@ func (ll *Labels) GetKeys(cb func(k string) bool) {
 func (ll *Labels) GetValues(key string, cb func(v string) bool) {
 	err := ll.db.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.Prefix = []byte("v:" + key + ":")
+		opts.Prefix = []byte(ll.prefix + "v:" + key + ":")
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
@@ -91,3 +104,49 @@ func (ll *Labels) GetValues(key string, cb func(v string) bool) {
 		panic(err)
 	}
 }
+
+// HasValue tells whether the value of the label was ever stored
+func (ll *Labels) HasValue(key, val string) bool {
+	err := ll.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte(ll.prefix + "v:" + key + ":" + val))
+		return err
+	})
+	return err == nil
+}
+
+// DeleteValue removes a value of the label, e.g of __name__ when all data of an app is deleted.
+// The label itself is kept, other values may still use it.
+func (ll *Labels) DeleteValue(key, val string) error {
+	return ll.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(ll.prefix + "v:" + key + ":" + val))
+	})
+}
+
+// Tenants calls cb for every tenant other than the default one that has labels stored
+func (ll *Labels) Tenants(cb func(tenant string) bool) {
+	err := ll.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("t:")
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); {
+			ks := string(it.Item().Key()[len(opts.Prefix):])
+			i := strings.Index(ks, ":")
+			if i < 0 {
+				it.Next()
+				continue
+			}
+			if !cb(ks[:i]) {
+				return nil
+			}
+			// skips the rest of the tenant's labels, ";" sorts right after ":"
+			it.Seek([]byte("t:" + ks[:i] + ";"))
+		}
+		return nil
+	})
+	if err != nil {
+		// TODO: handle
+		panic(err)
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrLocked is returned when a storage directory is used by another process
+var ErrLocked = errors.New("storage directory is locked")
+
+// badgerLockFile is where badger writes the pid of the process that uses the directory.
+// On most platforms the lock itself is released by the OS when the process exits, the file
+// is only a lock on Windows.
+const badgerLockFile = "LOCK"
+
+// openBadger is badger.Open with a clear error when the directory is locked. With forceUnlock
+// a lock file of a process that isn't running anymore is removed and opening is retried.
+func openBadger(opts badger.Options, forceUnlock bool) (*badger.DB, error) {
+	db, err := badger.Open(opts)
+	if err == nil || !isBadgerLockError(err) {
+		return db, err
+	}
+
+	lockPath := filepath.Join(opts.Dir, badgerLockFile)
+	pid, pidErr := readLockPID(lockPath)
+	if forceUnlock && pidErr == nil && !processRunning(pid) {
+		logrus.WithFields(logrus.Fields{
+			"path": lockPath,
+			"pid":  pid,
+		}).Warn("removing a stale storage lock")
+		if err = os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove stale lock %s: %v", lockPath, err)
+		}
+		if db, err = badger.Open(opts); err == nil || !isBadgerLockError(err) {
+			return db, err
+		}
+	}
+
+	owner := "another instance"
+	if pidErr == nil {
+		owner = fmt.Sprintf("another instance (pid %d)", pid)
+	}
+	return nil, fmt.Errorf("%w: %s is using %s, or a stale lock exists at %s. "+
+		"If no other instance is running, start with --force-unlock", ErrLocked, owner, opts.Dir, lockPath)
+}
+
+func isBadgerLockError(err error) bool {
+	return strings.Contains(err.Error(), "Another process is using this Badger database")
+}
+
+func readLockPID(path string) (int, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// processRunning returns true if a process with the pid exists, it errs on the side of true
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// FindProcess already fails for processes that don't exist and there's no signal 0
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
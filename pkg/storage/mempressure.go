@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/cache"
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	memoryPressure = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pyroscope_storage_memory_pressure",
+		Help: "1 when heap usage is above the high watermark and caches are evicted, 0 otherwise",
+	})
+	memoryPressureEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pyroscope_storage_memory_pressure_evictions_total",
+		Help: "number of cache entries evicted because of memory pressure",
+	})
+)
+
+const (
+	memoryPressureCheckInterval = time.Second
+	// bounds the time spent evicting when the heap doesn't shrink, e.g when memory is held by in-flight requests
+	memoryPressureMaxRounds = 10
+	// the low watermark defaults to this share of the high watermark
+	defaultLowWatermarkRatio = 0.8
+)
+
+// memoryWatermarks control eviction under memory pressure: once heap usage goes above high,
+// caches are evicted until it goes below low
+type memoryWatermarks struct {
+	high uint64
+	low  uint64
+}
+
+func newMemoryWatermarks(cfg *config.Server) (memoryWatermarks, error) {
+	high, low := cfg.MemoryPressureHighWatermark, cfg.MemoryPressureLowWatermark
+	if high < 0 {
+		return memoryWatermarks{}, fmt.Errorf("invalid memory-pressure-high-watermark %s: must not be negative", high)
+	}
+	if low < 0 {
+		return memoryWatermarks{}, fmt.Errorf("invalid memory-pressure-low-watermark %s: must not be negative", low)
+	}
+	if high == 0 {
+		return memoryWatermarks{}, nil
+	}
+	if low == 0 {
+		low = bytesize.ByteSize(float64(high) * defaultLowWatermarkRatio)
+	}
+	if low >= high {
+		return memoryWatermarks{}, fmt.Errorf("invalid memory-pressure-low-watermark %s: must be less than memory-pressure-high-watermark %s", low, high)
+	}
+	return memoryWatermarks{high: uint64(high), low: uint64(low)}, nil
+}
+
+func (wm memoryWatermarks) enabled() bool {
+	return wm.high > 0
+}
+
+// memoryPressureLoop periodically checks heap usage and evicts caches when it's above the high watermark
+func (s *Storage) memoryPressureLoop(wm memoryWatermarks) {
+	ticker := time.NewTicker(memoryPressureCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.memoryPressureStop:
+			close(s.memoryPressureDone)
+			return
+		case <-ticker.C:
+			s.relieveMemoryPressure(wm, heapInUse)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// relieveMemoryPressure evicts cache entries until heap usage goes below the low watermark.
+// Evicted entries are persisted first, so this only trades cache misses for memory.
+func (s *Storage) relieveMemoryPressure(wm memoryWatermarks, heap func() uint64) {
+	h := heap()
+	if h < wm.high {
+		memoryPressure.Set(0)
+		return
+	}
+	memoryPressure.Set(1)
+
+	start := h
+	var evicted int
+	for i := 0; i < memoryPressureMaxRounds && h > wm.low; i++ {
+		// entry sizes are unknown, so the share of entries evicted is the share the heap has to shrink by
+		ratio := float64(h-wm.low) / float64(h)
+		n := evictCaches(ratio, s.dimensions, s.segments, s.trees)
+		// dictionary goes last because trees write to dictionaries when they're persisted
+		n += evictCaches(ratio, s.dicts)
+		if n == 0 {
+			break
+		}
+		evicted += n
+		runtime.GC()
+		h = heap()
+	}
+
+	memoryPressureEvictions.Add(float64(evicted))
+	logrus.WithFields(logrus.Fields{
+		"evicted":    evicted,
+		"heapBefore": bytesize.ByteSize(start).String(),
+		"heapAfter":  bytesize.ByteSize(h).String(),
+	}).Warn("heap usage is above the high watermark, evicted cache entries")
+}
+
+func evictCaches(ratio float64, caches ...*cache.Cache) int {
+	var n int
+	for _, c := range caches {
+		n += c.EvictRatio(ratio)
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+type MergeReport struct {
+	Segments int `json:"segments"`
+	// Buckets is the number of 10 second buckets merged
+	Buckets int `json:"buckets"`
+	// Rescaled is the number of segments which values were scaled to the sample rate of the destination
+	Rescaled int `json:"rescaled"`
+	// Skipped lists segment keys that couldn't be parsed and weren't merged
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Merge adds all data of src to s, e.g to consolidate data of multiple servers. Data of the same series
+// and time is summed up, symbols are deduplicated by s dictionaries. When a series has a different
+// sample rate in s, values from src are scaled to it. Upload metadata, app aliases and retention
+// settings aren't merged. Both storages must not be used by anything else during the merge, src is
+// best opened with NewReadOnly.
+//
+// Only 10 second trees of src are read, higher depth trees of s are rebuilt from them by Put the same
+// way they're built on ingestion. Aggregates of src that outlived their 10 second trees (see
+// DeleteNodesBefore) are left out, they only hold data that is past the retention.
+func (s *Storage) Merge(src *Storage, progress func(segmentKey string)) (*MergeReport, error) {
+	segmentKeys, err := unusedKeys(src.dbSegments, "s:", nil)
+	if err != nil {
+		return nil, fmt.Errorf("list segments: %v", err)
+	}
+
+	r := &MergeReport{}
+	for _, sk := range segmentKeys {
+		if progress != nil {
+			progress(sk)
+		}
+		key, err := parseStoredKey(sk)
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", sk, err)
+			r.Skipped = append(r.Skipped, sk)
+			continue
+		}
+		n, rescaled, err := s.mergeSegment(src, key, sk)
+		if err != nil {
+			return nil, fmt.Errorf("merge %s: %v", sk, err)
+		}
+		r.Segments++
+		r.Buckets += n
+		if rescaled {
+			r.Rescaled++
+		}
+	}
+	return r, nil
+}
+
+func (s *Storage) mergeSegment(src *Storage, key *Key, sk string) (int, bool, error) {
+	res, err := src.segments.Get(sk)
+	if err != nil {
+		return 0, false, err
+	}
+	srcSeg := res.(*segment.Segment)
+	// uploads are aligned to buckets, so every bucket with data has a tree of its own
+	var buckets []time.Time
+	srcSeg.WalkNodes(func(depth int, t time.Time) {
+		if depth == 0 {
+			buckets = append(buckets, t)
+		}
+	})
+	if len(buckets) == 0 {
+		return 0, false, nil
+	}
+
+	if res, err = s.segments.Get(sk); err != nil {
+		return 0, false, err
+	}
+	sampleRate := res.(*segment.Segment).SampleRate()
+	if sampleRate == 0 {
+		sampleRate = srcSeg.SampleRate()
+	}
+	var scale *big.Rat
+	if srcRate := srcSeg.SampleRate(); srcRate != 0 && srcRate != sampleRate {
+		scale = big.NewRat(int64(sampleRate), int64(srcRate))
+	}
+
+	merged := 0
+	for _, t := range buckets {
+		v, err := src.trees.Get(key.TreeKey(0, t))
+		if err != nil {
+			return merged, false, err
+		}
+		if v == nil || v.(*tree.Tree).Samples() == 0 {
+			continue
+		}
+		t2 := v.(*tree.Tree)
+		if scale != nil {
+			t2 = t2.Clone(scale)
+		}
+		// higher depths are updated by Put
+		err = s.Put(&PutInput{
+			StartTime:       t,
+			EndTime:         t.Add(bucketDuration),
+			Key:             key,
+			Val:             t2,
+			SpyName:         srcSeg.SpyName(),
+			SampleRate:      sampleRate,
+			Units:           srcSeg.Units(),
+			AggregationType: srcSeg.AggregationType(),
+		})
+		if err != nil {
+			return merged, false, err
+		}
+		merged++
+	}
+	return merged, scale != nil, nil
+}
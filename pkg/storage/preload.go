@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Caches are empty after a restart, so first queries of every app have to read everything from disk.
+// Preloading queries the most important keys in the background on startup so that the caches
+// are warm by the time dashboards start querying them. Keys to preload are either configured
+// explicitly or picked by how often they were queried before the restart.
+
+// maxTrackedQueries bounds the number of query counts persisted between restarts. Any key can be queried,
+// so counts kept in memory are trimmed to the most queried ones once there are twice as many.
+const maxTrackedQueries = 1000
+
+var queryCountsKey = []byte("m:query-counts")
+
+type queryCounter struct {
+	m      sync.Mutex
+	counts map[string]uint64
+}
+
+func (qc *queryCounter) inc(key string) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	qc.counts[key]++
+	if len(qc.counts) > 2*maxTrackedQueries {
+		qc.trim(maxTrackedQueries)
+	}
+}
+
+// top returns up to n most queried keys, most queried first
+func (qc *queryCounter) top(n int) []string {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	return qc.topLocked(n)
+}
+
+// trim drops counts of all keys but the n most queried ones, it has to be called with the mutex held
+func (qc *queryCounter) trim(n int) {
+	counts := make(map[string]uint64, n)
+	for _, k := range qc.topLocked(n) {
+		counts[k] = qc.counts[k]
+	}
+	qc.counts = counts
+}
+
+func (qc *queryCounter) topLocked(n int) []string {
+	keys := make([]string, 0, len(qc.counts))
+	for k := range qc.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if qc.counts[keys[i]] != qc.counts[keys[j]] {
+			return qc.counts[keys[i]] > qc.counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+func (s *Storage) loadQueryCounts() error {
+	s.queries = &queryCounter{counts: make(map[string]uint64)}
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(queryCountsKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			return json.Unmarshal(v, &s.queries.counts)
+		})
+	})
+}
+
+func (s *Storage) saveQueryCounts() error {
+	s.queries.m.Lock()
+	s.queries.trim(maxTrackedQueries)
+	v, err := json.Marshal(s.queries.counts)
+	s.queries.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(queryCountsKey, v))
+	})
+}
+
+// preloadKeys returns configured keys followed by the most queried ones, without duplicates
+func (s *Storage) preloadKeys() []string {
+	res := []string{}
+	seen := map[string]bool{}
+	for _, k := range append(append([]string{}, s.cfg.PreloadKeys...), s.queries.top(s.cfg.PreloadTopQueried)...) {
+		if !seen[k] {
+			seen[k] = true
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+// preload warms up caches by querying keys the same way renders do
+func (s *Storage) preload(keys []string) {
+	startTime := time.Now()
+	now := time.Now()
+	for _, k := range keys {
+		key, err := ParseKey(k)
+		if err != nil {
+			logrus.WithError(err).WithField("key", k).Warn("invalid preload key")
+			continue
+		}
+		_, err = s.get(&GetInput{
+			StartTime: now.Add(-s.cfg.PreloadRange),
+			EndTime:   now,
+			Key:       key,
+		})
+		if errors.Is(err, ErrClosing) {
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).WithField("key", k).Warn("failed to preload key")
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"keys":     len(keys),
+		"duration": time.Since(startTime),
+	}).Info("preloaded caches")
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"math"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// Quantile queries return the tree of a single time bucket instead of the sum of all of them.
+//
+// Buckets are the segment nodes that Get would otherwise merge. Depending on the range and
+// on what's been written they can be of different resolution, so buckets are ranked by
+// activity: samples per second for regular profiles and samples per write for averaged
+// and snapshot profiles. When a query matches multiple series, nodes of all series that
+// start at the same time and have the same resolution form a single bucket.
+//
+// The bucket is selected using the nearest-rank method: with n buckets sorted by activity,
+// quantile q picks the ceil(q*n)-th one. E.g 0.95 returns the bucket that is busier than
+// at least 95% of buckets, 1 returns the busiest one.
+
+type quantileBucketID struct {
+	depth int
+	time  int64
+}
+
+type quantilePart struct {
+	key    *Key
+	r      *big.Rat
+	writes uint64
+	// trees of non-sum profiles are averaged over writes to get a single snapshot
+	average bool
+}
+
+type quantileBucket struct {
+	depth    int
+	time     time.Time
+	activity float64
+	parts    []quantilePart
+}
+
+type quantileBuckets map[quantileBucketID]*quantileBucket
+
+func (qb quantileBuckets) add(k *Key, st *segment.Segment, gi *GetInput) {
+	average := st.AggregationType() != AggregationSum && st.AggregationType() != ""
+	st.Get(gi.StartTime, gi.EndTime, func(depth int, samples, writes uint64, t time.Time, r *big.Rat) {
+		if writes == 0 {
+			return
+		}
+		var activity float64
+		if average {
+			activity = float64(samples) / float64(writes)
+		} else {
+			f, _ := r.Float64()
+			activity = float64(samples) * f / segment.DurationForDepth(depth).Seconds()
+		}
+
+		id := quantileBucketID{depth: depth, time: t.UnixNano()}
+		b, ok := qb[id]
+		if !ok {
+			b = &quantileBucket{depth: depth, time: t}
+			qb[id] = b
+		}
+		b.activity += activity
+		b.parts = append(b.parts, quantilePart{key: k, r: r, writes: writes, average: average})
+	})
+}
+
+// pick returns the bucket at quantile q, or nil if there are no buckets
+func (qb quantileBuckets) pick(q float64) *quantileBucket {
+	if len(qb) == 0 {
+		return nil
+	}
+	buckets := make([]*quantileBucket, 0, len(qb))
+	for _, b := range qb {
+		buckets = append(buckets, b)
+	}
+	// ties are broken by time so that results are stable
+	sort.Slice(buckets, func(i, j int) bool {
+		if buckets[i].activity != buckets[j].activity {
+			return buckets[i].activity < buckets[j].activity
+		}
+		return buckets[i].time.Before(buckets[j].time)
+	})
+	i := int(math.Ceil(q*float64(len(buckets)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(buckets) {
+		i = len(buckets) - 1
+	}
+	return buckets[i]
+}
+
+func (s *Storage) quantileTree(qb quantileBuckets, q float64) *tree.Tree {
+	b := qb.pick(q)
+	if b == nil {
+		return nil
+	}
+	var res *tree.Tree
+	for _, p := range b.parts {
+		tr := s.cachedTree(p.key.TreeKey(b.depth, b.time))
+		if tr == nil {
+			continue
+		}
+		r := p.r
+		if p.average {
+			r = new(big.Rat).Mul(r, big.NewRat(1, int64(p.writes)))
+		}
+		tr = tr.Clone(r)
+		if res == nil {
+			res = tr
+		} else {
+			res.Merge(tr)
+		}
+	}
+	return res
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// Apps nobody queries are candidates for earlier expiry. The last time each app was queried is
+// tracked, and with query-inactivity-retention set all data of apps that weren't queried within
+// that window is deleted, on top of data older than the retention which is deleted by age (see
+// expiry.go). Apps that were never queried count from when they were first seen, so that fresh apps
+// aren't deleted right away. Querying an app also counts as querying the apps it's an alias of,
+// their data is read too.
+//
+// Activity is kept in memory and persisted periodically and on shutdown, queries right before
+// a crash may be lost, which only delays expiry.
+
+// queryActivityInterval is how often inactive apps are looked for
+const queryActivityInterval = 10 * time.Minute
+
+var queryActivityKey = []byte("m:query-activity")
+
+var expiredInactiveApps = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pyroscope_storage_expired_inactive_apps_total",
+	Help: "number of apps deleted because they weren't queried within query-inactivity-retention",
+})
+
+type appRef struct {
+	Tenant string `json:"tenant"`
+	App    string `json:"app"`
+}
+
+type appActivity struct {
+	appRef
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastQueried time.Time `json:"lastQueried"`
+}
+
+// lastActive is when the app was last queried, or first seen if it never was
+func (a *appActivity) lastActive() time.Time {
+	if a.LastQueried.After(a.FirstSeen) {
+		return a.LastQueried
+	}
+	return a.FirstSeen
+}
+
+type queryActivity struct {
+	m    sync.Mutex
+	apps map[appRef]*appActivity
+}
+
+// seen records that the app exists, it's a no-op for known apps
+func (qa *queryActivity) seen(tenant, app string, now time.Time) {
+	r := appRef{Tenant: tenant, App: app}
+	qa.m.Lock()
+	defer qa.m.Unlock()
+	if _, ok := qa.apps[r]; !ok {
+		qa.apps[r] = &appActivity{appRef: r, FirstSeen: now}
+	}
+}
+
+// queried records a query of the app. Only apps that were seen are tracked, queries of apps
+// that don't exist don't grow the activity
+func (qa *queryActivity) queried(tenant, app string, now time.Time) {
+	r := appRef{Tenant: tenant, App: app}
+	qa.m.Lock()
+	defer qa.m.Unlock()
+	if a, ok := qa.apps[r]; ok {
+		a.LastQueried = now
+	}
+}
+
+// inactive returns apps that weren't active since the cutoff
+func (qa *queryActivity) inactive(cutoff time.Time) []appRef {
+	qa.m.Lock()
+	defer qa.m.Unlock()
+	var res []appRef
+	for r, a := range qa.apps {
+		if a.lastActive().Before(cutoff) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (qa *queryActivity) forget(r appRef) {
+	qa.m.Lock()
+	defer qa.m.Unlock()
+	delete(qa.apps, r)
+}
+
+// markQueried records a query of the app of the key and of all apps it's an alias of,
+// it has to be called with the closing mutex held
+func (s *Storage) markQueried(k *Key) {
+	now := time.Now()
+	s.queryActivity.queried(k.Tenant(), k.AppName(), now)
+	for _, ak := range s.aliasedKeys(k) {
+		s.queryActivity.queried(ak.Tenant(), ak.AppName(), now)
+	}
+}
+
+func (s *Storage) loadQueryActivity() error {
+	s.queryActivity = &queryActivity{apps: make(map[appRef]*appActivity)}
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(queryActivityKey)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error {
+			var apps []*appActivity
+			if err := json.Unmarshal(v, &apps); err != nil {
+				return err
+			}
+			for _, a := range apps {
+				s.queryActivity.apps[a.appRef] = a
+			}
+			return nil
+		})
+	})
+}
+
+func (s *Storage) saveQueryActivity() error {
+	s.queryActivity.m.Lock()
+	apps := make([]*appActivity, 0, len(s.queryActivity.apps))
+	for _, a := range s.queryActivity.apps {
+		c := *a
+		apps = append(apps, &c)
+	}
+	s.queryActivity.m.Unlock()
+
+	v, err := json.Marshal(apps)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry(queryActivityKey, v))
+	})
+}
+
+// AppLastQueried returns the last time the app was queried, ok is false if it never was
+// since query activity is tracked
+func (s *Storage) AppLastQueried(tenant, app string) (t time.Time, ok bool) {
+	s.queryActivity.m.Lock()
+	defer s.queryActivity.m.Unlock()
+	a, found := s.queryActivity.apps[appRef{Tenant: tenant, App: app}]
+	if !found || a.LastQueried.IsZero() {
+		return time.Time{}, false
+	}
+	return a.LastQueried, true
+}
+
+func (s *Storage) queryActivityLoop() {
+	ticker := time.NewTicker(queryActivityInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.queryActivityStop:
+			close(s.queryActivityDone)
+			return
+		case now := <-ticker.C:
+			if s.cfg.QueryInactivityRetention > 0 {
+				n, err := s.expireInactiveApps(now.Add(-s.cfg.QueryInactivityRetention))
+				if err != nil {
+					logrus.WithError(err).Error("failed to expire inactive apps")
+				}
+				if n > 0 {
+					logrus.WithField("apps", n).Info("deleted apps that weren't queried")
+				}
+			}
+			if err := s.saveQueryActivity(); err != nil {
+				logrus.WithError(err).Warn("failed to save query activity")
+			}
+		}
+	}
+}
+
+// expireInactiveApps deletes all data of apps that weren't queried since the cutoff.
+// Returns the number of deleted apps.
+func (s *Storage) expireInactiveApps(cutoff time.Time) (int, error) {
+	n := 0
+	for _, r := range s.queryActivity.inactive(cutoff) {
+		key, err := ParseKey(r.App)
+		if err != nil {
+			s.queryActivity.forget(r)
+			continue
+		}
+		key.SetTenant(r.Tenant)
+		if err = s.deleteApp(key); err != nil {
+			return n, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"tenant": r.Tenant,
+			"app":    r.App,
+		}).Info("deleted app that wasn't queried within query-inactivity-retention")
+		s.queryActivity.forget(r)
+		expiredInactiveApps.Inc()
+		n++
+	}
+	return n, nil
+}
+
+// deleteApp deletes all data of the app, the app is no longer listed afterwards
+func (s *Storage) deleteApp(key *Key) error {
+	err := s.Delete(&DeleteInput{
+		StartTime: time.Time{},
+		EndTime:   time.Now().Add(24 * time.Hour),
+		Key:       key,
+	})
+	if err != nil {
+		return err
+	}
+	return s.labels.ForTenant(key.Tenant()).DeleteValue("__name__", key.AppName())
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Per app retention overrides are records in the main db. They are few and consulted on every ingestion,
+// so all of them are also kept in memory.
+
+const retentionPrefix = "r:"
+
+var errInvalidRetention = errors.New("retention can't be negative")
+
+type appRetention struct {
+	m sync.RWMutex
+	// keyed by db keys
+	overrides map[string]time.Duration
+}
+
+func retentionKey(tenant, name string) string {
+	return retentionPrefix + tenant + ":" + name
+}
+
+func (s *Storage) loadAppRetention() error {
+	s.retention = &appRetention{overrides: make(map[string]time.Duration)}
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(retentionPrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func(v []byte) error {
+				d, err := time.ParseDuration(string(v))
+				if err != nil {
+					return err
+				}
+				s.retention.overrides[string(item.Key())] = d
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetAppRetention overrides the global retention for the app. 0 means the app data is kept forever.
+func (s *Storage) SetAppRetention(tenant, name string, d time.Duration) error {
+	if d < 0 {
+		return errInvalidRetention
+	}
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return ErrClosing
+	}
+
+	k := retentionKey(tenant, name)
+	s.retention.m.Lock()
+	defer s.retention.m.Unlock()
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(k), []byte(d.String())))
+	})
+	if err == nil {
+		s.retention.overrides[k] = d
+	}
+	return err
+}
+
+// DeleteAppRetention makes the app use the global retention again
+func (s *Storage) DeleteAppRetention(tenant, name string) error {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return ErrClosing
+	}
+
+	k := retentionKey(tenant, name)
+	s.retention.m.Lock()
+	defer s.retention.m.Unlock()
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(k))
+	})
+	if err == nil {
+		delete(s.retention.overrides, k)
+	}
+	return err
+}
+
+// AppRetention returns the retention override of the app, ok is false if the app uses the global retention
+func (s *Storage) AppRetention(tenant, name string) (d time.Duration, ok bool) {
+	s.retention.m.RLock()
+	defer s.retention.m.RUnlock()
+	d, ok = s.retention.overrides[retentionKey(tenant, name)]
+	return d, ok
+}
@@ -0,0 +1,88 @@
+package segment
+
+import "time"
+
+// Bounds returns the time range that contains all the data in the segment.
+// The precision is the segment's resolution (10 seconds). ok is false for empty segments.
+func (s *Segment) Bounds() (st, et time.Time, ok bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.root == nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return s.root.first().time, s.root.last().endTime(), true
+}
+
+func (sn *streeNode) first() *streeNode {
+	for {
+		var next *streeNode
+		for _, c := range sn.children {
+			if c != nil {
+				next = c
+				break
+			}
+		}
+		if next == nil {
+			return sn
+		}
+		sn = next
+	}
+}
+
+func (sn *streeNode) last() *streeNode {
+	for {
+		var next *streeNode
+		for i := len(sn.children) - 1; i >= 0; i-- {
+			if sn.children[i] != nil {
+				next = sn.children[i]
+				break
+			}
+		}
+		if next == nil {
+			return sn
+		}
+		sn = next
+	}
+}
+
+// Nearest returns the start of the resolution-wide bucket with data that is closest to t,
+// ok is false when there's no data within max of t
+func (s *Segment) Nearest(t time.Time, max time.Duration) (nearest time.Time, ok bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.root == nil {
+		return time.Time{}, false
+	}
+	best := max
+	s.root.nearest(t, &best, func(bt time.Time) {
+		nearest = bt
+		ok = true
+	})
+	return nearest, ok
+}
+
+// nodes only exist for time ranges something was written to, so the closest leaf is the closest data
+func (sn *streeNode) nearest(t time.Time, best *time.Duration, cb func(time.Time)) {
+	var d time.Duration
+	switch et := sn.endTime(); {
+	case t.Before(sn.time):
+		d = sn.time.Sub(t)
+	case !t.Before(et):
+		d = t.Sub(et)
+	}
+	if d > *best {
+		return
+	}
+	if sn.depth == 0 {
+		*best = d
+		cb(sn.time)
+		return
+	}
+	for _, child := range sn.children {
+		if child != nil {
+			child.nearest(t, best, cb)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package segment
+
+import (
+	"math/big"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pyroscope-io/pyroscope/pkg/testing"
+)
+
+var _ = Describe("segment bounds", func() {
+	It("returns false for empty segments", func() {
+		_, _, ok := New().Bounds()
+		Expect(ok).To(BeFalse())
+	})
+
+	It("returns the range of stored data", func() {
+		s := New()
+		noop := func(depth int, t time.Time, r *big.Rat, addons []Addon) {}
+		s.Put(testing.SimpleTime(20), testing.SimpleTime(29), 1, noop)
+		s.Put(testing.SimpleTime(1000), testing.SimpleTime(1009), 1, noop)
+		s.Put(testing.SimpleTime(130), testing.SimpleTime(139), 1, noop)
+
+		st, et, ok := s.Bounds()
+		Expect(ok).To(BeTrue())
+		Expect(st).To(Equal(testing.SimpleTime(20)))
+		Expect(et).To(Equal(testing.SimpleTime(1010)))
+	})
+
+	It("finds the closest data", func() {
+		s := New()
+		noop := func(depth int, t time.Time, r *big.Rat, addons []Addon) {}
+		_, ok := s.Nearest(testing.SimpleTime(20), time.Hour)
+		Expect(ok).To(BeFalse())
+
+		s.Put(testing.SimpleTime(20), testing.SimpleTime(29), 1, noop)
+		s.Put(testing.SimpleTime(1000), testing.SimpleTime(1019), 1, noop)
+
+		t, ok := s.Nearest(testing.SimpleTime(25), time.Minute)
+		Expect(ok).To(BeTrue())
+		Expect(t).To(Equal(testing.SimpleTime(20)))
+
+		t, ok = s.Nearest(testing.SimpleTime(900), time.Hour)
+		Expect(ok).To(BeTrue())
+		Expect(t).To(Equal(testing.SimpleTime(1000)))
+
+		t, ok = s.Nearest(testing.SimpleTime(1100), time.Hour)
+		Expect(ok).To(BeTrue())
+		Expect(t).To(Equal(testing.SimpleTime(1010)))
+
+		_, ok = s.Nearest(testing.SimpleTime(500), time.Minute)
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("segment retention", func() {
+	It("deletes nodes that end before the cutoff", func() {
+		s := New()
+		noop := func(depth int, t time.Time, r *big.Rat, addons []Addon) {}
+		s.Put(testing.SimpleTime(20), testing.SimpleTime(29), 1, noop)
+		s.Put(testing.SimpleTime(1000), testing.SimpleTime(1009), 1, noop)
+
+		var deleted []time.Time
+		cb := func(depth int, t time.Time) {
+			deleted = append(deleted, t)
+		}
+		Expect(s.DeleteNodesBefore(testing.SimpleTime(500), cb)).To(BeFalse())
+		Expect(deleted).To(Equal([]time.Time{testing.SimpleTime(20)}))
+		st, et, ok := s.Bounds()
+		Expect(ok).To(BeTrue())
+		Expect(st).To(Equal(testing.SimpleTime(1000)))
+		Expect(et).To(Equal(testing.SimpleTime(1010)))
+
+		deleted = nil
+		Expect(s.DeleteNodesBefore(testing.SimpleTime(500), cb)).To(BeFalse())
+		Expect(deleted).To(BeEmpty())
+
+		Expect(s.DeleteNodesBefore(testing.SimpleTime(100000), cb)).To(BeTrue())
+		Expect(deleted).ToNot(BeEmpty())
+		_, _, ok = s.Bounds()
+		Expect(ok).To(BeFalse())
+	})
+})
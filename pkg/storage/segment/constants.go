@@ -19,3 +19,8 @@ func init() {
 		d *= time.Duration(multiplier)
 	}
 }
+
+// DurationForDepth returns the time range covered by a segment node at the given depth
+func DurationForDepth(depth int) time.Duration {
+	return durations[depth]
+}
@@ -46,3 +46,11 @@ func overlapWrite(t1, t2, st, et time.Time, dur time.Duration) *big.Rat {
 	d := int64(et.Sub(st) / dur)
 	return big.NewRat(m, d)
 }
+
+// TrimRatio returns the share of the node at depth that starts at t and overlaps [st, et).
+// Ratios passed to Get callbacks are computed for the query range rounded to the resolution,
+// TrimRatio is precise to a second, so that partially overlapped buckets only contribute their part.
+func TrimRatio(depth int, t, st, et time.Time) *big.Rat {
+	d := durations[depth]
+	return overlapRead(t, t.Add(d), st, et, time.Second)
+}
@@ -0,0 +1,45 @@
+package segment
+
+import "time"
+
+// DeleteNodesBefore removes nodes that end before t and calls cb for every removed node that has
+// a tree stored for it, so that the caller can delete the trees. Nodes that span t are kept, together
+// with their aggregated trees, until they end before t too. It returns true if the segment is empty
+// afterwards.
+func (s *Segment) DeleteNodesBefore(t time.Time, cb func(depth int, t time.Time)) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.root == nil {
+		return true
+	}
+	if s.root.deleteBefore(t, cb) {
+		s.root = nil
+		return true
+	}
+	return false
+}
+
+// deleteBefore returns true if the node itself has to be removed
+func (sn *streeNode) deleteBefore(t time.Time, cb func(depth int, t time.Time)) bool {
+	if !sn.endTime().After(t) {
+		sn.walk(cb)
+		return true
+	}
+	if sn.time.After(t) {
+		return false
+	}
+	children := 0
+	for i, c := range sn.children {
+		if c == nil {
+			continue
+		}
+		if c.deleteBefore(t, cb) {
+			sn.children[i] = nil
+			continue
+		}
+		children++
+	}
+	// nodes without a tree of their own are only there for their children
+	return children == 0 && !sn.present
+}
@@ -260,6 +260,27 @@ func (s *Segment) Get(st, et time.Time, cb func(depth int, samples, writes uint6
 	v.print(fmt.Sprintf("/tmp/0-get-%s-%s.html", st.String(), et.String()))
 }
 
+// WalkNodes calls cb for every node that has a tree stored for it, parents before children
+func (s *Segment) WalkNodes(cb func(depth int, t time.Time)) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.root != nil {
+		s.root.walk(cb)
+	}
+}
+
+func (sn *streeNode) walk(cb func(depth int, t time.Time)) {
+	if sn.present {
+		cb(sn.depth, sn.time)
+	}
+	for _, child := range sn.children {
+		if child != nil {
+			child.walk(cb)
+		}
+	}
+}
+
 // TODO: this should be refactored
 
 func (s *Segment) SetMetadata(spyName string, sampleRate uint32, units, aggregationType string) {
@@ -11,6 +11,9 @@ type Timeline struct {
 	Samples       []uint64 `json:"samples"`
 	durationDelta time.Duration
 	DurationDelta int64 `json:"durationDelta"`
+
+	// SmoothedSamples is a moving average of Samples, it's only set by Smooth
+	SmoothedSamples []float64 `json:"smoothedSamples,omitempty"`
 }
 
 func GenerateTimeline(st, et time.Time) *Timeline {
@@ -56,6 +59,73 @@ func (tl *Timeline) PopulateTimeline(s *Segment) {
 	s.root.populateTimeline(tl.st, tl.et, tl.durationDelta, tl.Samples)
 }
 
+// Smooth sets SmoothedSamples to the moving average of samples over the window of buckets
+// ending at each bucket. Leading buckets are averaged over the buckets available so far.
+// Smoothing has to be done after resampling, windows are in buckets of the current resolution.
+func (tl *Timeline) Smooth(window int) {
+	if window <= 0 {
+		return
+	}
+	tl.SmoothedSamples = make([]float64, len(tl.Samples))
+	var sum uint64
+	for i := range tl.Samples {
+		sum += sampleValue(tl.Samples[i])
+		n := i + 1
+		if n > window {
+			sum -= sampleValue(tl.Samples[i-window])
+			n = window
+		}
+		tl.SmoothedSamples[i] = float64(sum) / float64(n)
+	}
+}
+
+// sampleValue is the number of samples of a bucket, non-empty buckets are offset by 1, see populateTimeline
+func sampleValue(v uint64) uint64 {
+	if v == 0 {
+		return 0
+	}
+	return v - 1
+}
+
+// Resample aggregates timeline buckets into coarser buckets of the given step, aligned to step
+// boundaries. Steps that are not coarser than the current resolution are ignored.
+func (tl *Timeline) Resample(step time.Duration) {
+	tl.ResampleInLocation(step, time.UTC)
+}
+
+// ResampleInLocation is like Resample, but steps are aligned to boundaries in loc, e.g 24h steps start
+// at local midnight. The offset of loc at the start of the timeline is used for the whole timeline.
+func (tl *Timeline) ResampleInLocation(step time.Duration, loc *time.Location) {
+	if step <= tl.durationDelta {
+		return
+	}
+
+	_, offset := tl.st.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	st := tl.st.Add(shift).Truncate(step).Add(-shift)
+	res := make([]uint64, (tl.et.Sub(st)+step-1)/step)
+	for i, v := range tl.Samples {
+		if v == 0 {
+			continue
+		}
+		j := int(tl.st.Add(time.Duration(i)*tl.durationDelta).Sub(st) / step)
+		if j >= len(res) {
+			continue
+		}
+		// non-empty buckets are offset by 1, see populateTimeline
+		if res[j] == 0 {
+			res[j] = 1
+		}
+		res[j] += v - 1
+	}
+
+	tl.st = st
+	tl.StartTime = st.Unix()
+	tl.Samples = res
+	tl.durationDelta = step
+	tl.DurationDelta = int64(step / time.Second)
+}
+
 func (sn *streeNode) populateTimeline(st, et time.Time, minDuration time.Duration, buf []uint64) {
 	rel := sn.relationship(st, et)
 	if rel != outside {
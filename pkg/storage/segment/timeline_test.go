@@ -87,4 +87,60 @@ var _ = Describe("timeline", func() {
 			}, 5)
 		})
 	})
+
+	Describe("Resample", func() {
+		BeforeEach(func() {
+			st = 20
+			et = 80
+		})
+
+		It("aggregates buckets aligned to the step", func() {
+			s := New()
+			for i, samples := range []uint64{2, 5, 0, 3, 4} {
+				s.Put(testing.SimpleTime(20+i*10),
+					testing.SimpleTime(29+i*10), samples, func(de int, t time.Time, r *big.Rat, a []Addon) {})
+			}
+			timeline.PopulateTimeline(s)
+			Expect(timeline.Samples).To(Equal([]uint64{3, 6, 1, 4, 5, 0}))
+
+			timeline.Resample(30 * time.Second)
+			Expect(timeline.StartTime).To(Equal(testing.SimpleTime(0).Unix()))
+			Expect(timeline.DurationDelta).To(Equal(int64(30)))
+			Expect(timeline.Samples).To(Equal([]uint64{3, 9, 5}))
+		})
+
+		It("aligns steps to boundaries in a location", func() {
+			s := New()
+			for i, samples := range []uint64{2, 5, 0, 3, 4} {
+				s.Put(testing.SimpleTime(20+i*10),
+					testing.SimpleTime(29+i*10), samples, func(de int, t time.Time, r *big.Rat, a []Addon) {})
+			}
+			timeline.PopulateTimeline(s)
+
+			timeline.ResampleInLocation(30*time.Second, time.FixedZone("UTC+10s", 10))
+			Expect(timeline.StartTime).To(Equal(testing.SimpleTime(20).Unix()))
+			Expect(timeline.Samples).To(Equal([]uint64{8, 8}))
+		})
+
+		It("ignores steps finer than the timeline resolution", func() {
+			timeline.Resample(time.Second)
+			Expect(timeline.DurationDelta).To(Equal(int64(10)))
+			Expect(timeline.Samples).To(HaveLen(6))
+		})
+	})
+
+	Describe("Smooth", func() {
+		It("averages samples over a trailing window of buckets", func() {
+			timeline.Samples = []uint64{3, 6, 0, 4, 5, 0}
+			timeline.Smooth(3)
+			// non-empty buckets are offset by 1, i.e these are 2, 5, 0, 3, 4 and 0 samples
+			Expect(timeline.SmoothedSamples).To(Equal([]float64{2, 3.5, 7.0 / 3, 8.0 / 3, 7.0 / 3, 7.0 / 3}))
+			Expect(timeline.Samples).To(Equal([]uint64{3, 6, 0, 4, 5, 0}))
+		})
+
+		It("ignores non-positive windows", func() {
+			timeline.Smooth(0)
+			Expect(timeline.SmoothedSamples).To(BeNil())
+		})
+	})
 })
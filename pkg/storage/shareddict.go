@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// sharedDictKey is the key of the dictionary used by all trees when SharedDictionary is enabled.
+// App keys can't start with a colon, so it never collides with per-key dictionaries.
+const sharedDictKey = ":shared:"
+
+// dictionaryModeKey is where the main db remembers which dictionary mode the data was written with
+var dictionaryModeKey = []byte("m:dictionary-mode")
+
+const (
+	dictionaryModePerKey = "per-key"
+	dictionaryModeShared = "shared"
+)
+
+// dictKey returns the key of the symbol dictionary used by the tree.
+// Apps built from the same codebase share most of their symbols, with a shared
+// dictionary each symbol is stored once instead of once per app.
+func (s *Storage) dictKey(treeKey string) string {
+	if s.cfg.SharedDictionary {
+		return sharedDictKey
+	}
+	return FromTreeToMainKey(treeKey)
+}
+
+// checkDictionaryMode makes sure the dictionary mode matches the one existing data was written with.
+// Trees only store references to dictionary entries, so reading them with a different
+// dictionary would silently produce garbage.
+func checkDictionaryMode(db, dbDicts *badger.DB, shared bool) error {
+	mode := dictionaryModePerKey
+	if shared {
+		mode = dictionaryModeShared
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(dictionaryModeKey)
+		switch {
+		case err == nil:
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if string(v) != mode {
+				return fmt.Errorf("storage was created with %s dictionaries, the dictionary mode can't be changed for existing storage", v)
+			}
+			return nil
+		case errors.Is(err, badger.ErrKeyNotFound):
+			// storage created before dictionary modes were introduced always uses per-key dictionaries
+			if shared && !isEmpty(dbDicts) {
+				return errors.New("storage was created with per-key dictionaries, the dictionary mode can't be changed for existing storage")
+			}
+			return txn.SetEntry(badger.NewEntry(dictionaryModeKey, []byte(mode)))
+		default:
+			return err
+		}
+	})
+}
+
+func isEmpty(db *badger.DB) bool {
+	empty := true
+	db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty
+}
@@ -6,7 +6,6 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
-	"runtime"
 	"sync"
 	"time"
 
@@ -14,25 +13,54 @@ import (
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/dgraph-io/badger/v2/options"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/annotations"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/cache"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/dict"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/dimension"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/labels"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
-	"github.com/pyroscope-io/pyroscope/pkg/structs/merge"
 	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
 	"github.com/pyroscope-io/pyroscope/pkg/util/slices"
 	"github.com/sirupsen/logrus"
 )
 
-var errClosing = errors.New("the db is in closing state")
-var errOutOfSpace = errors.New("running out of space")
+const (
+	AggregationSum     = "sum"
+	AggregationAverage = "average"
+	AggregationLast    = "last"
+	AggregationMax     = "max"
+)
+
+// IsValidAggregationType tells whether storage knows how to merge profiles with the given aggregation type
+func IsValidAggregationType(at string) bool {
+	switch at {
+	case AggregationSum, AggregationAverage, AggregationLast, AggregationMax:
+		return true
+	}
+	return false
+}
+
+// corrupted trees are skipped when reading, so that they don't render as garbage
+var corruptedTrees = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pyroscope_storage_corrupted_trees_total",
+	Help: "number of trees that failed checksum verification",
+})
+
+var ErrClosing = errors.New("the db is in closing state")
+var ErrOutOfSpace = errors.New("running out of space")
 
 type Storage struct {
 	closingMutex sync.RWMutex
 	closing      bool
+	// readOnly storages don't run background loops and don't persist anything on close
+	readOnly bool
+
+	// expiryMutex keeps the retention reaper from deleting series that are being written to
+	expiryMutex sync.RWMutex
 
 	cfg      *config.Server
 	segments *cache.Cache
@@ -42,49 +70,138 @@ type Storage struct {
 	trees      *cache.Cache
 	labels     *labels.Labels
 
+	labelLimits *labelValueLimits
+
+	annotations *annotations.Annotations
+	queries     *queryCounter
+	retention   *appRetention
+
+	queryActivity     *queryActivity
+	queryActivityStop chan struct{}
+	queryActivityDone chan struct{}
+
+	flushStop chan struct{}
+	flushDone chan struct{}
+
+	dirtyAgeStop chan struct{}
+	dirtyAgeDone chan struct{}
+
+	watermarks         memoryWatermarks
+	memoryPressureStop chan struct{}
+	memoryPressureDone chan struct{}
+
+	tieringStop chan struct{}
+	tieringDone chan struct{}
+
+	retentionStop chan struct{}
+	retentionDone chan struct{}
+
+	badgerGCStop chan struct{}
+	badgerGCDone chan struct{}
+
 	db           *badger.DB
 	dbTrees      *badger.DB
 	dbDicts      *badger.DB
 	dbDimensions *badger.DB
 	dbSegments   *badger.DB
+	// dbTreesCold is the cold tier of trees, it's nil unless cold-storage-path is set. See tiering.go
+	dbTreesCold *badger.DB
 }
 
-func badgerGC(db *badger.DB) {
+// badgerGCLoop runs value log GC of the given dbs until the storage is closed. It has to stop
+// before the dbs are closed, otherwise it keeps them (and their memtables) reachable forever
+func (s *Storage) badgerGCLoop(dbs []*badger.DB) {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
-	for range ticker.C {
-	again:
-		err := db.RunValueLogGC(0.7)
-		if err == nil {
-			goto again
+	for {
+		select {
+		case <-s.badgerGCStop:
+			close(s.badgerGCDone)
+			return
+		case <-ticker.C:
+			s.runBadgerGC(dbs)
+		}
+	}
+}
+
+// runBadgerGC rewrites value log files until there's nothing left to collect. A single pass can take
+// a while, so the stop channel is checked between passes for Close not to wait behind a long GC
+func (s *Storage) runBadgerGC(dbs []*badger.DB) {
+	for _, db := range dbs {
+		for {
+			select {
+			case <-s.badgerGCStop:
+				return
+			default:
+			}
+			if db.RunValueLogGC(0.7) != nil {
+				break
+			}
 		}
 	}
 }
 
 func newBadger(cfg *config.Server, name string) (*badger.DB, error) {
-	badgerPath := filepath.Join(cfg.StoragePath, name)
-	err := os.MkdirAll(badgerPath, 0o755)
-	if err != nil {
-		return nil, err
+	badgerPath := ""
+	if !cfg.InMemory {
+		badgerPath = filepath.Join(cfg.StoragePath, name)
+		err := os.MkdirAll(badgerPath, 0o755)
+		if err != nil {
+			return nil, err
+		}
 	}
 	badgerOptions := badger.DefaultOptions(badgerPath)
+	badgerOptions = badgerOptions.WithInMemory(cfg.InMemory)
 	badgerOptions = badgerOptions.WithTruncate(!cfg.BadgerNoTruncate)
 	badgerOptions = badgerOptions.WithSyncWrites(false)
 	badgerOptions = badgerOptions.WithCompression(options.ZSTD)
+	badgerOptions = applyBadgerOptions(cfg, badgerOptions)
 	badgerLevel := logrus.ErrorLevel
 	if l, err := logrus.ParseLevel(cfg.BadgerLogLevel); err == nil {
 		badgerLevel = l
 	}
 	badgerOptions = badgerOptions.WithLogger(badgerLogger{name: name, logLevel: badgerLevel})
 
-	db, err := badger.Open(badgerOptions)
-	if err == nil {
-		go badgerGC(db)
-	}
-	return db, err
+	return openBadger(badgerOptions, cfg.ForceUnlock)
 }
 
 func New(cfg *config.Server) (*Storage, error) { // TODO: cfg.Server?
+	s, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.startLoops()
+	return s, nil
+}
+
+// NewReadOnly opens the storage for reading only, e.g as a source of data for dbmanager commands.
+// No background loops (retention, GC, flushing, etc.) are started and nothing is written back on Close.
+func NewReadOnly(cfg *config.Server) (*Storage, error) {
+	s, err := open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.readOnly = true
+	return s, nil
+}
+
+func open(cfg *config.Server) (*Storage, error) {
+	if err := validateBadgerOptions(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateTiering(cfg); err != nil {
+		return nil, err
+	}
+	wm, err := newMemoryWatermarks(cfg)
+	if err != nil {
+		return nil, err
+	}
+	labelLimits, err := newLabelValueLimits(cfg)
+	if err != nil {
+		return nil, err
+	}
+	logBadgerOptions(cfg)
+
 	db, err := newBadger(cfg, "main")
 	if err != nil {
 		return nil, err
@@ -105,15 +222,27 @@ func New(cfg *config.Server) (*Storage, error) { // TODO: cfg.Server?
 	if err != nil {
 		return nil, err
 	}
+	dbTreesCold, err := newColdBadger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDictionaryMode(db, dbDicts, cfg.SharedDictionary); err != nil {
+		return nil, err
+	}
 
 	s := &Storage{
 		cfg:          cfg,
 		labels:       labels.New(db),
+		labelLimits:  labelLimits,
+		annotations:  annotations.New(db),
 		db:           db,
 		dbTrees:      dbTrees,
 		dbDicts:      dbDicts,
 		dbDimensions: dbDimensions,
 		dbSegments:   dbSegments,
+		dbTreesCold:  dbTreesCold,
+		watermarks:   wm,
 	}
 
 	s.dimensions = cache.New(dbDimensions, cfg.CacheDimensionSize, "i:")
@@ -152,8 +281,9 @@ func New(cfg *config.Server) (*Storage, error) { // TODO: cfg.Server?
 	}
 
 	s.trees = cache.New(dbTrees, cfg.CacheTreeSize, "t:")
+	s.trees.Cold = dbTreesCold
 	s.trees.Bytes = func(k string, v interface{}) ([]byte, error) {
-		key := FromTreeToMainKey(k)
+		key := s.dictKey(k)
 		d, err := s.dicts.Get(key)
 		if err != nil {
 			return nil, fmt.Errorf("dicts cache for %v: %v", key, err)
@@ -161,11 +291,14 @@ func New(cfg *config.Server) (*Storage, error) { // TODO: cfg.Server?
 		if d == nil { // key not found
 			return nil, nil
 		}
-		return v.(*tree.Tree).Bytes(d.(*dict.Dict), cfg.MaxNodesSerialization)
+		b, err := v.(*tree.Tree).Bytes(d.(*dict.Dict), cfg.MaxNodesSerialization)
+		// serialization adds new names to the dictionary
+		s.dicts.Put(key, d)
+		return b, err
 	}
 	s.trees.FromBytes = func(k string, v []byte) (interface{}, error) {
-		key := FromTreeToMainKey(k)
-		d, err := s.dicts.Get(FromTreeToMainKey(k))
+		key := s.dictKey(k)
+		d, err := s.dicts.Get(key)
 		if err != nil {
 			return nil, fmt.Errorf("dicts cache for %v: %v", key, err)
 		}
@@ -178,9 +311,64 @@ func New(cfg *config.Server) (*Storage, error) { // TODO: cfg.Server?
 		return tree.New()
 	}
 
+	if err := s.loadAppRetention(); err != nil {
+		return nil, fmt.Errorf("load app retention: %v", err)
+	}
+	if err := s.loadQueryCounts(); err != nil {
+		logrus.WithError(err).Warn("failed to load query counts")
+	}
+	if err := s.loadQueryActivity(); err != nil {
+		logrus.WithError(err).Warn("failed to load query activity")
+	}
 	return s, nil
 }
 
+func (s *Storage) startLoops() {
+	cfg := s.cfg
+	if keys := s.preloadKeys(); len(keys) > 0 {
+		go s.preload(keys)
+	}
+	// nothing is persisted in in-memory mode
+	if cfg.CacheFlushInterval > 0 && !cfg.InMemory {
+		s.flushStop = make(chan struct{})
+		s.flushDone = make(chan struct{})
+		go s.flushLoop(cfg.CacheFlushInterval)
+	}
+	if !cfg.InMemory {
+		s.dirtyAgeStop = make(chan struct{})
+		s.dirtyAgeDone = make(chan struct{})
+		go s.dirtyAgeLoop()
+	}
+	// evicted entries stay in memory in in-memory mode
+	if s.watermarks.enabled() && !cfg.InMemory {
+		s.memoryPressureStop = make(chan struct{})
+		s.memoryPressureDone = make(chan struct{})
+		go s.memoryPressureLoop(s.watermarks)
+	}
+	if cfg.ColdStorageAge > 0 {
+		s.tieringStop = make(chan struct{})
+		s.tieringDone = make(chan struct{})
+		go s.tieringLoop()
+	}
+	s.queryActivityStop = make(chan struct{})
+	s.queryActivityDone = make(chan struct{})
+	go s.queryActivityLoop()
+	// retention can be overridden per app at any time, so the loop runs even without the global one
+	s.retentionStop = make(chan struct{})
+	s.retentionDone = make(chan struct{})
+	go s.retentionLoop()
+	// value log GC is not supported in in-memory mode
+	if !cfg.InMemory {
+		dbs := []*badger.DB{s.db, s.dbTrees, s.dbDicts, s.dbDimensions, s.dbSegments}
+		if s.dbTreesCold != nil {
+			dbs = append(dbs, s.dbTreesCold)
+		}
+		s.badgerGCStop = make(chan struct{})
+		s.badgerGCDone = make(chan struct{})
+		go s.badgerGCLoop(dbs)
+	}
+}
+
 type PutInput struct {
 	StartTime       time.Time
 	EndTime         time.Time
@@ -190,18 +378,24 @@ type PutInput struct {
 	SampleRate      uint32
 	Units           string
 	AggregationType string
+	// Metadata are tags of this particular upload, see uploadmetadata.go
+	Metadata map[string]string
 }
 
 func (s *Storage) Put(po *PutInput) error {
 	s.closingMutex.RLock()
 	defer s.closingMutex.RUnlock()
 	if s.closing {
-		return errClosing
+		return ErrClosing
 	}
+	s.expiryMutex.RLock()
+	defer s.expiryMutex.RUnlock()
 
-	freeSpace, err := disk.FreeSpace(s.cfg.StoragePath)
-	if err == nil && freeSpace < s.cfg.OutOfSpaceThreshold {
-		return errOutOfSpace
+	if !s.cfg.InMemory {
+		freeSpace, err := disk.FreeSpace(s.cfg.StoragePath)
+		if err == nil && freeSpace < s.cfg.OutOfSpaceThreshold {
+			return ErrOutOfSpace
+		}
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -212,9 +406,10 @@ func (s *Storage) Put(po *PutInput) error {
 		"units":           po.Units,
 		"aggregationType": po.AggregationType,
 	}).Info("storage.Put")
-	for k, v := range po.Key.labels {
-		s.labels.Put(k, v)
+	if err := s.putLabels(po.Key); err != nil {
+		return err
 	}
+	s.queryActivity.seen(po.Key.Tenant(), po.Key.AppName(), time.Now())
 
 	sk := po.Key.SegmentKey()
 	for k, v := range po.Key.labels {
@@ -226,6 +421,7 @@ func (s *Storage) Put(po *PutInput) error {
 		}
 		if res != nil {
 			res.(*dimension.Dimension).Insert([]byte(sk))
+			s.dimensions.Put(key, res)
 		}
 	}
 
@@ -273,6 +469,16 @@ func (s *Storage) Put(po *PutInput) error {
 	})
 	s.segments.Put(string(sk), st)
 
+	if len(po.Metadata) > 0 {
+		if err := s.putUploadMetadata(po.Key, po.StartTime, po.EndTime, po.Metadata); err != nil {
+			return fmt.Errorf("upload metadata for %v: %v", sk, err)
+		}
+	}
+	if traceID := po.Metadata[TraceIDMetadata]; traceID != "" {
+		if err := s.putTraceProfile(traceID, po.Key, po.StartTime, po.EndTime); err != nil {
+			return fmt.Errorf("trace index for %v: %v", sk, err)
+		}
+	}
 	return nil
 }
 
@@ -280,21 +486,40 @@ type GetInput struct {
 	StartTime time.Time
 	EndTime   time.Time
 	Key       *Key
+	// Quantile, when set to a value in (0, 1], selects a single time bucket instead of summing
+	// all of them. See quantile.go for details
+	Quantile float64
+	// Trim makes buckets that partially overlap the time range contribute only the overlapping
+	// part of their values, instead of rounding the range to the 10s resolution
+	Trim bool
+	// Metadata restricts the query to uploads that have all of these metadata tags
+	Metadata map[string]string
 }
 
 type GetOutput struct {
-	Tree       *tree.Tree
-	Timeline   *segment.Timeline
-	SpyName    string
-	SampleRate uint32
-	Units      string
+	Tree            *tree.Tree
+	Timeline        *segment.Timeline
+	SpyName         string
+	SampleRate      uint32
+	Units           string
+	AggregationType string
 }
 
 func (s *Storage) Get(gi *GetInput) (*GetOutput, error) {
+	s.queries.inc(gi.Key.Normalized())
+	s.closingMutex.RLock()
+	if !s.closing {
+		s.markQueried(gi.Key)
+	}
+	s.closingMutex.RUnlock()
+	return s.get(gi)
+}
+
+func (s *Storage) get(gi *GetInput) (*GetOutput, error) {
 	s.closingMutex.RLock()
 	defer s.closingMutex.RUnlock()
 	if s.closing {
-		return nil, errClosing
+		return nil, ErrClosing
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -302,35 +527,52 @@ func (s *Storage) Get(gi *GetInput) (*GetOutput, error) {
 		"endTime":   gi.EndTime.String(),
 		"key":       gi.Key.Normalized(),
 	}).Info("storage.Get")
-	triesToMerge := []merge.Merger{}
+	return s.getKeys(gi, s.matchingKeys(gi.Key))
+}
 
-	dimensions := []*dimension.Dimension{}
-	for k, v := range gi.Key.labels {
-		key := k + ":" + v
-		res, err := s.dimensions.Get(key)
+// matchingKeys returns keys of all series matched by k
+func (s *Storage) matchingKeys(k *Key) []*Key {
+	segmentKeys := dimension.Intersection(s.keyDimensions(k)...)
+	// data of renamed apps is queried together with the new name, see aliases.go
+	for _, ak := range s.aliasedKeys(k) {
+		// Intersection can return a slice owned by a dimension, capping capacity makes append copy it
+		segmentKeys = append(segmentKeys[:len(segmentKeys):len(segmentKeys)], dimension.Intersection(s.keyDimensions(ak)...)...)
+	}
+
+	keys := make([]*Key, 0, len(segmentKeys))
+	for _, sk := range segmentKeys {
+		// TODO: refactor, store `Key`s in dimensions
+		parsedKey, err := parseStoredKey(string(sk))
 		if err != nil {
-			logrus.Errorf("dimensions cache for %v: %v", key, err)
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
 			continue
 		}
-		if res != nil {
-			dimensions = append(dimensions, res.(*dimension.Dimension))
+		// default tenant keys don't have a tenant label, so dimensions alone don't isolate tenants
+		if parsedKey.Tenant() != k.Tenant() {
+			continue
 		}
+		keys = append(keys, parsedKey)
+	}
+	return keys
+}
+
+// getKeys merges data of the given series, gi.Key is ignored
+func (s *Storage) getKeys(gi *GetInput, keys []*Key) (*GetOutput, error) {
+	if len(gi.Metadata) > 0 && gi.Quantile > 0 {
+		return nil, ErrUnsupportedMetadataFilter
 	}
 
-	segmentKeys := dimension.Intersection(dimensions...)
+	// trees are folded into the result one at a time, so that wide range queries
+	// don't need to hold all of them in memory at once
+	resultTree := tree.New()
+	merged := false
 
 	tl := segment.GenerateTimeline(gi.StartTime, gi.EndTime)
 	var lastSegment *segment.Segment
 	var writesTotal uint64
-	aggregationType := "sum"
-	for _, sk := range segmentKeys {
-		// TODO: refactor, store `Key`s in dimensions
-		parsedKey, err := ParseKey(string(sk))
-		if err != nil {
-			logrus.Errorf("parse key: %v: %v", string(sk), err)
-			continue
-		}
-
+	aggregationType := AggregationSum
+	buckets := quantileBuckets{}
+	for _, parsedKey := range keys {
 		key := parsedKey.SegmentKey()
 		res, err := s.segments.Get(key)
 		if err != nil {
@@ -342,50 +584,314 @@ func (s *Storage) Get(gi *GetInput) (*GetOutput, error) {
 		}
 
 		st := res.(*segment.Segment)
-		if st.AggregationType() == "average" {
-			aggregationType = "average"
+
+		ranges := []timeRange{{start: gi.StartTime, end: gi.EndTime}}
+		if len(gi.Metadata) > 0 {
+			if at := st.AggregationType(); at == AggregationLast || at == AggregationMax {
+				return nil, ErrUnsupportedMetadataFilter
+			}
+			if ranges, err = s.uploadRanges(key, gi.StartTime, gi.EndTime, gi.Metadata); err != nil {
+				logrus.Errorf("upload metadata for %v: %v", key, err)
+				continue
+			}
+			if len(ranges) == 0 {
+				continue
+			}
+		}
+
+		if st.AggregationType() == AggregationAverage {
+			aggregationType = AggregationAverage
 		}
 		lastSegment = st
 
 		tl.PopulateTimeline(st)
 
-		st.Get(gi.StartTime, gi.EndTime, func(depth int, samples, writes uint64, t time.Time, r *big.Rat) {
-			key := parsedKey.TreeKey(depth, t)
-			res, err := s.trees.Get(key)
-			if err != nil {
-				logrus.Errorf("trees cache for %v: %v", key, err)
-				return
+		if gi.Quantile > 0 {
+			buckets.add(parsedKey, st, gi)
+			continue
+		}
+
+		if at := st.AggregationType(); at == AggregationLast || at == AggregationMax {
+			if tr := s.snapshot(parsedKey, st, gi, at); tr != nil {
+				resultTree.Merge(tr)
+				merged = true
 			}
+			continue
+		}
 
-			tr := res.(*tree.Tree)
-			// TODO: these clones are probably are not the most efficient way of doing this
-			//   instead this info should be passed to the merger function imo
-			tr2 := tr.Clone(r)
-			triesToMerge = append(triesToMerge, merge.Merger(tr2))
-			writesTotal += writes
-		})
+		for _, tr := range ranges {
+			st.Get(tr.start, tr.end, func(depth int, samples, writes uint64, t time.Time, r *big.Rat) {
+				if gi.Trim {
+					if r = segment.TrimRatio(depth, t, tr.start, tr.end); r.Sign() == 0 {
+						return
+					}
+				}
+				cached := s.cachedTree(parsedKey.TreeKey(depth, t))
+				if cached == nil {
+					return
+				}
+				resultTree.MergeWithRatio(cached, r)
+				merged = true
+				writesTotal += writes
+			})
+		}
+	}
+
+	if gi.Quantile > 0 {
+		if tr := s.quantileTree(buckets, gi.Quantile); tr != nil {
+			resultTree.Merge(tr)
+			merged = true
+		}
 	}
 
-	resultTrie := merge.MergeTriesConcurrently(runtime.NumCPU(), triesToMerge...)
-	if resultTrie == nil {
+	if !merged {
 		return nil, nil
 	}
 
-	t := resultTrie.(*tree.Tree)
+	t := resultTree
 
-	if writesTotal > 0 && aggregationType == "average" {
+	if writesTotal > 0 && aggregationType == AggregationAverage {
 		t = t.Clone(big.NewRat(1, int64(writesTotal)))
 	}
 
+	if aggregationType != AggregationAverage && lastSegment.AggregationType() != "" {
+		aggregationType = lastSegment.AggregationType()
+	}
+
 	return &GetOutput{
-		Tree:       t,
-		Timeline:   tl,
-		SpyName:    lastSegment.SpyName(),
-		SampleRate: lastSegment.SampleRate(),
-		Units:      lastSegment.Units(),
+		Tree:            t,
+		Timeline:        tl,
+		SpyName:         lastSegment.SpyName(),
+		SampleRate:      lastSegment.SampleRate(),
+		Units:           lastSegment.Units(),
+		AggregationType: aggregationType,
 	}, nil
 }
 
+func (s *Storage) keyDimensions(k *Key) []*dimension.Dimension {
+	dimensions := []*dimension.Dimension{}
+	for lk, lv := range k.labels {
+		key := lk + ":" + lv
+		res, err := s.dimensions.Get(key)
+		if err != nil {
+			logrus.Errorf("dimensions cache for %v: %v", key, err)
+			continue
+		}
+		if res != nil {
+			dimensions = append(dimensions, res.(*dimension.Dimension))
+		}
+	}
+	return dimensions
+}
+
+// snapshot returns a single point in time tree of a segment for profile types that represent
+// a snapshot (e.g inuse_space), where summing values over time produces meaningless totals.
+// With AggregationLast it's the latest tree in the range, with AggregationMax it's the one
+// with the most samples per write.
+func (s *Storage) snapshot(k *Key, st *segment.Segment, gi *GetInput, aggregationType string) *tree.Tree {
+	var (
+		found     bool
+		bestDepth int
+		bestTime  time.Time
+		bestScore *big.Rat
+		bestWrite uint64
+	)
+	st.Get(gi.StartTime, gi.EndTime, func(depth int, samples, writes uint64, t time.Time, _ *big.Rat) {
+		if writes == 0 {
+			return
+		}
+		score := big.NewRat(int64(samples), int64(writes))
+		better := !found
+		if found {
+			switch aggregationType {
+			case AggregationLast:
+				better = t.After(bestTime)
+			case AggregationMax:
+				better = score.Cmp(bestScore) > 0
+			}
+		}
+		if better {
+			found = true
+			bestDepth, bestTime, bestScore, bestWrite = depth, t, score, writes
+		}
+	})
+	if !found {
+		return nil
+	}
+
+	tr := s.cachedTree(k.TreeKey(bestDepth, bestTime))
+	if tr == nil {
+		return nil
+	}
+	// trees of coarser nodes contain all writes within them, averaging turns it back into a snapshot
+	return tr.Clone(big.NewRat(1, int64(bestWrite)))
+}
+
+// cachedTree returns the tree stored under the key, or nil if it's missing or can't be read
+func (s *Storage) cachedTree(key string) *tree.Tree {
+	res, err := s.trees.Get(key)
+	if err != nil {
+		if errors.Is(err, tree.ErrChecksumMismatch) {
+			corruptedTrees.Inc()
+		}
+		logrus.Errorf("trees cache for %v: %v", key, err)
+		return nil
+	}
+	if res == nil {
+		return nil
+	}
+	return res.(*tree.Tree)
+}
+
+type DataRange struct {
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+// DataRange returns the time range of stored data matching the key, or nil if there's no data
+func (s *Storage) DataRange(key *Key) (*DataRange, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	dimensions := []*dimension.Dimension{}
+	for k, v := range key.labels {
+		res, err := s.dimensions.Get(k + ":" + v)
+		if err != nil {
+			return nil, fmt.Errorf("dimensions cache for %v: %v", k+":"+v, err)
+		}
+		if res != nil {
+			dimensions = append(dimensions, res.(*dimension.Dimension))
+		}
+	}
+
+	var res *DataRange
+	for _, sk := range dimension.Intersection(dimensions...) {
+		parsedKey, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			continue
+		}
+		if parsedKey.Tenant() != key.Tenant() {
+			continue
+		}
+		st, err := s.segments.Get(parsedKey.SegmentKey())
+		if err != nil {
+			return nil, fmt.Errorf("segments cache for %v: %v", parsedKey.SegmentKey(), err)
+		}
+		if st == nil {
+			continue
+		}
+		startTime, endTime, ok := st.(*segment.Segment).Bounds()
+		if !ok {
+			continue
+		}
+		if res == nil {
+			res = &DataRange{StartTime: startTime, EndTime: endTime}
+			continue
+		}
+		if startTime.Before(res.StartTime) {
+			res.StartTime = startTime
+		}
+		if endTime.After(res.EndTime) {
+			res.EndTime = endTime
+		}
+	}
+	return res, nil
+}
+
+// NearestData returns the 10 second bucket with data matching the key that is closest to t,
+// or nil if there's no data within max of t
+func (s *Storage) NearestData(key *Key, t time.Time, max time.Duration) (*DataRange, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	var res *DataRange
+	for _, sk := range dimension.Intersection(s.keyDimensions(key)...) {
+		parsedKey, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			continue
+		}
+		if parsedKey.Tenant() != key.Tenant() {
+			continue
+		}
+		st, err := s.segments.Get(parsedKey.SegmentKey())
+		if err != nil {
+			return nil, fmt.Errorf("segments cache for %v: %v", parsedKey.SegmentKey(), err)
+		}
+		if st == nil {
+			continue
+		}
+		nearest, ok := st.(*segment.Segment).Nearest(t, max)
+		if !ok {
+			continue
+		}
+		// segments are searched within the distance to the nearest bucket found so far
+		res = &DataRange{StartTime: nearest, EndTime: nearest.Add(bucketDuration)}
+		max = distance(t, res)
+	}
+	return res, nil
+}
+
+func distance(t time.Time, dr *DataRange) time.Duration {
+	switch {
+	case t.Before(dr.StartTime):
+		return dr.StartTime.Sub(t)
+	case t.After(dr.EndTime):
+		return t.Sub(dr.EndTime)
+	}
+	return 0
+}
+
+type Metadata struct {
+	SpyName         string
+	SampleRate      uint32
+	Units           string
+	AggregationType string
+}
+
+// Metadata returns the metadata of stored data matching the key, or nil if there's no data.
+// Segments matching the key are expected to share metadata, the first one found is returned.
+func (s *Storage) Metadata(key *Key) (*Metadata, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	for _, sk := range dimension.Intersection(s.keyDimensions(key)...) {
+		parsedKey, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			continue
+		}
+		if parsedKey.Tenant() != key.Tenant() {
+			continue
+		}
+		st, err := s.segments.Get(parsedKey.SegmentKey())
+		if err != nil {
+			return nil, fmt.Errorf("segments cache for %v: %v", parsedKey.SegmentKey(), err)
+		}
+		if st == nil {
+			continue
+		}
+		seg := st.(*segment.Segment)
+		return &Metadata{
+			SpyName:         seg.SpyName(),
+			SampleRate:      seg.SampleRate(),
+			Units:           seg.Units(),
+			AggregationType: seg.AggregationType(),
+		}, nil
+	}
+	return nil, nil
+}
+
 type DeleteInput struct {
 	StartTime time.Time
 	EndTime   time.Time
@@ -396,7 +902,7 @@ func (s *Storage) Delete(di *DeleteInput) error {
 	s.closingMutex.RLock()
 	defer s.closingMutex.RUnlock()
 	if s.closing {
-		return errClosing
+		return ErrClosing
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -419,7 +925,14 @@ func (s *Storage) Delete(di *DeleteInput) error {
 
 	for _, sk := range segmentKeys {
 		// TODO: refactor, store `Key`s in dimensions
-		skk, _ := ParseKey(string(sk))
+		skk, err := parseStoredKey(string(sk))
+		if err != nil {
+			logrus.Errorf("parse key: %v: %v", string(sk), err)
+			continue
+		}
+		if skk.Tenant() != di.Key.Tenant() {
+			continue
+		}
 		stInt, err := s.segments.Get(skk.SegmentKey())
 		if err != nil {
 			return nil
@@ -432,17 +945,40 @@ func (s *Storage) Delete(di *DeleteInput) error {
 		st.Get(di.StartTime, di.EndTime, func(depth int, samples, writes uint64, t time.Time, r *big.Rat) {
 			k := skk.TreeKey(depth, t)
 			s.trees.Delete(k)
-			s.dicts.Delete(FromTreeToMainKey(k))
+			// the shared dictionary is still used by other keys
+			if !s.cfg.SharedDictionary {
+				s.dicts.Delete(FromTreeToMainKey(k))
+			}
 		})
 
-		s.segments.Delete(skk.SegmentKey())
+		s.deleteSeries(skk)
 	}
 
-	for k, v := range di.Key.labels {
-		s.dimensions.Delete(k + ":" + v)
+	return nil
+}
+
+// deleteSeries removes the series once its trees are deleted
+func (s *Storage) deleteSeries(k *Key) {
+	s.segments.Delete(k.SegmentKey())
+	if err := s.deleteUploadMetadata(k.SegmentKey()); err != nil {
+		logrus.Errorf("upload metadata for %v: %v", k.SegmentKey(), err)
 	}
 
-	return nil
+	// dimensions are shared with other keys (e.g. the tenant or a common label),
+	// so only the deleted key is removed from them
+	sk := []byte(k.SegmentKey())
+	for name, v := range k.labels {
+		key := name + ":" + v
+		res, err := s.dimensions.Get(key)
+		if err != nil {
+			logrus.Errorf("dimensions cache for %v: %v", key, err)
+			continue
+		}
+		if res != nil {
+			res.(*dimension.Dimension).Delete(sk)
+			s.dimensions.Put(key, res)
+		}
+	}
 }
 
 func (s *Storage) Close() error {
@@ -450,6 +986,52 @@ func (s *Storage) Close() error {
 	s.closing = true
 	s.closingMutex.Unlock()
 
+	if s.readOnly {
+		if s.dbTreesCold != nil {
+			s.dbTreesCold.Close()
+		}
+		s.dbTrees.Close()
+		s.dbDicts.Close()
+		s.dbDimensions.Close()
+		s.dbSegments.Close()
+		return s.db.Close()
+	}
+
+	close(s.queryActivityStop)
+	<-s.queryActivityDone
+	close(s.retentionStop)
+	<-s.retentionDone
+
+	// nothing is persisted in in-memory mode, so there's no point in flushing caches
+	if s.cfg.InMemory {
+		s.dbTrees.Close()
+		s.dbDicts.Close()
+		s.dbDimensions.Close()
+		s.dbSegments.Close()
+		return s.db.Close()
+	}
+
+	if s.flushStop != nil {
+		close(s.flushStop)
+		<-s.flushDone
+	}
+	if s.dirtyAgeStop != nil {
+		close(s.dirtyAgeStop)
+		<-s.dirtyAgeDone
+	}
+	if s.memoryPressureStop != nil {
+		close(s.memoryPressureStop)
+		<-s.memoryPressureDone
+	}
+	if s.tieringStop != nil {
+		close(s.tieringStop)
+		<-s.tieringDone
+	}
+	if s.badgerGCStop != nil {
+		close(s.badgerGCStop)
+		<-s.badgerGCDone
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(3)
 	go func() { s.dimensions.Flush(); wg.Done() }()
@@ -458,6 +1040,15 @@ func (s *Storage) Close() error {
 	wg.Wait()
 	// dictionary has to flush last because trees write to dictionaries
 	s.dicts.Flush()
+	if err := s.saveQueryCounts(); err != nil {
+		logrus.WithError(err).Warn("failed to save query counts")
+	}
+	if err := s.saveQueryActivity(); err != nil {
+		logrus.WithError(err).Warn("failed to save query activity")
+	}
+	if s.dbTreesCold != nil {
+		s.dbTreesCold.Close()
+	}
 	s.dbTrees.Close()
 	s.dbDicts.Close()
 	s.dbDimensions.Close()
@@ -465,12 +1056,12 @@ func (s *Storage) Close() error {
 	return s.db.Close()
 }
 
-func (s *Storage) GetKeys(cb func(_k string) bool) {
-	s.labels.GetKeys(cb)
+func (s *Storage) GetKeys(tenant string, cb func(_k string) bool) {
+	s.labels.ForTenant(tenant).GetKeys(cb)
 }
 
-func (s *Storage) GetValues(key string, cb func(v string) bool) {
-	s.labels.GetValues(key, func(v string) bool {
+func (s *Storage) GetValues(tenant, key string, cb func(v string) bool) {
+	s.labels.ForTenant(tenant).GetValues(key, func(v string) bool {
 		if key != "__name__" || !slices.StringContains(s.cfg.HideApplications, v) {
 			return cb(v)
 		}
@@ -478,6 +1069,62 @@ func (s *Storage) GetValues(key string, cb func(v string) bool) {
 	})
 }
 
+// MarkAppSeen records that an app has reported data and returns true if that's the first time
+// it was seen by this tenant. The seen-set survives restarts, unlike in-memory stats.
+func (s *Storage) MarkAppSeen(tenant, app string) (bool, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return false, ErrClosing
+	}
+
+	k := []byte("s:" + tenant + ":" + app)
+	isNew := false
+	err := s.db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(k)
+		if err == nil {
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		isNew = true
+		return txn.SetEntry(badger.NewEntry(k, []byte{}))
+	})
+	if err == badger.ErrConflict {
+		// another request marked the app concurrently
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return isNew, nil
+}
+
+func (s *Storage) PutAnnotation(tenant string, t time.Time, text string, tags map[string]string) error {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return ErrClosing
+	}
+
+	return s.annotations.ForTenant(tenant).Put(&annotations.Annotation{
+		Time: t,
+		Text: text,
+		Tags: tags,
+	})
+}
+
+func (s *Storage) GetAnnotations(tenant string, startTime, endTime time.Time) ([]*annotations.Annotation, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, ErrClosing
+	}
+
+	return s.annotations.ForTenant(tenant).Get(startTime, endTime)
+}
+
 func (s *Storage) DiskUsage() map[string]bytesize.ByteSize {
 	res := map[string]bytesize.ByteSize{
 		"main":       0,
@@ -489,6 +1136,9 @@ func (s *Storage) DiskUsage() map[string]bytesize.ByteSize {
 	for k := range res {
 		res[k] = dirSize(filepath.Join(s.cfg.StoragePath, k))
 	}
+	if s.dbTreesCold != nil {
+		res["cold-trees"] = dirSize(filepath.Join(s.cfg.ColdStoragePath, "trees"))
+	}
 	return res
 }
 
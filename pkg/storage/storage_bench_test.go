@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
+)
+
+// BenchmarkGetWideRange queries two days of data. Besides allocations it reports peak-heap-bytes,
+// the max heap growth observed while the queries run.
+func BenchmarkGetWideRange(b *testing.B) {
+	dir, err := ioutil.TempDir("", "pyroscope-storage-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := New(&config.Server{
+		StoragePath:           dir,
+		CacheSegmentSize:      1000,
+		CacheTreeSize:         1000,
+		CacheDictionarySize:   1000,
+		CacheDimensionSize:    1000,
+		MaxNodesSerialization: 2048,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	key, _ := ParseKey("bench.cpu{}")
+	start := time.Unix(1600000000, 0).Truncate(24 * time.Hour)
+	end := start.Add(48 * time.Hour)
+	for t := start; t.Before(end); t = t.Add(time.Minute) {
+		tr := tree.New()
+		for i := 0; i < 50; i++ {
+			tr.Insert([]byte(fmt.Sprintf("main;handler%d;work%d;leaf%d", i%10, i%7, (i+int(t.Unix()/60))%100)), 1)
+		}
+		if err := s.Put(&PutInput{StartTime: t, EndTime: t.Add(10 * time.Second), Key: key, Val: tr, SpyName: "bench", SampleRate: 100}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	baseline := ms.HeapAlloc
+
+	var peak uint64
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var ms runtime.MemStats
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+				runtime.ReadMemStats(&ms)
+				if ms.HeapAlloc > atomic.LoadUint64(&peak) {
+					atomic.StoreUint64(&peak, ms.HeapAlloc)
+				}
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.Get(&GetInput{StartTime: start, EndTime: end, Key: key}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+	if p := atomic.LoadUint64(&peak); p > baseline {
+		b.ReportMetric(float64(p-baseline), "peak-heap-bytes")
+	}
+}
@@ -1,13 +1,23 @@
 package storage
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strconv"
+	"time"
 
+	"github.com/dgraph-io/badger/v2"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/dimension"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
 	"github.com/pyroscope-io/pyroscope/pkg/storage/tree"
 	"github.com/pyroscope-io/pyroscope/pkg/testing"
+	"github.com/pyroscope-io/pyroscope/pkg/util/bytesize"
 	"github.com/sirupsen/logrus"
 )
 
@@ -175,6 +185,37 @@ var _ = Describe("storage package", func() {
 					Expect(s.Close()).ToNot(HaveOccurred())
 				})
 			})
+			Context("legacy keys", func() {
+				It("reads and deletes series with label names that ParseKey rejects now", func() {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(1))
+					st := testing.SimpleTime(10)
+					et := testing.SimpleTime(19)
+					// keys like this one were accepted before label names were validated
+					key, _ := ParseKey("foo{}")
+					key.SetLabel("bar-baz", "1")
+					Expect(s.Put(&PutInput{
+						StartTime:  st,
+						EndTime:    et,
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+
+					app, _ := ParseKey("foo{}")
+					gOut, err := s.Get(&GetInput{StartTime: st, EndTime: et, Key: app})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(gOut).ToNot(BeNil())
+					Expect(gOut.Tree.String()).To(Equal(t.String()))
+
+					Expect(s.Delete(&DeleteInput{StartTime: st, EndTime: et, Key: app})).To(Succeed())
+					gOut, err = s.Get(&GetInput{StartTime: st, EndTime: et, Key: app})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(gOut).To(BeNil())
+					Expect(s.Close()).ToNot(HaveOccurred())
+				})
+			})
 		})
 
 		Context("smoke tests", func() {
@@ -271,6 +312,9 @@ var _ = Describe("storage package", func() {
 			})
 
 			It("persist data between restarts", func() {
+				if (*cfg).Server.InMemory {
+					Skip("data is not persisted in in-memory mode")
+				}
 				tree := tree.New()
 				tree.Insert([]byte("a;b"), uint64(1))
 				tree.Insert([]byte("a;c"), uint64(2))
@@ -314,5 +358,1272 @@ var _ = Describe("storage package", func() {
 				Expect(gOut2.Tree.String()).To(Equal(tree.String()))
 			})
 		})
+
+		Context("snapshot aggregation types", func() {
+			put := func(aggregationType string) *Key {
+				key, _ := ParseKey("foo{}")
+				for i, v := range []uint64{3, 5, 2} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), v)
+					Expect(s.Put(&PutInput{
+						StartTime:       testing.SimpleTime(i * 10),
+						EndTime:         testing.SimpleTime(i*10 + 9),
+						Key:             key,
+						Val:             t,
+						SpyName:         "testspy",
+						SampleRate:      100,
+						AggregationType: aggregationType,
+					})).To(Succeed())
+				}
+				return key
+			}
+
+			It("returns the latest tree with last aggregation", func() {
+				key := put(AggregationLast)
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 2\n"))
+			})
+
+			It("returns the largest tree with max aggregation", func() {
+				key := put(AggregationMax)
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 5\n"))
+			})
+		})
+
+		Context("in-memory mode", func() {
+			BeforeEach(func() {
+				(*cfg).Server.InMemory = true
+			})
+
+			It("doesn't write anything to disk", func() {
+				t := tree.New()
+				t.Insert([]byte("a;b"), uint64(1))
+				key, _ := ParseKey("foo{}")
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(10),
+					EndTime:    testing.SimpleTime(19),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(10), EndTime: testing.SimpleTime(19), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 1\n"))
+				Expect(s.Close()).To(Succeed())
+
+				files, err := ioutil.ReadDir((*cfg).Server.StoragePath)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(BeEmpty())
+			})
+		})
+
+		Context("storage locks", func() {
+			It("reports directories used by another instance", func() {
+				_, err := New(&(*cfg).Server)
+				Expect(err).To(MatchError(ErrLocked))
+				Expect(err.Error()).To(ContainSubstring("(pid " + strconv.Itoa(os.Getpid()) + ") is using " + (*cfg).Server.StoragePath))
+				Expect(err.Error()).To(ContainSubstring("--force-unlock"))
+
+				// the lock of a running process is never removed
+				(*cfg).Server.ForceUnlock = true
+				_, err = New(&(*cfg).Server)
+				Expect(err).To(MatchError(ErrLocked))
+			})
+
+			It("tells running processes apart", func() {
+				Expect(processRunning(os.Getpid())).To(BeTrue())
+				cmd := exec.Command("true")
+				Expect(cmd.Run()).To(Succeed())
+				Expect(processRunning(cmd.Process.Pid)).To(BeFalse())
+				Expect(processRunning(0)).To(BeFalse())
+			})
+		})
+
+		Context("shared dictionary", func() {
+			// puts the same stacks for many apps
+			putApps := func(s *Storage) {
+				for i := 0; i < 20; i++ {
+					t := tree.New()
+					t.Insert([]byte("main;net/http.(*conn).serve;net/http.serverHandler.ServeHTTP"), uint64(10))
+					t.Insert([]byte("main;runtime.gcBgMarkWorker;runtime.gcDrain"), uint64(20))
+					t.Insert([]byte("idle"), uint64(1))
+					key, _ := ParseKey("app-" + strconv.Itoa(i) + "{}")
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+			}
+			dictsSize := func(s *Storage) int {
+				size := 0
+				Expect(s.dbDicts.View(func(txn *badger.Txn) error {
+					it := txn.NewIterator(badger.DefaultIteratorOptions)
+					defer it.Close()
+					for it.Rewind(); it.Valid(); it.Next() {
+						size += int(it.Item().ValueSize())
+					}
+					return nil
+				})).To(Succeed())
+				return size
+			}
+
+			It("stores common symbols once and still resolves them", func() {
+				putApps(s)
+				Expect(s.Close()).To(Succeed())
+				s, err := New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				perKeySize := dictsSize(s)
+				Expect(s.Close()).To(Succeed())
+
+				(*cfg).Server.StoragePath = filepath.Join((*cfg).Server.StoragePath, "shared")
+				(*cfg).Server.SharedDictionary = true
+				s, err = New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				putApps(s)
+				Expect(s.Close()).To(Succeed())
+
+				s, err = New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+				sharedSize := dictsSize(s)
+				Expect(sharedSize * 10).To(BeNumerically("<", perKeySize))
+
+				key, _ := ParseKey("app-7{}")
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(10), EndTime: testing.SimpleTime(19), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"idle\" 1\n\"main;net/http.(*conn).serve;net/http.serverHandler.ServeHTTP\" 10\n\"main;runtime.gcBgMarkWorker;runtime.gcDrain\" 20\n"))
+			})
+
+			It("can't be enabled for existing storage", func() {
+				putApps(s)
+				Expect(s.Close()).To(Succeed())
+
+				(*cfg).Server.SharedDictionary = true
+				_, err := New(&(*cfg).Server)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("app aliases", func() {
+			It("queries data of renamed apps under the new name", func() {
+				for name, stack := range map[string]string{"a": "foo", "b": "bar", "c": "baz"} {
+					t := tree.New()
+					t.Insert([]byte(stack), uint64(1))
+					key, _ := ParseKey(name + "{}")
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				get := func() string {
+					key, _ := ParseKey("c{}")
+					gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(10), EndTime: testing.SimpleTime(19), Key: key})
+					Expect(err).ToNot(HaveOccurred())
+					return gOut.Tree.String()
+				}
+
+				// a was renamed to b, and then b to c
+				Expect(s.AddAppAlias("", "b", "a")).To(Succeed())
+				Expect(s.AddAppAlias("", "c", "b")).To(Succeed())
+				Expect(get()).To(Equal("\"bar\" 1\n\"baz\" 1\n\"foo\" 1\n"))
+				Expect(s.AppAliases("", "c")).To(Equal([]string{"b"}))
+
+				Expect(s.DeleteAppAlias("", "c", "b")).To(Succeed())
+				Expect(get()).To(Equal("\"baz\" 1\n"))
+			})
+
+			It("doesn't mix up aliases of apps with ':' in their names", func() {
+				Expect(s.AddAppAlias("", "foo:bar", "a")).To(Succeed())
+				Expect(s.AddAppAlias("", "foo", "b")).To(Succeed())
+				Expect(s.AppAliases("", "foo")).To(Equal([]string{"b"}))
+				Expect(s.AppAliases("", "foo:bar")).To(Equal([]string{"a"}))
+			})
+		})
+
+		Context("AppDiskUsage", func() {
+			It("counts only data of the app", func() {
+				put := func(name string, n int) {
+					for i := 0; i < n; i++ {
+						t := tree.New()
+						t.Insert([]byte("a;b"), uint64(1))
+						key, _ := ParseKey(name)
+						Expect(s.Put(&PutInput{
+							StartTime:  testing.SimpleTime(i * 10),
+							EndTime:    testing.SimpleTime(i*10 + 9),
+							Key:        key,
+							Val:        t,
+							SpyName:    "testspy",
+							SampleRate: 100,
+						})).To(Succeed())
+					}
+				}
+				put("foo{}", 10)
+				put("foo{env=prod}", 10)
+				put("foobar{}", 1)
+				Expect(s.Close()).To(Succeed())
+				s, err := New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+
+				foo, err := s.AppDiskUsage("", "foo")
+				Expect(err).ToNot(HaveOccurred())
+				foobar, err := s.AppDiskUsage("", "foobar")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(foobar).ToNot(BeZero())
+				Expect(foo).To(BeNumerically(">", foobar))
+
+				Expect(s.AppDiskUsage("", "baz")).To(BeZero())
+				Expect(s.AppDiskUsage("team-a", "foo")).To(BeZero())
+			})
+		})
+
+		Context("preload", func() {
+			It("keeps only the most queried keys in memory", func() {
+				qc := &queryCounter{counts: make(map[string]uint64)}
+				for i := 0; i < 5; i++ {
+					qc.inc("hot{}")
+				}
+				for i := 0; i < 3*maxTrackedQueries; i++ {
+					qc.inc("key" + strconv.Itoa(i) + "{}")
+				}
+				Expect(len(qc.counts)).To(BeNumerically("<=", 2*maxTrackedQueries))
+				Expect(qc.top(1)).To(Equal([]string{"hot{}"}))
+			})
+
+			It("warms up caches with the most queried keys after a restart", func() {
+				now := time.Now()
+				for _, name := range []string{"foo", "bar"} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(1))
+					key, _ := ParseKey(name + "{}")
+					Expect(s.Put(&PutInput{
+						StartTime:  now.Add(-time.Minute),
+						EndTime:    now,
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				for i := 0; i < 3; i++ {
+					key, _ := ParseKey("foo{}")
+					_, err := s.Get(&GetInput{StartTime: now.Add(-time.Hour), EndTime: now, Key: key})
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(s.Close()).To(Succeed())
+
+				(*cfg).Server.PreloadTopQueried = 1
+				(*cfg).Server.PreloadRange = time.Hour
+				s, err := New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+				Expect(s.preloadKeys()).To(Equal([]string{"foo{}"}))
+				Eventually(s.trees.Size).ShouldNot(BeZero())
+			})
+		})
+
+		Context("query activity", func() {
+			It("deletes apps that weren't queried since the cutoff", func() {
+				now := time.Now()
+				put := func(name, tenant string) {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(1))
+					key, _ := ParseKey(name)
+					key.SetTenant(tenant)
+					Expect(s.Put(&PutInput{
+						StartTime:  now.Add(-time.Minute),
+						EndTime:    now,
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				get := func(name, tenant string) *GetOutput {
+					key, _ := ParseKey(name)
+					key.SetTenant(tenant)
+					o, err := s.Get(&GetInput{StartTime: now.Add(-time.Hour), EndTime: now.Add(time.Minute), Key: key})
+					Expect(err).ToNot(HaveOccurred())
+					return o
+				}
+				apps := func(tenant string) []string {
+					res := []string{}
+					s.GetValues(tenant, "__name__", func(v string) bool {
+						res = append(res, v)
+						return true
+					})
+					return res
+				}
+
+				put("foo{host=a}", "")
+				put("bar{host=a}", "")
+				put("foo{host=a}", "team-a")
+				put("bar{host=a}", "team-a")
+				cutoff := time.Now()
+				_, ok := s.AppLastQueried("", "foo")
+				Expect(ok).To(BeFalse())
+
+				Expect(get("foo{}", "")).ToNot(BeNil())
+				Expect(get("bar{}", "team-a")).ToNot(BeNil())
+				t, ok := s.AppLastQueried("", "foo")
+				Expect(ok).To(BeTrue())
+				Expect(t).To(BeTemporally(">=", cutoff))
+
+				Expect(s.Close()).To(Succeed())
+				var err error
+				s, err = New(&(*cfg).Server)
+				Expect(err).ToNot(HaveOccurred())
+				defer s.Close()
+				_, ok = s.AppLastQueried("", "foo")
+				Expect(ok).To(BeTrue())
+
+				Expect(s.expireInactiveApps(cutoff)).To(Equal(2))
+				Expect(apps("")).To(Equal([]string{"foo"}))
+				Expect(apps("team-a")).To(Equal([]string{"bar"}))
+				key, _ := ParseKey("bar{host=a}")
+				o, err := s.Get(&GetInput{StartTime: now.Add(-time.Hour), EndTime: now.Add(time.Minute), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(o).To(BeNil())
+				key, _ = ParseKey("foo{host=a}")
+				o, err = s.Get(&GetInput{StartTime: now.Add(-time.Hour), EndTime: now.Add(time.Minute), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(o).ToNot(BeNil())
+			})
+
+			It("counts queries of an alias as queries of the apps it's an alias of", func() {
+				for _, name := range []string{"old{}", "new{}"} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(1))
+					key, _ := ParseKey(name)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(0),
+						EndTime:    testing.SimpleTime(10),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				Expect(s.AddAppAlias("", "new", "old")).To(Succeed())
+				cutoff := time.Now()
+
+				key, _ := ParseKey("new{}")
+				o, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(10), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(o.Tree.String()).To(Equal("\"a;b\" 2\n"))
+				_, ok := s.AppLastQueried("", "old")
+				Expect(ok).To(BeTrue())
+
+				Expect(s.expireInactiveApps(cutoff)).To(Equal(0))
+				key, _ = ParseKey("old{}")
+				o, err = s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(10), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(o).ToNot(BeNil())
+			})
+
+			It("doesn't track queries of apps that don't exist", func() {
+				key, _ := ParseKey("missing{}")
+				_, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(10), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				_, ok := s.AppLastQueried("", "missing")
+				Expect(ok).To(BeFalse())
+				Expect(s.queryActivity.apps).To(BeEmpty())
+			})
+		})
+
+		Context("retention", func() {
+			put := func(name, tenant string, st int) {
+				t := tree.New()
+				t.Insert([]byte("a;b"), uint64(1))
+				key, _ := ParseKey(name)
+				key.SetTenant(tenant)
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(st),
+					EndTime:    testing.SimpleTime(st + 10),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+			}
+			get := func(name string, st int) *GetOutput {
+				key, _ := ParseKey(name)
+				o, err := s.Get(&GetInput{StartTime: testing.SimpleTime(st), EndTime: testing.SimpleTime(st + 10), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				return o
+			}
+			apps := func(tenant string) []string {
+				res := []string{}
+				s.GetValues(tenant, "__name__", func(v string) bool {
+					res = append(res, v)
+					return true
+				})
+				return res
+			}
+
+			It("deletes data older than the retention", func() {
+				put("foo{host=a}", "", 0)
+				put("foo{host=a}", "", 10000)
+				put("bar{host=a}", "", 0)
+				put("foo{host=a}", "team-a", 0)
+				now := testing.SimpleTime(7200)
+
+				Expect(s.expireOldData(now)).To(Equal(0))
+				Expect(get("foo{}", 0)).ToNot(BeNil())
+
+				(*cfg).Server.Retention = time.Hour
+				n, err := s.expireOldData(now)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).ToNot(BeZero())
+				Expect(apps("")).To(Equal([]string{"foo"}))
+				Expect(apps("team-a")).To(BeEmpty())
+				Expect(get("foo{}", 0)).To(BeNil())
+				Expect(get("bar{}", 0)).To(BeNil())
+				Expect(get("foo{}", 10000).Tree.String()).To(Equal("\"a;b\" 1\n"))
+
+				Expect(s.expireOldData(now)).To(Equal(0))
+			})
+
+			It("deletes upload metadata of expired uploads", func() {
+				putWithMetadata := func(st int, traceID string) {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(1))
+					key, _ := ParseKey("foo{}")
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(st),
+						EndTime:    testing.SimpleTime(st + 10),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+						Metadata:   map[string]string{TraceIDMetadata: traceID},
+					})).To(Succeed())
+				}
+				(*cfg).Server.Retention = time.Hour
+				putWithMetadata(0, "abc")
+				putWithMetadata(10000, "abcd")
+				Expect(firstExpiresAt(s.db, uploadMetadataPrefix)).ToNot(BeZero())
+
+				Expect(s.expireOldData(testing.SimpleTime(7200))).ToNot(BeZero())
+				Expect(countKeys(s.db, uploadMetadataPrefix)).To(Equal(1))
+				Expect(countKeys(s.db, traceIndexPrefix)).To(Equal(1))
+				profiles, _, err := s.TraceProfiles("", "abcd", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(profiles).To(HaveLen(1))
+			})
+
+			It("expires series with label names that ParseKey rejects now", func() {
+				t := tree.New()
+				t.Insert([]byte("a;b"), uint64(1))
+				key, _ := ParseKey("foo{}")
+				key.SetLabel("bar-baz", "1")
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(0),
+					EndTime:    testing.SimpleTime(10),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+
+				(*cfg).Server.Retention = time.Hour
+				Expect(s.expireOldData(testing.SimpleTime(7200))).ToNot(BeZero())
+				Expect(apps("")).To(BeEmpty())
+				Expect(get("foo{}", 0)).To(BeNil())
+			})
+
+			It("deletes data according to per app retention overrides", func() {
+				put("foo{}", "", 0)
+				put("bar{}", "", 0)
+				put("baz{}", "", 0)
+				now := testing.SimpleTime(7200)
+
+				(*cfg).Server.Retention = time.Hour
+				Expect(s.SetAppRetention("", "foo", 0)).To(Succeed())
+				Expect(s.SetAppRetention("", "bar", 3*time.Hour)).To(Succeed())
+				Expect(s.expireOldData(now)).To(Equal(1))
+				Expect(apps("")).To(Equal([]string{"bar", "foo"}))
+
+				(*cfg).Server.Retention = 0
+				Expect(s.SetAppRetention("", "bar", time.Hour)).To(Succeed())
+				Expect(s.expireOldData(now)).To(Equal(1))
+				Expect(apps("")).To(Equal([]string{"foo"}))
+				Expect(get("foo{}", 0)).ToNot(BeNil())
+			})
+		})
+
+		Context("quantile queries", func() {
+			It("returns the tree of the bucket at the requested quantile", func() {
+				key, _ := ParseKey("foo{}")
+				for i, v := range []uint64{3, 5, 2} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), v)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(i * 10),
+						EndTime:    testing.SimpleTime(i*10 + 9),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+
+				for q, expected := range map[float64]string{0.01: "\"a;b\" 2\n", 0.5: "\"a;b\" 3\n", 0.95: "\"a;b\" 5\n", 1: "\"a;b\" 5\n"} {
+					gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key, Quantile: q})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(gOut.Tree.String()).To(Equal(expected))
+				}
+			})
+		})
+
+		Context("trimmed queries", func() {
+			It("counts only the overlapping part of edge buckets", func() {
+				key, _ := ParseKey("foo{}")
+				t := tree.New()
+				t.Insert([]byte("a;b"), 10)
+				t.Insert([]byte("a;c"), 20)
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(10),
+					EndTime:    testing.SimpleTime(19),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+
+				// the range cuts the 10-20 bucket in half
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(15), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal(t.String()))
+
+				gOut, err = s.Get(&GetInput{StartTime: testing.SimpleTime(15), EndTime: testing.SimpleTime(30), Key: key, Trim: true})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 5\n\"a;c\" 10\n"))
+			})
+		})
+
+		Context("grouped queries", func() {
+			It("merges series per distinct label value", func() {
+				put := func(name, stack string, v uint64) {
+					t := tree.New()
+					t.Insert([]byte(stack), v)
+					key, _ := ParseKey(name)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				put("foo{region=eu,host=a}", "a;b", 1)
+				put("foo{region=eu,host=b}", "a;b", 2)
+				put("foo{region=us,host=c}", "a;c", 3)
+				put("foo{host=d}", "a;d", 4)
+				put("bar{region=eu}", "x", 5)
+
+				key, _ := ParseKey("foo{}")
+				gi := &GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key}
+				groups, err := s.GetGrouped(gi, "region", 0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(groups).To(HaveLen(3))
+				Expect(groups["eu"].Tree.String()).To(Equal("\"a;b\" 3\n"))
+				Expect(groups["us"].Tree.String()).To(Equal("\"a;c\" 3\n"))
+				Expect(groups[""].Tree.String()).To(Equal("\"a;d\" 4\n"))
+				Expect(groups["eu"].SampleRate).To(Equal(uint32(100)))
+
+				_, err = s.GetGrouped(gi, "host", 3)
+				Expect(err).To(MatchError(ErrTooManyGroups))
+			})
+		})
+
+		Context("Keys", func() {
+			It("lists stored series matching a key", func() {
+				put := func(name string, tenant string) {
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					key, _ := ParseKey(name)
+					key.SetTenant(tenant)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				put("foo.cpu{region=us}", "")
+				put("foo.cpu{region=eu}", "")
+				put("foo.cpu{region=eu,host=a}", "")
+				put("bar.cpu{region=eu}", "")
+				put("foo.cpu{region=ap}", "team-a")
+
+				names := func(matcher string, max int) ([]string, bool) {
+					key, err := ParseKey(matcher)
+					Expect(err).ToNot(HaveOccurred())
+					keys, truncated, err := s.Keys(key, max)
+					Expect(err).ToNot(HaveOccurred())
+					res := []string{}
+					for _, k := range keys {
+						Expect(k.LastSeen).To(Equal(testing.SimpleTime(20)))
+						res = append(res, k.Key.Normalized())
+					}
+					return res, truncated
+				}
+
+				keys, truncated := names("foo.cpu{}", 10)
+				Expect(keys).To(Equal([]string{"foo.cpu{host=a,region=eu}", "foo.cpu{region=eu}", "foo.cpu{region=us}"}))
+				Expect(truncated).To(BeFalse())
+
+				keys, truncated = names("foo.cpu{region=eu}", 1)
+				Expect(keys).To(HaveLen(1))
+				Expect(truncated).To(BeTrue())
+
+				keys, _ = names("foo.cpu{region=mars}", 10)
+				Expect(keys).To(BeEmpty())
+			})
+		})
+
+		Context("tenants", func() {
+			It("isolates data of different tenants", func() {
+				st := testing.SimpleTime(10)
+				et := testing.SimpleTime(19)
+				put := func(tenant, stack string) {
+					t := tree.New()
+					t.Insert([]byte(stack), uint64(1))
+					key, _ := ParseKey("foo{}")
+					key.SetTenant(tenant)
+					Expect(s.Put(&PutInput{
+						StartTime:  st,
+						EndTime:    et,
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				put("", "a;b")
+				put("team-a", "c;d")
+
+				for tenant, expected := range map[string]string{"": "\"a;b\" 1\n", "team-a": "\"c;d\" 1\n"} {
+					key, _ := ParseKey("foo{}")
+					key.SetTenant(tenant)
+					gOut, err := s.Get(&GetInput{StartTime: st, EndTime: et, Key: key})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(gOut.Tree.String()).To(Equal(expected))
+				}
+
+				keys := []string{}
+				s.GetKeys("", func(k string) bool {
+					keys = append(keys, k)
+					return true
+				})
+				Expect(keys).To(ConsistOf("__name__"))
+
+				apps := []string{}
+				s.GetValues("team-b", "__name__", func(v string) bool {
+					apps = append(apps, v)
+					return true
+				})
+				Expect(apps).To(BeEmpty())
+			})
+		})
+
+		Context("annotations", func() {
+			It("returns annotations within the time range in order", func() {
+				Expect(s.PutAnnotation("", testing.SimpleTime(20), "incident", nil)).To(Succeed())
+				Expect(s.PutAnnotation("", testing.SimpleTime(10), "deploy", map[string]string{"version": "1.0"})).To(Succeed())
+				Expect(s.PutAnnotation("", testing.SimpleTime(10), "config change", nil)).To(Succeed())
+				Expect(s.PutAnnotation("", testing.SimpleTime(30), "out of range", nil)).To(Succeed())
+
+				res, err := s.GetAnnotations("", testing.SimpleTime(10), testing.SimpleTime(30))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(HaveLen(3))
+				Expect(res[0].Time.Unix()).To(Equal(testing.SimpleTime(10).Unix()))
+				Expect(res[1].Time.Unix()).To(Equal(testing.SimpleTime(10).Unix()))
+				Expect(res[2].Text).To(Equal("incident"))
+			})
+
+			It("keeps annotations of tenants apart", func() {
+				Expect(s.PutAnnotation("", testing.SimpleTime(10), "default", nil)).To(Succeed())
+				Expect(s.PutAnnotation("team-a", testing.SimpleTime(10), "team-a", nil)).To(Succeed())
+				Expect(s.PutAnnotation("team-b", testing.SimpleTime(20), "team-b", nil)).To(Succeed())
+
+				for tenant, text := range map[string]string{"": "default", "team-a": "team-a", "team-b": "team-b"} {
+					res, err := s.GetAnnotations(tenant, testing.SimpleTime(0), testing.SimpleTime(30))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(res).To(HaveLen(1), tenant)
+					Expect(res[0].Text).To(Equal(text))
+				}
+			})
+		})
+
+		Context("upload metadata", func() {
+			It("restricts queries to uploads with matching metadata", func() {
+				key, _ := ParseKey("foo{}")
+				for i, build := range []string{"1", "2", "1"} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(i+1))
+					t.Insert([]byte("a;c"), 10)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10 + i*10),
+						EndTime:    testing.SimpleTime(19 + i*10),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+						Metadata:   map[string]string{"build": build, "env": "prod"},
+					})).To(Succeed())
+				}
+
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(60), Key: key, Metadata: map[string]string{"build": "1"}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 4\n\"a;c\" 20\n"))
+
+				gOut, err = s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(60), Key: key, Metadata: map[string]string{"build": "2", "env": "prod"}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 2\n\"a;c\" 10\n"))
+
+				gOut, err = s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(60), Key: key, Metadata: map[string]string{"build": "3"}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut).To(BeNil())
+
+				_, err = s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(60), Key: key, Metadata: map[string]string{"build": "1"}, Quantile: 0.5})
+				Expect(err).To(MatchError(ErrUnsupportedMetadataFilter))
+			})
+		})
+
+		Context("trace profiles", func() {
+			It("finds uploads linked to a trace", func() {
+				put := func(tenant, name string, st int, metadata map[string]string) {
+					key, err := ParseKey(name)
+					Expect(err).ToNot(HaveOccurred())
+					key.SetTenant(tenant)
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(st),
+						EndTime:    testing.SimpleTime(st + 9),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+						Metadata:   metadata,
+					})).To(Succeed())
+				}
+				put("", "foo.cpu{}", 10, map[string]string{TraceIDMetadata: "abc"})
+				put("", "bar.cpu{env=prod}", 20, map[string]string{TraceIDMetadata: "abc", "build": "1"})
+				put("", "foo.cpu{}", 30, map[string]string{TraceIDMetadata: "abcd"})
+				put("", "foo.cpu{}", 40, nil)
+				put("team-a", "foo.cpu{}", 50, map[string]string{TraceIDMetadata: "abc"})
+
+				profiles, truncated, err := s.TraceProfiles("", "abc", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(truncated).To(BeFalse())
+				Expect(profiles).To(HaveLen(2))
+				Expect(profiles[0].Key.Normalized()).To(Equal("bar.cpu{env=prod}"))
+				Expect(profiles[0].StartTime.Unix()).To(Equal(testing.SimpleTime(20).Unix()))
+				Expect(profiles[0].EndTime.Unix()).To(Equal(testing.SimpleTime(29).Unix()))
+				Expect(profiles[1].Key.Normalized()).To(Equal("foo.cpu{}"))
+				Expect(profiles[1].StartTime.Unix()).To(Equal(testing.SimpleTime(10).Unix()))
+
+				profiles, truncated, err = s.TraceProfiles("", "abc", 1)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(truncated).To(BeTrue())
+				Expect(profiles).To(HaveLen(1))
+
+				profiles, _, err = s.TraceProfiles("team-a", "abc", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(profiles).To(HaveLen(1))
+				Expect(profiles[0].StartTime.Unix()).To(Equal(testing.SimpleTime(50).Unix()))
+
+				profiles, _, err = s.TraceProfiles("", "unknown", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(profiles).To(BeEmpty())
+
+				key, _ := ParseKey("bar.cpu{env=prod}")
+				Expect(s.Delete(&DeleteInput{StartTime: testing.SimpleTime(20), EndTime: testing.SimpleTime(29), Key: key})).To(Succeed())
+				profiles, _, err = s.TraceProfiles("", "abc", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(profiles).To(HaveLen(1))
+				Expect(profiles[0].Key.Normalized()).To(Equal("foo.cpu{}"))
+				Expect(countKeys(s.db, traceIndexPrefix)).To(Equal(3))
+			})
+
+			It("doesn't create series of records without data", func() {
+				key, _ := ParseKey("foo.cpu{}")
+				Expect(s.putTraceProfile("abc", key, testing.SimpleTime(10), testing.SimpleTime(19))).To(Succeed())
+				profiles, _, err := s.TraceProfiles("", "abc", 10)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(profiles).To(BeEmpty())
+				Expect(s.segments.Contains(key.SegmentKey())).To(BeFalse())
+			})
+		})
+
+		Context("label value limits", func() {
+			BeforeEach(func() {
+				(*cfg).Server.MaxLabelValues = 2
+				(*cfg).Server.MaxLabelValuesOverrides = map[string]string{"region": "1"}
+			})
+
+			It("rejects new values of labels that reached the limit", func() {
+				put := func(k string) error {
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					t.Insert([]byte("a;c"), 2)
+					key, _ := ParseKey(k)
+					return s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})
+				}
+				Expect(put("foo{pod=a,region=eu}")).To(Succeed())
+				Expect(put("foo{pod=b,region=eu}")).To(Succeed())
+				Expect(put("foo{pod=c,region=eu}")).To(MatchError(ErrTooManyLabelValues))
+				Expect(put("foo{pod=a,region=us}")).To(MatchError(ErrTooManyLabelValues))
+				Expect(put("foo{pod=b,region=eu}")).To(Succeed())
+				// app names aren't limited by the global limit
+				Expect(put("bar{pod=a}")).To(Succeed())
+				Expect(put("baz{pod=b}")).To(Succeed())
+
+				for label, expected := range map[string][]string{"pod": {"a", "b"}, "region": {"eu"}} {
+					values := []string{}
+					s.GetValues("", label, func(v string) bool {
+						values = append(values, v)
+						return true
+					})
+					Expect(values).To(ConsistOf(expected))
+				}
+			})
+
+			It("applies to each tenant separately", func() {
+				for tenant, region := range map[string]string{"": "eu", "team-a": "us"} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					t.Insert([]byte("a;c"), 2)
+					key, _ := ParseKey("foo{region=" + region + "}")
+					key.SetTenant(tenant)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+			})
+		})
+
+		Context("cache flush", func() {
+			It("reports the age of the oldest entry that isn't persisted", func() {
+				t := tree.New()
+				t.Insert([]byte("a;b"), 1)
+				key, _ := ParseKey("foo{}")
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(10),
+					EndTime:    testing.SimpleTime(19),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+
+				s.updateOldestDirtyAge(time.Now().Add(time.Minute))
+				Expect(testutil.ToFloat64(cacheOldestDirtyAge)).To(BeNumerically(">=", 60))
+				s.flushDirty()
+				s.updateOldestDirtyAge(time.Now().Add(time.Minute))
+				Expect(testutil.ToFloat64(cacheOldestDirtyAge)).To(BeZero())
+			})
+		})
+
+		Context("integrity check", func() {
+			treeKey := "t:foo{}:0:" + strconv.Itoa(int(testing.SimpleTime(10).Unix()))
+			put := func(names ...string) {
+				for _, name := range names {
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					t.Insert([]byte("a;c"), 2)
+					key, _ := ParseKey(name)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				s.flushDirty()
+			}
+			set := func(db *badger.DB, key string, v []byte) {
+				Expect(db.Update(func(txn *badger.Txn) error {
+					if v == nil {
+						return txn.Delete([]byte(key))
+					}
+					return txn.Set([]byte(key), v)
+				})).To(Succeed())
+			}
+			// foo loses a tree, bar's dictionary is garbage, baz segment is garbage
+			// and a dimension references a segment that doesn't exist
+			corrupt := func() {
+				d := dimension.New()
+				d.Insert([]byte("qux{}"))
+				dBytes, err := d.Bytes()
+				Expect(err).ToNot(HaveOccurred())
+				set(s.dbTrees, treeKey, nil)
+				set(s.dbDicts, "d:bar{}", []byte("garbage"))
+				set(s.dbSegments, "s:baz{}", []byte("garbage"))
+				set(s.dbDimensions, "i:__name__:qux", dBytes)
+			}
+
+			It("reports dangling references and unreadable entries", func() {
+				put("foo{}", "bar{}")
+				report, err := s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.OK()).To(BeTrue())
+				Expect(report.Segments).To(Equal(2))
+				Expect(report.Trees).To(Equal(2))
+				Expect(report.Dicts).To(Equal(2))
+				Expect(report.Dimensions).To(Equal(2))
+
+				corrupt()
+				report, err = s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				for i := range report.Problems {
+					Expect(report.Problems[i].Err != "").To(Equal(report.Problems[i].Kind == IntegrityUnreadable))
+					report.Problems[i].Err = ""
+				}
+				Expect(report.Problems).To(Equal([]IntegrityProblem{
+					{Kind: IntegrityUnreadable, Key: "d:bar{}"},
+					{Kind: IntegrityUnreadable, Key: "s:baz{}"},
+					{Kind: IntegrityDangling, Key: treeKey, Ref: "s:foo{}"},
+					{Kind: IntegrityDangling, Key: "s:qux{}", Ref: "i:__name__:qux"},
+				}))
+			})
+
+			It("repairs the storage keeping good data", func() {
+				put("foo{}", "bar{}", "good{}")
+				corrupt()
+
+				r, err := s.Repair(true)
+				Expect(err).ToNot(HaveOccurred())
+				expected := &RepairReport{
+					Removed: []string{
+						"s:bar{}", "s:baz{}", "s:foo{}",
+						"t:bar{}:0:" + strconv.Itoa(int(testing.SimpleTime(10).Unix())),
+						"d:bar{}", "d:foo{}",
+					},
+					Updated: []string{"i:__name__:bar", "i:__name__:foo", "i:__name__:qux"},
+				}
+				Expect(r).To(Equal(&RepairReport{DryRun: true, Removed: expected.Removed, Updated: expected.Updated}))
+				report, err := s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.Problems).To(HaveLen(4))
+
+				r, err = s.Repair(false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(r).To(Equal(expected))
+				report, err = s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.Problems).To(BeEmpty())
+				Expect(report.Segments).To(Equal(1))
+				Expect(report.Dimensions).To(Equal(1))
+
+				key, _ := ParseKey("good{}")
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 1\n\"a;c\" 2\n"))
+				key, _ = ParseKey("bar{}")
+				gOut, err = s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut).To(BeNil())
+			})
+
+			It("keeps series with label names that ParseKey rejects now", func() {
+				t := tree.New()
+				t.Insert([]byte("a;b"), 1)
+				key, _ := ParseKey("foo{}")
+				key.SetLabel("bar-baz", "1")
+				Expect(s.Put(&PutInput{
+					StartTime:  testing.SimpleTime(10),
+					EndTime:    testing.SimpleTime(19),
+					Key:        key,
+					Val:        t,
+					SpyName:    "testspy",
+					SampleRate: 100,
+				})).To(Succeed())
+				s.flushDirty()
+
+				report, err := s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.Problems).To(BeEmpty())
+				Expect(report.Trees).To(Equal(1))
+				r, err := s.Repair(false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(r.Removed).To(BeEmpty())
+				Expect(r.Updated).To(BeEmpty())
+			})
+		})
+
+		Context("cold storage", func() {
+			BeforeEach(func() {
+				(*cfg).Server.ColdStoragePath = filepath.Join((*cfg).Server.StoragePath, "cold")
+			})
+
+			It("moves old trees to the cold tier transparently to queries", func() {
+				key, _ := ParseKey("foo{}")
+				now := time.Now().Truncate(10 * time.Second)
+				old := now.Add(-3 * time.Hour)
+				for i, st := range []time.Time{old, now} {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(i+1))
+					t.Insert([]byte("a;c"), 10)
+					Expect(s.Put(&PutInput{
+						StartTime:  st,
+						EndTime:    st.Add(9 * time.Second),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				s.trees.EvictRatio(1)
+
+				n, err := s.moveColdTrees(time.Now().Add(-time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeNumerically(">", 0))
+				hot, err := unusedKeys(s.dbTrees, "t:", nil)
+				Expect(err).ToNot(HaveOccurred())
+				cold, err := unusedKeys(s.dbTreesCold, "t:", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cold).To(HaveLen(n))
+				for _, k := range hot {
+					et, ok := treeEndTime(k)
+					Expect(ok).To(BeTrue())
+					Expect(et.After(time.Now().Add(-time.Hour))).To(BeTrue(), k)
+				}
+
+				gOut, err := s.Get(&GetInput{StartTime: old, EndTime: old.Add(10 * time.Second), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 1\n\"a;c\" 10\n"))
+
+				r, err := s.CheckIntegrity()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(r.Problems).To(BeEmpty())
+
+				Expect(s.Delete(&DeleteInput{StartTime: old, EndTime: now.Add(time.Hour), Key: key})).To(Succeed())
+				cold, err = unusedKeys(s.dbTreesCold, "t:", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cold).To(BeEmpty())
+			})
+
+			It("validates the config", func() {
+				Expect(validateTiering(&config.Server{ColdStoragePath: "cold", ColdStorageAge: time.Hour})).To(Succeed())
+				Expect(validateTiering(&config.Server{ColdStorageAge: time.Hour})).ToNot(Succeed())
+				Expect(validateTiering(&config.Server{ColdStoragePath: "cold", InMemory: true})).ToNot(Succeed())
+				Expect(validateTiering(&config.Server{ColdStoragePath: "cold", ColdStorageAge: -1})).ToNot(Succeed())
+			})
+		})
+
+		Context("merge", func() {
+			It("adds data of another storage, scaled to the sample rate", func() {
+				srcCfg := (*cfg).Server
+				srcCfg.StoragePath = filepath.Join(srcCfg.StoragePath, "src")
+				src, err := New(&srcCfg)
+				Expect(err).ToNot(HaveOccurred())
+				defer src.Close()
+
+				put := func(s *Storage, k string, st int, sampleRate uint32, b, c uint64) {
+					t := tree.New()
+					t.Insert([]byte("a;b"), b)
+					t.Insert([]byte("a;c"), c)
+					key, _ := ParseKey(k)
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(st),
+						EndTime:    testing.SimpleTime(st + 9),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: sampleRate,
+					})).To(Succeed())
+				}
+				put(s, "foo{}", 10, 100, 1, 2)
+				put(src, "foo{}", 10, 50, 1, 1)
+				put(src, "foo{}", 20, 50, 2, 1)
+				put(src, "bar{}", 10, 100, 1, 2)
+				src.flushDirty()
+
+				r, err := s.Merge(src, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(r).To(Equal(&MergeReport{Segments: 2, Buckets: 3, Rescaled: 1}))
+
+				get := func(k string, st, et int) string {
+					key, _ := ParseKey(k)
+					gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(st), EndTime: testing.SimpleTime(et), Key: key})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(gOut.SampleRate).To(Equal(uint32(100)))
+					return gOut.Tree.String()
+				}
+				Expect(get("foo{}", 10, 20)).To(Equal("\"a;b\" 3\n\"a;c\" 4\n"))
+				Expect(get("foo{}", 20, 30)).To(Equal("\"a;b\" 4\n\"a;c\" 2\n"))
+				Expect(get("bar{}", 10, 20)).To(Equal("\"a;b\" 1\n\"a;c\" 2\n"))
+			})
+
+			It("skips unparsable keys, rebuilds higher depths and reads src without background loops", func() {
+				srcCfg := (*cfg).Server
+				srcCfg.StoragePath = filepath.Join(srcCfg.StoragePath, "src")
+				src, err := New(&srcCfg)
+				Expect(err).ToNot(HaveOccurred())
+				for i := 0; i < 10; i++ {
+					t := tree.New()
+					t.Insert([]byte("a;b"), 1)
+					t.Insert([]byte("a;c"), 2)
+					key, _ := ParseKey("foo{}")
+					// keys like this one were accepted before label names were validated
+					key.SetLabel("bar-baz", "1")
+					Expect(src.Put(&PutInput{
+						StartTime:  testing.SimpleTime(i * 10),
+						EndTime:    testing.SimpleTime(i*10 + 9),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				Expect(src.dbSegments.Update(func(txn *badger.Txn) error {
+					return txn.Set([]byte("s:broken{"), []byte{})
+				})).To(Succeed())
+				Expect(src.Close()).To(Succeed())
+
+				src, err = NewReadOnly(&srcCfg)
+				Expect(err).ToNot(HaveOccurred())
+				defer src.Close()
+				Expect(src.retentionStop).To(BeNil())
+				Expect(src.queryActivityStop).To(BeNil())
+				Expect(src.badgerGCStop).To(BeNil())
+
+				r, err := s.Merge(src, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(r).To(Equal(&MergeReport{Segments: 1, Buckets: 10, Skipped: []string{"broken{"}}))
+
+				res, err := s.segments.Get("foo{bar-baz=1}")
+				Expect(err).ToNot(HaveOccurred())
+				var depths []int
+				res.(*segment.Segment).WalkNodes(func(depth int, t time.Time) {
+					depths = append(depths, depth)
+				})
+				// the 100 second tree is rebuilt from the 10 second ones of src
+				Expect(depths).To(ContainElement(1))
+				app, _ := ParseKey("foo{}")
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(100), Key: app})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 10\n\"a;c\" 20\n"))
+			})
+		})
+
+		Context("memory pressure", func() {
+			It("evicts caches down to the low watermark and keeps the data", func() {
+				for i := 0; i < 10; i++ {
+					t := tree.New()
+					t.Insert([]byte("a;b"), uint64(i+1))
+					t.Insert([]byte("a;c"), 1)
+					key, _ := ParseKey("app" + strconv.Itoa(i) + "{}")
+					Expect(s.Put(&PutInput{
+						StartTime:  testing.SimpleTime(10),
+						EndTime:    testing.SimpleTime(19),
+						Key:        key,
+						Val:        t,
+						SpyName:    "testspy",
+						SampleRate: 100,
+					})).To(Succeed())
+				}
+				Expect(s.trees.Size()).To(Equal(uint64(10)))
+
+				heap := []uint64{200, 40}
+				s.relieveMemoryPressure(memoryWatermarks{high: 100, low: 50}, func() uint64 {
+					h := heap[0]
+					heap = heap[1:]
+					return h
+				})
+				// the heap has to shrink by 75%
+				Expect(s.trees.Size()).To(Equal(uint64(2)))
+				Expect(s.segments.Size()).To(Equal(uint64(2)))
+				Expect(heap).To(BeEmpty())
+
+				key, _ := ParseKey("app3{}")
+				gOut, err := s.Get(&GetInput{StartTime: testing.SimpleTime(0), EndTime: testing.SimpleTime(30), Key: key})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(gOut.Tree.String()).To(Equal("\"a;b\" 4\n\"a;c\" 1\n"))
+			})
+
+			It("doesn't evict anything below the high watermark", func() {
+				t := tree.New()
+				t.Insert([]byte("a;b"), 1)
+				key, _ := ParseKey("foo{}")
+				Expect(s.Put(&PutInput{StartTime: testing.SimpleTime(10), EndTime: testing.SimpleTime(19), Key: key, Val: t, SpyName: "testspy", SampleRate: 100})).To(Succeed())
+
+				s.relieveMemoryPressure(memoryWatermarks{high: 100, low: 50}, func() uint64 { return 99 })
+				Expect(s.trees.Size()).To(Equal(uint64(1)))
+			})
+
+			It("validates watermarks", func() {
+				wm, err := newMemoryWatermarks(&config.Server{MemoryPressureHighWatermark: 100 * bytesize.MB})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wm).To(Equal(memoryWatermarks{high: uint64(100 * bytesize.MB), low: uint64(80 * bytesize.MB)}))
+
+				wm, err = newMemoryWatermarks(&config.Server{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(wm.enabled()).To(BeFalse())
+
+				_, err = newMemoryWatermarks(&config.Server{MemoryPressureHighWatermark: bytesize.MB, MemoryPressureLowWatermark: bytesize.MB})
+				Expect(err).To(HaveOccurred())
+				_, err = newMemoryWatermarks(&config.Server{MemoryPressureHighWatermark: -1})
+				Expect(err).To(HaveOccurred())
+			})
+		})
 	})
 })
+
+func countKeys(db *badger.DB, prefix string) int {
+	n := 0
+	Expect(iteratePrefix(db, prefix, func(_, _ []byte) error {
+		n++
+		return nil
+	})).To(Succeed())
+	return n
+}
+
+// firstExpiresAt returns when the first record with the prefix expires, 0 means never
+func firstExpiresAt(db *badger.DB, prefix string) uint64 {
+	var res uint64
+	Expect(db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		if it.Rewind(); it.Valid() {
+			res = it.Item().ExpiresAt()
+		}
+		return nil
+	})).To(Succeed())
+	return res
+}
@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/pyroscope-io/pyroscope/pkg/config"
+	"github.com/pyroscope-io/pyroscope/pkg/storage/segment"
+	"github.com/sirupsen/logrus"
+)
+
+// Storage can be split into two tiers: trees, which are the bulk of stored data, are moved from storage-path
+// (hot tier, e.g NVMe) to cold-storage-path (cold tier, e.g HDD) once the time range they cover is older
+// than cold-storage-age. Segments, dictionaries and dimensions are small and always stay in the hot tier.
+//
+// Trees are always written to the hot tier and read from it first, so a tree that gets modified after
+// it was moved (e.g a late upload) is read from the hot tier until it's moved again.
+
+// tieringInterval is how often old trees are looked for
+const tieringInterval = 10 * time.Minute
+
+var movedTrees = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "pyroscope_storage_cold_moved_trees_total",
+	Help: "number of trees moved to cold storage",
+})
+
+func validateTiering(cfg *config.Server) error {
+	if cfg.ColdStorageAge < 0 {
+		return fmt.Errorf("invalid cold-storage-age %s: must not be negative", cfg.ColdStorageAge)
+	}
+	if cfg.ColdStorageAge > 0 && cfg.ColdStoragePath == "" {
+		return errors.New("cold-storage-age requires cold-storage-path")
+	}
+	if cfg.ColdStoragePath != "" && cfg.InMemory {
+		return errors.New("cold-storage-path can't be used in in-memory mode")
+	}
+	return nil
+}
+
+// newColdBadger opens the cold tier trees db, it's nil when tiering is disabled
+func newColdBadger(cfg *config.Server) (*badger.DB, error) {
+	if cfg.ColdStoragePath == "" {
+		return nil, nil
+	}
+	coldCfg := *cfg
+	coldCfg.StoragePath = cfg.ColdStoragePath
+	return newBadger(&coldCfg, "trees")
+}
+
+func (s *Storage) tieringLoop() {
+	ticker := time.NewTicker(tieringInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.tieringStop:
+			close(s.tieringDone)
+			return
+		case <-ticker.C:
+			n, err := s.moveColdTrees(time.Now().Add(-s.cfg.ColdStorageAge))
+			if err != nil {
+				logrus.WithError(err).Error("failed to move trees to cold storage")
+			}
+			if n > 0 {
+				logrus.WithField("trees", n).Debug("moved trees to cold storage")
+			}
+		}
+	}
+}
+
+// moveColdTrees moves trees that only cover time before the cutoff to the cold tier.
+// Returns the number of moved trees.
+func (s *Storage) moveColdTrees(cutoff time.Time) (int, error) {
+	var keys []string
+	err := s.dbTrees.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("t:")
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			k := string(it.Item().Key())
+			if et, ok := treeEndTime(k[len("t:"):]); ok && !et.After(cutoff) {
+				keys = append(keys, k)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, k := range keys {
+		ok, err := s.moveColdTree([]byte(k))
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+			movedTrees.Inc()
+		}
+	}
+	return moved, nil
+}
+
+// moveColdTree copies the tree to the cold tier and deletes it from the hot one. The deletion
+// is in the same transaction as the read, so a tree written in between isn't lost: the
+// transaction conflicts and the tree stays in the hot tier until the next attempt.
+func (s *Storage) moveColdTree(k []byte) (bool, error) {
+	txn := s.dbTrees.NewTransaction(true)
+	defer txn.Discard()
+	item, err := txn.Get(k)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	v, err := item.ValueCopy(nil)
+	if err != nil {
+		return false, err
+	}
+	if err = s.dbTreesCold.Update(func(coldTxn *badger.Txn) error {
+		return coldTxn.SetEntry(badger.NewEntry(k, v))
+	}); err != nil {
+		return false, err
+	}
+	if err = txn.Delete(k); err != nil {
+		return false, err
+	}
+	if err = txn.Commit(); err != nil {
+		if errors.Is(err, badger.ErrConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// treeEndTime returns the end of the time range covered by the tree, tree keys
+// are <segment key>:<depth>:<start time>, see Key.TreeKey
+func treeEndTime(treeKey string) (time.Time, bool) {
+	i := strings.LastIndex(treeKey, ":")
+	if i < 0 {
+		return time.Time{}, false
+	}
+	j := strings.LastIndex(treeKey[:i], ":")
+	if j < 0 {
+		return time.Time{}, false
+	}
+	depth, err := strconv.Atoi(treeKey[j+1 : i])
+	if err != nil || depth < 0 {
+		return time.Time{}, false
+	}
+	st, err := strconv.ParseInt(treeKey[i+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(st, 0).Add(segment.DurationForDepth(depth)), true
+}
+
+// readTree reads a stored tree from whichever tier it is in
+func (s *Storage) readTree(dbKey string) ([]byte, bool, error) {
+	v, found, err := readValue(s.dbTrees, dbKey)
+	if err != nil || found || s.dbTreesCold == nil {
+		return v, found, err
+	}
+	return readValue(s.dbTreesCold, dbKey)
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Profiles can be linked to traces: uploads with the TraceIDMetadata tag are indexed by the trace ID,
+// so that profiles of a trace can be found without knowing their apps or times, e.g when navigating
+// from a span. Every tagged upload gets a record in the main db:
+//
+//   tr:<trace id>:<segment key>:<start time, 8 bytes> -> JSON encoded traceProfile
+//
+// The data itself is stored as usual, queries of a trace profile are restricted to its upload with
+// the metadata filter. Records expire with the retention of the app and are deleted together with
+// their series, see deleteTraceProfiles.
+
+// TraceIDMetadata is the upload metadata tag uploads are linked to traces with
+const TraceIDMetadata = "traceID"
+
+const traceIndexPrefix = "tr:"
+
+// TraceProfile is an upload linked to a trace
+type TraceProfile struct {
+	Key       *Key
+	StartTime time.Time
+	EndTime   time.Time
+}
+
+type traceProfile struct {
+	Key       string `json:"key"`
+	StartTime int64  `json:"start"`
+	EndTime   int64  `json:"end"`
+}
+
+func traceIndexTracePrefix(traceID string) []byte {
+	return []byte(traceIndexPrefix + traceID + ":")
+}
+
+func (s *Storage) putTraceProfile(traceID string, key *Key, st, et time.Time) error {
+	v, err := json.Marshal(traceProfile{Key: key.SegmentKey(), StartTime: st.Unix(), EndTime: et.Unix()})
+	if err != nil {
+		return err
+	}
+	e := s.withRetentionTTL(badger.NewEntry(traceIndexKey(traceID, uploadMetadataKey(key.SegmentKey(), st)), v), key)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+// traceIndexKey returns the key of the trace index record of the upload with the metadata record key
+func traceIndexKey(traceID string, uploadMetadataKey []byte) []byte {
+	return append(traceIndexTracePrefix(traceID), uploadMetadataKey[len(uploadMetadataPrefix):]...)
+}
+
+// TraceProfiles returns up to max uploads of the tenant linked to the trace, ordered by series and time,
+// and whether there were more of them
+func (s *Storage) TraceProfiles(tenant, traceID string, max int) ([]TraceProfile, bool, error) {
+	s.closingMutex.RLock()
+	defer s.closingMutex.RUnlock()
+	if s.closing {
+		return nil, false, ErrClosing
+	}
+
+	res := []TraceProfile{}
+	truncated := false
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = traceIndexTracePrefix(traceID)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var tp traceProfile
+			if err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &tp)
+			}); err != nil {
+				return err
+			}
+			key, err := parseStoredKey(tp.Key)
+			if err != nil || key.Tenant() != tenant {
+				continue
+			}
+			// records are deleted together with series, this guards against records written
+			// while their series was being deleted. Get would create the missing segment
+			ok, err := s.segments.Contains(tp.Key)
+			if err != nil {
+				return fmt.Errorf("segments cache for %v: %v", tp.Key, err)
+			}
+			if !ok {
+				continue
+			}
+			if len(res) == max {
+				truncated = true
+				return nil
+			}
+			res = append(res, TraceProfile{
+				Key:       key,
+				StartTime: time.Unix(tp.StartTime, 0),
+				EndTime:   time.Unix(tp.EndTime, 0),
+			})
+		}
+		return nil
+	})
+	return res, truncated, err
+}
+
+// deleteTraceProfiles removes trace index records of the series. Every record has an upload metadata
+// record with the trace ID, so they are found through these.
+func (s *Storage) deleteTraceProfiles(segmentKey string) error {
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = uploadMetadataSeriesPrefix(segmentKey)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var um uploadMetadata
+			if err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &um)
+			}); err != nil {
+				return err
+			}
+			if traceID := um.Metadata[TraceIDMetadata]; traceID != "" {
+				keys = append(keys, traceIndexKey(traceID, it.Item().Key()))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
@@ -0,0 +1,226 @@
+package tree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/varint"
+)
+
+// Columnar format is a compact encoding of profiles meant for high-throughput ingestion.
+// All numbers are varints, tables are stored column by column:
+//
+//   <version = 1>
+//   <number of frames> (<name length> <name>)...
+//   <number of stacks> <parent>... <frame>...
+//   <number of samples> <stack>... <value>...
+//
+// A stack is a frame on top of its parent stack, parent 0 means the root and i means stack i-1,
+// so parents always come before their children. Samples refer to stacks by their indices.
+// Decoding creates a node per stack, not per frame of every sample, and nodes share names with the frames table.
+
+const columnarVersion = 1
+
+// maxColumnarPrealloc caps slices preallocated from lengths in the input, so that bogus lengths
+// fail with an unexpected EOF instead of allocating a lot of memory
+const maxColumnarPrealloc = 1 << 16
+
+// maxColumnarFrameLen is the max length of frame names
+const maxColumnarFrameLen = 1 << 20
+
+var errColumnarVersion = errors.New("unsupported columnar format version")
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func DeserializeColumnar(r io.Reader) (*Tree, error) {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	version, err := varint.Read(br)
+	if err != nil {
+		return nil, err
+	}
+	if version != columnarVersion {
+		return nil, errColumnarVersion
+	}
+
+	// frames
+	n, err := varint.Read(br)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, preallocLen(n))
+	var names []byte
+	for i := uint64(0); i < n; i++ {
+		l, err := varint.Read(br)
+		if err != nil {
+			return nil, err
+		}
+		if l > maxColumnarFrameLen {
+			return nil, fmt.Errorf("frame %d: name is longer than %d bytes", i, maxColumnarFrameLen)
+		}
+		// names are read into shared chunks rather than allocated one by one
+		if uint64(cap(names)-len(names)) < l {
+			names = make([]byte, 0, max64(l, 64<<10))
+		}
+		start := len(names)
+		names = names[:start+int(l)]
+		if _, err = io.ReadFull(br, names[start:]); err != nil {
+			return nil, err
+		}
+		frames = append(frames, names[start:start+int(l):start+int(l)])
+	}
+
+	// stacks
+	if n, err = varint.Read(br); err != nil {
+		return nil, err
+	}
+	parents := make([]uint64, 0, preallocLen(n))
+	for i := uint64(0); i < n; i++ {
+		p, err := varint.Read(br)
+		if err != nil {
+			return nil, err
+		}
+		if p > i {
+			return nil, fmt.Errorf("stack %d: parent %d isn't defined before it", i, p)
+		}
+		parents = append(parents, p)
+	}
+	t := New()
+	nodes := make([]*treeNode, 0, preallocLen(n))
+	for i := range parents {
+		f, err := varint.Read(br)
+		if err != nil {
+			return nil, err
+		}
+		if f >= uint64(len(frames)) {
+			return nil, fmt.Errorf("stack %d: frame %d is out of range", i, f)
+		}
+		parent := t.root
+		if parents[i] > 0 {
+			parent = nodes[parents[i]-1]
+		}
+		nodes = append(nodes, parent.insert(frames[f]))
+	}
+
+	// samples
+	if n, err = varint.Read(br); err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, 0, preallocLen(n))
+	for i := uint64(0); i < n; i++ {
+		id, err := varint.Read(br)
+		if err != nil {
+			return nil, err
+		}
+		if id >= uint64(len(nodes)) {
+			return nil, fmt.Errorf("sample %d: stack %d is out of range", i, id)
+		}
+		ids = append(ids, id)
+	}
+	self := make([]uint64, len(nodes))
+	for _, id := range ids {
+		v, err := varint.Read(br)
+		if err != nil {
+			return nil, err
+		}
+		self[id] += v
+	}
+
+	// children come after parents, so totals are complete by the time they're added to parents
+	cum := make([]uint64, len(self))
+	copy(cum, self)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		nodes[i].Self += self[i]
+		nodes[i].Total += cum[i]
+		if p := parents[i]; p > 0 {
+			cum[p-1] += cum[i]
+		} else {
+			t.root.Total += cum[i]
+		}
+	}
+	return t, nil
+}
+
+// SerializeColumnar writes the tree in the columnar format, see DeserializeColumnar
+func (t *Tree) SerializeColumnar(w io.Writer) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	frameIndex := map[string]uint64{}
+	var frames [][]byte
+	var parents, stackFrames, sampleStacks, values []uint64
+
+	type stack struct {
+		node   *treeNode
+		parent uint64
+	}
+	stacks := []stack{}
+	for _, n := range t.root.ChildrenNodes {
+		stacks = append(stacks, stack{node: n})
+	}
+	for i := 0; i < len(stacks); i++ {
+		s := stacks[i]
+		f, ok := frameIndex[string(s.node.Name)]
+		if !ok {
+			f = uint64(len(frames))
+			frameIndex[string(s.node.Name)] = f
+			frames = append(frames, s.node.Name)
+		}
+		parents = append(parents, s.parent)
+		stackFrames = append(stackFrames, f)
+		if s.node.Self > 0 {
+			sampleStacks = append(sampleStacks, uint64(i))
+			values = append(values, s.node.Self)
+		}
+		for _, n := range s.node.ChildrenNodes {
+			stacks = append(stacks, stack{node: n, parent: uint64(i) + 1})
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	varint.Write(bw, columnarVersion)
+	varint.Write(bw, uint64(len(frames)))
+	for _, f := range frames {
+		varint.Write(bw, uint64(len(f)))
+		bw.Write(f)
+	}
+	writeColumns(bw, parents, stackFrames)
+	writeColumns(bw, sampleStacks, values)
+	return bw.Flush()
+}
+
+// writeColumns writes a table of two columns of the same length
+func writeColumns(w *bufio.Writer, a, b []uint64) {
+	varint.Write(w, uint64(len(a)))
+	for _, column := range [][]uint64{a, b} {
+		for _, v := range column {
+			varint.Write(w, v)
+		}
+	}
+}
+
+func preallocLen(n uint64) uint64 {
+	return min64(n, maxColumnarPrealloc)
+}
+
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
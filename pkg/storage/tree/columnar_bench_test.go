@@ -0,0 +1,52 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func benchmarkTree() *Tree {
+	tree := New()
+	r := rand.New(rand.NewSource(123))
+	for i := 0; i < 10000; i++ {
+		var stack []byte
+		for d := 0; d < 20; d++ {
+			stack = append(stack, fmt.Sprintf("pkg%d.func%d;", r.Intn(10), r.Intn(50))...)
+		}
+		tree.Insert(stack[:len(stack)-1], uint64(r.Intn(100)+1))
+	}
+	return tree
+}
+
+func BenchmarkDeserializeColumnar(b *testing.B) {
+	var buf bytes.Buffer
+	if err := benchmarkTree().SerializeColumnar(&buf); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DeserializeColumnar(bytes.NewReader(buf.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDeserializeNoDict is the tree format, for comparison
+func BenchmarkDeserializeNoDict(b *testing.B) {
+	var buf bytes.Buffer
+	if err := benchmarkTree().SerializeNoDict(1<<24, &buf); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(buf.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DeserializeNoDict(bytes.NewReader(buf.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/util/varint"
+)
+
+var _ = Describe("columnar format", func() {
+	It("round-trips trees", func() {
+		tree := New()
+		tree.Insert([]byte("a;b"), uint64(1))
+		tree.Insert([]byte("a;c"), uint64(2))
+		tree.Insert([]byte("a"), uint64(3))
+		tree.Insert([]byte("d;b;a"), uint64(4))
+
+		var buf bytes.Buffer
+		Expect(tree.SerializeColumnar(&buf)).To(Succeed())
+		t2, err := DeserializeColumnar(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t2.String()).To(Equal(tree.String()))
+		Expect(t2.Samples()).To(Equal(uint64(10)))
+	})
+
+	It("sums samples of the same stack and merges duplicate stacks", func() {
+		var buf bytes.Buffer
+		for _, v := range []uint64{
+			1,
+			2, 1, 'a', 1, 'b',
+			// a, a;b and a duplicate of a
+			3, 0, 1, 0, 0, 1, 0,
+			// a;b twice, the duplicate of a once
+			3, 1, 1, 2, 5, 6, 7,
+		} {
+			varint.Write(&buf, v)
+		}
+		tree, err := DeserializeColumnar(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tree.String()).To(Equal("\"a\" 7\n\"a;b\" 11\n"))
+		Expect(tree.Samples()).To(Equal(uint64(18)))
+	})
+
+	It("rejects malformed input", func() {
+		for _, input := range [][]uint64{
+			{2},
+			{1, 1, 1},
+			{1, 1, 1, 'a', 1, 1, 0},
+			{1, 1, 1, 'a', 1, 0, 1},
+			{1, 1, 1, 'a', 1, 0, 0, 1, 1, 1},
+			{1, 1, 1 << 30},
+		} {
+			var buf bytes.Buffer
+			for _, v := range input {
+				varint.Write(&buf, v)
+			}
+			_, err := DeserializeColumnar(&buf)
+			Expect(err).To(HaveOccurred(), fmt.Sprint(input))
+		}
+	})
+
+	It("builds the same tree from random profiles", func() {
+		tree := New()
+		r := rand.New(rand.NewSource(123))
+		for i := 0; i < 1000; i++ {
+			tree.Insert([]byte(fmt.Sprintf("foo;bar%d;baz%d", r.Intn(30), r.Intn(30))), uint64(r.Intn(100)+1))
+		}
+		var buf bytes.Buffer
+		Expect(tree.SerializeColumnar(&buf)).To(Succeed())
+		t2, err := DeserializeColumnar(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(t2.String()).To(Equal(tree.String()))
+	})
+})
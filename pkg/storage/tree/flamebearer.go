@@ -1,10 +1,28 @@
 package tree
 
+import (
+	"bytes"
+	"sort"
+)
+
+// ChildrenOrder determines the order of sibling nodes in a flamegraph
+type ChildrenOrder int
+
+const (
+	// OrderByName is the order nodes are stored in
+	OrderByName ChildrenOrder = iota
+	// OrderBySelf puts nodes with the highest self value first, ties are ordered by name
+	OrderBySelf
+)
+
 type Flamebearer struct {
 	Names    []string `json:"names"`
 	Levels   [][]int  `json:"levels"`
 	NumTicks int      `json:"numTicks"`
 	MaxSelf  int      `json:"maxSelf"`
+	// Percents has total and self of every bar in Levels as a percentage of NumTicks,
+	// in the same order. It's only set by AddPercents.
+	Percents [][]float64 `json:"percents,omitempty"`
 	// TODO: see note in render.go
 	SpyName    string `json:"spyName"`
 	SampleRate uint32 `json:"sampleRate"`
@@ -12,6 +30,10 @@ type Flamebearer struct {
 }
 
 func (t *Tree) FlamebearerStruct(maxNodes int) *Flamebearer {
+	return t.FlamebearerStructWithOrder(maxNodes, OrderByName)
+}
+
+func (t *Tree) FlamebearerStructWithOrder(maxNodes int, order ChildrenOrder) *Flamebearer {
 	t.m.RLock()
 	defer t.m.RUnlock()
 
@@ -70,7 +92,7 @@ func (t *Tree) FlamebearerStruct(maxNodes int) *Flamebearer {
 
 			xOffset += int(tn.Self)
 			otherTotal := uint64(0)
-			for _, n := range tn.ChildrenNodes {
+			for _, n := range orderedChildren(tn, order) {
 				if n.Total >= minVal {
 					xOffsets = append([]int{xOffset}, xOffsets...)
 					levels = append([]int{level + 1}, levels...)
@@ -108,3 +130,38 @@ func (t *Tree) FlamebearerStruct(maxNodes int) *Flamebearer {
 	// }
 	return &res
 }
+
+// AddPercents sets Percents, e.g to compare profiles of different durations.
+// Absolute values are kept in Levels.
+func (fb *Flamebearer) AddPercents() {
+	fb.Percents = make([][]float64, len(fb.Levels))
+	for i, l := range fb.Levels {
+		p := make([]float64, 0, len(l)/2)
+		for j := 0; j+3 < len(l); j += 4 {
+			p = append(p, percent(l[j+1], fb.NumTicks), percent(l[j+2], fb.NumTicks))
+		}
+		fb.Percents[i] = p
+	}
+}
+
+func percent(v, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(v) * 100 / float64(total)
+}
+
+func orderedChildren(tn *treeNode, order ChildrenOrder) []*treeNode {
+	if order != OrderBySelf || len(tn.ChildrenNodes) < 2 {
+		return tn.ChildrenNodes
+	}
+	// children are sorted by name in the tree itself, so we have to sort a copy
+	res := append([]*treeNode{}, tn.ChildrenNodes...)
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Self != res[j].Self {
+			return res[i].Self > res[j].Self
+		}
+		return bytes.Compare(res[i].Name, res[j].Name) < 0
+	})
+	return res
+}
@@ -0,0 +1,159 @@
+package tree
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// FlamebearerJSONOptions are the fields of the flamebearer written by WriteFlamebearerJSON
+// that don't come from the tree itself
+type FlamebearerJSONOptions struct {
+	SpyName    string
+	SampleRate uint32
+	Units      string
+	// Percents adds percents, see Flamebearer.AddPercents
+	Percents bool
+}
+
+// flamebearerBar is a node of a flamegraph level, x is the absolute offset
+type flamebearerBar struct {
+	node *treeNode
+	x    uint64
+}
+
+// WriteFlamebearerJSON writes the flamebearer FlamebearerStructWithOrder would return as JSON.
+// Levels are built and written one at a time, so that memory use doesn't depend on the number of
+// levels. Bars are the same, but names can be indexed in a different order.
+// Nothing is buffered, so a failed write leaves w with incomplete JSON.
+func (t *Tree) WriteFlamebearerJSON(w io.Writer, maxNodes int, order ChildrenOrder, opts FlamebearerJSONOptions) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	minVal := t.minValue(maxNodes)
+	numTicks := t.Samples()
+
+	names := []string{}
+	nameIndex := map[string]int{}
+	maxSelf := uint64(0)
+	var b []byte
+
+	bw.WriteString(`{"levels":[`)
+	err := t.walkLevels(minVal, order, func(i int, level []flamebearerBar) error {
+		b = b[:0]
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '[')
+		prev := uint64(0)
+		for j, bar := range level {
+			name := string(bar.node.Name)
+			k, ok := nameIndex[name]
+			if !ok {
+				k = len(names)
+				nameIndex[name] = k
+				if k == 0 {
+					name = "total"
+				}
+				names = append(names, name)
+			}
+			if bar.node.Self > maxSelf {
+				maxSelf = bar.node.Self
+			}
+			if j > 0 {
+				b = append(b, ',')
+			}
+			// x offset (delta encoded), total, self, name index
+			b = strconv.AppendUint(b, bar.x-prev, 10)
+			b = append(b, ',')
+			b = strconv.AppendUint(b, bar.node.Total, 10)
+			b = append(b, ',')
+			b = strconv.AppendUint(b, bar.node.Self, 10)
+			b = append(b, ',')
+			b = strconv.AppendInt(b, int64(k), 10)
+			prev = bar.x + bar.node.Total
+		}
+		b = append(b, ']')
+		_, err := bw.Write(b)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString(`]`)
+
+	if opts.Percents {
+		bw.WriteString(`,"percents":[`)
+		err = t.walkLevels(minVal, order, func(i int, level []flamebearerBar) error {
+			b = b[:0]
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, '[')
+			for j, bar := range level {
+				if j > 0 {
+					b = append(b, ',')
+				}
+				b = strconv.AppendFloat(b, percent(int(bar.node.Total), int(numTicks)), 'g', -1, 64)
+				b = append(b, ',')
+				b = strconv.AppendFloat(b, percent(int(bar.node.Self), int(numTicks)), 'g', -1, 64)
+			}
+			b = append(b, ']')
+			_, err := bw.Write(b)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		bw.WriteString(`]`)
+	}
+
+	namesJSON, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	spyName, _ := json.Marshal(opts.SpyName)
+	units, _ := json.Marshal(opts.Units)
+	bw.WriteString(`,"names":`)
+	bw.Write(namesJSON)
+	bw.WriteString(`,"numTicks":` + strconv.FormatUint(numTicks, 10))
+	bw.WriteString(`,"maxSelf":` + strconv.FormatUint(maxSelf, 10))
+	bw.WriteString(`,"spyName":` + string(spyName))
+	bw.WriteString(`,"sampleRate":` + strconv.FormatUint(uint64(opts.SampleRate), 10))
+	bw.WriteString(`,"units":` + string(units) + `}`)
+	return bw.Flush()
+}
+
+// walkLevels calls fn with the bars of every flamegraph level, from the root down and left to right.
+// Nodes below minVal are merged into "other" nodes, like FlamebearerStructWithOrder does.
+func (t *Tree) walkLevels(minVal uint64, order ChildrenOrder, fn func(i int, level []flamebearerBar) error) error {
+	level := []flamebearerBar{{node: t.root}}
+	for i := 0; len(level) > 0; i++ {
+		if err := fn(i, level); err != nil {
+			return err
+		}
+		var next []flamebearerBar
+		for _, bar := range level {
+			x := bar.x + bar.node.Self
+			otherTotal := uint64(0)
+			for _, n := range orderedChildren(bar.node, order) {
+				if n.Total >= minVal {
+					next = append(next, flamebearerBar{node: n, x: x})
+					x += n.Total
+				} else {
+					otherTotal += n.Total
+				}
+			}
+			if otherTotal != 0 {
+				next = append(next, flamebearerBar{
+					node: &treeNode{Name: jsonableSlice("other"), Total: otherTotal, Self: otherTotal},
+					x:    x,
+				})
+			}
+		}
+		level = next
+	}
+	return nil
+}
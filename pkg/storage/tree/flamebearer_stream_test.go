@@ -0,0 +1,75 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// bars resolves name indices, names of streamed flamebearers can be indexed in a different order
+func bars(f *Flamebearer) [][]string {
+	res := [][]string{}
+	for _, l := range f.Levels {
+		level := []string{}
+		for i := 0; i < len(l); i += 4 {
+			level = append(level, fmt.Sprintf("%d %d %d %s", l[i], l[i+1], l[i+2], f.Names[l[i+3]]))
+		}
+		res = append(res, level)
+	}
+	return res
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+var _ = Describe("WriteFlamebearerJSON", func() {
+	It("writes the same flamegraph as FlamebearerStruct", func() {
+		tree := New()
+		r := rand.New(rand.NewSource(123))
+		for i := 0; i < 2048; i++ {
+			tree.Insert([]byte(fmt.Sprintf("foo;bar%d;baz%d", i%100, i)), uint64(r.Intn(4000)))
+		}
+
+		for _, order := range []ChildrenOrder{OrderByName, OrderBySelf} {
+			expected := tree.FlamebearerStructWithOrder(64, order)
+			expected.SpyName = "gospy"
+			expected.SampleRate = 100
+			expected.AddPercents()
+
+			var buf bytes.Buffer
+			Expect(tree.WriteFlamebearerJSON(&buf, 64, order, FlamebearerJSONOptions{
+				SpyName:    "gospy",
+				SampleRate: 100,
+				Percents:   true,
+			})).To(Succeed())
+			var f Flamebearer
+			Expect(json.Unmarshal(buf.Bytes(), &f)).To(Succeed())
+
+			Expect(f.Names).To(ConsistOf(expected.Names))
+			Expect(bars(&f)).To(Equal(bars(expected)))
+			Expect(f.Percents).To(Equal(expected.Percents))
+			Expect(f.NumTicks).To(Equal(expected.NumTicks))
+			Expect(f.MaxSelf).To(Equal(expected.MaxSelf))
+			Expect(f.SpyName).To(Equal("gospy"))
+			Expect(f.SampleRate).To(Equal(uint32(100)))
+		}
+	})
+
+	It("writes empty trees", func() {
+		var buf bytes.Buffer
+		Expect(New().WriteFlamebearerJSON(&buf, 1024, OrderByName, FlamebearerJSONOptions{})).To(Succeed())
+		Expect(buf.String()).To(Equal(`{"levels":[[0,0,0,0]],"names":["total"],"numTicks":0,"maxSelf":0,"spyName":"","sampleRate":0,"units":""}`))
+	})
+
+	It("returns write errors", func() {
+		tree := New()
+		tree.Insert([]byte("a;b"), uint64(1))
+		Expect(tree.WriteFlamebearerJSON(failingWriter{}, 1024, OrderByName, FlamebearerJSONOptions{})).ToNot(Succeed())
+	})
+})
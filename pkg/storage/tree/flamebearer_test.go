@@ -34,4 +34,29 @@ var _ = Describe("FlamebearerStruct", func() {
 			Expect(f.Names).To(ContainElement("other"))
 		})
 	})
+	Context("ordering by self", func() {
+		It("puts nodes with the highest self value first", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+			tree.Insert([]byte("a;c"), uint64(3))
+			tree.Insert([]byte("a;d"), uint64(1))
+
+			f := tree.FlamebearerStructWithOrder(1024, OrderBySelf)
+			Expect(f.Names).To(Equal([]string{"total", "a", "d", "b", "c"}))
+			// x offset (delta encoded), total, self, name index
+			Expect(f.Levels[2]).To(Equal([]int{0, 3, 3, 4, 0, 1, 1, 3, 0, 1, 1, 2}))
+		})
+	})
+	Context("percents", func() {
+		It("has total and self of every bar relative to the root", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+			tree.Insert([]byte("a;c"), uint64(3))
+
+			f := tree.FlamebearerStruct(1024)
+			f.AddPercents()
+			Expect(f.Percents).To(Equal([][]float64{{100, 0}, {100, 0}, {25, 25, 75, 75}}))
+			Expect(f.Levels[2]).To(Equal([]int{0, 1, 1, 3, 0, 3, 3, 2}))
+		})
+	})
 })
@@ -0,0 +1,39 @@
+package tree
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/twmb/murmur3"
+)
+
+const hashSeed = 6231912
+
+// Hash returns a hash of the tree structure and values. It doesn't depend on the order of children,
+// so identical profiles have identical hashes no matter how they were built. It's based on murmur3,
+// which unlike hash/maphash is stable across process runs and Go versions.
+func (t *Tree) Hash() uint64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.root.hash()
+}
+
+func (n *treeNode) hash() uint64 {
+	children := make([]uint64, len(n.ChildrenNodes))
+	for i, cn := range n.ChildrenNodes {
+		children[i] = cn.hash()
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i] < children[j] })
+
+	b := make([]byte, binary.MaxVarintLen64*3+len(n.Name)+8*len(children))
+	// the length prefix keeps names from running into values
+	i := binary.PutUvarint(b, uint64(len(n.Name)))
+	i += copy(b[i:], n.Name)
+	i += binary.PutUvarint(b[i:], n.Self)
+	i += binary.PutUvarint(b[i:], n.Total)
+	for _, h := range children {
+		binary.LittleEndian.PutUint64(b[i:], h)
+		i += 8
+	}
+	return murmur3.SeedSum64(hashSeed, b[:i])
+}
@@ -0,0 +1,57 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tree hashing", func() {
+	Context("Hash", func() {
+		It("doesn't depend on the order of children", func() {
+			t1 := New()
+			t1.Insert([]byte("a;b"), uint64(1))
+			t1.Insert([]byte("a;c"), uint64(2))
+			t1.Insert([]byte("d"), uint64(3))
+
+			t2 := New()
+			t2.Insert([]byte("d"), uint64(3))
+			t2.Insert([]byte("a;c"), uint64(2))
+			t2.Insert([]byte("a;b"), uint64(1))
+			Expect(t2.Hash()).To(Equal(t1.Hash()))
+
+			// Insert keeps children sorted, reversing them checks the hash itself
+			for _, n := range []*treeNode{t2.root, t2.root.ChildrenNodes[0]} {
+				for i, j := 0, len(n.ChildrenNodes)-1; i < j; i, j = i+1, j-1 {
+					n.ChildrenNodes[i], n.ChildrenNodes[j] = n.ChildrenNodes[j], n.ChildrenNodes[i]
+				}
+			}
+			Expect(t2.root.ChildrenNodes[0].Name).To(BeEquivalentTo("d"))
+			Expect(t2.Hash()).To(Equal(t1.Hash()))
+		})
+
+		It("changes when values or structure change", func() {
+			t1 := New()
+			t1.Insert([]byte("a;b"), uint64(1))
+
+			t2 := New()
+			t2.Insert([]byte("a;b"), uint64(2))
+			Expect(t2.Hash()).ToNot(Equal(t1.Hash()))
+
+			t3 := New()
+			t3.Insert([]byte("a;c"), uint64(1))
+			Expect(t3.Hash()).ToNot(Equal(t1.Hash()))
+
+			t4 := New()
+			t4.Insert([]byte("ab"), uint64(1))
+			Expect(t4.Hash()).ToNot(Equal(t1.Hash()))
+		})
+
+		It("is stable", func() {
+			t := New()
+			t.Insert([]byte("a;b"), uint64(1))
+			t.Insert([]byte("a;c"), uint64(2))
+			// hashes are used as ETags, changing the value invalidates clients' caches
+			Expect(t.Hash()).To(Equal(uint64(17455409951635127023)))
+		})
+	})
+})
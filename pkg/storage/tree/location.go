@@ -0,0 +1,69 @@
+package tree
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// Frames can carry the source location they were sampled at, it's appended to the function name
+// after a space, e.g "main.work main.go:42", the same way pprof names frames with -lines.
+// Frames of the same function at different lines are different nodes, which is what line level views
+// need, WithoutLocations merges them back into per function nodes.
+
+// FrameWithLocation returns the name of a frame of function name at file:line.
+// Unknown locations, i.e empty file or line 0, are omitted.
+func FrameWithLocation(name, file string, line int64) string {
+	if file == "" || line <= 0 {
+		return name
+	}
+	return name + " " + file + ":" + strconv.FormatInt(line, 10)
+}
+
+// SplitLocation splits a frame into the function name and the location, location is nil
+// if the frame doesn't have one
+func SplitLocation(frame []byte) (name, location []byte) {
+	i := bytes.LastIndexByte(frame, ' ')
+	if i <= 0 {
+		return frame, nil
+	}
+	loc := frame[i+1:]
+	j := bytes.LastIndexByte(loc, ':')
+	if j <= 0 || j == len(loc)-1 {
+		return frame, nil
+	}
+	for _, c := range loc[j+1:] {
+		if c < '0' || c > '9' {
+			return frame, nil
+		}
+	}
+	return frame[:i], loc
+}
+
+// HasLocations tells whether any frame of the tree carries a location
+func (t *Tree) HasLocations() bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	nodes := []*treeNode{t.root}
+	for len(nodes) > 0 {
+		n := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		if _, loc := SplitLocation(n.Name); loc != nil {
+			return true
+		}
+		nodes = append(nodes, n.ChildrenNodes...)
+	}
+	return false
+}
+
+// WithoutLocations returns a tree with locations removed from frames, frames of the same function
+// at different lines are merged. Trees without locations are returned as is.
+func (t *Tree) WithoutLocations() *Tree {
+	if !t.HasLocations() {
+		return t
+	}
+	return t.MapNames(func(name []byte) []byte {
+		n, _ := SplitLocation(name)
+		return n
+	})
+}
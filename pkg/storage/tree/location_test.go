@@ -0,0 +1,40 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("locations", func() {
+	It("splits frames into function names and locations", func() {
+		split := func(frame string) (string, string) {
+			name, loc := SplitLocation([]byte(frame))
+			return string(name), string(loc)
+		}
+		Expect(FrameWithLocation("main.work", "main.go", 42)).To(Equal("main.work main.go:42"))
+		Expect(FrameWithLocation("main.work", "", 42)).To(Equal("main.work"))
+		Expect(FrameWithLocation("main.work", "main.go", 0)).To(Equal("main.work"))
+
+		name, loc := split("main.work /src/main.go:42")
+		Expect(name).To(Equal("main.work"))
+		Expect(loc).To(Equal("/src/main.go:42"))
+		for _, frame := range []string{"main.work", "operator new", "foo (bar.py:12)", "a b:", " main.go:1", "a b:c"} {
+			name, loc = split(frame)
+			Expect(name).To(Equal(frame))
+			Expect(loc).To(BeEmpty())
+		}
+	})
+
+	It("merges frames of the same function at different lines", func() {
+		tree := New()
+		tree.Insert([]byte("main main.go:3;foo foo.go:10"), uint64(1))
+		tree.Insert([]byte("main main.go:3;foo foo.go:12"), uint64(2))
+		tree.Insert([]byte("main main.go:5;bar"), uint64(3))
+		Expect(tree.HasLocations()).To(BeTrue())
+
+		res := tree.WithoutLocations()
+		Expect(res.String()).To(Equal("\"main;bar\" 3\n\"main;foo\" 3\n"))
+		Expect(res.HasLocations()).To(BeFalse())
+		Expect(res.WithoutLocations()).To(BeIdenticalTo(res))
+	})
+})
@@ -0,0 +1,18 @@
+package tree
+
+// Prefix returns a copy of the tree with an extra root frame named name,
+// so that all stacks start with it. Useful when merging trees from different sources.
+func (t *Tree) Prefix(name string) *Tree {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	n := t.root.clone(1, 1)
+	n.Name = jsonableSlice(name)
+	return &Tree{
+		root: &treeNode{
+			Name:          jsonableSlice{},
+			Total:         n.Total,
+			ChildrenNodes: []*treeNode{n},
+		},
+	}
+}
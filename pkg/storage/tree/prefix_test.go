@@ -0,0 +1,21 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tree prefix", func() {
+	Context("Prefix", func() {
+		It("adds a root frame to every stack", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+			tree.Insert([]byte("c"), uint64(2))
+
+			res := tree.Prefix("foo")
+			Expect(res.String()).To(Equal("\"foo;a;b\" 1\n\"foo;c\" 2\n"))
+			Expect(res.Samples()).To(Equal(uint64(3)))
+			Expect(tree.String()).To(Equal("\"a;b\" 1\n\"c\" 2\n"))
+		})
+	})
+})
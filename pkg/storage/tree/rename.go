@@ -0,0 +1,17 @@
+package tree
+
+import "bytes"
+
+// MapNames returns a new tree with every frame name replaced with fn(name).
+// Frames that end up with the same names are merged together.
+func (t *Tree) MapNames(fn func(name []byte) []byte) *Tree {
+	res := New()
+	t.IterateStacks(func(stack []byte, val uint64) {
+		names := bytes.Split(stack, []byte(";"))
+		for i, n := range names {
+			names[i] = fn(n)
+		}
+		res.Insert(bytes.Join(names, []byte(";")), val)
+	})
+	return res
+}
@@ -0,0 +1,26 @@
+package tree
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MapNames", func() {
+	It("renames frames and merges the ones that end up with the same name", func() {
+		tree := New()
+		tree.Insert([]byte("a;Foo[int];b"), uint64(1))
+		tree.Insert([]byte("a;Foo[string];b"), uint64(2))
+		tree.Insert([]byte("a;c"), uint64(3))
+
+		res := tree.MapNames(func(name []byte) []byte {
+			if i := bytes.IndexByte(name, '['); i != -1 {
+				return name[:i]
+			}
+			return name
+		})
+		Expect(res.String()).To(Equal("\"a;Foo;b\" 3\n\"a;c\" 3\n"))
+		Expect(res.Samples()).To(Equal(tree.Samples()))
+	})
+})
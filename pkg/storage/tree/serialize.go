@@ -4,19 +4,57 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
+	"math"
 
 	"github.com/pyroscope-io/pyroscope/pkg/storage/dict"
 	"github.com/pyroscope-io/pyroscope/pkg/util/varint"
 )
 
-// serialization format version. it's not very useful right now, but it will be in the future
-const currentVersion = 1
+// serialization format version:
+// 1 — initial version
+// 2 — adds a CRC32 checksum of everything before it at the end
+const currentVersion = 2
+
+var (
+	// ErrChecksumMismatch means the serialized tree is corrupted
+	ErrChecksumMismatch = errors.New("tree checksum mismatch")
+	// ErrCorrupted means the serialized tree has lengths that don't fit in its size
+	ErrCorrupted = errors.New("tree is corrupted")
+)
+
+// checksumReader computes a checksum of the bytes that have been read so far
+type checksumReader struct {
+	r *bufio.Reader
+	h hash.Hash32
+}
+
+func (cr *checksumReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.h.Write(p[:n])
+	return n, err
+}
 
 func (t *Tree) Serialize(d *dict.Dict, maxNodes int, w io.Writer) error {
 	t.m.RLock()
 	defer t.m.RUnlock()
 
+	out := w
+	h := crc32.NewIEEE()
+	w = io.MultiWriter(out, h)
+
 	varint.Write(w, currentVersion)
 
 	nodes := []*treeNode{t.root}
@@ -53,7 +91,7 @@ func (t *Tree) Serialize(d *dict.Dict, maxNodes int, w io.Writer) error {
 			return err
 		}
 	}
-	return nil
+	return binary.Write(out, binary.BigEndian, h.Sum32())
 }
 
 func (t *Tree) SerializeNoDict(maxNodes int, w io.Writer) error {
@@ -101,30 +139,54 @@ type parentNode struct {
 	parent *parentNode
 }
 
+// pendingParent is a node some of whose children are yet to be read
+type pendingParent struct {
+	*parentNode
+	children uint64
+}
+
+// minNodeSize is the smallest size of a serialized node: label length, self and children count
+const minNodeSize = 3
+
 func Deserialize(d *dict.Dict, r io.Reader) (*Tree, error) {
 	t := New()
-	br := bufio.NewReader(r) // TODO if it's already a bytereader skip
+	// TODO if it's already a bytereader skip
+	br := &checksumReader{r: bufio.NewReader(r), h: crc32.NewIEEE()}
+	// when the length of the input is known, lengths read from it are checked against it,
+	// so that corrupted ones fail fast instead of allocating or looping a lot
+	src, _ := r.(interface{ Len() int })
+	remaining := func() (uint64, bool) {
+		if src == nil {
+			return 0, false
+		}
+		return uint64(src.Len() + br.r.Buffered()), true
+	}
 
 	// reads serialization format version, see comment at the top
-	_, err := varint.Read(br)
+	version, err := varint.Read(br)
 	if err != nil {
 		return nil, err
 	}
 
-	parents := []*parentNode{{t.root, nil}}
-	j := 0
+	// children are read depth first, pending counts the nodes that are announced but not read yet
+	parents := []*pendingParent{{&parentNode{t.root, nil}, 1}}
+	pending := uint64(1)
 
 	for len(parents) > 0 {
-		j++
-		parent := parents[0]
-		parents = parents[1:]
+		top := parents[len(parents)-1]
+		if top.children == 0 {
+			parents = parents[:len(parents)-1]
+			continue
+		}
+		top.children--
+		pending--
+		parent := top.parentNode
 
 		labelLen, err := varint.Read(br)
-		// if err == io.EOF {
-		// 	return t, nil
-		// }
-		labelLinkBuf := make([]byte, labelLen) // TODO: there are better ways to do this?
-		_, err = io.ReadAtLeast(br, labelLinkBuf, int(labelLen))
+		if err != nil {
+			return nil, err
+		}
+		labelLinkBuf, err := readLabel(br, labelLen, remaining)
 		if err != nil {
 			return nil, err
 		}
@@ -151,9 +213,23 @@ func Deserialize(d *dict.Dict, r io.Reader) (*Tree, error) {
 		if err != nil {
 			return nil, err
 		}
+		if childrenLen > 0 {
+			if n, ok := remaining(); ok && (childrenLen > n/minNodeSize || pending+childrenLen > n/minNodeSize) {
+				return nil, ErrCorrupted
+			}
+			pending += childrenLen
+			parents = append(parents, &pendingParent{&parentNode{tn, parent}, childrenLen})
+		}
+	}
 
-		for i := uint64(0); i < childrenLen; i++ {
-			parents = append([]*parentNode{{tn, parent}}, parents...)
+	if version >= 2 {
+		expected := br.h.Sum32()
+		var checksum uint32
+		if err := binary.Read(br.r, binary.BigEndian, &checksum); err != nil {
+			return nil, err
+		}
+		if checksum != expected {
+			return nil, ErrChecksumMismatch
 		}
 	}
 
@@ -162,6 +238,27 @@ func Deserialize(d *dict.Dict, r io.Reader) (*Tree, error) {
 	return t, nil
 }
 
+// readLabel reads a label of the given length. When the remaining input length is unknown, the label
+// is read in chunks so that a corrupted length doesn't allocate more than there's input
+func readLabel(r io.Reader, n uint64, remaining func() (uint64, bool)) ([]byte, error) {
+	if rem, ok := remaining(); ok {
+		if n > rem {
+			return nil, ErrCorrupted
+		}
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	if n > math.MaxInt32 {
+		return nil, ErrCorrupted
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func DeserializeNoDict(r io.Reader) (*Tree, error) {
 	t := New()
 	br := bufio.NewReader(r) // TODO if it's already a bytereader skip
@@ -220,6 +317,21 @@ func (t *Tree) Bytes(d *dict.Dict, maxNodes int) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+// FromBytes verifies the checksum of version 2 trees before parsing them,
+// corrupted trees are rejected before any of their lengths are trusted
 func FromBytes(d *dict.Dict, p []byte) (*Tree, error) {
+	version, n := binary.Uvarint(p)
+	if n <= 0 {
+		return nil, ErrCorrupted
+	}
+	if version >= 2 {
+		if len(p) < n+4 {
+			return nil, ErrCorrupted
+		}
+		body := p[:len(p)-4]
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(p[len(body):]) {
+			return nil, ErrChecksumMismatch
+		}
+	}
 	return Deserialize(d, bytes.NewReader(p))
 }
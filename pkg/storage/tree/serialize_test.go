@@ -2,6 +2,7 @@ package tree
 
 import (
 	"bytes"
+	"testing/iotest"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -10,6 +11,9 @@ import (
 
 var dictSerializeExample = []byte("\x01\x00\x00\x01\x02\x00\x01\x00\x02\x02\x01\x01\x01\x00\x02\x02\x01\x02\x00")
 
+// same as dictSerializeExample, but version 2 with a checksum at the end
+var dictSerializeExampleV2 = []byte("\x02\x00\x00\x01\x02\x00\x01\x00\x02\x02\x01\x01\x01\x00\x02\x02\x01\x02\x00\xb7\xc6\xd3\xd0")
+
 var _ = Describe("tree", func() {
 	Describe("Insert", func() {
 		tree := New()
@@ -30,7 +34,7 @@ var _ = Describe("tree", func() {
 		It("serializes tree", func() {
 			var buf bytes.Buffer
 			tree.Serialize(d, 1024, &buf)
-			Expect(buf.Bytes()).To(Equal(dictSerializeExample))
+			Expect(buf.Bytes()).To(Equal(dictSerializeExampleV2))
 		})
 
 		Context("Ran 1000000 times", func() {
@@ -57,5 +61,49 @@ var _ = Describe("tree", func() {
 			Expect(string(t.root.ChildrenNodes[0].ChildrenNodes[0].Name)).To(Equal("label not found AQE="))
 			Expect(string(t.root.ChildrenNodes[0].ChildrenNodes[1].Name)).To(Equal("label not found AgE="))
 		})
+
+		It("verifies checksums", func() {
+			d := dict.New()
+			t, err := Deserialize(d, bytes.NewReader(dictSerializeExampleV2))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Samples()).To(Equal(uint64(3)))
+
+			corrupted := append([]byte{}, dictSerializeExampleV2...)
+			corrupted[10] = 0x03
+			_, err = Deserialize(d, bytes.NewReader(corrupted))
+			Expect(err).To(Equal(ErrChecksumMismatch))
+		})
+
+		Context("corrupted lengths", func() {
+			// withLength replaces the byte at i, 3 is the children count of the root
+			// and 4 is the label length of its first child
+			withLength := func(src []byte, i int, v ...byte) []byte {
+				return append(append(append([]byte{}, src[:i]...), v...), src[i+1:]...)
+			}
+			hugeVarint := []byte{0xff, 0xff, 0xff, 0xff, 0x0f}
+
+			It("rejects them before parsing when the checksum doesn't match", func() {
+				d := dict.New()
+				_, err := FromBytes(d, withLength(dictSerializeExampleV2, 4, 0x7f))
+				Expect(err).To(Equal(ErrChecksumMismatch))
+				_, err = FromBytes(d, withLength(dictSerializeExampleV2, 3, hugeVarint...))
+				Expect(err).To(Equal(ErrChecksumMismatch))
+			})
+
+			It("returns an error instead of allocating or looping", func() {
+				d := dict.New()
+				for _, corrupted := range [][]byte{
+					withLength(dictSerializeExample, 4, hugeVarint...),
+					withLength(dictSerializeExample, 3, hugeVarint...),
+					withLength(dictSerializeExample, 4, 0x7f),
+				} {
+					_, err := Deserialize(d, bytes.NewReader(corrupted))
+					Expect(err).To(Equal(ErrCorrupted))
+					// the input length is unknown to Deserialize here
+					_, err = Deserialize(d, iotest.OneByteReader(bytes.NewReader(corrupted)))
+					Expect(err).To(HaveOccurred())
+				}
+			})
+		})
 	})
 })
@@ -0,0 +1,15 @@
+package tree
+
+// IterateStacks calls cb for every stack with a non-zero self value.
+// Stacks are in folded format ("foo;bar"). The slice passed to cb is only valid during the call.
+func (t *Tree) IterateStacks(cb func(stack []byte, val uint64)) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	t.iterate(func(k []byte, v uint64) {
+		if v > 0 {
+			// iterate prefixes stacks with separators for the root node
+			cb(k[2:], v)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package tree
+
+import "sort"
+
+// FunctionSelf is the self value of a function, summed over all of its call paths
+type FunctionSelf struct {
+	Name string `json:"name"`
+	Self uint64 `json:"self"`
+}
+
+// Stats returns the number of nodes and the depth of the tree, the root isn't counted
+func (t *Tree) Stats() (nodes, maxDepth int) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	type item struct {
+		n     *treeNode
+		depth int
+	}
+	stack := []item{{t.root, 0}}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if it.depth > maxDepth {
+			maxDepth = it.depth
+		}
+		nodes += len(it.n.ChildrenNodes)
+		for _, cn := range it.n.ChildrenNodes {
+			stack = append(stack, item{cn, it.depth + 1})
+		}
+	}
+	return nodes, maxDepth
+}
+
+// TopFunctions returns up to n functions with the highest self values, ties are ordered by name.
+// Values of a function at different source locations are summed. Functions without self value
+// aren't returned.
+func (t *Tree) TopFunctions(n int) []FunctionSelf {
+	t.m.RLock()
+	self := make(map[string]uint64)
+	stack := []*treeNode{t.root}
+	for len(stack) > 0 {
+		tn := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if tn != t.root && tn.Self > 0 {
+			name, _ := SplitLocation(tn.Name)
+			self[string(name)] += tn.Self
+		}
+		stack = append(stack, tn.ChildrenNodes...)
+	}
+	t.m.RUnlock()
+
+	res := make([]FunctionSelf, 0, len(self))
+	for name, v := range self {
+		res = append(res, FunctionSelf{Name: name, Self: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Self != res[j].Self {
+			return res[i].Self > res[j].Self
+		}
+		return res[i].Name < res[j].Name
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
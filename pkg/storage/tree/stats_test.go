@@ -0,0 +1,53 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tree stats", func() {
+	var tree *Tree
+	BeforeEach(func() {
+		tree = New()
+		tree.Insert([]byte("a;foo;b"), uint64(1))
+		tree.Insert([]byte("c;foo;b"), uint64(2))
+		tree.Insert([]byte("c;foo;d"), uint64(3))
+		tree.Insert([]byte("c;e"), uint64(3))
+	})
+
+	Context("Stats", func() {
+		It("counts nodes and levels", func() {
+			nodes, maxDepth := tree.Stats()
+			Expect(nodes).To(Equal(8))
+			Expect(maxDepth).To(Equal(3))
+		})
+
+		It("returns zeros for empty trees", func() {
+			nodes, maxDepth := New().Stats()
+			Expect(nodes).To(BeZero())
+			Expect(maxDepth).To(BeZero())
+		})
+	})
+
+	Context("TopFunctions", func() {
+		It("sums self values of functions over call paths", func() {
+			Expect(tree.TopFunctions(3)).To(Equal([]FunctionSelf{
+				{Name: "b", Self: 3},
+				{Name: "d", Self: 3},
+				{Name: "e", Self: 3},
+			}))
+			Expect(tree.TopFunctions(10)).To(HaveLen(3))
+		})
+
+		It("sums self values of a function at different locations", func() {
+			t := New()
+			t.Insert([]byte("a;foo main.go:10"), uint64(1))
+			t.Insert([]byte("a;foo main.go:20"), uint64(2))
+			t.Insert([]byte("a;bar main.go:30"), uint64(2))
+			Expect(t.TopFunctions(10)).To(Equal([]FunctionSelf{
+				{Name: "foo", Self: 3},
+				{Name: "bar", Self: 2},
+			}))
+		})
+	})
+})
@@ -0,0 +1,34 @@
+package tree
+
+// Subtree returns a new tree containing only the subtrees rooted at nodes named name.
+// When the function appears in multiple call paths all of its subtrees are merged together.
+// Recursive calls are only counted once: nodes nested under a matching node are not considered
+// separately because they're already part of the outer subtree.
+func (t *Tree) Subtree(name string) *Tree {
+	t.m.RLock()
+	matches := []*treeNode{}
+	nodes := []*treeNode{t.root}
+	for len(nodes) > 0 {
+		tn := nodes[0]
+		nodes = nodes[1:]
+
+		if tn != t.root && string(tn.Name) == name {
+			matches = append(matches, tn.clone(1, 1))
+			continue
+		}
+		nodes = append(append([]*treeNode{}, tn.ChildrenNodes...), nodes...)
+	}
+	t.m.RUnlock()
+
+	res := New()
+	for _, m := range matches {
+		res.Merge(&Tree{
+			root: &treeNode{
+				Name:          jsonableSlice{},
+				Total:         m.Total,
+				ChildrenNodes: []*treeNode{m},
+			},
+		})
+	}
+	return res
+}
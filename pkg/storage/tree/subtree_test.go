@@ -0,0 +1,38 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tree subtree", func() {
+	Context("Subtree", func() {
+		It("merges subtrees from multiple call paths", func() {
+			tree := New()
+			tree.Insert([]byte("a;foo;b"), uint64(1))
+			tree.Insert([]byte("c;foo;b"), uint64(2))
+			tree.Insert([]byte("c;foo;d"), uint64(3))
+			tree.Insert([]byte("c;e"), uint64(4))
+
+			res := tree.Subtree("foo")
+			Expect(res.String()).To(Equal("\"foo;b\" 3\n\"foo;d\" 3\n"))
+			Expect(res.Samples()).To(Equal(uint64(6)))
+		})
+
+		It("counts recursive calls once", func() {
+			tree := New()
+			tree.Insert([]byte("foo;bar;foo;baz"), uint64(1))
+
+			res := tree.Subtree("foo")
+			Expect(res.String()).To(Equal("\"foo;bar;foo;baz\" 1\n"))
+			Expect(res.Samples()).To(Equal(uint64(1)))
+		})
+
+		It("returns an empty tree when there are no matches", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+
+			Expect(tree.Subtree("foo").Samples()).To(Equal(uint64(0)))
+		})
+	})
+})
@@ -61,7 +61,16 @@ func New() *Tree {
 }
 
 func (dstTrie *Tree) Merge(srcTrieI merge.Merger) {
-	srcTrie := srcTrieI.(*Tree)
+	dstTrie.merge(srcTrieI.(*Tree), 1, 1)
+}
+
+// MergeWithRatio adds values of src multiplied by r to the tree. It's the same as merging
+// src.Clone(r), but without allocating the intermediate clone.
+func (dstTrie *Tree) MergeWithRatio(src *Tree, r *big.Rat) {
+	dstTrie.merge(src, uint64(r.Num().Int64()), uint64(r.Denom().Int64()))
+}
+
+func (dstTrie *Tree) merge(srcTrie *Tree, m, d uint64) {
 	srcNodes := []*treeNode{srcTrie.root}
 	dstNodes := []*treeNode{dstTrie.root}
 
@@ -70,21 +79,23 @@ func (dstTrie *Tree) Merge(srcTrieI merge.Merger) {
 	dstTrie.m.Lock()
 	defer dstTrie.m.Unlock()
 
+	// nodes are processed in stack order, so that the stacks don't grow beyond the tree depth
+	// times the max number of children
 	for len(srcNodes) > 0 {
-		st := srcNodes[0]
-		srcNodes = srcNodes[1:]
+		st := srcNodes[len(srcNodes)-1]
+		srcNodes = srcNodes[:len(srcNodes)-1]
 
-		dt := dstNodes[0]
-		dstNodes = dstNodes[1:]
+		dt := dstNodes[len(dstNodes)-1]
+		dstNodes = dstNodes[:len(dstNodes)-1]
 
-		dt.Self += st.Self
-		dt.Total += st.Total
+		dt.Self += st.Self * m / d
+		dt.Total += st.Total * m / d
 
 		for _, srcChildNode := range st.ChildrenNodes {
 			dstChildNode := dt.insert(srcChildNode.Name)
 
-			srcNodes = append([]*treeNode{srcChildNode}, srcNodes...)
-			dstNodes = append([]*treeNode{dstChildNode}, dstNodes...)
+			srcNodes = append(srcNodes, srcChildNode)
+			dstNodes = append(dstNodes, dstChildNode)
 		}
 	}
 }
@@ -0,0 +1,154 @@
+package tree
+
+import (
+	"bytes"
+	"sort"
+)
+
+// TruncatedNodeName is the name of the synthetic node that replaces frames cut off by TruncateDepth
+const TruncatedNodeName = "(truncated)"
+
+// OtherNodeName is the name of the synthetic node that replaces siblings cut off by CapWidth
+const OtherNodeName = "(other)"
+
+// TruncateDepth collapses all frames deeper than maxDepth into a single synthetic
+// "(truncated)" leaf. Values are preserved, so totals at every level stay the same.
+// Returns true if the tree was modified.
+func (t *Tree) TruncateDepth(maxDepth int) bool {
+	if maxDepth <= 0 {
+		return false
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	truncated := false
+	// root is an empty node, frames start at depth 1
+	nodes := []*treeNode{t.root}
+	depths := []int{0}
+	for len(nodes) > 0 {
+		tn := nodes[0]
+		nodes = nodes[1:]
+		depth := depths[0]
+		depths = depths[1:]
+
+		if depth < maxDepth {
+			for _, n := range tn.ChildrenNodes {
+				nodes = append(nodes, n)
+				depths = append(depths, depth+1)
+			}
+			continue
+		}
+
+		if len(tn.ChildrenNodes) == 0 {
+			continue
+		}
+		if len(tn.ChildrenNodes) == 1 && string(tn.ChildrenNodes[0].Name) == TruncatedNodeName &&
+			len(tn.ChildrenNodes[0].ChildrenNodes) == 0 {
+			continue
+		}
+
+		v := tn.Total - tn.Self
+		tn.ChildrenNodes = []*treeNode{{
+			Name:          jsonableSlice(TruncatedNodeName),
+			Total:         v,
+			Self:          v,
+			ChildrenNodes: []*treeNode{},
+		}}
+		truncated = true
+	}
+	return truncated
+}
+
+// CapWidth limits the number of children of every node to maxWidth: the children with the
+// largest totals are kept, the rest are merged into a single synthetic "(other)" leaf.
+// Values are preserved, so totals at every level stay the same. maxWidth <= 0 means no limit.
+// Returns true if the tree was modified.
+func (t *Tree) CapWidth(maxWidth int) bool {
+	if maxWidth <= 0 {
+		return false
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	capped := false
+	nodes := []*treeNode{t.root}
+	for len(nodes) > 0 {
+		tn := nodes[0]
+		nodes = nodes[1:]
+
+		if len(tn.ChildrenNodes) > maxWidth {
+			tn.ChildrenNodes = capChildren(tn.ChildrenNodes, maxWidth)
+			capped = true
+		}
+		for _, n := range tn.ChildrenNodes {
+			nodes = append(nodes, n)
+		}
+	}
+	return capped
+}
+
+// capChildren keeps maxWidth-1 children with the largest totals and merges the rest,
+// including an existing "(other)" node, into an "(other)" leaf. Children stay sorted by name.
+func capChildren(children []*treeNode, maxWidth int) []*treeNode {
+	other := &treeNode{
+		Name:          jsonableSlice(OtherNodeName),
+		ChildrenNodes: []*treeNode{},
+	}
+	candidates := make([]*treeNode, 0, len(children))
+	for _, n := range children {
+		if string(n.Name) == OtherNodeName {
+			other.Total += n.Total
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Total > candidates[j].Total
+	})
+	kept := candidates[:maxWidth-1]
+	for _, n := range candidates[maxWidth-1:] {
+		other.Total += n.Total
+	}
+	other.Self = other.Total
+
+	res := make([]*treeNode, 0, maxWidth)
+	res = append(res, kept...)
+	res = append(res, other)
+	sort.Slice(res, func(i, j int) bool {
+		return bytes.Compare(res[i].Name, res[j].Name) < 0
+	})
+	return res
+}
+
+// TrimDepth returns a copy of the tree with at most maxDepth levels of frames. Unlike
+// TruncateDepth it doesn't add synthetic nodes: values of deeper frames are added to
+// self of the last visible node, so totals at every level stay the same.
+// maxDepth <= 0 means no limit.
+func (t *Tree) TrimDepth(maxDepth int) *Tree {
+	t.m.RLock()
+	defer t.m.RUnlock()
+
+	if maxDepth <= 0 {
+		return &Tree{root: t.root.clone(1, 1)}
+	}
+	return &Tree{root: t.root.trim(maxDepth)}
+}
+
+func (n *treeNode) trim(depth int) *treeNode {
+	newNode := &treeNode{
+		Name:          n.Name,
+		Total:         n.Total,
+		Self:          n.Self,
+		ChildrenNodes: []*treeNode{},
+	}
+	if depth == 0 {
+		newNode.Self = n.Total
+		return newNode
+	}
+	for _, cn := range n.ChildrenNodes {
+		newNode.ChildrenNodes = append(newNode.ChildrenNodes, cn.trim(depth-1))
+	}
+	return newNode
+}
@@ -0,0 +1,80 @@
+package tree
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tree truncation", func() {
+	Context("TruncateDepth", func() {
+		It("collapses deep frames into a truncated leaf", func() {
+			tree := New()
+			tree.Insert([]byte("a;b;c;d"), uint64(1))
+			tree.Insert([]byte("a;b;e"), uint64(2))
+			tree.Insert([]byte("a;f"), uint64(3))
+
+			Expect(tree.TruncateDepth(2)).To(BeTrue())
+			Expect(tree.String()).To(Equal("\"a;b;(truncated)\" 3\n\"a;f\" 3\n"))
+			Expect(tree.Samples()).To(Equal(uint64(6)))
+		})
+
+		It("doesn't modify shallow trees", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+
+			Expect(tree.TruncateDepth(2)).To(BeFalse())
+			Expect(tree.TruncateDepth(0)).To(BeFalse())
+			Expect(tree.String()).To(Equal("\"a;b\" 1\n"))
+		})
+	})
+
+	Context("CapWidth", func() {
+		It("merges the smallest siblings into an other leaf", func() {
+			tree := New()
+			tree.Insert([]byte("a;b;x"), uint64(5))
+			tree.Insert([]byte("a;c"), uint64(1))
+			tree.Insert([]byte("a;d;y"), uint64(2))
+			tree.Insert([]byte("a;e"), uint64(4))
+			tree.Insert([]byte("f"), uint64(3))
+
+			Expect(tree.CapWidth(3)).To(BeTrue())
+			Expect(tree.String()).To(Equal("\"a;(other)\" 3\n\"a;b;x\" 5\n\"a;e\" 4\n\"f\" 3\n"))
+			Expect(tree.Samples()).To(Equal(uint64(15)))
+
+			tree.Insert([]byte("a;g"), uint64(1))
+			Expect(tree.CapWidth(3)).To(BeTrue())
+			Expect(tree.String()).To(Equal("\"a;(other)\" 4\n\"a;b;x\" 5\n\"a;e\" 4\n\"f\" 3\n"))
+		})
+
+		It("doesn't modify narrow trees", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+			tree.Insert([]byte("a;c"), uint64(2))
+
+			Expect(tree.CapWidth(2)).To(BeFalse())
+			Expect(tree.CapWidth(0)).To(BeFalse())
+			Expect(tree.String()).To(Equal("\"a;b\" 1\n\"a;c\" 2\n"))
+		})
+	})
+
+	Context("TrimDepth", func() {
+		It("rolls deep frames into the last visible node", func() {
+			tree := New()
+			tree.Insert([]byte("a;b;c;d"), uint64(1))
+			tree.Insert([]byte("a;b;e"), uint64(2))
+			tree.Insert([]byte("a;f"), uint64(3))
+
+			trimmed := tree.TrimDepth(2)
+			Expect(trimmed.String()).To(Equal("\"a;b\" 3\n\"a;f\" 3\n"))
+			Expect(trimmed.Samples()).To(Equal(uint64(6)))
+			Expect(tree.String()).To(Equal("\"a;b;c;d\" 1\n\"a;b;e\" 2\n\"a;f\" 3\n"))
+		})
+
+		It("returns a full copy when there's no limit", func() {
+			tree := New()
+			tree.Insert([]byte("a;b"), uint64(1))
+
+			Expect(tree.TrimDepth(0).String()).To(Equal("\"a;b\" 1\n"))
+		})
+	})
+})
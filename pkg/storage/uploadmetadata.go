@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// Upload metadata are tags attached to a single upload (e.g a build ID). Unlike labels they don't create
+// series, so they can have any number of distinct values. Every upload with metadata gets a record in the
+// main db, keyed by the segment key and the upload start time, so that records of a series are adjacent
+// and sorted by time:
+//
+//   um:<segment key>:<start time, 8 bytes> -> JSON encoded uploadMetadata
+//
+// Records expire with the retention of the app and are deleted together with the data they describe.
+// See docs/storage-design.md for query performance implications.
+
+const uploadMetadataPrefix = "um:"
+
+// maxUploadDuration bounds how long before the start of a query uploads that overlap it are looked up
+const maxUploadDuration = time.Hour
+
+// bucketDuration is the resolution of stored data
+const bucketDuration = 10 * time.Second
+
+var ErrUnsupportedMetadataFilter = errors.New("metadata filters can only be used with sum and average aggregation and without reduce")
+
+type uploadMetadata struct {
+	EndTime  int64             `json:"end"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type timeRange struct {
+	start time.Time
+	end   time.Time
+}
+
+func uploadMetadataSeriesPrefix(segmentKey string) []byte {
+	return []byte(uploadMetadataPrefix + segmentKey + ":")
+}
+
+func uploadMetadataKey(segmentKey string, t time.Time) []byte {
+	var ts [8]byte
+	// flipping the sign bit makes negative timestamps sort before positive ones
+	binary.BigEndian.PutUint64(ts[:], uint64(t.Unix())^(1<<63))
+	return append(uploadMetadataSeriesPrefix(segmentKey), ts[:]...)
+}
+
+func uploadStartTime(k []byte) time.Time {
+	return time.Unix(int64(binary.BigEndian.Uint64(k[len(k)-8:])^(1<<63)), 0)
+}
+
+func (s *Storage) putUploadMetadata(key *Key, st, et time.Time, md map[string]string) error {
+	v, err := json.Marshal(uploadMetadata{EndTime: et.Unix(), Metadata: md})
+	if err != nil {
+		return err
+	}
+	e := s.withRetentionTTL(badger.NewEntry(uploadMetadataKey(key.SegmentKey(), st), v), key)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+// withRetentionTTL makes records about uploads expire with the data of the app,
+// so that they don't outlive it when it's expired by the retention
+func (s *Storage) withRetentionTTL(e *badger.Entry, key *Key) *badger.Entry {
+	if retention := s.retentionOf(key.Tenant(), key.AppName()); retention > 0 {
+		return e.WithTTL(retention)
+	}
+	return e
+}
+
+func (s *Storage) deleteUploadMetadata(segmentKey string) error {
+	if err := s.deleteTraceProfiles(segmentKey); err != nil {
+		return err
+	}
+	return s.db.DropPrefix(uploadMetadataSeriesPrefix(segmentKey))
+}
+
+// deleteUploadMetadataBefore deletes records of uploads of the series that end before the cutoff,
+// together with their trace index records
+func (s *Storage) deleteUploadMetadataBefore(segmentKey string, cutoff time.Time) error {
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = uploadMetadataSeriesPrefix(segmentKey)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		// uploads that start after the cutoff can't end before it
+		last := uploadMetadataKey(segmentKey, cutoff)
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.Compare(item.Key(), last) >= 0 {
+				break
+			}
+			var um uploadMetadata
+			if err := item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &um)
+			}); err != nil {
+				return err
+			}
+			if um.EndTime > cutoff.Unix() {
+				continue
+			}
+			keys = append(keys, item.KeyCopy(nil))
+			if traceID := um.Metadata[TraceIDMetadata]; traceID != "" {
+				keys = append(keys, traceIndexKey(traceID, item.Key()))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, k := range keys {
+		if err := wb.Delete(k); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// uploadRanges returns time ranges of uploads of the series within [st, et) that have all of the filter
+// metadata. Ranges are aligned to buckets and don't overlap, so that no bucket is counted twice.
+func (s *Storage) uploadRanges(segmentKey string, st, et time.Time, filter map[string]string) ([]timeRange, error) {
+	var ranges []timeRange
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = uploadMetadataSeriesPrefix(segmentKey)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		last := uploadMetadataKey(segmentKey, et)
+		for it.Seek(uploadMetadataKey(segmentKey, st.Add(-maxUploadDuration))); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.Compare(item.Key(), last) >= 0 {
+				break
+			}
+			var um uploadMetadata
+			if err := item.Value(func(v []byte) error {
+				return json.Unmarshal(v, &um)
+			}); err != nil {
+				return err
+			}
+			if um.EndTime <= st.Unix() || !matchesMetadata(um.Metadata, filter) {
+				continue
+			}
+			r := timeRange{
+				start: uploadStartTime(item.Key()).Truncate(bucketDuration),
+				end:   roundUp(time.Unix(um.EndTime, 0), bucketDuration),
+			}
+			if r.start.Before(st) {
+				r.start = st
+			}
+			if r.end.After(et) {
+				r.end = et
+			}
+			// records are sorted by start time, so overlapping ranges are adjacent
+			if n := len(ranges); n > 0 && !r.start.After(ranges[n-1].end) {
+				if r.end.After(ranges[n-1].end) {
+					ranges[n-1].end = r.end
+				}
+				continue
+			}
+			ranges = append(ranges, r)
+		}
+		return nil
+	})
+	return ranges, err
+}
+
+func matchesMetadata(md, filter map[string]string) bool {
+	for k, v := range filter {
+		if md[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func roundUp(t time.Time, d time.Duration) time.Time {
+	if r := t.Truncate(d); !r.Equal(t) {
+		return r.Add(d)
+	}
+	return t
+}
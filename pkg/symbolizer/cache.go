@@ -0,0 +1,46 @@
+package symbolizer
+
+import "sync"
+
+type cacheEntry struct {
+	name string
+	ok   bool
+}
+
+// cache remembers resolutions of the underlying symbolizer, including failed ones.
+// It's cleared once it's full, profiles of an app keep hitting the same hot addresses.
+type cache struct {
+	s    Symbolizer
+	size int
+
+	mu      sync.Mutex
+	entries map[uint64]cacheEntry
+}
+
+// NewCache returns a symbolizer that caches up to size resolutions of s, e.g for symbolizers
+// that are expensive to query
+func NewCache(s Symbolizer, size int) Symbolizer {
+	return &cache{
+		s:       s,
+		size:    size,
+		entries: make(map[uint64]cacheEntry),
+	}
+}
+
+func (c *cache) Symbolize(addr uint64) (string, bool) {
+	c.mu.Lock()
+	e, found := c.entries[addr]
+	c.mu.Unlock()
+	if found {
+		return e.name, e.ok
+	}
+
+	e.name, e.ok = c.s.Symbolize(addr)
+	c.mu.Lock()
+	if len(c.entries) >= c.size {
+		c.entries = make(map[uint64]cacheEntry)
+	}
+	c.entries[addr] = e
+	c.mu.Unlock()
+	return e.name, e.ok
+}
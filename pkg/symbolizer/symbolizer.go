@@ -0,0 +1,62 @@
+// Package symbolizer resolves raw addresses, found in profiles of native or stripped binaries,
+// to function names. Profiles can be pushed without symbols and symbolized by the server.
+package symbolizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Symbolizer resolves an address to the name of the function it belongs to
+type Symbolizer interface {
+	Symbolize(addr uint64) (name string, ok bool)
+}
+
+// Opener creates a symbolizer from a source, e.g a path to a symbol map
+type Opener func(source string) (Symbolizer, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{
+		"perfmap": OpenPerfMap,
+		"elf":     OpenELF,
+	}
+)
+
+// Register makes a kind of symbolizers available to Open, e.g one backed by a symbol server.
+// It's meant to be called from init functions of packages providing them.
+func Register(kind string, o Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+	openers[kind] = o
+}
+
+// Kinds returns the registered kinds of symbolizers
+func Kinds() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+	res := make([]string, 0, len(openers))
+	for k := range openers {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Open creates a symbolizer from a <kind>:<source> spec, e.g perfmap:/tmp/perf-123.map
+func Open(spec string) (Symbolizer, error) {
+	i := strings.Index(spec, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid symbolizer %q: expected <kind>:<source>", spec)
+	}
+	kind := spec[:i]
+	openersMu.RLock()
+	o, ok := openers[kind]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unsupported symbolizer kind %q, supported ones are: %s", kind, strings.Join(Kinds(), ", "))
+	}
+	return o(spec[i+1:])
+}
@@ -0,0 +1,13 @@
+package symbolizer_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestSymbolizer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Symbolizer Suite")
+}
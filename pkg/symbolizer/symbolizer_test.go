@@ -0,0 +1,140 @@
+package symbolizer_test
+
+import (
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/pyroscope-io/pyroscope/pkg/symbolizer"
+)
+
+type countingSymbolizer struct {
+	calls int
+}
+
+func (c *countingSymbolizer) Symbolize(addr uint64) (string, bool) {
+	c.calls++
+	return "fn", addr == 1
+}
+
+var _ = Describe("symbolizer", func() {
+	Context("Table", func() {
+		It("resolves addresses within symbols", func() {
+			t := symbolizer.NewTable([]symbolizer.Symbol{
+				{Start: 0x200, Size: 0x10, Name: "b"},
+				{Start: 0x100, Size: 0x10, Name: "a"},
+				{Start: 0x300, Name: "c"},
+				{Start: 0x400, Name: "d"},
+			})
+			for addr, expected := range map[uint64]string{
+				0x100: "a", 0x10f: "a", 0x200: "b", 0x300: "c", 0x3ff: "c", 0x400: "d",
+			} {
+				name, ok := t.Symbolize(addr)
+				Expect(ok).To(BeTrue())
+				Expect(name).To(Equal(expected))
+			}
+			for _, addr := range []uint64{0, 0xff, 0x110, 0x210, 0x401} {
+				_, ok := t.Symbolize(addr)
+				Expect(ok).To(BeFalse())
+			}
+		})
+
+		It("parses perf maps", func() {
+			t, err := symbolizer.ParsePerfMap(strings.NewReader("7f0010 20 Interpreter::run\n\n7f0100 8 LambdaForm$MH/0x1 linkToStatic\n"))
+			Expect(err).ToNot(HaveOccurred())
+			name, ok := t.Symbolize(0x7f0104)
+			Expect(ok).To(BeTrue())
+			Expect(name).To(Equal("LambdaForm$MH/0x1 linkToStatic"))
+			name, _ = t.Symbolize(0x7f001f)
+			Expect(name).To(Equal("Interpreter::run"))
+
+			_, err = symbolizer.ParsePerfMap(strings.NewReader("7f0010 zz foo\n"))
+			Expect(err).To(MatchError(ContainSubstring("line 1: invalid size")))
+		})
+
+		It("reads function symbols of ELF binaries", func() {
+			if runtime.GOOS != "linux" {
+				Skip("test binaries are only ELF on linux")
+			}
+			exe, err := os.Executable()
+			Expect(err).ToNot(HaveOccurred())
+			s, err := symbolizer.OpenELF(exe)
+			Expect(err).ToNot(HaveOccurred())
+			// addresses are the ones in the binary, not in memory, test binaries can be position
+			// independent and stripped of everything but dynamic symbols
+			f, err := elf.Open(exe)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			syms, _ := f.Symbols()
+			dynSyms, _ := f.DynamicSymbols()
+			names := map[uint64][]string{}
+			for _, sym := range append(syms, dynSyms...) {
+				if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 && sym.Size > 1 {
+					names[sym.Value] = append(names[sym.Value], sym.Name)
+				}
+			}
+			Expect(names).ToNot(BeEmpty())
+			for addr, fns := range names {
+				name, ok := s.Symbolize(addr + 1)
+				Expect(ok).To(BeTrue())
+				Expect(fns).To(ContainElement(name))
+			}
+		})
+	})
+
+	Context("Open", func() {
+		It("opens symbolizers by kind", func() {
+			dir, err := ioutil.TempDir("", "symbolizer")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "perf-1.map")
+			Expect(ioutil.WriteFile(path, []byte("10 10 foo\n"), 0644)).To(Succeed())
+
+			s, err := symbolizer.Open("perfmap:" + path)
+			Expect(err).ToNot(HaveOccurred())
+			name, _ := s.Symbolize(0x11)
+			Expect(name).To(Equal("foo"))
+
+			_, err = symbolizer.Open(path)
+			Expect(err).To(MatchError(ContainSubstring("expected <kind>:<source>")))
+			_, err = symbolizer.Open("pdb:" + path)
+			Expect(err).To(MatchError(ContainSubstring(`unsupported symbolizer kind "pdb"`)))
+		})
+
+		It("opens registered symbolizers", func() {
+			symbolizer.Register("static", func(source string) (symbolizer.Symbolizer, error) {
+				return symbolizer.NewTable([]symbolizer.Symbol{{Start: 1, Size: 1, Name: source}}), nil
+			})
+			Expect(symbolizer.Kinds()).To(ContainElement("static"))
+			s, err := symbolizer.Open("static:main")
+			Expect(err).ToNot(HaveOccurred())
+			name, ok := s.Symbolize(1)
+			Expect(ok).To(BeTrue())
+			Expect(name).To(Equal("main"))
+		})
+	})
+
+	Context("NewCache", func() {
+		It("caches resolutions", func() {
+			cs := &countingSymbolizer{}
+			c := symbolizer.NewCache(cs, 2)
+			for i := 0; i < 3; i++ {
+				_, ok := c.Symbolize(1)
+				Expect(ok).To(BeTrue())
+				_, ok = c.Symbolize(2)
+				Expect(ok).To(BeFalse())
+			}
+			Expect(cs.calls).To(Equal(2))
+			// a full cache starts over
+			c.Symbolize(3)
+			c.Symbolize(1)
+			Expect(cs.calls).To(Equal(4))
+		})
+	})
+})
@@ -0,0 +1,124 @@
+package symbolizer
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol is a function that occupies [Start, Start+Size)
+type Symbol struct {
+	Start uint64
+	Size  uint64
+	Name  string
+}
+
+// Table is a Symbolizer backed by a list of symbols, e.g from a symbol map or a binary
+type Table struct {
+	symbols []Symbol
+}
+
+// NewTable returns a table of the symbols. Symbols of unknown size (0) are assumed
+// to end where the next one starts.
+func NewTable(symbols []Symbol) *Table {
+	s := make([]Symbol, len(symbols))
+	copy(s, symbols)
+	sort.Slice(s, func(i, j int) bool { return s[i].Start < s[j].Start })
+	for i := range s {
+		if s[i].Size != 0 {
+			continue
+		}
+		if i+1 < len(s) {
+			s[i].Size = s[i+1].Start - s[i].Start
+		} else {
+			s[i].Size = 1
+		}
+	}
+	return &Table{symbols: s}
+}
+
+func (t *Table) Symbolize(addr uint64) (string, bool) {
+	// the last symbol that starts at or before addr
+	i := sort.Search(len(t.symbols), func(i int) bool { return t.symbols[i].Start > addr }) - 1
+	if i < 0 {
+		return "", false
+	}
+	s := t.symbols[i]
+	if addr-s.Start >= s.Size {
+		return "", false
+	}
+	return s.Name, true
+}
+
+// ParsePerfMap parses a symbol map in the perf map format, as written by JITs for perf
+// (e.g /tmp/perf-<pid>.map): a line per symbol, "<start> <size> <name>", numbers are hex.
+func ParsePerfMap(r io.Reader) (*Table, error) {
+	var symbols []Symbol
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected <start> <size> <name>", n)
+		}
+		start, err := strconv.ParseUint(strings.TrimPrefix(fields[0], "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid start: %v", n, err)
+		}
+		size, err := strconv.ParseUint(strings.TrimPrefix(fields[1], "0x"), 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid size: %v", n, err)
+		}
+		symbols = append(symbols, Symbol{Start: start, Size: size, Name: strings.TrimSpace(fields[2])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewTable(symbols), nil
+}
+
+// OpenPerfMap reads a symbol map file, see ParsePerfMap
+func OpenPerfMap(path string) (Symbolizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParsePerfMap(f)
+}
+
+// OpenELF reads function symbols of an ELF binary (or of its separate debug info file).
+// Addresses are resolved as they are in the binary, i.e they have to be adjusted for
+// the load address of position independent binaries by whoever collects profiles.
+func OpenELF(path string) (Symbolizer, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var symbols []Symbol
+	for _, load := range []func() ([]elf.Symbol, error){f.Symbols, f.DynamicSymbols} {
+		syms, err := load()
+		if err != nil && err != elf.ErrNoSymbols {
+			return nil, err
+		}
+		for _, s := range syms {
+			if elf.ST_TYPE(s.Info) == elf.STT_FUNC && s.Value != 0 {
+				symbols = append(symbols, Symbol{Start: s.Value, Size: s.Size, Name: s.Name})
+			}
+		}
+	}
+	if len(symbols) == 0 {
+		return nil, fmt.Errorf("%s: no function symbols", path)
+	}
+	return NewTable(symbols), nil
+}
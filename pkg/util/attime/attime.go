@@ -15,7 +15,19 @@ func init() {
 	digitsOnly = regexp.MustCompile("^\\d+$")
 }
 
+// Parse parses an absolute or relative (e.g now-1h) time, dates are in UTC.
+// Every time reference means now, use ParseInLocation for day references.
 func Parse(s string) time.Time {
+	return parse(s, time.UTC, false)
+}
+
+// ParseInLocation is like Parse, but dates (e.g 20200101) are interpreted in loc and so are
+// day references (today, yesterday, tomorrow, midnight), which mean the start of the day
+func ParseInLocation(s string, loc *time.Location) time.Time {
+	return parse(s, loc, true)
+}
+
+func parse(s string, loc *time.Location, dayRefs bool) time.Time {
 	s = strings.TrimSpace(s)
 	// s = strings.ToLower(s)
 	s = strings.Replace(s, "_", "", -1)
@@ -23,7 +35,7 @@ func Parse(s string) time.Time {
 	s = strings.Replace(s, " ", "", -1)
 
 	if digitsOnly.MatchString(s) {
-		t, _ := time.Parse("20060102", s)
+		t, _ := time.ParseInLocation("20060102", s, loc)
 		if len(s) == 8 && t.Year() > 1900 && t.Month() < 13 && t.Day() < 32 {
 			return t
 		}
@@ -43,13 +55,27 @@ func Parse(s string) time.Time {
 		offset = s[i:]
 	}
 
-	return parseTimeReference(ref).Add(parseTimeOffset(offset))
+	if !dayRefs {
+		return time.Now().Add(parseTimeOffset(offset))
+	}
+	return parseTimeReference(ref, loc).Add(parseTimeOffset(offset))
 }
 
-func parseTimeReference(_ string) time.Time {
+func parseTimeReference(ref string, loc *time.Location) time.Time {
 	now := time.Now()
-	// TODO: implement
-	return now
+	// TODO: implement the rest of graphite references, e.g noon or 8am
+	days := 0
+	switch ref {
+	case "today", "midnight":
+	case "yesterday":
+		days = -1
+	case "tomorrow":
+		days = 1
+	default:
+		return now
+	}
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d+days, 0, 0, 0, 0, loc)
 }
 
 func parseTimeOffset(offset string) (d time.Duration) {
@@ -26,5 +26,27 @@ var _ = Describe("attime", func() {
 				Expect(Parse("1577836800")).To(BeTemporally("~", time.Unix(1577836800, 0)))
 			})
 		})
+
+		Context("time zones", func() {
+			It("interprets dates and days in the location", func() {
+				loc := time.FixedZone("UTC+2", 2*3600)
+				Expect(ParseInLocation("20200101", loc)).To(BeTemporally("==", time.Unix(1577836800-2*3600, 0)))
+				Expect(ParseInLocation("1577836800", loc)).To(BeTemporally("==", time.Unix(1577836800, 0)))
+				Expect(ParseInLocation("now-1h", loc)).To(BeTemporally("~", time.Now().Add(-time.Hour)))
+
+				y, m, d := time.Now().In(loc).Date()
+				today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+				Expect(ParseInLocation("today", loc)).To(BeTemporally("==", today))
+				Expect(ParseInLocation("midnight", loc)).To(BeTemporally("==", today))
+				Expect(ParseInLocation("yesterday", loc)).To(BeTemporally("==", today.AddDate(0, 0, -1)))
+				Expect(ParseInLocation("today-6h", loc)).To(BeTemporally("==", today.Add(-6*time.Hour)))
+				Expect(ParseInLocation("today", time.UTC)).To(BeTemporally("==", time.Now().UTC().Truncate(24*time.Hour)))
+			})
+
+			It("keeps day references meaning now in Parse", func() {
+				Expect(Parse("today")).To(BeTemporally("~", time.Now()))
+				Expect(Parse("yesterday-1h")).To(BeTemporally("~", time.Now().Add(-time.Hour)))
+			})
+		})
 	})
 })
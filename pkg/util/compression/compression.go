@@ -0,0 +1,79 @@
+// Package compression implements the content encodings of uploaded profiles. Agents compress
+// payloads to save bandwidth, the server decompresses them based on the Content-Encoding header.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	None = "none"
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// ErrZstdUnavailable is returned for zstd in builds without cgo, the zstd library requires it
+var ErrZstdUnavailable = errors.New("zstd compression requires a build with cgo enabled")
+
+// Validate returns an error if the compression isn't supported by this build, empty means none
+func Validate(compression string) error {
+	switch compression {
+	case "", None, Gzip:
+		return nil
+	case Zstd:
+		if !zstdAvailable {
+			return ErrZstdUnavailable
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q, supported ones are: %s, %s, %s", compression, None, Gzip, Zstd)
+}
+
+// ContentEncoding is the Content-Encoding header value of the compression, empty for none
+func ContentEncoding(compression string) string {
+	if compression == None {
+		return ""
+	}
+	return compression
+}
+
+// Compress returns b compressed with the compression
+func Compress(compression string, b []byte) ([]byte, error) {
+	switch compression {
+	case "", None:
+		return b, nil
+	case Gzip:
+		var buf bytes.Buffer
+		// payloads are compressed on every upload, speed matters more than the last few percent
+		gw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if _, err := gw.Write(b); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdCompress(b)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+// NewReader returns a reader of r decompressed according to a Content-Encoding header value.
+// Empty and identity encodings mean r isn't compressed.
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "", "identity":
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		return zstdNewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
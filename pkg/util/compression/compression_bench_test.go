@@ -0,0 +1,44 @@
+package compression
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/pyroscope-io/pyroscope/pkg/structs/transporttrie"
+)
+
+// benchmarkPayload is a serialized trie, as uploaded by agents
+func benchmarkPayload() []byte {
+	t := transporttrie.New()
+	r := rand.New(rand.NewSource(123))
+	for i := 0; i < 10000; i++ {
+		var stack []byte
+		for d := 0; d < 20; d++ {
+			stack = append(stack, fmt.Sprintf("pkg%d.func%d;", r.Intn(10), r.Intn(50))...)
+		}
+		t.Insert(stack[:len(stack)-1], uint64(r.Intn(100)+1))
+	}
+	return t.Bytes()
+}
+
+func benchmarkCompress(b *testing.B, compression string) {
+	if err := Validate(compression); err != nil {
+		b.Skip(err)
+	}
+	payload := benchmarkPayload()
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	var compressed []byte
+	for i := 0; i < b.N; i++ {
+		var err error
+		if compressed, err = Compress(compression, payload); err != nil {
+			b.Fatal(err)
+		}
+	}
+	// the share of bandwidth left, e.g 0.2 means uploads are 5x smaller
+	b.ReportMetric(float64(len(compressed))/float64(len(payload)), "ratio")
+}
+
+func BenchmarkCompressGzip(b *testing.B) { benchmarkCompress(b, Gzip) }
+func BenchmarkCompressZstd(b *testing.B) { benchmarkCompress(b, Zstd) }
@@ -0,0 +1,49 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("compression package", func() {
+	payload := bytes.Repeat([]byte("main;work;compute 10\n"), 1000)
+
+	roundTrip := func(compression string) []byte {
+		b, err := Compress(compression, payload)
+		Expect(err).ToNot(HaveOccurred())
+		r, err := NewReader(ContentEncoding(compression), bytes.NewReader(b))
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		res, err := ioutil.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal(payload))
+		return b
+	}
+
+	It("leaves payloads as is without compression", func() {
+		Expect(roundTrip(None)).To(Equal(payload))
+		Expect(ContentEncoding(None)).To(BeEmpty())
+	})
+
+	It("compresses payloads with gzip", func() {
+		Expect(len(roundTrip(Gzip))).To(BeNumerically("<", len(payload)/10))
+	})
+
+	It("compresses payloads with zstd", func() {
+		if !zstdAvailable {
+			Skip("zstd requires cgo")
+		}
+		Expect(len(roundTrip(Zstd))).To(BeNumerically("<", len(payload)/10))
+	})
+
+	It("rejects unsupported compressions", func() {
+		Expect(Validate("")).To(Succeed())
+		Expect(Validate(Gzip)).To(Succeed())
+		Expect(Validate("lz4")).ToNot(Succeed())
+		_, err := NewReader("br", bytes.NewReader(payload))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,19 @@
+// +build cgo
+
+package compression
+
+import (
+	"io"
+
+	"github.com/DataDog/zstd"
+)
+
+const zstdAvailable = true
+
+func zstdCompress(b []byte) ([]byte, error) {
+	return zstd.CompressLevel(nil, b, zstd.BestSpeed)
+}
+
+func zstdNewReader(r io.Reader) (io.ReadCloser, error) {
+	return zstd.NewReader(r), nil
+}
@@ -0,0 +1,15 @@
+// +build !cgo
+
+package compression
+
+import "io"
+
+const zstdAvailable = false
+
+func zstdCompress(b []byte) ([]byte, error) {
+	return nil, ErrZstdUnavailable
+}
+
+func zstdNewReader(r io.Reader) (io.ReadCloser, error) {
+	return nil, ErrZstdUnavailable
+}
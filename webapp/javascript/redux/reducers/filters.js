@@ -24,14 +24,34 @@ const defaultName = window.initialState.appNames.find(
   (x) => x !== "pyroscope.server.cpu"
 );
 
+// parses queries like myapp.cpu{env=prod} into a list of labels
+function parseQuery(query) {
+  const m = query.match(/^([^{]*)(?:\{(.*)\})?$/);
+  if (!m) {
+    return [];
+  }
+  const labels = [{ name: "__name__", value: m[1].trim() }];
+  (m[2] || "").split(",").forEach((pair) => {
+    const [name, value] = pair.split("=").map((x) => x && x.trim());
+    if (name && value) {
+      labels.push({ name, value });
+    }
+  });
+  return labels;
+}
+
+const defaultLabels = window.initialState.defaultQuery
+  ? parseQuery(window.initialState.defaultQuery)
+  : [{ name: "__name__", value: defaultName || "pyroscope.server.cpu" }];
+
 const initialState = {
-  from: "now-1h",
+  from: window.initialState.defaultFrom || "now-1h",
   leftFrom: "now-1h",
   rightFrom: "now-30m",
   until: "now",
   leftUntil: "now-30m",
   rightUntil: "now",
-  labels: [{ name: "__name__", value: defaultName || "pyroscope.server.cpu" }],
+  labels: defaultLabels,
   names: window.initialState.appNames,
   timeline: null,
   isJSONLoading: false,